@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Slugs are short, so scanners try them at random. With abuse.enabled, a
+// client whose lookups come up empty more than max_misses times in a window
+// is backed off: its redirects are answered 429, with Retry-After, for
+// backoff, doubling with each strike up to max_backoff. Strikes are forgiven
+// after forgive without one. With tarpit, a 429 is held that long first, at
+// most max_tarpitted at a time, to slow a scanner which doesn't wait.
+//
+// Clients are counted by IP in each process, so behind a load balancer a
+// scanner gets a little more room; nothing is written to Redis on the way.
+// Only the slug route is backed off: the API has its keys and quotas.
+//
+// Honeypots (honeypots.go) are the other way in: a client following one is
+// flagged, and may be given a strike at once, or blocked from every route
+// for block_for. Blocks are in abuse:blocked, by IP with when they end, so
+// each replica reads them every few seconds.
+
+type AbuseConfig struct {
+	Enabled      bool     `json:"enabled"`
+	Window       Duration `json:"window"`
+	MaxMisses    int      `json:"max_misses"` // 404s in a window before a strike
+	Backoff      Duration `json:"backoff"`    // after the first strike
+	MaxBackoff   Duration `json:"max_backoff"`
+	Forgive      Duration `json:"forgive"`
+	Tarpit       Duration `json:"tarpit"` // 0 answers at once
+	MaxTarpitted int      `json:"max_tarpitted"`
+	MaxClients   int      `json:"max_clients"` // the most IPs kept
+	Exempt       []string `json:"exempt"`      // CIDRs never backed off, such as monitoring
+	WebhookURL   string   `json:"webhook_url"`
+
+	HoneypotAction string   `json:"honeypot_action"` // flag, backoff or block
+	BlockFor       Duration `json:"block_for"`
+}
+
+const (
+	keyOfBlockedClients = "abuse:blocked"
+	keyOfFlaggedClients = "abuse:flagged"
+)
+
+// How often each replica reads the blocked clients
+const blocklistRefresh = 10 * time.Second
+
+func validateAbuse(c AbuseConfig) error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Window.Duration <= 0 || c.MaxMisses <= 0 || c.MaxClients <= 0 {
+		return errors.New("abuse.window, max_misses and max_clients must be positive")
+	}
+	if c.Backoff.Duration <= 0 || c.MaxBackoff.Duration < c.Backoff.Duration {
+		return errors.New("abuse.backoff must be positive, and no more than max_backoff")
+	}
+	if c.Tarpit.Duration < 0 || (c.Tarpit.Duration > 0 && c.MaxTarpitted <= 0) {
+		return errors.New("abuse.tarpit can't be negative, and needs a positive max_tarpitted")
+	}
+	switch c.HoneypotAction {
+	case "flag", "backoff":
+	case "block":
+		if c.BlockFor.Duration <= 0 {
+			return errors.New("abuse.block_for must be positive to block")
+		}
+	default:
+		return errors.New("abuse.honeypot_action must be flag, backoff or block")
+	}
+	if _, err := parseCIDRs(c.Exempt); err != nil {
+		return errors.New("abuse.exempt: " + err.Error())
+	}
+	return nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+var (
+	abuse_misses    = newCounter("shortener_abuse_misses_total", "Slug lookups which came up empty, counted against their client")
+	abuse_strikes   = newCounter("shortener_abuse_strikes_total", "Strikes against clients, by reason: misses, or honeypot")
+	abuse_throttled = newCounter("shortener_abuse_throttled_total", "Redirects answered 429 while backed off, by tarpit: yes or no")
+	abuse_blocked   = newCounter("shortener_abuse_blocked_total", "Requests refused from blocked clients")
+)
+
+// Set in main when configured
+var abuse *abuseTracker
+
+type abuseTracker struct {
+	c         AbuseConfig
+	exempt    []*net.IPNet
+	tarpitted chan struct{}
+
+	mu      sync.Mutex
+	clients map[string]*abuseClient
+	blocked map[string]time.Time // until when, as last read from Redis
+}
+
+type abuseClient struct {
+	window_start  time.Time
+	misses        int
+	strikes       int
+	last_strike   time.Time
+	blocked_until time.Time
+}
+
+func newAbuseTracker(c AbuseConfig) *abuseTracker {
+	if !c.Enabled {
+		return nil
+	}
+	exempt, _ := parseCIDRs(c.Exempt)
+	a := &abuseTracker{c: c, exempt: exempt, clients: map[string]*abuseClient{}, blocked: map[string]time.Time{}}
+	if c.Tarpit.Duration > 0 {
+		a.tarpitted = make(chan struct{}, c.MaxTarpitted)
+	}
+	newGaugeFunc("shortener_abuse_backed_off_clients", "Clients backed off now", func() float64 {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		now, n := time.Now(), 0
+		for _, client := range a.clients {
+			if now.Before(client.blocked_until) {
+				n++
+			}
+		}
+		return float64(n)
+	})
+	return a
+}
+
+func (a *abuseTracker) exempted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	for _, n := range a.exempt {
+		if parsed != nil && n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// backedOff is how much longer ip is backed off, or 0
+func (a *abuseTracker) backedOff(ip string, now time.Time) time.Duration {
+	if a == nil {
+		return 0
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	client, ok := a.clients[ip]
+	if !ok || !now.Before(client.blocked_until) {
+		return 0
+	}
+	return client.blocked_until.Sub(now)
+}
+
+// miss counts a lookup which came up empty, answering the backoff when it
+// was one too many
+func (a *abuseTracker) miss(ip string, now time.Time) (time.Duration, int) {
+	if a == nil || a.exempted(ip) {
+		return 0, 0
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	abuse_misses.Inc()
+	client, ok := a.clients[ip]
+	if !ok {
+		if len(a.clients) >= a.c.MaxClients {
+			a.sweepLocked(now)
+		}
+		if len(a.clients) >= a.c.MaxClients {
+			// full of clients still being counted; this one goes uncounted
+			return 0, 0
+		}
+		client = &abuseClient{}
+		a.clients[ip] = client
+	}
+	if client.strikes > 0 && now.Sub(client.last_strike) > a.c.Forgive.Duration {
+		client.strikes = 0
+	}
+	if now.Sub(client.window_start) >= a.c.Window.Duration {
+		client.window_start, client.misses = now, 0
+	}
+	client.misses++
+	if client.misses <= a.c.MaxMisses {
+		return 0, 0
+	}
+	return a.strikeLocked(client, now, "misses")
+}
+
+func (a *abuseTracker) strikeLocked(client *abuseClient, now time.Time, reason string) (time.Duration, int) {
+	client.strikes++
+	client.last_strike = now
+	client.window_start, client.misses = now, 0
+	backoff := backoffFor(a.c, client.strikes)
+	client.blocked_until = now.Add(backoff)
+	abuse_strikes.Inc("reason", reason)
+	return backoff, client.strikes
+}
+
+// strike backs ip off at once, as if it had missed too often
+func (a *abuseTracker) strike(ip string, now time.Time) (time.Duration, int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	client, ok := a.clients[ip]
+	if !ok {
+		if len(a.clients) >= a.c.MaxClients {
+			a.sweepLocked(now)
+		}
+		client = &abuseClient{window_start: now}
+		a.clients[ip] = client
+	}
+	if client.strikes > 0 && now.Sub(client.last_strike) > a.c.Forgive.Duration {
+		client.strikes = 0
+	}
+	return a.strikeLocked(client, now, "honeypot")
+}
+
+// block refuses ip on every route until then, in this process until the
+// blocklist is next read
+func (a *abuseTracker) block(ip string, until time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.blocked[ip] = until
+}
+
+func (a *abuseTracker) unblock(ip string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.blocked, ip)
+}
+
+func (a *abuseTracker) blockedUntil(ip string, now time.Time) (time.Time, bool) {
+	if a == nil {
+		return time.Time{}, false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	until, ok := a.blocked[ip]
+	return until, ok && now.Before(until)
+}
+
+// refreshBlocklist reads the blocked clients every few seconds, until the process ends
+func (a *abuseTracker) refreshBlocklist(redis_db Storage) {
+	for {
+		blocked, err := blockedClients(redis_db, context.Background(), time.Now())
+		if err != nil {
+			log.Println("Cannot read the blocked clients", err)
+		} else {
+			a.mu.Lock()
+			a.blocked = map[string]time.Time{}
+			for _, b := range blocked {
+				a.blocked[b.IP] = b.Until
+			}
+			a.mu.Unlock()
+		}
+		time.Sleep(blocklistRefresh)
+	}
+}
+
+type BlockedClient struct {
+	IP    string    `json:"ip"`
+	Until time.Time `json:"until"`
+}
+
+func blockedClients(redis_db Storage, ctx context.Context, now time.Time) ([]BlockedClient, error) {
+	zs, err := redis_db.ZRangeByScoreWithScores(ctx, keyOfBlockedClients, &redis.ZRangeBy{
+		Min: strconv.FormatInt(now.Unix(), 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	blocked := make([]BlockedClient, len(zs))
+	for i, z := range zs {
+		blocked[i] = BlockedClient{IP: z.Member.(string), Until: time.Unix(int64(z.Score), 0).UTC()}
+	}
+	return blocked, nil
+}
+
+// withBlocklist refuses blocked clients, whatever they ask for
+func withBlocklist(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if _, blocked := abuse.blockedUntil(remoteHost(req), time.Now()); blocked {
+			abuse_blocked.Inc()
+			writeLocalizedError(w, req, http.StatusForbidden, "Requests from this address are blocked.")
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// backoffFor doubles with each strike after the first
+func backoffFor(c AbuseConfig, strikes int) time.Duration {
+	backoff := float64(c.Backoff.Duration) * math.Pow(2, float64(strikes-1))
+	return time.Duration(math.Min(backoff, float64(c.MaxBackoff.Duration)))
+}
+
+// sweepLocked forgets clients with nothing left to remember
+func (a *abuseTracker) sweepLocked(now time.Time) {
+	for ip, client := range a.clients {
+		if now.Sub(client.window_start) < a.c.Window.Duration || now.Before(client.blocked_until) {
+			continue
+		}
+		if client.strikes > 0 && now.Sub(client.last_strike) <= a.c.Forgive.Duration {
+			continue
+		}
+		delete(a.clients, ip)
+	}
+}
+
+// checkBackoff answers 429 to a client which is backed off, reporting false
+func checkBackoff(w http.ResponseWriter, req *http.Request) bool {
+	if abuse == nil {
+		return true
+	}
+	remaining := abuse.backedOff(remoteHost(req), time.Now())
+	if remaining <= 0 {
+		return true
+	}
+	tarpitted := "no"
+	if abuse.tarpitted != nil {
+		select {
+		case abuse.tarpitted <- struct{}{}:
+			tarpitted = "yes"
+			timer := time.NewTimer(abuse.c.Tarpit.Duration)
+			select {
+			case <-timer.C:
+			case <-req.Context().Done():
+				timer.Stop()
+			}
+			<-abuse.tarpitted
+		default:
+			// too many held already, this one is answered at once
+		}
+	}
+	abuse_throttled.Inc("tarpit", tarpitted)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(remaining.Seconds()))))
+	writeLocalizedError(w, req, http.StatusTooManyRequests, "Too many requests for links which don't exist. Try again later.")
+	return false
+}
+
+// countMiss counts a slug which wasn't found against the request's client
+func countMiss(req *http.Request) {
+	backoff, strikes := abuse.miss(remoteHost(req), time.Now())
+	if backoff <= 0 {
+		return
+	}
+	client := loggedHost(req)
+	log.Println("Backing off", client, "for", backoff, "after", abuse.c.MaxMisses, "missing slugs, strike", strikes)
+	notifyAbuse(map[string]interface{}{
+		"event":           "enumeration_backoff",
+		"client":          client,
+		"strikes":         strikes,
+		"backoff_seconds": int64(backoff.Seconds()),
+		"until":           time.Now().Add(backoff).UTC(),
+	})
+}
+
+// notifyAbuse posts an event to the webhook, if there is one, in the background
+func notifyAbuse(payload map[string]interface{}) {
+	if abuse.c.WebhookURL == "" {
+		return
+	}
+	go func() {
+		if err := postWebhook(abuse.c.WebhookURL, payload); err != nil {
+			log.Println("Abuse webhook failed", err)
+		}
+	}()
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/handlers"
+)
+
+type AccessLogConfig struct {
+	Format       string   `json:"format"`      // combined, json, none
+	Destination  string   `json:"destination"` // stdout, file, syslog
+	File         string   `json:"file"`
+	MaxSizeMB    int      `json:"max_size_mb"`
+	MaxBackups   int      `json:"max_backups"`
+	SyslogTag    string   `json:"syslog_tag"`
+	RedactParams []string `json:"redact_params"`
+}
+
+// accessLogHandler wraps the router according to config.AccessLog
+func accessLogHandler(c AccessLogConfig, h http.Handler) (http.Handler, error) {
+	if c.Format == "none" {
+		return h, nil
+	}
+
+	var out io.Writer
+	switch c.Destination {
+	case "", "stdout":
+		out = os.Stdout
+	case "file":
+		if c.File == "" {
+			return nil, errors.New("Access log destination file needs a file path")
+		}
+		out = &rotatingFile{path: c.File, max_size: int64(c.MaxSizeMB) << 20, max_backups: c.MaxBackups}
+	case "syslog":
+		w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, c.SyslogTag)
+		if err != nil {
+			return nil, err
+		}
+		out = w
+	default:
+		return nil, fmt.Errorf("Unknown access log destination %q", c.Destination)
+	}
+
+	switch c.Format {
+	case "", "combined":
+		return handlers.CustomLoggingHandler(out, h, combinedFormatter(c.RedactParams)), nil
+	case "json":
+		return handlers.CustomLoggingHandler(out, h, jsonFormatter(c.RedactParams)), nil
+	}
+	return nil, fmt.Errorf("Unknown access log format %q", c.Format)
+}
+
+// redactedURI blanks out the value of any sensitive query parameter
+func redactedURI(u url.URL, redact []string) string {
+	if u.RawQuery == "" {
+		return u.RequestURI()
+	}
+	q := u.Query()
+	changed := false
+	for _, name := range redact {
+		if _, present := q[name]; present {
+			q.Set(name, "REDACTED")
+			changed = true
+		}
+	}
+	if changed {
+		u.RawQuery = q.Encode()
+	}
+	return u.RequestURI()
+}
+
+func remoteHost(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func combinedFormatter(redact []string) handlers.LogFormatter {
+	return func(w io.Writer, p handlers.LogFormatterParams) {
+		username := "-"
+		if p.URL.User != nil && p.URL.User.Username() != "" {
+			username = p.URL.User.Username()
+		}
+		fmt.Fprintf(w, "%s - %s [%s] %q %d %d %q %q\n",
+			loggedHost(p.Request),
+			username,
+			p.TimeStamp.Format("02/Jan/2006:15:04:05 -0700"),
+			p.Request.Method+" "+redactedURI(p.URL, redact)+" "+p.Request.Proto,
+			p.StatusCode,
+			p.Size,
+			p.Request.Referer(),
+			p.Request.UserAgent(),
+		)
+	}
+}
+
+type jsonLogLine struct {
+	Time      time.Time `json:"time"`
+	Remote    string    `json:"remote"`
+	Method    string    `json:"method"`
+	URI       string    `json:"uri"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Size      int       `json:"size"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Duration  float64   `json:"duration_ms"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+func jsonFormatter(redact []string) handlers.LogFormatter {
+	return func(w io.Writer, p handlers.LogFormatterParams) {
+		b, _ := json.Marshal(jsonLogLine{
+			Time:      p.TimeStamp,
+			Remote:    loggedHost(p.Request),
+			Method:    p.Request.Method,
+			URI:       redactedURI(p.URL, redact),
+			Proto:     p.Request.Proto,
+			Status:    p.StatusCode,
+			Size:      p.Size,
+			Referer:   p.Request.Referer(),
+			UserAgent: p.Request.UserAgent(),
+			Duration:  float64(time.Since(p.TimeStamp).Microseconds()) / 1000,
+			RequestID: p.Request.Header.Get(requestIDHeader),
+		})
+		w.Write(append(b, '\n'))
+	}
+}
+
+// rotatingFile is an append-only log file that rolls over to path.1, path.2... at max_size
+type rotatingFile struct {
+	path        string
+	max_size    int64
+	max_backups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func (r *rotatingFile) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	if r.max_size > 0 && r.size+int64(len(b)) > r.max_size {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(b)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	r.f = nil
+	if r.max_backups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", r.path, r.max_backups))
+		for i := r.max_backups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		os.Rename(r.path, r.path+".1")
+	} else {
+		os.Remove(r.path)
+	}
+	return r.open()
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+// With activation on, links asked for without an API key or a session aren't
+// created right away. /_create holds them as pending:<id>, for
+// activation.pending_for, and mails the address given in the form a signed
+// link to /_activate. That page shows the target and asks to confirm; the
+// link is only created, quota and all, when the confirmation is posted, so
+// mail scanners opening the URL don't activate it. Anonymous callers of the
+// compatible APIs are refused, having no address to confirm from.
+
+type ActivationConfig struct {
+	Enabled      bool     `json:"enabled"`
+	PendingFor   Duration `json:"pending_for"`
+	SMTPAddr     string   `json:"smtp_addr"` // host:port
+	SMTPUser     string   `json:"smtp_user"` // no authentication when empty
+	SMTPPassword string   `json:"smtp_password"`
+	From         string   `json:"from"`
+}
+
+const activationTokenPurpose = "activate"
+
+var activations = newCounter("shortener_activations_total", "Anonymous links held for activation, and activated")
+
+func validateActivation(c ActivationConfig) error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.PendingFor.Duration < time.Minute {
+		return fmt.Errorf("activation.pending_for must be at least a minute")
+	}
+	if _, _, err := net.SplitHostPort(c.SMTPAddr); err != nil {
+		return fmt.Errorf("activation.smtp_addr must be host:port: %v", err)
+	}
+	if _, err := mail.ParseAddress(c.From); err != nil {
+		return fmt.Errorf("activation.from is not an address: %v", err)
+	}
+	return nil
+}
+
+// needsActivation tells if the links of identity wait for their creator to confirm them
+func needsActivation(identity Identity) bool {
+	return config.Activation.Enabled && identity.KeyId == ""
+}
+
+func keyOfPendingLink(id string) string {
+	return "pending:" + id
+}
+
+// PendingLink is what /_create was asked for, kept until it's activated
+type PendingLink struct {
+	Target    string      `json:"target"`
+	Options   LinkOptions `json:"options"`
+	Keyword   string      `json:"keyword,omitempty"`
+	Email     string      `json:"email"`
+	Requested time.Time   `json:"requested"`
+}
+
+// ActivationMailError is a failure to send the activation mail, as opposed to one of Redis
+type ActivationMailError struct {
+	Err error
+}
+
+func (e ActivationMailError) Error() string {
+	return "Cannot send the activation mail: " + e.Err.Error()
+}
+
+// holdForActivation stores the pending link and mails its activation URL
+func holdForActivation(redis_db Storage, ctx context.Context, req *http.Request, pending PendingLink) error {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	id := hex.EncodeToString(nonce)
+	data, err := json.Marshal(pending)
+	if err != nil {
+		return err
+	}
+	if err := redis_db.Set(ctx, keyOfPendingLink(id), data, config.Activation.PendingFor.Duration).Err(); err != nil {
+		return err
+	}
+
+	activate_url := publicURL(req, "/_activate?token="+signToken(activationTokenPurpose, id))
+	if err := sendActivationMail(config.Activation, pending, activate_url); err != nil {
+		redis_db.Del(ctx, keyOfPendingLink(id))
+		return ActivationMailError{err}
+	}
+	activations.Inc("state", "pending")
+	log.Println("Holding link to", pending.Target, "until", pending.Email, "activates it")
+	return nil
+}
+
+func sendActivationMail(c ActivationConfig, pending PendingLink, activate_url string) error {
+	host, _, _ := net.SplitHostPort(c.SMTPAddr)
+	var auth smtp.Auth
+	if c.SMTPUser != "" {
+		auth = smtp.PlainAuth("", c.SMTPUser, c.SMTPPassword, host)
+	}
+	from, _ := mail.ParseAddress(c.From)
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", pending.Email)
+	fmt.Fprintf(&msg, "Subject: Activate your short link\r\n")
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "A short link to\r\n\r\n    %s\r\n\r\nwas asked for with this address. ", pending.Target)
+	fmt.Fprintf(&msg, "It won't work until you activate it, before %s, at\r\n\r\n    %s\r\n\r\n",
+		pending.Requested.Add(c.PendingFor.Duration).UTC().Format(time.RFC1123), activate_url)
+	fmt.Fprintf(&msg, "If you didn't ask for it, there is nothing to do: it will be forgotten.\r\n")
+	return smtp.SendMail(c.SMTPAddr, auth, from.Address, []string{pending.Email}, []byte(msg.String()))
+}
+
+// holdLink answers /_create for a caller who needs activation
+func holdLink(redis_db Storage, w http.ResponseWriter, req *http.Request, identity Identity, keyword string, opts LinkOptions) {
+	if !identity.can(roleEditor) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "Creating links needs the editor role")
+		return
+	}
+	address, err := mail.ParseAddress(req.FormValue("email"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "An email address is needed, to send the activation link to")
+		return
+	}
+	target := asciiTarget(req.FormValue("target"))
+	if _, err := validateTarget(target); err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprintf(w, "Cannot shorten: %v", err)
+		return
+	}
+
+	pending := PendingLink{Target: target, Options: opts, Keyword: keyword, Email: address.Address, Requested: time.Now()}
+	err = holdForActivation(redis_db, req.Context(), req, pending)
+	var mail_err ActivationMailError
+	if errors.As(err, &mail_err) {
+		log.Println("To", pending.Email+":", err)
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(w, "Cannot send the activation mail")
+		return
+	} else if err != nil {
+		writeUnavailable(w)
+		return
+	}
+	if wantsJSON(req) {
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{"pending": true, "email": pending.Email, "target": target})
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "Check %s for the link to activate your short link with, within %v", pending.Email, config.Activation.PendingFor.Duration)
+}
+
+var errNotPending = errors.New("No such pending link; it may have expired or been activated already")
+
+// pendingOfToken returns the pending link an activation token is for
+func pendingOfToken(redis_db Storage, ctx context.Context, token string) (string, PendingLink, error) {
+	var pending PendingLink
+	id, err := verifyToken(activationTokenPurpose, token)
+	if err != nil {
+		return "", pending, err
+	}
+	data, err := redis_db.Get(ctx, keyOfPendingLink(id)).Result()
+	if err == redis.Nil {
+		return id, pending, errNotPending
+	} else if err != nil {
+		return id, pending, err
+	}
+	return id, pending, json.Unmarshal([]byte(data), &pending)
+}
+
+type ActivatePage struct {
+	Token     string
+	Target    string
+	Keyword   string
+	Email     string
+	Error     string
+	CSRFToken string
+}
+
+func registerActivationRoutes(router *mux.Router, redis_db Storage) {
+	router.HandleFunc("/_activate", func(w http.ResponseWriter, req *http.Request) {
+		page := ActivatePage{Token: req.FormValue("token")}
+		_, pending, err := pendingOfToken(redis_db, req.Context(), page.Token)
+		if redisUnavailable(err) {
+			writeUnavailable(w)
+			return
+		} else if err != nil {
+			page.Error = err.Error()
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			setLanguage(w, req)
+			w.WriteHeader(http.StatusGone)
+		} else {
+			page.Target, page.Keyword, page.Email = pending.Target, pending.Keyword, pending.Email
+			page.CSRFToken = csrfToken(w, req)
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			setLanguage(w, req)
+		}
+		renderPage(w, req, "activate.html", viewerBranding(req), page)
+	}).Methods("GET", "HEAD")
+
+	router.HandleFunc("/_activate", func(w http.ResponseWriter, req *http.Request) {
+		if !checkCSRF(w, req) {
+			return
+		}
+		id, pending, err := pendingOfToken(redis_db, req.Context(), req.PostFormValue("token"))
+		if redisUnavailable(err) {
+			writeUnavailable(w)
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusGone)
+			fmt.Fprintf(w, "%v", err)
+			return
+		}
+		// whoever deletes it activates it, once
+		if n, err := redis_db.Del(req.Context(), keyOfPendingLink(id)).Result(); err != nil {
+			writeUnavailable(w)
+			return
+		} else if n == 0 {
+			w.WriteHeader(http.StatusGone)
+			fmt.Fprintf(w, "%v", errNotPending)
+			return
+		}
+
+		identity, _ := identityOfKey("")
+		pending.Options.Activated = true
+		su, status, err := shorten(redis_db, w, req, identity, pending.Target, pending.Options)
+		if status == http.StatusServiceUnavailable {
+			writeUnavailable(w)
+			return
+		} else if err != nil {
+			w.WriteHeader(status)
+			fmt.Fprintf(w, "%v", err)
+			return
+		}
+		activations.Inc("state", "activated")
+		log.Println("Activated", su.Slug, "for", pending.Email)
+		if pending.Keyword != "" {
+			if err := addAlias(redis_db, req.Context(), su.Slug, pending.Keyword); err != nil {
+				log.Println("Keyword", pending.Keyword, "not added to", su.Slug, err)
+				w.WriteHeader(http.StatusConflict)
+				fmt.Fprintf(w, "Created %v, but not the keyword %v: %v", publicURL(req, "/"+su.Slug), pending.Keyword, err)
+				return
+			}
+			su.Aliases = []string{pending.Keyword}
+			reindexTerms(redis_db, req.Context(), su.Slug)
+		}
+		writeCreated(w, req, su)
+	}).Methods("POST")
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Maintenance endpoints under /api/v1/admin, for the admin role
+
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		identity, ok := hasRole(w, req, roleAdmin)
+		if !ok {
+			return
+		}
+		log.Println("Admin request", req.Method, req.URL.Path, "by key", identity.KeyId)
+		next.ServeHTTP(w, req)
+	})
+}
+
+func registerAdminRoutes(router *mux.Router, redis_db Storage) {
+	router.Use(requireAdmin)
+
+	// Dry run unless ?dry_run=false
+	router.HandleFunc("/purge-orphans", func(w http.ResponseWriter, req *http.Request) {
+		dry_run := req.FormValue("dry_run") != "false"
+		report, err := purgeOrphans(redis_db, req.Context(), dry_run)
+		if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	}).Methods("POST")
+
+	// The last nightly report, or a fresh one with POST
+	router.HandleFunc("/integrity", func(w http.ResponseWriter, req *http.Request) {
+		report, err := lastIntegrityReport(redis_db, req.Context())
+		if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		} else if report == nil {
+			writeJSONError(w, http.StatusNotFound, "The integrity check hasn't run yet")
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	}).Methods("GET")
+	router.HandleFunc("/integrity", func(w http.ResponseWriter, req *http.Request) {
+		report, err := checkIntegrity(redis_db, req.Context())
+		if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	}).Methods("POST")
+
+	router.HandleFunc("/sync", handleSync(redis_db)).Methods("POST")
+
+	registerBulkRoutes(router, redis_db)
+	registerAbuseRoutes(router, redis_db)
+
+	router.HandleFunc("/sample", handleSample(redis_db)).Methods("GET")
+	router.HandleFunc("/attributed-urls", handleAttributedURL).Methods("POST")
+	if config.Metering.Enabled {
+		router.HandleFunc("/usage", handleUsageExport(redis_db)).Methods("GET")
+	}
+
+	router.HandleFunc("/duplicates", handleDuplicates(redis_db)).Methods("GET")
+	router.HandleFunc("/duplicates/merge", handleMerge(redis_db)).Methods("POST")
+
+	router.HandleFunc("/prune-analytics", func(w http.ResponseWriter, req *http.Request) {
+		events, hourly := analyticsRetention(config)
+		report, err := pruneAnalytics(redis_db, req.Context(), events, hourly)
+		if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	}).Methods("POST")
+
+	router.HandleFunc("/anomalies", func(w http.ResponseWriter, req *http.Request) {
+		anomalies, err := recentAnomalies(redis_db, req.Context())
+		if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, anomalies)
+	}).Methods("GET")
+
+	if config.GDPR.Enabled {
+		router.HandleFunc("/visitors/{visitor}", handleEraseVisitor(redis_db)).Methods("DELETE")
+	}
+}
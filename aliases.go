@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Alias slugs point at an existing link and share its counters, TTL and
+// lifecycle: alias:<alias> holds the canonical slug and urlaliases:<slug> the
+// set of its aliases. An alias has no TTL of its own; it simply stops
+// resolving once its link is gone, and is cleaned up then.
+
+var aliasPattern = regexp.MustCompile(`^[0-9A-Za-z]{3,64}$`)
+
+// With slugs.unicode, aliases may also be letters, digits and symbols
+// (emoji) of any script, composed (NFC) and up to max_runes long
+
+type SlugsConfig struct {
+	Unicode  bool               `json:"unicode"`
+	MaxRunes int                `json:"max_runes"`
+	Numeric  NumericSlugsConfig `json:"numeric"` // see numeric.go
+}
+
+const (
+	zeroWidthJoiner   = 0x200D
+	variationSelector = 0xFE0F
+)
+
+// normalizeSlug composes a slug from the route or an API call, in unicode mode
+func normalizeSlug(slug string) string {
+	if !config.Slugs.Unicode {
+		return slug
+	}
+	return composeNFC(slug)
+}
+
+func aliasIsValid(alias string) bool {
+	if aliasPattern.MatchString(alias) {
+		return true
+	}
+	// ASCII-only aliases keep the rules above
+	if !config.Slugs.Unicode || !utf8.ValidString(alias) || len(alias) == utf8.RuneCountInString(alias) {
+		return false
+	}
+	count := utf8.RuneCountInString(alias)
+	if count < 1 || count > config.Slugs.MaxRunes {
+		return false
+	}
+	for i, r := range alias {
+		switch {
+		case unicode.IsLetter(r), unicode.IsDigit(r), unicode.Is(unicode.So, r):
+		case i > 0 && (isCombining(r) || r == zeroWidthJoiner || r == variationSelector || unicode.Is(unicode.Sk, r)):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+var errAliasTaken = errors.New("Alias is already in use")
+
+// routeNames are the server's own pages at the root; a link of one of these
+// names would never be reached
+var routeNames = []string{"healthz", "readyz", "metrics"}
+
+var errRouteName = errors.New("Name is taken by one of the server's own pages")
+
+func isRouteName(name string) bool {
+	for _, route := range routeNames {
+		if strings.EqualFold(name, route) {
+			return true
+		}
+	}
+	return false
+}
+
+func keyOfAlias(alias string) string {
+	return "alias:" + alias
+}
+
+func keyOfSlugAliases(slug string) string {
+	return "urlaliases:" + slug
+}
+
+// resolveSlug follows an alias to its link, returning the canonical slug and target
+func resolveSlug(redis_db Storage, ctx context.Context, slug string) (string, string, error) {
+	target, err := redis_db.Get(ctx, keyOfSlug(slug)).Result()
+	if err != redis.Nil {
+		return slug, target, err
+	}
+
+	canonical, err := redis_db.Get(ctx, keyOfAlias(slug)).Result()
+	if err != nil {
+		return slug, "", err
+	}
+	target, err = redis_db.Get(ctx, keyOfSlug(canonical)).Result()
+	if err == redis.Nil {
+		// the link went away, take the alias with it
+		redis_db.Del(ctx, keyOfAlias(slug))
+	}
+	return canonical, target, err
+}
+
+func addAlias(redis_db Storage, ctx context.Context, slug string, alias string) error {
+	if inNumericNamespace(alias) {
+		return errNumericName
+	}
+	if isRouteName(alias) {
+		return errRouteName
+	}
+	// a reserved name is taken too, until confirmed, as is a honeypot
+	taken, err := redis_db.Exists(ctx, keyOfSlug(alias), keyOfReservation(alias), keyOfHoneypot(alias)).Result()
+	if err != nil {
+		return err
+	}
+	if taken > 0 {
+		return errAliasTaken
+	}
+	created, err := redis_db.SetNX(ctx, keyOfAlias(alias), slug, 0).Result()
+	if err != nil {
+		return err
+	}
+	if !created {
+		return errAliasTaken
+	}
+	_, err = redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, keyOfSlugAliases(slug), alias)
+		touchLink(pipe, ctx, slug)
+		return nil
+	})
+	return err
+}
+
+func removeAlias(redis_db Storage, ctx context.Context, slug string, alias string) error {
+	if canonical, err := redis_db.Get(ctx, keyOfAlias(alias)).Result(); err != nil || canonical != slug {
+		return errors.New("No such alias on this link")
+	}
+	_, err := redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, keyOfAlias(alias))
+		pipe.SRem(ctx, keyOfSlugAliases(slug), alias)
+		touchLink(pipe, ctx, slug)
+		return nil
+	})
+	if err == nil {
+		purgeLinks(slug)
+	}
+	return err
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Background check for links whose clicks this hour jump far above their own
+// hourly baseline (z-score), or past an absolute threshold. Flagged links get
+// "anomaly"/"anomaly_at" fields in urlmeta: and an entry in the anomalies
+// sorted set; both count as current for a day.
+
+type AnomalyConfig struct {
+	Enabled           bool     `json:"enabled"`
+	Interval          Duration `json:"interval"`
+	BaselineHours     int      `json:"baseline_hours"`
+	ZScore            float64  `json:"z_score"`
+	MinClicks         int64    `json:"min_clicks"`         // below this an hour is never a spike
+	AbsoluteThreshold int64    `json:"absolute_threshold"` // clicks in an hour, 0 disables
+	WebhookURL        string   `json:"webhook_url"`
+}
+
+type Anomaly struct {
+	Slug     string    `json:"slug"`
+	Clicks   int64     `json:"clicks_this_hour"`
+	Baseline float64   `json:"baseline_mean"`
+	ZScore   float64   `json:"z_score"`
+	Reason   string    `json:"reason"`
+	Flagged  time.Time `json:"flagged"`
+}
+
+const keyOfAnomalies = "anomalies"
+
+// judgeClicks compares the last bucket with the ones before it
+func judgeClicks(hourly []int64, c AnomalyConfig) (Anomaly, bool) {
+	current := hourly[len(hourly)-1]
+	baseline := hourly[:len(hourly)-1]
+
+	mean := 0.0
+	for _, n := range baseline {
+		mean += float64(n)
+	}
+	mean /= float64(len(baseline))
+	variance := 0.0
+	for _, n := range baseline {
+		variance += (float64(n) - mean) * (float64(n) - mean)
+	}
+	stddev := math.Sqrt(variance / float64(len(baseline)))
+
+	a := Anomaly{Clicks: current, Baseline: mean}
+	// a flat baseline would divide by zero; treat it as a spread of one click
+	a.ZScore = (float64(current) - mean) / math.Max(stddev, 1)
+
+	if c.AbsoluteThreshold > 0 && current >= c.AbsoluteThreshold {
+		a.Reason = "absolute threshold"
+		return a, true
+	}
+	if current >= c.MinClicks && a.ZScore >= c.ZScore {
+		a.Reason = "z-score"
+		return a, true
+	}
+	return a, false
+}
+
+func hourlyClicks(redis_db Storage, ctx context.Context, slug string, hours int) ([]int64, error) {
+	points, err := clickSeries(redis_db, ctx, []string{slug}, hours)
+	if err != nil {
+		return nil, err
+	}
+	r := make([]int64, len(points))
+	for i, p := range points {
+		r[i] = p.Clicks
+	}
+	return r, nil
+}
+
+func detectAnomalies(redis_db Storage, ctx context.Context, c AnomalyConfig) ([]Anomaly, error) {
+	now := time.Now()
+	// only links clicked this hour can be spiking
+	slugs, err := redis_db.ZRangeByScore(ctx, keyOfLastClickIndex, &redis.ZRangeBy{
+		Min: strconv.FormatInt(now.Truncate(time.Hour).Unix(), 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	found := []Anomaly{}
+	for _, slug := range slugs {
+		hourly, err := hourlyClicks(redis_db, ctx, slug, c.BaselineHours+1)
+		if err != nil {
+			return found, err
+		}
+		a, spiking := judgeClicks(hourly, c)
+		if !spiking {
+			continue
+		}
+		a.Slug = slug
+		a.Flagged = now.UTC()
+
+		// only report each link once per hour
+		hour := now.Truncate(time.Hour).Unix()
+		if at, err := redis_db.ZScore(ctx, keyOfAnomalies, slug).Result(); err == nil && int64(at) >= hour {
+			continue
+		}
+
+		details, _ := json.Marshal(a)
+		_, err = redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.ZAdd(ctx, keyOfAnomalies, &redis.Z{Score: float64(hour), Member: slug})
+			pipe.HSet(ctx, keyOfSlugMeta(slug), "anomaly", string(details), "anomaly_at", now.Unix())
+			touchLink(pipe, ctx, slug)
+			return nil
+		})
+		if err != nil {
+			return found, err
+		}
+		found = append(found, a)
+	}
+
+	// forget flags, and links not clicked, older than a day
+	day_ago := strconv.FormatInt(now.Add(-24*time.Hour).Unix(), 10)
+	redis_db.ZRemRangeByScore(ctx, keyOfAnomalies, "-inf", day_ago)
+	redis_db.ZRemRangeByScore(ctx, keyOfLastClickIndex, "-inf", day_ago)
+	return found, nil
+}
+
+func anomalyJob(redis_db Storage, c AnomalyConfig) scheduledJob {
+	return scheduledJob{name: "anomalies", schedule: everySchedule(c.Interval.Duration), run: func(ctx context.Context) error {
+		found, err := detectAnomalies(redis_db, ctx, c)
+		if err != nil {
+			return err
+		}
+		for _, a := range found {
+			log.Println("Click anomaly on", a.Slug, a.Reason, "clicks", a.Clicks, "z", a.ZScore)
+			if c.WebhookURL != "" {
+				if err := postWebhook(c.WebhookURL, map[string]interface{}{"event": "click_anomaly", "anomaly": a}); err != nil {
+					log.Println("Anomaly webhook failed", err)
+				}
+			}
+		}
+		return nil
+	}}
+}
+
+func anomalyIsCurrent(meta map[string]string) bool {
+	at := unixTime(meta["anomaly_at"])
+	return !at.IsZero() && time.Since(at) < 24*time.Hour
+}
+
+// recentAnomalies lists flagged links still around, newest first
+func recentAnomalies(redis_db Storage, ctx context.Context) ([]Anomaly, error) {
+	slugs, err := redis_db.ZRevRange(ctx, keyOfAnomalies, 0, 99).Result()
+	if err != nil {
+		return nil, err
+	}
+	r := []Anomaly{}
+	for _, slug := range slugs {
+		v, err := redis_db.HGet(ctx, keyOfSlugMeta(slug), "anomaly").Result()
+		if err != nil {
+			continue
+		}
+		var a Anomaly
+		if json.Unmarshal([]byte(v), &a) == nil {
+			r = append(r, a)
+		}
+	}
+	return r, nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Helpers shared by the JSON API handlers
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	if status == http.StatusServiceUnavailable {
+		setRetryAfter(w)
+	}
+	writeJSON(w, status, apiError{Error: message})
+}
+
+// readJSON decodes a request body, capped at 1MiB
+func readJSON(w http.ResponseWriter, req *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, req.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+// Links with app_links open in the native app on phones which have it: the
+// apps named in app_links are associated with this domain through
+// /.well-known/apple-app-site-association (iOS Universal Links, listing the
+// paths of those links) and /.well-known/assetlinks.json (Android App Links,
+// which leave the paths to the app's manifest). A phone without the app
+// opens the short URL in the browser, and the redirect then goes to the
+// link's store page for that platform, or the target when it has none.
+// These redirects differ by device, so the CDN never keeps them.
+
+type AppLinksConfig struct {
+	AppleAppIDs         []string `json:"apple_app_ids"` // <team id>.<bundle id>
+	AndroidPackage      string   `json:"android_package"`
+	AndroidFingerprints []string `json:"android_fingerprints"` // SHA-256 of the signing certificate, AA:BB:...
+}
+
+// AppLinks are a link's fallbacks when the app isn't installed
+type AppLinks struct {
+	IOSStore     string `json:"ios_store,omitempty"`
+	AndroidStore string `json:"android_store,omitempty"`
+}
+
+// keyOfAppLinks is the set of slugs with app links, for the association file
+const keyOfAppLinks = "idx:app_links"
+
+func appLinksOfMeta(encoded string) *AppLinks {
+	if encoded == "" {
+		return nil
+	}
+	var a AppLinks
+	if err := json.Unmarshal([]byte(encoded), &a); err != nil {
+		return nil
+	}
+	return &a
+}
+
+// fallback is where a browser on this device goes, the app not having opened the link
+func (a *AppLinks) fallback(req *http.Request, target string) string {
+	ua := req.UserAgent()
+	switch {
+	case a.IOSStore != "" && (strings.Contains(ua, "iPhone") || strings.Contains(ua, "iPad") || strings.Contains(ua, "iPod")):
+		return a.IOSStore
+	case a.AndroidStore != "" && strings.Contains(ua, "Android"):
+		return a.AndroidStore
+	}
+	return target
+}
+
+func validateAppLinks(a AppLinks) error {
+	for name, store := range map[string]string{"ios_store": a.IOSStore, "android_store": a.AndroidStore} {
+		if store == "" {
+			continue
+		}
+		if _, err := validateTarget(store); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// setAppLinks replaces the link's app links, or removes them when nil. With
+// both stores empty the link still opens the app, falling back on the target.
+func setAppLinks(redis_db Storage, ctx context.Context, slug string, a *AppLinks) error {
+	_, err := redis_db.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		touchLink(pipe, ctx, slug)
+		if a == nil {
+			pipe.HDel(ctx, keyOfSlugMeta(slug), "app_links")
+			pipe.SRem(ctx, keyOfAppLinks, slug)
+			return nil
+		}
+		encoded, _ := json.Marshal(a)
+		pipe.HSet(ctx, keyOfSlugMeta(slug), "app_links", string(encoded))
+		pipe.SAdd(ctx, keyOfAppLinks, slug)
+		return nil
+	})
+	if err == nil {
+		// the edge may hold a redirect which didn't look at the device
+		purgeLinks(slug)
+	}
+	return err
+}
+
+// appLinkPaths are the paths which open the app: the links with app links, and their aliases
+func appLinkPaths(redis_db Storage, ctx context.Context) ([]string, error) {
+	slugs, err := redis_db.SMembers(ctx, keyOfAppLinks).Result()
+	if err != nil || len(slugs) == 0 {
+		return []string{}, err
+	}
+	missing, err := missingSlugs(redis_db, ctx, slugs)
+	if err != nil {
+		return nil, err
+	}
+	gone := map[string]bool{}
+	members := []interface{}{}
+	for _, slug := range missing {
+		gone[slug] = true
+		members = append(members, slug)
+	}
+	if len(members) > 0 {
+		// deleted or expired since
+		redis_db.SRem(ctx, keyOfAppLinks, members...)
+	}
+	aliases := make([]*redis.StringSliceCmd, len(slugs))
+	_, err = redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, slug := range slugs {
+			aliases[i] = pipe.SMembers(ctx, keyOfSlugAliases(slug))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{}
+	for i, slug := range slugs {
+		if gone[slug] {
+			continue
+		}
+		for _, name := range append([]string{slug}, aliases[i].Val()...) {
+			paths = append(paths, "/"+name)
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func registerAppLinkRoutes(router *mux.Router, redis_db Storage) {
+	if len(config.AppLinks.AppleAppIDs) > 0 {
+		router.HandleFunc("/.well-known/apple-app-site-association", func(w http.ResponseWriter, req *http.Request) {
+			paths, err := appLinkPaths(redis_db, req.Context())
+			if err != nil {
+				log.Println("Cannot list the app link paths", err)
+				writeUnavailable(w)
+				return
+			}
+			components := make([]map[string]string, len(paths))
+			for i, path := range paths {
+				components[i] = map[string]string{"/": path}
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"applinks": map[string]interface{}{
+					"details": []interface{}{
+						map[string]interface{}{"appIDs": config.AppLinks.AppleAppIDs, "components": components},
+					},
+				},
+			})
+		}).Methods("GET", "HEAD")
+	}
+
+	if config.AppLinks.AndroidPackage != "" {
+		router.HandleFunc("/.well-known/assetlinks.json", func(w http.ResponseWriter, req *http.Request) {
+			writeJSON(w, http.StatusOK, []interface{}{
+				map[string]interface{}{
+					"relation": []string{"delegate_permission/common.handle_all_urls"},
+					"target": map[string]interface{}{
+						"namespace":                "android_app",
+						"package_name":             config.AppLinks.AndroidPackage,
+						"sha256_cert_fingerprints": config.AppLinks.AndroidFingerprints,
+					},
+				},
+			})
+		}).Methods("GET", "HEAD")
+	}
+}
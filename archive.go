@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// With archive enabled, a new link's target is sent to the Wayback Machine's
+// Save Page Now in the background, and the snapshot's URL is kept in meta's
+// archive_url. It's offered as the way to the page when a liveness check
+// finds the target dead. Links which aren't public are never sent. Save Page
+// Now is slow and rate limited, so only a couple of requests are made at a
+// time; with an access and secret key (archive.org's S3-like keys) the limits
+// are those of the account.
+
+type ArchiveConfig struct {
+	Enabled   bool     `json:"enabled"`
+	Endpoint  string   `json:"endpoint"` // the target is appended
+	AccessKey string   `json:"access_key"`
+	SecretKey string   `json:"secret_key"`
+	Timeout   Duration `json:"timeout"`
+}
+
+var archive_slots = make(chan struct{}, 2)
+
+var archived = newCounter("shortener_archived_total", "Targets sent to the Wayback Machine, by outcome")
+
+// snapshotURL asks for a snapshot of target and returns where it will be
+func snapshotURL(ctx context.Context, c ArchiveConfig, target string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.Endpoint+target, nil)
+	if err != nil {
+		return "", err
+	}
+	if c.AccessKey != "" {
+		req.Header.Set("Authorization", "LOW "+c.AccessKey+":"+c.SecretKey)
+	}
+	client := &http.Client{
+		Transport: egressRoundTripper{},
+		Timeout:   c.Timeout.Duration,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return "", fmt.Errorf("%s answered %s", c.Endpoint, resp.Status)
+	}
+	location := resp.Header.Get("Location")
+	if location == "" {
+		location = resp.Header.Get("Content-Location")
+	}
+	if !strings.Contains(location, "/web/") {
+		return "", fmt.Errorf("%s answered %s without a snapshot", c.Endpoint, resp.Status)
+	}
+	snapshot, err := req.URL.Parse(location)
+	if err != nil {
+		return "", err
+	}
+	return snapshot.String(), nil
+}
+
+// archiveTarget snapshots the target and keeps the snapshot's URL in the link's meta
+func archiveTarget(redis_db Storage, slug string, target string) {
+	archive_slots <- struct{}{}
+	defer func() { <-archive_slots }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.Archive.Timeout.Duration)
+	defer cancel()
+	snapshot, err := snapshotURL(ctx, config.Archive, target)
+	if err != nil {
+		archived.Inc("outcome", "failed")
+		log.Println("Cannot archive the target of", slug, err)
+		return
+	}
+	archived.Inc("outcome", "saved")
+
+	// The link may have been deleted meanwhile
+	exists, err := redis_db.Exists(ctx, keyOfSlug(slug)).Result()
+	if err != nil || exists == 0 {
+		return
+	}
+	_, err = redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, keyOfSlugMeta(slug), "archive_url", snapshot)
+		touchLink(pipe, ctx, slug)
+		return nil
+	})
+	if err != nil {
+		log.Println("Cannot store the archive URL of", slug, err)
+	}
+}
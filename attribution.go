@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Trusted third parties can attribute clicks to their own users: they link to
+// /{slug}?uid=<their user id>&sig=<party>.<signature>, and the click event
+// carries the uid and party only when the signature verifies. The signature
+// is a hex HMAC-SHA256, with the party's secret, over the slug as it's in the
+// path, a newline, and the uid. Anyone can add a uid to a link; only a party
+// can make one count. The redirect happens whether it does or not.
+
+type AttributionConfig struct {
+	Parties []AttributionParty `json:"parties"`
+}
+
+type AttributionParty struct {
+	ID     string `json:"id"`
+	Secret string `json:"secret"`
+}
+
+const maxAttributedUID = 128
+
+func validateAttribution(c AttributionConfig) error {
+	seen := map[string]bool{}
+	for _, party := range c.Parties {
+		if party.ID == "" || strings.Contains(party.ID, ".") || seen[party.ID] {
+			return fmt.Errorf("Attribution party ids must be given, unique and without dots: %q", party.ID)
+		}
+		seen[party.ID] = true
+		if len(party.Secret) < minSigningSecret {
+			return fmt.Errorf("The secret of attribution party %q must be at least %d bytes", party.ID, minSigningSecret)
+		}
+	}
+	return nil
+}
+
+var attributed_clicks = newCounter("shortener_attributed_clicks_total", "Clicks carrying a uid, by result: ok, unknown_party or bad_signature")
+
+func attributionParty(id string) *AttributionParty {
+	for i, party := range config.Attribution.Parties {
+		if party.ID == id {
+			return &config.Attribution.Parties[i]
+		}
+	}
+	return nil
+}
+
+func attributionSignature(secret string, slug string, uid string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(slug + "\n" + uid))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// attributionOf is the party and uid of a click, when the link was signed for them
+func attributionOf(req *http.Request, slug string) (string, string) {
+	query := req.URL.Query()
+	uid, sig := query.Get("uid"), query.Get("sig")
+	if uid == "" || sig == "" || len(config.Attribution.Parties) == 0 {
+		return "", ""
+	}
+	parts := strings.SplitN(sig, ".", 2)
+	party := attributionParty(parts[0])
+	if party == nil || len(parts) != 2 {
+		attributed_clicks.Inc("result", "unknown_party")
+		return "", ""
+	}
+	if len(uid) > maxAttributedUID || !hmac.Equal([]byte(parts[1]), []byte(attributionSignature(party.Secret, slug, uid))) {
+		attributed_clicks.Inc("result", "bad_signature")
+		return "", ""
+	}
+	attributed_clicks.Inc("result", "ok")
+	return party.ID, uid
+}
+
+// attributedURL is the path a party would sign for a uid
+func attributedURL(party *AttributionParty, slug string, uid string) string {
+	return "/" + url.PathEscape(slug) + "?" + url.Values{
+		"uid": {uid},
+		"sig": {party.ID + "." + attributionSignature(party.Secret, slug, uid)},
+	}.Encode()
+}
+
+var errAttributionRequest = errors.New("Expected {\"party\": ..., \"slug\": ..., \"uid\": ...}, with a known party and a uid of at most 128 bytes")
+
+// handleAttributedURL signs a URL for a party, for admins issuing them on its behalf
+func handleAttributedURL(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Party string `json:"party"`
+		Slug  string `json:"slug"`
+		UID   string `json:"uid"`
+	}
+	if err := readJSON(w, req, &body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	party := attributionParty(body.Party)
+	if party == nil || body.Slug == "" || body.UID == "" || len(body.UID) > maxAttributedUID {
+		writeJSONError(w, http.StatusBadRequest, errAttributionRequest.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"url": publicURL(req, attributedURL(party, body.Slug, body.UID))})
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// API keys identify callers as a tenant. Requests without a key belong to the
+// anonymous tenant "", or with a SAML session, to a tenant of its email.
+
+type APIKeyConfig struct {
+	Key    string `json:"key"`
+	Tenant string `json:"tenant"`
+	Role   string `json:"role"`  // viewer, editor (the default) or admin
+	Admin  bool   `json:"admin"` // same as "role": "admin"
+}
+
+type Identity struct {
+	Tenant string
+	KeyId  string // last characters of the key, or the session's email; safe to log
+	Role   string
+}
+
+func apiKeyOfRequest(req *http.Request) string {
+	if v := req.Header.Get("Authorization"); strings.HasPrefix(v, "Bearer ") {
+		return strings.TrimPrefix(v, "Bearer ")
+	}
+	return req.Header.Get("X-API-Key")
+}
+
+// hasCredentials is true for a request with an API key or a signature, rather than a session
+func hasCredentials(req *http.Request) bool {
+	_, signed := signedIdentityOf(req)
+	return signed || apiKeyOfRequest(req) != ""
+}
+
+// identify returns false when a key was given but isn't known
+func identify(req *http.Request) (Identity, bool) {
+	if identity, ok := certIdentityOf(req); ok {
+		return identity, true
+	} else if config.Server.ClientCerts.Require {
+		// nothing else counts; management routes were refused already
+		return Identity{Role: config.Roles.Anonymous}, true
+	}
+	if identity, ok := signedIdentityOf(req); ok {
+		return identity, true
+	}
+	key := apiKeyOfRequest(req)
+	if s, ok := sessionOf(req); ok && key == "" {
+		return Identity{Tenant: s.Email, KeyId: s.Email, Role: roleOfSession(s)}, true
+	}
+	return identityOfKey(key)
+}
+
+func identityOfKey(key string) (Identity, bool) {
+	if key == "" {
+		return Identity{Role: config.Roles.Anonymous}, true
+	}
+	digest := keyDigest(key)
+	if !rotated_keys.usable(digest, time.Now()) {
+		return Identity{}, false
+	}
+	for _, k := range config.APIKeys {
+		if subtle.ConstantTimeCompare([]byte(k.Key), []byte(key)) == 1 {
+			return Identity{Tenant: k.Tenant, KeyId: keyId(key), Role: roleOfKey(k)}, true
+		}
+	}
+	if identity, ok := rotated_keys.identity(digest); ok {
+		identity.KeyId = keyId(key)
+		return identity, true
+	}
+	return Identity{}, false
+}
+
+func keyId(key string) string {
+	if len(key) <= 4 {
+		return "****"
+	}
+	return "..." + key[len(key)-4:]
+}
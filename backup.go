@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Periodic snapshots of every link as gzipped JSON Lines, written to S3 (or
+// GCS through its S3-compatible XML API) or a local directory. This doesn't
+// depend on Redis RDB/AOF persistence, which operators may not control.
+
+type BackupConfig struct {
+	Driver    string   `json:"driver"` // "", "s3", "file"
+	Interval  Duration `json:"interval"`
+	Prefix    string   `json:"prefix"`
+	Directory string   `json:"directory"`
+
+	S3Endpoint  string `json:"s3_endpoint"` // https://s3.amazonaws.com, https://storage.googleapis.com
+	S3Region    string `json:"s3_region"`
+	S3Bucket    string `json:"s3_bucket"`
+	S3AccessKey string `json:"s3_access_key"`
+	S3SecretKey string `json:"s3_secret_key"`
+}
+
+type BackupRecord struct {
+	Slug         string            `json:"slug"`
+	Target       string            `json:"target"`
+	TtlSeconds   int64             `json:"ttl_seconds"`
+	Clicks       int64             `json:"clicks"`
+	UniqueClicks int64             `json:"unique_clicks"`
+	Meta         map[string]string `json:"meta,omitempty"`
+}
+
+type blobStore interface {
+	put(ctx context.Context, name string, data []byte) error
+	get(ctx context.Context, name string) ([]byte, error)
+}
+
+func newBlobStore(c BackupConfig) (blobStore, error) {
+	switch c.Driver {
+	case "s3":
+		if c.S3Bucket == "" || c.S3AccessKey == "" || c.S3SecretKey == "" {
+			return nil, errors.New("S3 backup needs s3_bucket, s3_access_key and s3_secret_key")
+		}
+		return &s3Store{
+			endpoint:   strings.TrimRight(c.S3Endpoint, "/"),
+			region:     c.S3Region,
+			bucket:     c.S3Bucket,
+			access_key: c.S3AccessKey,
+			secret_key: c.S3SecretKey,
+			client:     &http.Client{Timeout: 5 * time.Minute},
+		}, nil
+	case "file":
+		if c.Directory == "" {
+			return nil, errors.New("File backup needs a directory")
+		}
+		return dirStore(c.Directory), nil
+	}
+	return nil, fmt.Errorf("Unknown backup driver %q", c.Driver)
+}
+
+// dumpLinks walks the whole keyspace, one SCAN page at a time
+func dumpLinks(redis_db Storage, ctx context.Context, out io.Writer) (int, error) {
+	encoder := json.NewEncoder(out)
+	count := 0
+	var cursor uint64
+	for {
+		keys, next, err := redis_db.Scan(ctx, cursor, keyOfSlug("*"), 500).Result()
+		if err != nil {
+			return count, err
+		}
+
+		if len(keys) > 0 {
+			slugs := make([]string, len(keys))
+			for i, k := range keys {
+				slugs[i], _ = slugFromKey(k)
+			}
+
+			targets := make([]*redis.StringCmd, len(slugs))
+			ttls := make([]*redis.DurationCmd, len(slugs))
+			counters := make([]*redis.SliceCmd, len(slugs))
+			metas := make([]*redis.StringStringMapCmd, len(slugs))
+			_, err := redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+				for i, slug := range slugs {
+					targets[i] = pipe.Get(ctx, keys[i])
+					ttls[i] = pipe.TTL(ctx, keyOfSlug(slug))
+					counters[i] = pipe.MGet(ctx, keyOfSlugHitCount(slug), keyOfSlugUniqueHitCount(slug))
+					metas[i] = pipe.HGetAll(ctx, keyOfSlugMeta(slug))
+				}
+				return nil
+			})
+			if err != nil && err != redis.Nil {
+				return count, err
+			}
+
+			for i, slug := range slugs {
+				target, err := targets[i].Result()
+				if err != nil {
+					continue // expired between SCAN and GET
+				}
+				record := BackupRecord{
+					Slug:       slug,
+					Target:     target,
+					TtlSeconds: int64(ttls[i].Val().Seconds()),
+					Meta:       metas[i].Val(),
+				}
+				if s, ok := counters[i].Val()[0].(string); ok {
+					record.Clicks, _ = strconv.ParseInt(s, 10, 64)
+				}
+				if s, ok := counters[i].Val()[1].(string); ok {
+					record.UniqueClicks, _ = strconv.ParseInt(s, 10, 64)
+				}
+				if err := encoder.Encode(record); err != nil {
+					return count, err
+				}
+				count++
+			}
+		}
+
+		cursor = next
+		if cursor == 0 {
+			return count, nil
+		}
+	}
+}
+
+// runBackup writes one snapshot and returns its object name
+func runBackup(redis_db Storage, ctx context.Context, store blobStore, prefix string) (string, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	count, err := dumpLinks(redis_db, ctx, gz)
+	if err != nil {
+		return "", err
+	}
+	if err := gz.Close(); err != nil {
+		return "", err
+	}
+
+	name := prefix + "links-" + time.Now().UTC().Format("20060102T150405Z") + ".jsonl.gz"
+	if err := store.put(ctx, name, buf.Bytes()); err != nil {
+		return "", err
+	}
+	log.Println("Backed up", count, "links to", name)
+	return name, nil
+}
+
+// backupJob has no schedule without an interval, leaving only the backup command
+func backupJob(redis_db Storage, store blobStore, c BackupConfig) scheduledJob {
+	return scheduledJob{name: "backup", schedule: everySchedule(c.Interval.Duration), run: func(ctx context.Context) error {
+		_, err := runBackup(redis_db, ctx, store, c.Prefix)
+		return err
+	}}
+}
+
+// restoreBackup loads a snapshot. Existing links are kept unless overwrite is set.
+func restoreBackup(redis_db Storage, ctx context.Context, store blobStore, name string, overwrite bool) (int, error) {
+	data, err := store.get(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+
+	restored := 0
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var record BackupRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return restored, err
+		}
+		if record.Slug == "" || !slugIsValid(record.Slug) {
+			log.Println("Skipping invalid slug in backup", record.Slug)
+			continue
+		}
+
+		ttl := time.Duration(record.TtlSeconds) * time.Second
+		if ttl <= 0 {
+			ttl = default_ttl
+		}
+
+		if overwrite {
+			err = redis_db.Set(ctx, keyOfSlug(record.Slug), record.Target, ttl).Err()
+		} else {
+			var created bool
+			created, err = redis_db.SetNX(ctx, keyOfSlug(record.Slug), record.Target, ttl).Result()
+			if err == nil && !created {
+				continue
+			}
+		}
+		if err != nil {
+			return restored, err
+		}
+
+		_, err = redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			writeLinkRecord(pipe, ctx, record, ttl)
+			return nil
+		})
+		if err != nil {
+			return restored, err
+		}
+		if err := indexLinkTerms(redis_db, ctx, record.Slug); err != nil {
+			return restored, err
+		}
+		if overwrite {
+			purgeLinks(record.Slug)
+		}
+		restored++
+	}
+	return restored, scanner.Err()
+}
+
+// writeLinkRecord writes everything of a record but its url: key, which the caller has set
+func writeLinkRecord(pipe redis.Pipeliner, ctx context.Context, record BackupRecord, ttl time.Duration) {
+	pipe.Set(ctx, keyOfSlugHitCount(record.Slug), record.Clicks, counterTTL(ttl))
+	pipe.Set(ctx, keyOfSlugUniqueHitCount(record.Slug), record.UniqueClicks, counterTTL(ttl))
+	pipe.Del(ctx, keyOfSlugMeta(record.Slug))
+	if len(record.Meta) > 0 {
+		fields := make(map[string]interface{}, len(record.Meta))
+		for k, v := range record.Meta {
+			fields[k] = v
+		}
+		pipe.HSet(ctx, keyOfSlugMeta(record.Slug), fields)
+		pipe.Expire(ctx, keyOfSlugMeta(record.Slug), ttl)
+	}
+	created := unixTime(record.Meta["created"])
+	if created.IsZero() {
+		created = time.Now()
+	}
+	indexNewLink(pipe, ctx, record.Slug, created, time.Now().Add(ttl))
+	pipe.ZAdd(ctx, keyOfTargetLinks(targetDigest(record.Target)), &redis.Z{Score: float64(created.Unix()), Member: record.Slug})
+	pipe.ZAdd(ctx, keyOfTenantLinks(record.Meta["tenant"]), &redis.Z{Score: float64(created.Unix()), Member: record.Slug})
+	pipe.ZAdd(ctx, keyOfClicksIndex, &redis.Z{Score: float64(record.Clicks), Member: record.Slug})
+	if record.Meta["app_links"] != "" {
+		pipe.SAdd(ctx, keyOfAppLinks, record.Slug)
+	}
+}
+
+type dirStore string
+
+func (d dirStore) put(ctx context.Context, name string, data []byte) error {
+	path := filepath.Join(string(d), name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+func (d dirStore) get(ctx context.Context, name string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(string(d), name))
+}
+
+// s3Store uses path-style requests signed with AWS Signature Version 4
+type s3Store struct {
+	endpoint   string
+	region     string
+	bucket     string
+	access_key string
+	secret_key string
+	client     *http.Client
+}
+
+func (s *s3Store) put(ctx context.Context, name string, data []byte) error {
+	resp, err := s.do(ctx, "PUT", name, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Upload of %s failed: %s", name, resp.Status)
+	}
+	return nil
+}
+
+func (s *s3Store) get(ctx context.Context, name string) ([]byte, error) {
+	resp, err := s.do(ctx, "GET", name, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Download of %s failed: %s", name, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (s *s3Store) do(ctx context.Context, method string, name string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.endpoint+"/"+s.bucket+"/"+name, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	payload_hash := sha256.Sum256(body)
+	s.sign(req, hex.EncodeToString(payload_hash[:]), time.Now().UTC())
+	return s.client.Do(req)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func (s *s3Store) sign(req *http.Request, payload_hash string, now time.Time) {
+	amz_date := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("x-amz-date", amz_date)
+	req.Header.Set("x-amz-content-sha256", payload_hash)
+
+	signed_headers := "host;x-amz-content-sha256;x-amz-date"
+	canonical_request := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host + "\nx-amz-content-sha256:" + payload_hash + "\nx-amz-date:" + amz_date + "\n",
+		signed_headers,
+		payload_hash,
+	}, "\n")
+	canonical_hash := sha256.Sum256([]byte(canonical_request))
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	string_to_sign := "AWS4-HMAC-SHA256\n" + amz_date + "\n" + scope + "\n" + hex.EncodeToString(canonical_hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secret_key), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, string_to_sign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.access_key+"/"+scope+
+		", SignedHeaders="+signed_headers+", Signature="+signature)
+}
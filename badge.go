@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// /{slug}/badge.svg is a shields.io-style badge of the link's click count, to
+// embed next to the short link in READMEs and wikis. ?label= changes the left
+// side, ?color= the right (a name below or hex digits), and ?unique counts
+// unique clicks. It's shown to whoever may see the link's details.
+
+var badgeColors = map[string]string{
+	"brightgreen": "#4c1", "green": "#97ca00", "yellow": "#dfb317", "orange": "#fe7d37",
+	"red": "#e05d44", "blue": "#007ec6", "grey": "#555", "lightgrey": "#9f9f9f",
+}
+
+var hexColorPattern = regexp.MustCompile(`^(?:[0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+const maxBadgeLabel = 40
+
+func badgeColor(name string) string {
+	if c, ok := badgeColors[name]; ok {
+		return c
+	}
+	if hexColorPattern.MatchString(name) {
+		return "#" + name
+	}
+	return badgeColors["blue"]
+}
+
+// shortCount writes large counts the way badges do: 999, 1.2k, 34k, 5.6M
+func shortCount(n int) string {
+	switch {
+	case n < 1000:
+		return fmt.Sprint(n)
+	case n < 10000:
+		return fmt.Sprintf("%.1fk", float64(n)/1000)
+	case n < 1000000:
+		return fmt.Sprintf("%dk", n/1000)
+	case n < 10000000:
+		return fmt.Sprintf("%.1fM", float64(n)/1000000)
+	}
+	return fmt.Sprintf("%dM", n/1000000)
+}
+
+// badgeTextWidth approximates 11px Verdana, which is wide
+func badgeTextWidth(s string) int {
+	width := 0
+	for _, r := range s {
+		switch {
+		case strings.ContainsRune("iljtf.,:;|!'I ", r):
+			width += 4
+		case strings.ContainsRune("mwMW", r):
+			width += 11
+		case r >= 'A' && r <= 'Z':
+			width += 8
+		default:
+			width += 7
+		}
+	}
+	return width
+}
+
+func badgeSVG(label string, value string, color string) string {
+	left, right := badgeTextWidth(label)+10, badgeTextWidth(value)+10
+	label, value = html.EscapeString(label), html.EscapeString(value)
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="20" role="img" aria-label="%[4]s: %[5]s">`+
+		`<title>%[4]s: %[5]s</title>`+
+		`<linearGradient id="s" x2="0" y2="100%%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>`+
+		`<clipPath id="r"><rect width="%[1]d" height="20" rx="3" fill="#fff"/></clipPath>`+
+		`<g clip-path="url(#r)"><rect width="%[2]d" height="20" fill="#555"/><rect x="%[2]d" width="%[3]d" height="20" fill="%[6]s"/><rect width="%[1]d" height="20" fill="url(#s)"/></g>`+
+		`<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">`+
+		`<text x="%[7]d" y="15" fill="#010101" fill-opacity=".3">%[4]s</text><text x="%[7]d" y="14">%[4]s</text>`+
+		`<text x="%[8]d" y="15" fill="#010101" fill-opacity=".3">%[5]s</text><text x="%[8]d" y="14">%[5]s</text></g></svg>`,
+		left+right, left, right, label, value, color, left/2, left+right/2)
+}
+
+func writeBadge(w http.ResponseWriter, status int, label string, value string, color string) {
+	w.Header().Set("Content-Type", "image/svg+xml")
+	if w.Header().Get("Cache-Control") == "" {
+		w.Header().Set("Cache-Control", "public, max-age=300")
+	}
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+	w.WriteHeader(status)
+	fmt.Fprint(w, badgeSVG(label, value, color))
+}
+
+func registerBadgeRoutes(router *mux.Router, redis_db Storage) {
+	router.HandleFunc("/{slug}/badge.svg", func(w http.ResponseWriter, req *http.Request) {
+		label := truncateRunes(req.FormValue("label"), maxBadgeLabel)
+		_, unique := req.URL.Query()["unique"]
+		if label == "" {
+			label = "clicks"
+			if unique {
+				label = "unique clicks"
+			}
+		}
+
+		link, err := resolveLink(redis_db, req.Context(), normalizeSlug(mux.Vars(req)["slug"]))
+		if err == errSlugNotFound {
+			writeBadge(w, http.StatusNotFound, label, "not found", badgeColors["lightgrey"])
+			return
+		} else if err != nil {
+			writeUnavailable(w)
+			return
+		}
+		su, err := getDetailsOfKey(redis_db, req.Context(), link.slug)
+		if err == errSlugNotFound {
+			writeBadge(w, http.StatusNotFound, label, "not found", badgeColors["lightgrey"])
+			return
+		} else if err != nil {
+			writeUnavailable(w)
+			return
+		}
+		if !canViewDetails(req, su) || !mayFollow(su.Access, viewerOf(req)) {
+			writeBadge(w, http.StatusForbidden, label, "private", badgeColors["lightgrey"])
+			return
+		}
+
+		if config.Details.RequireAuth || !su.Access.Public() {
+			w.Header().Set("Cache-Control", "private, max-age=300")
+		}
+		count := su.Clicks
+		if unique {
+			count = su.UniqueClicks
+		}
+		if notModified(w, req, linkETag(su), su.Modified()) {
+			return
+		}
+		writeBadge(w, http.StatusOK, label, shortCount(count), badgeColor(req.FormValue("color")))
+	}).Methods("GET")
+}
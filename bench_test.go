@@ -0,0 +1,122 @@
+package main
+
+// Benchmarks of the redirect path and of creating links, against a real Redis:
+//
+//	go test -run '^$' -bench . -redis localhost:6379 -redis-db 15
+//
+// They write links with the default TTL, which expire on their own, to the
+// database given; without -redis they're skipped. The HTTP side is measured
+// end to end by cmd/loadgen.
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+var bench_redis = flag.String("redis", "", "address of a Redis to benchmark against")
+var bench_redis_db = flag.Int("redis-db", 15, "Redis database the benchmarks write to")
+
+func benchRedis(b *testing.B) Storage {
+	if *bench_redis == "" {
+		b.Skip("no -redis to benchmark against")
+	}
+	redis_db := redis.NewClient(&redis.Options{Addr: *bench_redis, DB: *bench_redis_db})
+	if err := redis_db.Ping(context.Background()).Err(); err != nil {
+		b.Skip("cannot reach Redis at ", *bench_redis, ": ", err)
+	}
+	b.Cleanup(func() { redis_db.Close() })
+	return redis_db
+}
+
+// benchLinks creates n links to follow
+func benchLinks(b *testing.B, redis_db Storage, n int) []string {
+	slugs := make([]string, n)
+	for i := range slugs {
+		su, err := store(redis_db, context.Background(), "https://example.com/bench/"+strconv.Itoa(i), LinkOptions{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		slugs[i] = su.Slug
+	}
+	return slugs
+}
+
+// BenchmarkRedirect is what following a link costs in Redis: resolving it,
+// then counting the click
+func BenchmarkRedirect(b *testing.B) {
+	redis_db := benchRedis(b)
+	ctx := context.Background()
+	slugs := benchLinks(b, redis_db, 100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		link, err := resolveLink(redis_db, ctx, slugs[i%len(slugs)])
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := countClick(redis_db, ctx, link.slug, link.access, true, time.Now()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkResolveLink(b *testing.B) {
+	redis_db := benchRedis(b)
+	ctx := context.Background()
+	slugs := benchLinks(b, redis_db, 100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := resolveLink(redis_db, ctx, slugs[i%len(slugs)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCountClick(b *testing.B) {
+	redis_db := benchRedis(b)
+	ctx := context.Background()
+	slugs := benchLinks(b, redis_db, 100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := countClick(redis_db, ctx, slugs[i%len(slugs)], LinkAccess{}, true, time.Now()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkCreateLink is the createLink script alone, with slugs known to be free
+func BenchmarkCreateLink(b *testing.B) {
+	redis_db := benchRedis(b)
+	ctx := context.Background()
+	prefix := fmt.Sprintf("bench%d", time.Now().UnixNano())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		created, err := createLink(redis_db, ctx, prefix+strconv.Itoa(i), "https://example.com/bench", LinkOptions{}, time.Now())
+		if err != nil {
+			b.Fatal(err)
+		}
+		if !created {
+			b.Fatal("slug taken")
+		}
+	}
+}
+
+// BenchmarkShorten is all /_create does: quota, checks, a new slug and the script
+func BenchmarkShorten(b *testing.B) {
+	redis_db := benchRedis(b)
+	identity := Identity{Tenant: "bench", KeyId: "bench", Role: roleEditor}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := httptest.NewRequest("POST", "/_create", nil)
+		_, status, err := shorten(redis_db, httptest.NewRecorder(), req, identity, "https://example.com/bench/"+strconv.Itoa(i), LinkOptions{})
+		if err != nil {
+			b.Fatal(status, err)
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+// Bulk operations act on every link matching a filter (a tag, a target
+// domain, a tenant) server-side, rather than in a client's loop over the API:
+// extend_ttl, disable or enable, trash, or export. They run in the background on the replica
+// which was asked, saving their progress after every batch, so any replica
+// can report on them; a running operation can be cancelled between batches.
+//
+// bulk:<id> holds the operation, and bulk:<id>:export the exported links,
+// one JSON document each, for a week.
+
+const bulkKept = 7 * 24 * time.Hour
+
+var bulkActions = []string{"extend_ttl", "disable", "enable", "trash", "export"}
+
+type BulkFilter struct {
+	Tag    string `json:"tag,omitempty"`
+	Domain string `json:"domain,omitempty"` // the target's host, or a subdomain of it
+	Tenant string `json:"tenant,omitempty"`
+}
+
+type BulkOperation struct {
+	Id         string     `json:"id"`
+	Action     string     `json:"action"`
+	Filter     BulkFilter `json:"filter"`
+	TTLSeconds int64      `json:"ttl_seconds,omitempty"` // extend_ttl: expire no sooner than this from now
+	DryRun     bool       `json:"dry_run,omitempty"`     // count matches, change nothing
+	By         string     `json:"by"`
+
+	State    string     `json:"state"` // running, done, cancelled or failed
+	Error    string     `json:"error,omitempty"`
+	Scanned  int        `json:"scanned"`
+	Matched  int        `json:"matched"`
+	Done     int        `json:"done"`
+	Failed   int        `json:"failed"`
+	Started  time.Time  `json:"started"`
+	Updated  time.Time  `json:"updated"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Export   string     `json:"export,omitempty"` // where to read an export
+}
+
+var bulk_links = newCounter("shortener_bulk_links_total", "Links changed or exported by bulk operations, by action and result")
+
+func keyOfBulk(id string) string {
+	return "bulk:" + id
+}
+
+func keyOfBulkExport(id string) string {
+	return "bulk:" + id + ":export"
+}
+
+func keyOfBulkCancel(id string) string {
+	return "bulk:" + id + ":cancel"
+}
+
+func validateBulk(op BulkOperation) error {
+	if !containsString(bulkActions, op.Action) {
+		return errors.New("action must be one of " + strings.Join(bulkActions, ", "))
+	}
+	f := op.Filter
+	if f.Tag == "" && f.Domain == "" && f.Tenant == "" {
+		return errors.New("filter needs a tag, domain or tenant")
+	}
+	if f.Tag != "" && !tagPattern.MatchString(f.Tag) {
+		return errors.New("filter.tag isn't a valid tag")
+	}
+	if op.Action == "extend_ttl" && op.TTLSeconds <= 0 {
+		return errors.New("extend_ttl needs a positive ttl_seconds")
+	}
+	return nil
+}
+
+// matches checks a link's target and meta against the filter
+func (f BulkFilter) matches(target string, meta map[string]string) bool {
+	if f.Tenant != "" && meta["tenant"] != f.Tenant {
+		return false
+	}
+	if f.Tag != "" && !containsString(tagsOfMeta(meta), f.Tag) {
+		return false
+	}
+	if f.Domain != "" {
+		host, domain := strings.ToLower(hostOfTarget(target)), strings.ToLower(f.Domain)
+		if host != domain && !strings.HasSuffix(host, "."+domain) {
+			return false
+		}
+	}
+	return true
+}
+
+func saveBulk(redis_db Storage, ctx context.Context, op *BulkOperation) error {
+	op.Updated = time.Now().UTC()
+	data, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+	return redis_db.Set(ctx, keyOfBulk(op.Id), data, bulkKept).Err()
+}
+
+func loadBulk(redis_db Storage, ctx context.Context, id string) (*BulkOperation, error) {
+	data, err := redis_db.Get(ctx, keyOfBulk(id)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var op BulkOperation
+	return &op, json.Unmarshal(data, &op)
+}
+
+// extendLink makes a link expire no sooner than ttl from now; a longer ttl
+// becomes the link's own, so clicks keep it
+func extendLink(redis_db Storage, ctx context.Context, slug string, meta map[string]string, ttl time.Duration) error {
+	current, err := redis_db.TTL(ctx, keyOfSlug(slug)).Result()
+	if err != nil || current >= ttl || current < 0 {
+		return err // already long enough, or doesn't expire
+	}
+	_, err = redis_db.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if ttl > ttlOfMeta(meta) {
+			// so clicks renew it to ttl, and the integrity check allows it
+			pipe.HSet(ctx, keyOfSlugMeta(slug), "ttl", int64(ttl.Seconds()))
+		}
+		touchLink(pipe, ctx, slug)
+		pipe.Expire(ctx, keyOfSlug(slug), ttl)
+		pipe.Expire(ctx, keyOfSlugMeta(slug), ttl)
+		expireCounter(pipe, ctx, keyOfSlugHitCount(slug), ttl)
+		expireCounter(pipe, ctx, keyOfSlugUniqueHitCount(slug), ttl)
+		expireCounter(pipe, ctx, keyOfSlugSeries(slug), ttl)
+		pipe.ZAdd(ctx, keyOfExpiresIndex, &redis.Z{Score: float64(time.Now().Add(ttl).Unix()), Member: slug})
+		return nil
+	})
+	if err == nil && ttl > ttlOfMeta(meta) {
+		// replicas' cached ttl would have the next click cut it back
+		shared_cache.forget(slug)
+	}
+	return err
+}
+
+// disableLink sets or clears a link's "disabled" field. A disabled link
+// refuses its redirect but is otherwise kept, so enabling it brings it back.
+func disableLink(redis_db Storage, ctx context.Context, slug string, disabled bool) error {
+	var aliases *redis.StringSliceCmd
+	_, err := redis_db.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if disabled {
+			pipe.HSet(ctx, keyOfSlugMeta(slug), "disabled", time.Now().Unix())
+		} else {
+			pipe.HDel(ctx, keyOfSlugMeta(slug), "disabled")
+		}
+		touchLink(pipe, ctx, slug)
+		aliases = pipe.SMembers(ctx, keyOfSlugAliases(slug))
+		return nil
+	})
+	if err == nil {
+		// cached with the link's access
+		purgeLinks(append([]string{slug}, aliases.Val()...)...)
+	}
+	return err
+}
+
+// applyBulk does the operation's action to one matching link
+func applyBulk(redis_db Storage, ctx context.Context, op *BulkOperation, slug string, meta map[string]string) error {
+	switch op.Action {
+	case "extend_ttl":
+		return extendLink(redis_db, ctx, slug, meta, time.Duration(op.TTLSeconds)*time.Second)
+	case "disable", "enable":
+		return disableLink(redis_db, ctx, slug, op.Action == "disable")
+	case "trash":
+		_, err := trashLink(redis_db, ctx, slug, op.By)
+		return err
+	case "export":
+		su, err := getDetailsOfKey(redis_db, ctx, slug)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(linkResponseOf(su))
+		if err != nil {
+			return err
+		}
+		_, err = redis_db.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.RPush(ctx, keyOfBulkExport(op.Id), data)
+			pipe.Expire(ctx, keyOfBulkExport(op.Id), bulkKept)
+			return nil
+		})
+		return err
+	}
+	return nil
+}
+
+// runBulk goes through every link, batch by batch, until done or cancelled
+func runBulk(redis_db Storage, op *BulkOperation) {
+	ctx := context.Background()
+	errCancelled := errors.New("cancelled")
+	err := scanKeys(redis_db, ctx, keyOfSlug("*"), func(keys []string) error {
+		targets := make([]*redis.StringCmd, len(keys))
+		metas := make([]*redis.StringStringMapCmd, len(keys))
+		var cancelled *redis.IntCmd
+		_, err := redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, key := range keys {
+				slug, _ := slugFromKey(key)
+				targets[i] = pipe.Get(ctx, key)
+				metas[i] = pipe.HGetAll(ctx, keyOfSlugMeta(slug))
+			}
+			cancelled = pipe.Exists(ctx, keyOfBulkCancel(op.Id))
+			return nil
+		})
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if cancelled.Val() > 0 {
+			return errCancelled
+		}
+		for i, key := range keys {
+			slug, _ := slugFromKey(key)
+			target, err := targets[i].Result()
+			if err != nil {
+				continue // expired since
+			}
+			op.Scanned++
+			if !op.Filter.matches(target, metas[i].Val()) {
+				continue
+			}
+			op.Matched++
+			if op.DryRun {
+				continue
+			}
+			if err := applyBulk(redis_db, ctx, op, slug, metas[i].Val()); err != nil {
+				op.Failed++
+				bulk_links.Inc("action", op.Action, "result", "failed")
+				log.Println("Bulk", op.Id, op.Action, "failed on", slug, err)
+				continue
+			}
+			op.Done++
+			bulk_links.Inc("action", op.Action, "result", "done")
+		}
+		return saveBulk(redis_db, ctx, op)
+	})
+
+	finished := time.Now().UTC()
+	op.Finished = &finished
+	switch {
+	case err == errCancelled:
+		op.State = "cancelled"
+	case err != nil:
+		op.State, op.Error = "failed", err.Error()
+	default:
+		op.State = "done"
+	}
+	if err := saveBulk(redis_db, ctx, op); err != nil {
+		log.Println("Cannot save bulk operation", op.Id, err)
+	}
+	log.Printf("Bulk %s %s %s: %d of %d links matched, %d done, %d failed", op.Id, op.Action, op.State, op.Matched, op.Scanned, op.Done, op.Failed)
+}
+
+func handleBulk(redis_db Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var op BulkOperation
+		var body struct {
+			Action     string     `json:"action"`
+			Filter     BulkFilter `json:"filter"`
+			TTLSeconds int64      `json:"ttl_seconds"`
+			DryRun     bool       `json:"dry_run"`
+		}
+		if err := readJSON(w, req, &body); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		op.Action, op.Filter, op.TTLSeconds, op.DryRun = body.Action, body.Filter, body.TTLSeconds, body.DryRun
+		if err := validateBulk(op); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		nonce := make([]byte, 8)
+		rand.Read(nonce)
+		op.Id = hex.EncodeToString(nonce)
+		identity, _ := identify(req)
+		op.By = identity.KeyId
+		op.State = "running"
+		op.Started = time.Now().UTC()
+		if op.Action == "export" {
+			op.Export = "/api/v1/admin/bulk/" + op.Id + "/export"
+		}
+		if err := saveBulk(redis_db, req.Context(), &op); err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		log.Println("Bulk", op.Id, op.Action, "of", op.Filter, "started by", op.By)
+		started := op
+		go runBulk(redis_db, &op)
+		w.Header().Set("Location", "/api/v1/admin/bulk/"+started.Id)
+		writeJSON(w, http.StatusAccepted, started)
+	}
+}
+
+func registerBulkRoutes(router *mux.Router, redis_db Storage) {
+	router.HandleFunc("/bulk", handleBulk(redis_db)).Methods("POST")
+
+	router.HandleFunc("/bulk/{id:[0-9a-f]+}", func(w http.ResponseWriter, req *http.Request) {
+		op, err := loadBulk(redis_db, req.Context(), mux.Vars(req)["id"])
+		if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		} else if op == nil {
+			writeJSONError(w, http.StatusNotFound, "No such bulk operation")
+			return
+		}
+		writeJSON(w, http.StatusOK, op)
+	}).Methods("GET")
+
+	// Cancels between batches; what's done stays done
+	router.HandleFunc("/bulk/{id:[0-9a-f]+}", func(w http.ResponseWriter, req *http.Request) {
+		id := mux.Vars(req)["id"]
+		op, err := loadBulk(redis_db, req.Context(), id)
+		if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		} else if op == nil {
+			writeJSONError(w, http.StatusNotFound, "No such bulk operation")
+			return
+		} else if op.State != "running" {
+			writeJSONError(w, http.StatusConflict, "The bulk operation is "+op.State)
+			return
+		}
+		if err := redis_db.Set(req.Context(), keyOfBulkCancel(id), 1, bulkKept).Err(); err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}).Methods("DELETE")
+
+	// The exported links so far, one JSON document a line
+	router.HandleFunc("/bulk/{id:[0-9a-f]+}/export", func(w http.ResponseWriter, req *http.Request) {
+		id := mux.Vars(req)["id"]
+		op, err := loadBulk(redis_db, req.Context(), id)
+		if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		} else if op == nil || op.Action != "export" {
+			writeJSONError(w, http.StatusNotFound, "No such export")
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("X-Bulk-State", op.State)
+		for start := int64(0); ; start += 500 {
+			lines, err := redis_db.LRange(req.Context(), keyOfBulkExport(id), start, start+499).Result()
+			if err != nil {
+				log.Println("Cannot read export", id, err)
+				return
+			}
+			for _, line := range lines {
+				w.Write([]byte(line + "\n"))
+			}
+			if len(lines) < 500 {
+				return
+			}
+		}
+	}).Methods("GET")
+}
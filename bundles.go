@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+// A bundle is one slug for several destinations: following it shows a page
+// listing them, in its tenant's theme, instead of redirecting. The visit
+// counts as a click on the link, as a redirect would; each destination is
+// reached through /{slug}/go/{n}, which counts it apart and redirects.
+//
+// A bundle is a link whose url: key is empty, with its destinations in the
+// "bundle" meta field, so its expiry, aliases, visibility and privacy work as
+// for any link. urlbundle:<slug> is a hash of clicks by destination, a
+// counter like urlgeo:.
+
+type BundleDestination struct {
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+// The most destinations one bundle may have
+const maxBundleDestinations = 20
+
+func keyOfBundleClicks(slug string) string {
+	return "urlbundle:" + slug
+}
+
+var bundle_clicks = newCounter("shortener_bundle_clicks_total", "Destinations followed from bundle pages")
+
+func bundleOfMeta(encoded string) []BundleDestination {
+	if encoded == "" {
+		return nil
+	}
+	var destinations []BundleDestination
+	if err := json.Unmarshal([]byte(encoded), &destinations); err != nil {
+		return nil
+	}
+	return destinations
+}
+
+// validateBundle checks each destination as a target, and titles the
+// untitled ones after their host
+func validateBundle(destinations []BundleDestination) ([]BundleDestination, error) {
+	if len(destinations) == 0 || len(destinations) > maxBundleDestinations {
+		return nil, fmt.Errorf("A bundle has 1 to %d destinations", maxBundleDestinations)
+	}
+	valid := make([]BundleDestination, len(destinations))
+	for i, d := range destinations {
+		target := asciiTarget(d.URL)
+		if _, err := validateTarget(target); err != nil {
+			return nil, fmt.Errorf("destinations[%d]: %v", i, err)
+		}
+		title := truncateRunes(strings.TrimSpace(d.Title), maxTitleRunes)
+		if title == "" {
+			title = hostOfTarget(target)
+		}
+		valid[i] = BundleDestination{Title: title, URL: target}
+	}
+	return valid, nil
+}
+
+type BundleDestinationResponse struct {
+	Title  string `json:"title"`
+	URL    string `json:"url"`
+	Clicks int64  `json:"clicks"`
+}
+
+// BundleDestinations are a bundle's destinations with their clicks, for the
+// details page and the API
+func (su ShortUrl) BundleDestinations() []BundleDestinationResponse {
+	if len(su.Access.Bundle) == 0 {
+		return nil
+	}
+	r := make([]BundleDestinationResponse, len(su.Access.Bundle))
+	for i, d := range su.Access.Bundle {
+		clicks, _ := strconv.ParseInt(su.BundleClicks[strconv.Itoa(i)], 10, 64)
+		r[i] = BundleDestinationResponse{Title: d.Title, URL: d.URL, Clicks: clicks}
+	}
+	return r
+}
+
+type BundlePage struct {
+	ShortUrl
+	Destinations []BundleDestination // linking through /{slug}/go/{n}
+}
+
+// writeBundlePage is shown instead of redirecting, for a bundle
+func writeBundlePage(redis_db Storage, w http.ResponseWriter, req *http.Request, slug string, access LinkAccess) {
+	page := BundlePage{ShortUrl: ShortUrl{Slug: slug, Access: access}}
+	if meta, err := redis_db.HMGet(req.Context(), keyOfSlugMeta(slug), "title", "description", "tenant").Result(); err == nil {
+		page.Title, _ = meta[0].(string)
+		page.Description, _ = meta[1].(string)
+		page.Tenant, _ = meta[2].(string)
+	}
+	for i, d := range access.Bundle {
+		page.Destinations = append(page.Destinations, BundleDestination{Title: d.Title, URL: "/" + url.PathEscape(slug) + "/go/" + strconv.Itoa(i)})
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	setLanguage(w, req)
+	if access.Privacy != "" {
+		w.Header().Set("Referrer-Policy", "no-referrer")
+	}
+	renderPage(w, req, "bundle.html", brandingOf(page.Tenant), page)
+}
+
+func countBundleClick(writes_db Storage, ctx context.Context, slug string, access LinkAccess, n int) error {
+	_, err := writes_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HIncrBy(ctx, keyOfBundleClicks(slug), strconv.Itoa(n), 1)
+		expireCounter(pipe, ctx, keyOfBundleClicks(slug), access.clickTTL())
+		meterUsage(pipe, ctx, access.Tenant, usageRedirects, time.Now())
+		return nil
+	})
+	return err
+}
+
+// registerBundleRoutes adds the destinations' redirects; clicks go to writes_db
+func registerBundleRoutes(router *mux.Router, redis_db Storage, writes_db Storage) {
+	router.HandleFunc("/{slug:[0-9A-Za-z]+}/go/{n:[0-9]+}", func(w http.ResponseWriter, req *http.Request) {
+		uncached(w)
+		if !checkBackoff(w, req) {
+			return
+		}
+		requested := normalizeSlug(mux.Vars(req)["slug"])
+		link, err := resolveLink(redis_db, req.Context(), requested)
+		link, err = notReplicatedYet(req.Context(), requested, link, err)
+		if err == errSlugNotFound {
+			countMiss(req)
+			writeLocalizedError(w, req, http.StatusNotFound, "Slug not found")
+			return
+		} else if err != nil {
+			log.Println("Storage error looking up", requested, "request", req.Header.Get(requestIDHeader), err)
+			writeUnavailable(w)
+			return
+		}
+		n, _ := strconv.Atoi(mux.Vars(req)["n"])
+		if n >= len(link.access.Bundle) {
+			writeLocalizedError(w, req, http.StatusNotFound, "Slug not found")
+			return
+		}
+		if !checkAccess(w, req, link.access) {
+			return
+		}
+		if err := countBundleClick(writes_db, req.Context(), link.slug, link.access, n); err != nil {
+			// the redirect goes ahead regardless
+			log.Println("Cannot count the click on", link.slug, "destination", n, err)
+		}
+		bundle_clicks.Inc()
+		target := rewriteTarget(link.access.Bundle[n].URL)
+		switch link.access.Privacy {
+		case privacyDereferrer:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			setLanguage(w, req)
+			w.Header().Set("Referrer-Policy", "no-referrer")
+			renderPage(w, req, "dereferrer.html", brandingOf(""), ShortUrl{Slug: link.slug, Target: target})
+			return
+		case privacyNoReferrer:
+			w.Header().Set("Referrer-Policy", "no-referrer")
+		}
+		// every click has to reach the counter, so nothing may cache it
+		http.Redirect(w, req, target, http.StatusFound)
+	}).Methods("GET", "HEAD")
+}
+
+func registerBundleAPIRoutes(router *mux.Router, redis_db Storage) {
+
+	router.HandleFunc("", func(w http.ResponseWriter, req *http.Request) {
+		identity, ok := hasRole(w, req, roleEditor)
+		if !ok {
+			return
+		}
+		var body struct {
+			Title        string              `json:"title"` // shown on the page
+			Description  string              `json:"description"`
+			Destinations []BundleDestination `json:"destinations"`
+			Visibility   string              `json:"visibility"`
+			Allow        string              `json:"allow"`
+			Privacy      string              `json:"privacy"`
+			Tags         []string            `json:"tags"`
+		}
+		if err := readJSON(w, req, &body); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		opts := LinkOptions{Tags: body.Tags}
+		var err error
+		if opts.Bundle, err = validateBundle(body.Destinations); err != nil {
+			writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		if opts.Access, err = parseLinkAccess(body.Visibility, body.Allow); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if opts.Access.Privacy, err = parseLinkPrivacy(body.Privacy); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		su, status, err := shorten(redis_db, w, req, identity, "", opts)
+		if err != nil {
+			writeJSONError(w, status, err.Error())
+			return
+		}
+		su.Access.Bundle = opts.Bundle
+		fields := []interface{}{}
+		if title := strings.TrimSpace(body.Title); title != "" {
+			su.Title = truncateRunes(title, maxTitleRunes)
+			fields = append(fields, "title", su.Title)
+		}
+		if description := strings.TrimSpace(body.Description); description != "" {
+			su.Description = truncateRunes(description, maxDescriptionRunes)
+			fields = append(fields, "description", su.Description)
+		}
+		if len(fields) > 0 {
+			redis_db.HSet(req.Context(), keyOfSlugMeta(su.Slug), fields...)
+		}
+		reindexTerms(redis_db, req.Context(), su.Slug)
+		log.Println("Created bundle", su.Slug, "of", len(opts.Bundle), "destinations by", identity.KeyId)
+		writeJSON(w, http.StatusCreated, linkResponseOf(su))
+	}).Methods("POST")
+}
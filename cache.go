@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// With a ttl, redirects are answered from the slugs resolved in the last ttl
+// without asking Redis. To spare a freshly started replica the cold start,
+// the most clicked links (from idx:clicks) are loaded at startup, and again
+// every preload_interval so they stay fresh.
+
+type CacheConfig struct {
+	TTL             Duration `json:"ttl"` // 0 only uses the cache during Redis outages
+	Preload         int      `json:"preload"`
+	PreloadInterval Duration `json:"preload_interval"`
+
+	Shared   SharedCacheConfig `json:"shared"`   // see sharedcache.go
+	Tracking TrackingConfig    `json:"tracking"` // see tracking.go
+}
+
+// fresh returns an entry resolved less than ttl ago
+func (r *resolvedSlugs) fresh(requested string, ttl time.Duration) (resolvedSlug, bool) {
+	if ttl <= 0 {
+		return resolvedSlug{}, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.entries[requested]
+	if !ok || time.Since(e.at) > ttl {
+		return resolvedSlug{}, false
+	}
+	return e, true
+}
+
+// preload caches the n most clicked links, returning how many it found
+func (r *resolvedSlugs) preload(redis_db Storage, ctx context.Context, n int) (int, error) {
+	if n > r.size {
+		n = r.size
+	}
+	if n <= 0 {
+		return 0, nil
+	}
+	slugs, err := redis_db.ZRevRange(ctx, keyOfClicksIndex, 0, int64(n)-1).Result()
+	if err != nil || len(slugs) == 0 {
+		return 0, err
+	}
+	keys := make([]string, len(slugs))
+	for i, slug := range slugs {
+		keys[i] = keyOfSlug(slug)
+	}
+	targets := make([]*redis.StringCmd, len(slugs))
+	accesses := make([]*redis.SliceCmd, len(slugs))
+	_, err = redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, slug := range slugs {
+			targets[i] = pipe.Get(ctx, keys[i])
+			accesses[i] = pipe.HMGet(ctx, keyOfSlugMeta(slug), accessFields...)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return 0, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	loaded := 0
+	for i, slug := range slugs {
+		if target, err := targets[i].Result(); err == nil {
+			meta := map[string]string{}
+			for j, name := range accessFields {
+				meta[name], _ = accesses[i].Val()[j].(string)
+			}
+			access := accessOfMeta(meta)
+			r.put(slug, resolvedSlug{slug: slug, target: target, access: access})
+			loaded++
+		}
+	}
+	return loaded, nil
+}
+
+func (r *resolvedSlugs) preloadPeriodically(redis_db Storage, c CacheConfig) {
+	if c.Preload <= 0 {
+		return
+	}
+	for {
+		start := time.Now()
+		if loaded, err := r.preload(redis_db, context.Background(), c.Preload); err != nil {
+			log.Println("Preloading the slug cache failed", err)
+		} else {
+			log.Println("Preloaded", loaded, "slugs into the cache in", time.Since(start))
+		}
+		if c.PreloadInterval.Duration <= 0 {
+			return
+		}
+		time.Sleep(c.PreloadInterval.Duration)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+// A campaign groups several short links so their stats can be read together.
+// campaign:<id> is a hash of its attributes, campaignlinks:<id> the set of member slugs.
+
+type Campaign struct {
+	Id      string    `json:"id"`
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	Slugs   []string  `json:"slugs"`
+}
+
+type CampaignStats struct {
+	Campaign
+	Clicks       int64         `json:"clicks"`
+	UniqueClicks int64         `json:"unique_clicks"`
+	ActiveLinks  int           `json:"active_links"`
+	Series       []SeriesPoint `json:"series"`
+}
+
+var campaignIdPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,63}$`)
+
+var errCampaignNotFound = errors.New("Campaign not found")
+var errCampaignExists = errors.New("Campaign already exists")
+
+func keyOfCampaign(id string) string {
+	return "campaign:" + id
+}
+
+func keyOfCampaignLinks(id string) string {
+	return "campaignlinks:" + id
+}
+
+func createCampaign(redis_db Storage, ctx context.Context, id string, name string) (Campaign, error) {
+	c := Campaign{Id: id, Name: name, Created: time.Now().UTC(), Slugs: []string{}}
+	created, err := redis_db.HSetNX(ctx, keyOfCampaign(id), "name", name).Result()
+	if err != nil {
+		return Campaign{}, err
+	}
+	if !created {
+		return Campaign{}, errCampaignExists
+	}
+	err = redis_db.HSet(ctx, keyOfCampaign(id), "created", c.Created.Unix()).Err()
+	return c, err
+}
+
+func getCampaign(redis_db Storage, ctx context.Context, id string) (Campaign, error) {
+	var attrs *redis.StringStringMapCmd
+	var members *redis.StringSliceCmd
+	_, err := redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		attrs = pipe.HGetAll(ctx, keyOfCampaign(id))
+		members = pipe.SMembers(ctx, keyOfCampaignLinks(id))
+		return nil
+	})
+	if err != nil {
+		return Campaign{}, err
+	}
+	if len(attrs.Val()) == 0 {
+		return Campaign{}, errCampaignNotFound
+	}
+	created, _ := strconv.ParseInt(attrs.Val()["created"], 10, 64)
+	return Campaign{
+		Id:      id,
+		Name:    attrs.Val()["name"],
+		Created: time.Unix(created, 0).UTC(),
+		Slugs:   members.Val(),
+	}, nil
+}
+
+// attachToCampaign answers errCampaignNotFound or errSlugNotFound when
+// either is missing; other errors are the storage's
+func attachToCampaign(redis_db Storage, ctx context.Context, id string, slug string) error {
+	var campaign, link *redis.IntCmd
+	_, err := redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		campaign = pipe.Exists(ctx, keyOfCampaign(id))
+		link = pipe.Exists(ctx, keyOfSlug(slug))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if campaign.Val() == 0 {
+		return errCampaignNotFound
+	}
+	if link.Val() == 0 {
+		return errSlugNotFound
+	}
+	return redis_db.SAdd(ctx, keyOfCampaignLinks(id), slug).Err()
+}
+
+// campaignStats adds up the counters of every member link which still exists,
+// and of expired ones too when counters outlive links
+func campaignStats(redis_db Storage, ctx context.Context, c Campaign, hours int) (CampaignStats, error) {
+	stats := CampaignStats{Campaign: c}
+
+	for _, slug := range c.Slugs {
+		su, err := getDetailsOfKey(redis_db, ctx, slug)
+		if err == nil {
+			stats.ActiveLinks++
+			stats.Clicks += int64(su.Clicks)
+			stats.UniqueClicks += int64(su.UniqueClicks)
+		} else if err == errSlugNotFound && countersOutliveLinks() {
+			counters, err := redis_db.MGet(ctx, keyOfSlugHitCount(slug), keyOfSlugUniqueHitCount(slug)).Result()
+			if err != nil {
+				return stats, err
+			}
+			if s, ok := counters[0].(string); ok {
+				n, _ := strconv.ParseInt(s, 10, 64)
+				stats.Clicks += n
+			}
+			if s, ok := counters[1].(string); ok {
+				n, _ := strconv.ParseInt(s, 10, 64)
+				stats.UniqueClicks += n
+			}
+		}
+	}
+
+	series, err := clickSeries(redis_db, ctx, c.Slugs, hours)
+	stats.Series = series
+	return stats, err
+}
+
+func registerCampaignRoutes(router *mux.Router, redis_db Storage) {
+	router.Use(requireRoleByMethod)
+
+	router.HandleFunc("", func(w http.ResponseWriter, req *http.Request) {
+		var body struct {
+			Id   string `json:"id"`
+			Name string `json:"name"`
+		}
+		if err := readJSON(w, req, &body); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Invalid JSON body")
+			return
+		}
+		if !campaignIdPattern.MatchString(body.Id) {
+			writeJSONError(w, http.StatusBadRequest, "Campaign id must be lowercase letters, digits and hyphens")
+			return
+		}
+		if body.Name == "" {
+			body.Name = body.Id
+		}
+
+		c, err := createCampaign(redis_db, req.Context(), body.Id, body.Name)
+		if err == errCampaignExists {
+			writeJSONError(w, http.StatusConflict, err.Error())
+			return
+		} else if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		w.Header().Set("Location", "/api/v1/campaigns/"+c.Id)
+		writeJSON(w, http.StatusCreated, c)
+	}).Methods("POST")
+
+	router.HandleFunc("/{id}", func(w http.ResponseWriter, req *http.Request) {
+		c, err := getCampaign(redis_db, req.Context(), mux.Vars(req)["id"])
+		if err == errCampaignNotFound {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		} else if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+
+		hours := 24
+		if v := req.FormValue("hours"); v != "" {
+			if n, err := strconv.Atoi(v); err == nil && n > 0 && n <= 24*90 {
+				hours = n
+			} else {
+				writeJSONError(w, http.StatusBadRequest, "hours must be between 1 and 2160")
+				return
+			}
+		}
+
+		stats, err := campaignStats(redis_db, req.Context(), c, hours)
+		if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, stats)
+	}).Methods("GET")
+
+	router.HandleFunc("/{id}/geo", func(w http.ResponseWriter, req *http.Request) {
+		c, err := getCampaign(redis_db, req.Context(), mux.Vars(req)["id"])
+		if err == errCampaignNotFound {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		} else if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		geo, err := clickGeo(redis_db, req.Context(), c.Slugs)
+		if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, geo)
+	}).Methods("GET")
+
+	router.HandleFunc("/{id}/links", func(w http.ResponseWriter, req *http.Request) {
+		var body struct {
+			Slug string `json:"slug"`
+		}
+		if err := readJSON(w, req, &body); err != nil || !slugIsValid(body.Slug) || body.Slug == "" {
+			writeJSONError(w, http.StatusBadRequest, "Expected {\"slug\": ...}")
+			return
+		}
+		err := attachToCampaign(redis_db, req.Context(), mux.Vars(req)["id"], body.Slug)
+		if err == errCampaignNotFound || err == errSlugNotFound {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		} else if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("POST")
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// With a CDN in front, redirects of public links are answered 301 and may be
+// kept at the edge for cdn.max_age, tagged with the link's surrogate key
+// (Surrogate-Key for Fastly, Cache-Tag for Cloudflare). When a link is
+// deleted, retargeted or loses an alias, its key is purged through the CDN's
+// API, so the edge doesn't go on sending visitors to the old target.
+// Everything else the slug routes answer is marked no-store.
+
+type CDNConfig struct {
+	Provider         string   `json:"provider"` // fastly or cloudflare, none when empty
+	MaxAge           Duration `json:"max_age"`
+	APIToken         string   `json:"api_token"`
+	FastlyServiceID  string   `json:"fastly_service_id"`
+	CloudflareZoneID string   `json:"cloudflare_zone_id"`
+	APIURL           string   `json:"api_url"` // the provider's API, for tests and proxies
+}
+
+var cdn_purges_failed = newCounter("shortener_cdn_purges_failed_total", "Surrogate key purges the CDN did not accept")
+
+func validateCDN(c CDNConfig) error {
+	switch c.Provider {
+	case "":
+		return nil
+	case "fastly":
+		if c.FastlyServiceID == "" {
+			return fmt.Errorf("cdn.fastly_service_id is needed with the fastly provider")
+		}
+	case "cloudflare":
+		if c.CloudflareZoneID == "" {
+			return fmt.Errorf("cdn.cloudflare_zone_id is needed with the cloudflare provider")
+		}
+	default:
+		return fmt.Errorf("cdn.provider must be fastly or cloudflare, not %q", c.Provider)
+	}
+	if c.APIToken == "" {
+		return fmt.Errorf("cdn.api_token is needed to purge links")
+	}
+	if c.MaxAge.Duration <= 0 {
+		return fmt.Errorf("cdn.max_age must be positive")
+	}
+	return nil
+}
+
+func cdnEnabled() bool {
+	return config.CDN.Provider != ""
+}
+
+// surrogateKeyOf is a link's key at the CDN; keys are space separated, and header values ASCII
+func surrogateKeyOf(slug string) string {
+	return "link-" + url.PathEscape(slug)
+}
+
+// uncached keeps the CDN from storing whatever the slug routes answer
+func uncached(w http.ResponseWriter) {
+	if cdnEnabled() {
+		w.Header().Set("Cache-Control", "no-store")
+	}
+}
+
+// cdnRedirect redirects, letting the CDN keep it when there is one. One asked
+// for with a query, such as an attributed click's, has to reach us each time.
+func cdnRedirect(w http.ResponseWriter, req *http.Request, slug string, target string, access LinkAccess) {
+	if !cdnEnabled() || !access.Public() || req.URL.RawQuery != "" {
+		http.Redirect(w, req, target, http.StatusFound)
+		return
+	}
+	// browsers check back each time, the edge keeps it for max_age
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=0, s-maxage=%d", int64(config.CDN.MaxAge.Seconds())))
+	w.Header().Set("Surrogate-Key", surrogateKeyOf(slug))
+	w.Header().Set("Cache-Tag", surrogateKeyOf(slug))
+	http.Redirect(w, req, target, http.StatusMovedPermanently)
+}
+
+// purgeLinks drops the links' cached redirects at the CDN, and in the shared
+// cache. It waits for the answer, so commands don't exit first, but goes
+// ahead when the CDN fails.
+func purgeLinks(slugs ...string) {
+	shared_cache.forget(slugs...)
+	if !cdnEnabled() || len(slugs) == 0 {
+		return
+	}
+	keys := make([]string, len(slugs))
+	for i, slug := range slugs {
+		keys[i] = surrogateKeyOf(slug)
+	}
+	if err := purgeSurrogateKeys(config.CDN, keys); err != nil {
+		cdn_purges_failed.Add(1)
+		log.Println("Cannot purge", strings.Join(keys, " "), "at the CDN", err)
+	}
+}
+
+func purgeSurrogateKeys(c CDNConfig, keys []string) error {
+	var endpoint string
+	var payload interface{}
+	header := http.Header{}
+	switch c.Provider {
+	case "fastly":
+		endpoint = "https://api.fastly.com"
+		if c.APIURL != "" {
+			endpoint = c.APIURL
+		}
+		endpoint += "/service/" + url.PathEscape(c.FastlyServiceID) + "/purge"
+		payload = map[string][]string{"surrogate_keys": keys}
+		header.Set("Fastly-Key", c.APIToken)
+	case "cloudflare":
+		endpoint = "https://api.cloudflare.com/client/v4"
+		if c.APIURL != "" {
+			endpoint = c.APIURL
+		}
+		endpoint += "/zones/" + url.PathEscape(c.CloudflareZoneID) + "/purge_cache"
+		payload = map[string][]string{"tags": keys}
+		header.Set("Authorization", "Bearer "+c.APIToken)
+	default:
+		return nil
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header = header
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := webhook_client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s answered %s", endpoint, resp.Status)
+	}
+	return nil
+}
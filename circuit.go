@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// A circuit breaker around Redis: after enough consecutive failed commands
+// it opens, and commands fail at once with errCircuitOpen instead of each
+// waiting out its timeout. After the cooldown one command is let through as
+// a probe; its success closes the circuit, its failure reopens it, and a
+// probe whose request was cancelled lets the next command probe. While
+// open, redirects are served from recently resolved slugs where possible.
+
+type CircuitConfig struct {
+	Failures  int      `json:"failures"` // consecutive failures which open the circuit, 0 disables it
+	Cooldown  Duration `json:"cooldown"`
+	CacheSize int      `json:"cache_size"` // recently resolved slugs kept for outages
+}
+
+var errCircuitOpen = errors.New("Redis circuit breaker is open")
+
+const (
+	circuitClosed = iota
+	circuitHalfOpen
+	circuitOpen
+)
+
+var circuitStateNames = []string{"closed", "half-open", "open"}
+
+var circuit_trips = newCounter("shortener_redis_circuit_trips_total", "Times the Redis circuit breaker opened")
+
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	opened   time.Time
+}
+
+// newCircuitBreaker returns nil when the breaker is turned off
+func newCircuitBreaker(c CircuitConfig) *circuitBreaker {
+	if c.Failures <= 0 {
+		return nil
+	}
+	b := &circuitBreaker{threshold: c.Failures, cooldown: c.Cooldown.Duration}
+	newGaugeFunc("shortener_redis_circuit_state", "Redis circuit breaker: 0 closed, 1 half-open, 2 open", func() float64 {
+		return float64(b.State())
+	})
+	return b
+}
+
+func (b *circuitBreaker) State() int {
+	if b == nil {
+		return circuitClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if time.Since(b.opened) < b.cooldown {
+			return errCircuitOpen
+		}
+		b.state = circuitHalfOpen // this command is the probe
+		return nil
+	case circuitHalfOpen:
+		return errCircuitOpen
+	}
+	return nil
+}
+
+func (b *circuitBreaker) record(err error) {
+	if err == errCircuitOpen {
+		return
+	}
+	if errors.Is(err, context.Canceled) {
+		// not an answer from Redis either way; a probe given up on leaves the
+		// circuit open, with the next command as the probe
+		b.mu.Lock()
+		if b.state == circuitHalfOpen {
+			b.state, b.opened = circuitOpen, time.Now().Add(-b.cooldown)
+		}
+		b.mu.Unlock()
+		return
+	}
+	var reply redis.Error
+	failed := err != nil && err != redis.Nil && !errors.As(err, &reply)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !failed {
+		if b.state != circuitClosed {
+			log.Println("Redis is back, closing the circuit breaker")
+		}
+		b.state, b.failures = circuitClosed, 0
+		return
+	}
+	b.failures++
+	if b.state == circuitHalfOpen || (b.state == circuitClosed && b.failures >= b.threshold) {
+		log.Println("Opening the Redis circuit breaker after", b.failures, "failures:", err)
+		circuit_trips.Inc()
+		b.state, b.opened = circuitOpen, time.Now()
+	}
+}
+
+func (b *circuitBreaker) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return ctx, b.allow()
+}
+
+func (b *circuitBreaker) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	b.record(cmd.Err())
+	return nil
+}
+
+func (b *circuitBreaker) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return ctx, b.allow()
+}
+
+func (b *circuitBreaker) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	var err error
+	for _, cmd := range cmds {
+		if err = cmd.Err(); err != nil && err != redis.Nil {
+			break
+		}
+	}
+	b.record(err)
+	return nil
+}
+
+// resolvedSlugs remembers recent lookups, including slugs which don't exist
+type resolvedSlugs struct {
+	size int
+
+	mu      sync.Mutex
+	entries map[string]resolvedSlug
+}
+
+type resolvedSlug struct {
+	slug    string
+	target  string
+	missing bool
+	access  LinkAccess
+	at      time.Time
+	shared  bool // from the shared cache, which may be behind
+}
+
+func (e resolvedSlug) err() error {
+	if e.missing {
+		return errSlugNotFound
+	}
+	return nil
+}
+
+func newResolvedSlugs(size int) *resolvedSlugs {
+	return &resolvedSlugs{size: size, entries: map[string]resolvedSlug{}}
+}
+
+// remember takes resolveLink's answer for a requested slug. When Redis was
+// unavailable it answers from memory instead, if it can.
+func (r *resolvedSlugs) remember(requested string, found resolvedSlug, err error) (resolvedSlug, error) {
+	if r.size <= 0 {
+		return found, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch {
+	case err == nil:
+		r.put(requested, found)
+	case err == errSlugNotFound:
+		r.put(requested, resolvedSlug{slug: requested, missing: true})
+	case redisUnavailable(err):
+		if e, ok := r.entries[requested]; ok {
+			return e, e.err()
+		}
+	}
+	return found, err
+}
+
+func (r *resolvedSlugs) put(requested string, e resolvedSlug) {
+	if _, ok := r.entries[requested]; !ok && len(r.entries) >= r.size {
+		for k := range r.entries {
+			delete(r.entries, k) // any one will do
+			break
+		}
+	}
+	e.at = time.Now()
+	r.entries[requested] = e
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The clickhouse click sink INSERTs batches of events as JSONEachRow over
+// ClickHouse's HTTP interface, for long-term analytics Redis can't hold.
+// Batching goes through the export queue; with async_insert ClickHouse also
+// buffers small inserts on its side.
+
+type ClickHouseConfig struct {
+	URL         string `json:"url"` // e.g. http://clickhouse:8123
+	Database    string `json:"database"`
+	Table       string `json:"table"`
+	User        string `json:"user"`
+	Password    string `json:"password"`
+	AsyncInsert bool   `json:"async_insert"`
+}
+
+type clickHousePublisher struct {
+	url      string
+	user     string
+	password string
+	client   *http.Client
+}
+
+func newClickHousePublisher(c ClickHouseConfig) (*clickHousePublisher, error) {
+	if c.URL == "" || c.Table == "" {
+		return nil, errors.New("ClickHouse sink needs url and table")
+	}
+	params := url.Values{}
+	params.Set("query", "INSERT INTO "+clickHouseTable(c)+" FORMAT JSONEachRow")
+	params.Set("date_time_input_format", "best_effort") // for RFC 3339 timestamps
+	if c.AsyncInsert {
+		params.Set("async_insert", "1")
+		params.Set("wait_for_async_insert", "0")
+	}
+	return &clickHousePublisher{
+		url:      strings.TrimRight(c.URL, "/") + "/?" + params.Encode(),
+		user:     c.User,
+		password: c.Password,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func clickHouseTable(c ClickHouseConfig) string {
+	if c.Database != "" {
+		return c.Database + "." + c.Table
+	}
+	return c.Table
+}
+
+func (c *clickHousePublisher) publish(batch [][]byte) error {
+	return c.post(c.url, bytes.Join(batch, []byte("\n")))
+}
+
+// clickHouseExec runs a statement which returns nothing, such as ALTER TABLE ... DELETE
+func clickHouseExec(c ClickHouseConfig, query string) error {
+	p, err := newClickHousePublisher(c)
+	if err != nil {
+		return err
+	}
+	return p.post(strings.TrimRight(c.URL, "/")+"/", []byte(query))
+}
+
+func (c *clickHousePublisher) post(endpoint string, body []byte) error {
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if c.user != "" {
+		req.Header.Set("X-ClickHouse-User", c.user)
+		req.Header.Set("X-ClickHouse-Key", c.password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("ClickHouse answered %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
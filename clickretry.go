@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// When the click pipeline fails (a Redis blip), the click is kept in memory
+// and written later, in order, so analytics don't silently lose hits. Clicks
+// which can't be held or are too old to retry are counted as lost, as are
+// clicks on links gone by the time of the retry: writing them would bring
+// back a deleted link's meta, counters and index entries.
+
+var clicks_failed = newCounter("shortener_click_writes_failed_total", "Click writes which failed and were queued for retry")
+var clicks_retried = newCounter("shortener_click_writes_retried_total", "Queued clicks written on retry")
+var clicks_lost = newCounter("shortener_clicks_lost_total", "Clicks dropped without being counted")
+
+type pendingClick struct {
+	slug string
+	ttl  time.Duration
+	at   time.Time
+}
+
+type clickRetryBuffer struct {
+	queue chan pendingClick
+}
+
+func newClickRetryBuffer(size int) *clickRetryBuffer {
+	b := &clickRetryBuffer{queue: make(chan pendingClick, size)}
+	newGaugeFunc("shortener_click_retry_queue_length", "Clicks waiting to be retried", func() float64 {
+		return float64(len(b.queue))
+	})
+	return b
+}
+
+func (b *clickRetryBuffer) add(slug string, ttl time.Duration, at time.Time, err error) {
+	clicks_failed.Inc()
+	select {
+	case b.queue <- pendingClick{slug: slug, ttl: ttl, at: at}:
+		log.Println("Counting click on", slug, "failed, will retry:", err)
+	default:
+		clicks_lost.Inc("reason", "queue_full")
+		log.Println("Counting click on", slug, "failed and retry queue is full:", err)
+	}
+}
+
+func (b *clickRetryBuffer) run(redis_db Storage) {
+	backoff := 100 * time.Millisecond
+	for c := range b.queue {
+		for {
+			if time.Since(c.at) > config.Clicks.RetryFor.Duration {
+				clicks_lost.Inc("reason", "too_old")
+				break
+			}
+			// renewing the link first tells whether it's still there
+			exists, err := redis_db.Expire(context.Background(), keyOfSlug(c.slug), c.ttl).Result()
+			if err == nil && !exists {
+				clicks_lost.Inc("reason", "link_gone")
+				break
+			}
+			if err == nil {
+				_, err = redis_db.Pipelined(context.Background(), func(pipe redis.Pipeliner) error {
+					recordClick(pipe, context.Background(), c.slug, c.ttl, c.at)
+					return nil
+				})
+			}
+			if err == nil {
+				clicks_retried.Inc()
+				backoff = 100 * time.Millisecond
+				break
+			}
+			time.Sleep(backoff)
+			if backoff < 30*time.Second {
+				backoff *= 2
+			}
+		}
+	}
+}
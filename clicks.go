@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Counters, series and geo counts expire with their link by default, each
+// write extending them like a click extends the link. clicks.counter_ttl
+// gives them a lifetime of their own after the last click, and
+// clicks.keep_counters keeps them for good, so analytics outlive the link and
+// carry on if the slug is created again.
+
+// counterTTL is how long counters live after a write, for a link with link_ttl. 0 means for good.
+func counterTTL(link_ttl time.Duration) time.Duration {
+	switch {
+	case config.Clicks.KeepCounters:
+		return 0
+	case config.Clicks.CounterTTL.Duration > 0:
+		return config.Clicks.CounterTTL.Duration
+	}
+	return link_ttl
+}
+
+func expireCounter(pipe redis.Pipeliner, ctx context.Context, key string, link_ttl time.Duration) {
+	if ttl := counterTTL(link_ttl); ttl > 0 {
+		pipe.Expire(ctx, key, ttl)
+	} else {
+		pipe.Persist(ctx, key)
+	}
+}
+
+// countersOutliveLinks is true when counters are kept after their link is gone
+func countersOutliveLinks() bool {
+	return config.Clicks.KeepCounters || config.Clicks.CounterTTL.Duration > default_ttl
+}
+
+// Click dedup: with a window set, a visitor (IP + User-Agent) is counted once
+// per window in urluniqhitcount:, while urlhitcount: keeps counting every hit.
+
+func keyOfClickDedup(slug string, visitor string) string {
+	return "urlclickdedup:" + slug + ":" + visitor
+}
+
+func visitorHash(req *http.Request) string {
+	sum := sha256.Sum256([]byte(remoteHost(req) + "\x00" + req.UserAgent()))
+	return hex.EncodeToString(sum[:12])
+}
+
+// dedupWindowOfSlug is the link's own window, or the configured default
+func dedupWindowOfSlug(redis_db Storage, ctx context.Context, slug string) time.Duration {
+	v, _ := redis_db.HGet(ctx, keyOfSlugMeta(slug), "dedup_window").Result()
+	return dedupWindowOfMeta(map[string]string{"dedup_window": v})
+}
+
+// dedupWindow is the window a link created with these options gets
+func (opts LinkOptions) dedupWindow() time.Duration {
+	if opts.DedupWindowSet || opts.DedupWindow > 0 {
+		return opts.DedupWindow
+	}
+	return config.Clicks.DedupWindow.Duration
+}
+
+func dedupWindowOfMeta(meta map[string]string) time.Duration {
+	if seconds, err := strconv.ParseInt(meta["dedup_window"], 10, 64); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	return config.Clicks.DedupWindow.Duration
+}
+
+// countUniqueClick bumps the deduped counter unless this visitor was already
+// seen within the window. An unknown visitor, "", is always counted. The
+// counter lives as long as the link, ttl.
+func countUniqueClick(redis_db Storage, ctx context.Context, slug string, ttl time.Duration, visitor string, window time.Duration) (bool, error) {
+	if visitor != "" {
+		first, err := redis_db.SetNX(ctx, keyOfClickDedup(slug, visitor), 1, window).Result()
+		if err != nil || !first {
+			return false, err
+		}
+	}
+	_, err := redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Incr(ctx, keyOfSlugUniqueHitCount(slug))
+		expireCounter(pipe, ctx, keyOfSlugUniqueHitCount(slug), ttl)
+		return nil
+	})
+	return err == nil, err
+}
+
+// countClick is the one round trip a redirect makes: the click when counted,
+// or else only the renewed expiry, and the tenant's usage. The counter's INCR
+// is nil when not counted.
+func countClick(writes_db Storage, ctx context.Context, slug string, access LinkAccess, counted bool, at time.Time) (*redis.IntCmd, error) {
+	var counter *redis.IntCmd
+	_, err := writes_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		if counted {
+			counter = recordClick(pipe, ctx, slug, access.clickTTL(), at)
+		} else {
+			renewLink(pipe, ctx, slug, access.clickTTL())
+		}
+		meterUsage(pipe, ctx, access.Tenant, usageRedirects, at)
+		return nil
+	})
+	return counter, err
+}
+
+// recordClick queues every write a click makes on a pipeline: the counter,
+// TTL extension (to the link's own ttl), series and indexes. It returns the
+// counter's INCR.
+func recordClick(pipe redis.Pipeliner, ctx context.Context, slug string, ttl time.Duration, at time.Time) *redis.IntCmd {
+	counter := pipe.Incr(ctx, keyOfSlugHitCount(slug))
+	expireCounter(pipe, ctx, keyOfSlugHitCount(slug), ttl)
+	pipe.Expire(ctx, keyOfSlug(slug), ttl)
+	pipe.HSet(ctx, keyOfSlugMeta(slug), "last_click", at.Unix())
+	pipe.Expire(ctx, keyOfSlugMeta(slug), ttl)
+	recordClickSeries(pipe, ctx, slug, ttl, at)
+	indexClick(pipe, ctx, slug, at, time.Now().Add(ttl))
+	countDaily(pipe, ctx, "clicks", at)
+	return counter
+}
+
+// Clicks are also bucketed per UTC hour, for time series
+
+const seriesBucketFormat = "2006010215"
+
+func keyOfSlugSeries(slug string) string {
+	return "urlseries:" + slug
+}
+
+func recordClickSeries(pipe redis.Pipeliner, ctx context.Context, slug string, ttl time.Duration, at time.Time) {
+	pipe.HIncrBy(ctx, keyOfSlugSeries(slug), at.UTC().Format(seriesBucketFormat), 1)
+	expireCounter(pipe, ctx, keyOfSlugSeries(slug), ttl)
+}
+
+type SeriesPoint struct {
+	Hour   time.Time `json:"hour"`
+	Clicks int64     `json:"clicks"`
+}
+
+// clickSeries sums the hourly buckets of several slugs over the last n hours, oldest first
+func clickSeries(redis_db Storage, ctx context.Context, slugs []string, hours int) ([]SeriesPoint, error) {
+	now := time.Now().UTC().Truncate(time.Hour)
+	each, err := slugSeries(redis_db, ctx, slugs, now.Add(-time.Duration(hours-1)*time.Hour), now.Add(time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	points := make([]SeriesPoint, hours)
+	for i := range points {
+		points[i].Hour = now.Add(-time.Duration(hours-1-i) * time.Hour)
+		for _, series := range each {
+			points[i].Clicks += series[i].Clicks
+		}
+	}
+	return points, nil
+}
+
+// slugSeries reads the hourly buckets of each slug from the hour of from until to, oldest first
+func slugSeries(redis_db Storage, ctx context.Context, slugs []string, from time.Time, to time.Time) ([][]SeriesPoint, error) {
+	hours := []time.Time{}
+	fields := []string{}
+	for hour := from.UTC().Truncate(time.Hour); hour.Before(to); hour = hour.Add(time.Hour) {
+		hours = append(hours, hour)
+		fields = append(fields, hour.Format(seriesBucketFormat))
+	}
+
+	cmds := make([]*redis.SliceCmd, len(slugs))
+	if len(fields) > 0 {
+		_, err := redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, slug := range slugs {
+				cmds[i] = pipe.HMGet(ctx, keyOfSlugSeries(slug), fields...)
+			}
+			return nil
+		})
+		if err != nil && err != redis.Nil {
+			return nil, err
+		}
+	}
+
+	each := make([][]SeriesPoint, len(slugs))
+	for i := range slugs {
+		each[i] = make([]SeriesPoint, len(hours))
+		for j := range hours {
+			each[i][j].Hour = hours[j]
+		}
+		if cmds[i] == nil {
+			continue
+		}
+		for j, v := range cmds[i].Val() {
+			if s, ok := v.(string); ok {
+				each[i][j].Clicks, _ = strconv.ParseInt(s, 10, 64)
+			}
+		}
+	}
+	return each, nil
+}
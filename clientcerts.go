@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Where bearer credentials aren't allowed, callers can be known by the TLS
+// client certificate they present instead. With server.client_certs, the
+// server asks for one, verified against ca_file, and a certificate whose
+// subject is mapped in identities acts as that tenant and role, wherever an
+// API key would. Redirects never need one.
+//
+// With require, the management UI and the API take nothing else: a request
+// there without a mapped certificate is refused, and API keys, signatures
+// and sessions are ignored.
+//
+// A subject matches the certificate's whole subject (as in
+// "CN=billing,O=Example"), its common name, or any of its DNS or URI names,
+// such as a SPIFFE id.
+
+type ClientCertsConfig struct {
+	CAFile     string               `json:"ca_file"`
+	Require    bool                 `json:"require"`
+	Identities []ClientCertIdentity `json:"identities"`
+}
+
+type ClientCertIdentity struct {
+	Subject string `json:"subject"`
+	Tenant  string `json:"tenant"`
+	Role    string `json:"role"` // viewer, editor (the default) or admin
+}
+
+func (c ClientCertsConfig) enabled() bool {
+	return c.CAFile != ""
+}
+
+func validateClientCerts(s ServerConfig) error {
+	c := s.ClientCerts
+	if !c.enabled() {
+		if c.Require || len(c.Identities) > 0 {
+			return errors.New("server.client_certs needs a ca_file")
+		}
+		return nil
+	}
+	if s.TLSCertFile == "" {
+		return errors.New("server.client_certs needs the server to serve TLS, with tls_cert_file")
+	}
+	for _, identity := range c.Identities {
+		if identity.Subject == "" {
+			return errors.New("Every server.client_certs identity needs a subject")
+		}
+	}
+	return nil
+}
+
+// clientCertsTLSConfig asks clients for a certificate, without requiring one at
+// the handshake, since redirects don't need one
+func clientCertsTLSConfig(c ClientCertsConfig) (*tls.Config, error) {
+	pem, err := ioutil.ReadFile(c.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates in %v", c.CAFile)
+	}
+	return &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven, MinVersion: tls.VersionTLS12}, nil
+}
+
+// namesOfCert is everything a subject in the config can match
+func namesOfCert(cert *x509.Certificate) []string {
+	names := []string{cert.Subject.String()}
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	return names
+}
+
+// certIdentityOf is who a request's verified client certificate says it is
+func certIdentityOf(req *http.Request) (Identity, bool) {
+	if !config.Server.ClientCerts.enabled() || req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return Identity{}, false
+	}
+	names := namesOfCert(req.TLS.VerifiedChains[0][0])
+	for _, mapped := range config.Server.ClientCerts.Identities {
+		if containsString(names, mapped.Subject) {
+			role := mapped.Role
+			if role == "" {
+				role = roleEditor
+			}
+			return Identity{Tenant: mapped.Tenant, KeyId: "cert:" + mapped.Subject, Role: role}, true
+		}
+	}
+	return Identity{}, false
+}
+
+// managementRoute is true of the UI and the API, rather than redirects and
+// what public pages use
+func managementRoute(req *http.Request) bool {
+	path := req.URL.Path
+	return path == "/" || (strings.HasPrefix(path, "/_") && path != "/_privacy") || strings.HasPrefix(path, "/api/") ||
+		path == "/v4/shorten" || path == "/yourls-api.php"
+}
+
+// withClientCerts refuses management requests without a mapped certificate,
+// when one is required
+func withClientCerts(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if config.Server.ClientCerts.Require && managementRoute(req) {
+			if _, ok := certIdentityOf(req); !ok {
+				writeJSONError(w, http.StatusUnauthorized, "A client certificate known here is required")
+				return
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
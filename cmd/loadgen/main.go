@@ -0,0 +1,171 @@
+package main
+
+// loadgen drives a mix of creates and redirects against a running instance
+// and reports latency percentiles for each, so a slower redirect path shows
+// up before a release:
+//
+//	go run ./cmd/loadgen -base http://localhost:8080 -duration 1m -concurrency 32 -create 0.05
+//
+// Links are created through the Bitly-compatible API, which takes the same
+// API key as the rest of the service. With -max-p99, it exits non-zero when
+// the redirect p99 is over it, for use in CI.
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type result struct {
+	op      string
+	latency time.Duration
+	err     bool
+}
+
+type loadgen struct {
+	base    string
+	api_key string
+	target  string
+	client  *http.Client
+
+	mu    sync.Mutex
+	slugs []string
+}
+
+func (l *loadgen) create() error {
+	body, _ := json.Marshal(map[string]string{"long_url": fmt.Sprintf("%s?loadgen=%d", l.target, rand.Int63())})
+	req, err := http.NewRequest("POST", l.base+"/v4/shorten", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if l.api_key != "" {
+		req.Header.Set("Authorization", "Bearer "+l.api_key)
+	}
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("create answered %s", resp.Status)
+	}
+	var link struct {
+		Link string `json:"link"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&link); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.slugs = append(l.slugs, link.Link[strings.LastIndex(link.Link, "/")+1:])
+	l.mu.Unlock()
+	return nil
+}
+
+func (l *loadgen) redirect() error {
+	l.mu.Lock()
+	slug := l.slugs[rand.Intn(len(l.slugs))]
+	l.mu.Unlock()
+	resp, err := l.client.Get(l.base + "/" + slug)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 300 || resp.StatusCode >= 400 {
+		return fmt.Errorf("redirect answered %s", resp.Status)
+	}
+	return nil
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(float64(len(sorted)-1)*p)]
+}
+
+func main() {
+	base := flag.String("base", "http://localhost:8080", "instance to load")
+	api_key := flag.String("api-key", "", "API key for creating links")
+	target := flag.String("target", "https://example.com/", "target of created links")
+	duration := flag.Duration("duration", 30*time.Second, "how long to run")
+	concurrency := flag.Int("concurrency", 16, "parallel clients")
+	create_ratio := flag.Float64("create", 0.05, "fraction of requests which create a link, the rest are redirects")
+	initial := flag.Int("links", 50, "links to create before starting")
+	max_p99 := flag.Duration("max-p99", 0, "fail when the redirect p99 is over this, 0 to only report")
+	flag.Parse()
+
+	l := &loadgen{
+		base:    strings.TrimRight(*base, "/"),
+		api_key: *api_key,
+		target:  *target,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+			Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency},
+		},
+	}
+	for i := 0; i < *initial; i++ {
+		if err := l.create(); err != nil {
+			log.Fatalln("Cannot create the initial links", err)
+		}
+	}
+
+	results := make(chan result, 1024)
+	deadline := time.Now().Add(*duration)
+	var workers sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for time.Now().Before(deadline) {
+				op, do := "redirect", l.redirect
+				if rand.Float64() < *create_ratio {
+					op, do = "create", l.create
+				}
+				start := time.Now()
+				err := do()
+				results <- result{op: op, latency: time.Since(start), err: err != nil}
+			}
+		}()
+	}
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+
+	latencies := map[string][]time.Duration{}
+	errors := map[string]int{}
+	for r := range results {
+		if r.err {
+			errors[r.op]++
+			continue
+		}
+		latencies[r.op] = append(latencies[r.op], r.latency)
+	}
+
+	fmt.Printf("%-9s %8s %7s %8s %10s %10s %10s %10s\n", "op", "ok", "errors", "req/s", "p50", "p90", "p99", "max")
+	for _, op := range []string{"redirect", "create"} {
+		sorted := latencies[op]
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		fmt.Printf("%-9s %8d %7d %8.1f %10v %10v %10v %10v\n", op, len(sorted), errors[op],
+			float64(len(sorted))/duration.Seconds(),
+			percentile(sorted, 0.5), percentile(sorted, 0.9), percentile(sorted, 0.99), percentile(sorted, 1))
+	}
+
+	if p99 := percentile(latencies["redirect"], 0.99); *max_p99 > 0 && p99 > *max_p99 {
+		fmt.Printf("redirect p99 %v is over %v\n", p99, *max_p99)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"strings"
+)
+
+// One-shot maintenance commands, run instead of the server: url-shortener [flags] <command> [args]
+
+var restore_overwrite = flag.Bool("overwrite", false, "restore: replace links which already exist")
+
+// runCommand returns false when args don't name a command, meaning: serve
+func runCommand(args []string, redis_db Storage) bool {
+	if len(args) == 0 {
+		return false
+	}
+	ctx := context.Background()
+
+	switch args[0] {
+	case "backup":
+		store, err := newBlobStore(config.Backup)
+		if err != nil {
+			log.Fatalln("Cannot set up backup", err)
+		}
+		if _, err := runBackup(redis_db, ctx, store, config.Backup.Prefix); err != nil {
+			log.Fatalln("Backup failed", err)
+		}
+
+	case "restore":
+		if len(args) != 2 {
+			log.Fatalln("Usage: restore <backup object name>")
+		}
+		store, err := newBlobStore(config.Backup)
+		if err != nil {
+			log.Fatalln("Cannot set up backup", err)
+		}
+		restored, err := restoreBackup(redis_db, ctx, store, args[1], *restore_overwrite)
+		log.Println("Restored", restored, "links from", args[1])
+		if err != nil {
+			log.Fatalln("Restore failed", err)
+		}
+
+	case "purge-orphans":
+		dry_run := len(args) < 2 || args[1] != "--really"
+		report, err := purgeOrphans(redis_db, ctx, dry_run)
+		if err != nil {
+			log.Fatalln("Purge failed", err)
+		}
+		log.Printf("Orphans (dry run: %v): keys %v, index entries %v", report.DryRun, report.Keys, report.IndexEntries)
+		for _, s := range report.Sample {
+			log.Println("  ", s)
+		}
+
+	case "check-integrity":
+		report, err := checkIntegrity(redis_db, ctx)
+		if err != nil {
+			log.Fatalln("Integrity check failed", err)
+		}
+		log.Printf("Integrity of %d links: violations %v", report.Links, report.Violations)
+		for _, s := range report.Sample {
+			log.Println("  ", s)
+		}
+		if report.total() > 0 {
+			os.Exit(1)
+		}
+
+	case "sync":
+		if len(args) < 2 {
+			log.Fatalln("Usage: sync <file> [--really]")
+		}
+		file, err := os.Open(args[1])
+		if err != nil {
+			log.Fatalln("Cannot open sync file", err)
+		}
+		f, err := readSyncFile(file)
+		file.Close()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		report, err := syncLinks(redis_db, ctx, f, len(args) < 3 || args[2] != "--really")
+		for _, change := range report.Changes {
+			log.Println("  ", change.Action, change.Slug, strings.Join(change.Changes, "; "), change.Error)
+		}
+		log.Printf("Sync %v (dry run: %v): %v changes, %v unchanged", report.ManagedBy, report.DryRun, len(report.Changes), report.Unchanged)
+		if err != nil {
+			log.Fatalln("Sync failed", err)
+		}
+
+	case "migrate":
+		if err := migrateKeyspace(redis_db, ctx, config.Migrations); err != nil {
+			log.Fatalln("Migration failed", err)
+		}
+		version, _ := schemaVersion(redis_db, ctx)
+		log.Println("Keyspace at version", version)
+
+	case "reindex":
+		count, err := reindexLinks(redis_db, ctx)
+		log.Println("Indexed", count, "links")
+		if err != nil {
+			log.Fatalln("Reindex failed", err)
+		}
+		count, err = indexAllLinkTerms(redis_db, ctx)
+		log.Println("Filed", count, "links in the search index")
+		if err != nil {
+			log.Fatalln("Reindex failed", err)
+		}
+
+	case "reshard":
+		copying := len(args) > 1 && (args[1] == "--copy" || args[1] == "--really")
+		report, err := reshard(redis_db, ctx, copying, len(args) > 1 && args[1] == "--really")
+		log.Printf("Reshard (dry run: %v): misplaced %v, copied %v, deleted %v", report.DryRun, report.Moves, report.Copied, report.Deleted)
+		for _, s := range report.Sample {
+			log.Println("  ", s)
+		}
+		if err != nil {
+			log.Fatalln("Reshard failed", err)
+		}
+
+	default:
+		log.Fatalln("Unknown command", args[0])
+	}
+	return true
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Comparing links puts the click series of several slugs, or of every member
+// of a campaign, side by side over the same dates: the way to tell which of
+// the links shared on different channels did best. /api/v1/compare answers
+// the series as JSON, /_compare draws them on one chart. Dates are UTC days,
+// from and to both included; the series come from the hourly buckets, so
+// they reach back as far as those are kept.
+
+const maxComparedSlugs = 20
+const maxComparedDays = 90
+
+type ComparedSeries struct {
+	Slug   string        `json:"slug"`
+	Clicks int64         `json:"clicks"` // within the dates
+	Points []SeriesPoint `json:"points"` // hour is the start of each bucket
+}
+
+type Comparison struct {
+	From   time.Time        `json:"from"`
+	To     time.Time        `json:"to"` // the end of the last day
+	Bucket string           `json:"bucket"`
+	Series []ComparedSeries `json:"series"`
+	Best   string           `json:"best,omitempty"` // the slug with the most clicks
+}
+
+type ComparisonQuery struct {
+	Slugs    []string
+	Campaign string
+	From     time.Time
+	To       time.Time // exclusive
+	Bucket   string
+}
+
+var errCompareQuery = errors.New("invalid comparison")
+
+// parseComparisonQuery reads slugs (comma separated, or repeated), campaign,
+// from and to (YYYY-MM-DD, the last 7 days by default) and bucket (hour or day)
+func parseComparisonQuery(form url.Values) (ComparisonQuery, error) {
+	q := ComparisonQuery{Campaign: strings.TrimSpace(form.Get("campaign")), Bucket: form.Get("bucket")}
+	for _, v := range form["slugs"] {
+		for _, slug := range strings.Split(v, ",") {
+			if slug = normalizeSlug(strings.TrimSpace(slug)); slug == "" {
+				continue
+			} else if !slugIsValid(slug) {
+				return q, fmt.Errorf("%w: invalid slug %q", errCompareQuery, slug)
+			} else if !containsString(q.Slugs, slug) {
+				q.Slugs = append(q.Slugs, slug)
+			}
+		}
+	}
+	if q.Campaign != "" && !campaignIdPattern.MatchString(q.Campaign) {
+		return q, fmt.Errorf("%w: invalid campaign %q", errCompareQuery, q.Campaign)
+	}
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	q.From, q.To = today.AddDate(0, 0, -6), today
+	for _, d := range []struct {
+		name string
+		into *time.Time
+	}{{"from", &q.From}, {"to", &q.To}} {
+		if v := form.Get(d.name); v != "" {
+			day, err := time.Parse("2006-01-02", v)
+			if err != nil {
+				return q, fmt.Errorf("%w: %s must be a date, YYYY-MM-DD", errCompareQuery, d.name)
+			}
+			*d.into = day
+		}
+	}
+	q.To = q.To.AddDate(0, 0, 1)
+	if !q.From.Before(q.To) {
+		return q, fmt.Errorf("%w: from is after to", errCompareQuery)
+	}
+	if q.To.Sub(q.From) > maxComparedDays*24*time.Hour {
+		return q, fmt.Errorf("%w: at most %d days can be compared", errCompareQuery, maxComparedDays)
+	}
+
+	switch q.Bucket {
+	case "":
+		q.Bucket = "day"
+		if q.To.Sub(q.From) <= 2*24*time.Hour {
+			q.Bucket = "hour"
+		}
+	case "hour", "day":
+	default:
+		return q, fmt.Errorf("%w: bucket must be hour or day", errCompareQuery)
+	}
+	return q, nil
+}
+
+// comparableSlugs is the query's slugs and campaign members, each of which the caller may see the details of
+func comparableSlugs(redis_db Storage, req *http.Request, q ComparisonQuery) ([]string, int, error) {
+	slugs := append([]string{}, q.Slugs...)
+	if q.Campaign != "" {
+		c, err := getCampaign(redis_db, req.Context(), q.Campaign)
+		if err == errCampaignNotFound {
+			return nil, http.StatusNotFound, err
+		} else if err != nil {
+			return nil, http.StatusServiceUnavailable, err
+		}
+		for _, slug := range c.Slugs {
+			if !containsString(slugs, slug) {
+				slugs = append(slugs, slug)
+			}
+		}
+	}
+	if len(slugs) == 0 {
+		return nil, http.StatusBadRequest, fmt.Errorf("%w: pick slugs or a campaign", errCompareQuery)
+	}
+	if len(slugs) > maxComparedSlugs {
+		return nil, http.StatusBadRequest, fmt.Errorf("%w: at most %d links can be compared", errCompareQuery, maxComparedSlugs)
+	}
+
+	for _, slug := range slugs {
+		su, err := getDetailsOfKey(redis_db, req.Context(), slug)
+		if err == errSlugNotFound {
+			// gone, but its series may have outlived it; only its owner could tell
+			if countersOutliveLinks() && !config.Details.RequireAuth {
+				continue
+			}
+			return nil, http.StatusNotFound, fmt.Errorf("Slug not found: %s", slug)
+		} else if err != nil {
+			return nil, http.StatusServiceUnavailable, err
+		}
+		if !canViewDetails(req, su) {
+			return nil, http.StatusForbidden, fmt.Errorf("Not allowed to see details of %s", slug)
+		}
+	}
+	return slugs, http.StatusOK, nil
+}
+
+// compareSlugs reads and buckets the series of each slug
+func compareSlugs(redis_db Storage, ctx context.Context, slugs []string, q ComparisonQuery) (Comparison, error) {
+	cmp := Comparison{From: q.From, To: q.To, Bucket: q.Bucket, Series: []ComparedSeries{}}
+	each, err := slugSeries(redis_db, ctx, slugs, q.From, q.To)
+	if err != nil {
+		return cmp, err
+	}
+	var best int64
+	for i, slug := range slugs {
+		s := ComparedSeries{Slug: slug, Points: each[i]}
+		if q.Bucket == "day" {
+			s.Points = []SeriesPoint{}
+			for _, p := range each[i] {
+				day := p.Hour.Truncate(24 * time.Hour)
+				if n := len(s.Points); n == 0 || !s.Points[n-1].Hour.Equal(day) {
+					s.Points = append(s.Points, SeriesPoint{Hour: day})
+				}
+				s.Points[len(s.Points)-1].Clicks += p.Clicks
+			}
+		}
+		for _, p := range s.Points {
+			s.Clicks += p.Clicks
+		}
+		if s.Clicks > best {
+			best, cmp.Best = s.Clicks, slug
+		}
+		cmp.Series = append(cmp.Series, s)
+	}
+	return cmp, nil
+}
+
+// comparisonOf answers the comparison asked for by the request, or a status and error
+func comparisonOf(redis_db Storage, req *http.Request) (Comparison, int, error) {
+	q, err := parseComparisonQuery(req.URL.Query())
+	if err != nil {
+		return Comparison{}, http.StatusBadRequest, err
+	}
+	slugs, status, err := comparableSlugs(redis_db, req, q)
+	if err != nil {
+		return Comparison{}, status, err
+	}
+	cmp, err := compareSlugs(redis_db, req.Context(), slugs, q)
+	if err != nil {
+		return cmp, http.StatusServiceUnavailable, err
+	}
+	return cmp, http.StatusOK, nil
+}
+
+// The chart is drawn on the server as SVG, so the page needs no script
+
+const chartWidth, chartHeight, chartMargin = 720, 320, 40
+
+var chartColors = []string{"#1f77b4", "#ff7f0e", "#2ca02c", "#d62728", "#9467bd", "#8c564b", "#e377c2", "#7f7f7f", "#bcbd22", "#17becf"}
+
+type ChartLine struct {
+	Slug   string
+	Clicks int64
+	Color  string
+	Points string // an SVG polyline's points
+}
+
+type ChartTick struct {
+	X, Y  int
+	Label string
+}
+
+type ComparePage struct {
+	Comparison
+	Query     ComparisonQuery
+	Slugs     string // as typed into the form
+	Error     string
+	JSONURL   string // the same comparison from the API
+	Width     int
+	Height    int
+	Margin    int
+	Bottom    int // of the plot
+	Lines     []ChartLine
+	MaxClicks int64
+	XTicks    []ChartTick
+}
+
+// chartOf lays the comparison's series out on the chart
+func chartOf(page *ComparePage) {
+	page.Width, page.Height, page.Margin, page.Bottom = chartWidth, chartHeight, chartMargin, chartHeight-chartMargin
+	page.MaxClicks = 1
+	buckets := 0
+	for _, s := range page.Series {
+		for _, p := range s.Points {
+			if p.Clicks > page.MaxClicks {
+				page.MaxClicks = p.Clicks
+			}
+		}
+		if len(s.Points) > buckets {
+			buckets = len(s.Points)
+		}
+	}
+	plot_width, plot_height := chartWidth-2*chartMargin, chartHeight-2*chartMargin
+	x := func(i int) int {
+		if buckets < 2 {
+			return chartMargin
+		}
+		return chartMargin + i*plot_width/(buckets-1)
+	}
+
+	for n, s := range page.Series {
+		points := make([]string, len(s.Points))
+		for i, p := range s.Points {
+			points[i] = fmt.Sprintf("%d,%d", x(i), chartMargin+plot_height-int(p.Clicks*int64(plot_height)/page.MaxClicks))
+		}
+		page.Lines = append(page.Lines, ChartLine{Slug: s.Slug, Clicks: s.Clicks, Color: chartColors[n%len(chartColors)], Points: strings.Join(points, " ")})
+	}
+
+	if len(page.Series) == 0 {
+		return
+	}
+	format, every := "01-02", (buckets+5)/6
+	if page.Bucket == "hour" {
+		format = "01-02 15h"
+	}
+	for i, p := range page.Series[0].Points {
+		if i%every == 0 {
+			page.XTicks = append(page.XTicks, ChartTick{X: x(i), Y: chartHeight - chartMargin + 16, Label: p.Hour.Format(format)})
+		}
+	}
+}
+
+func registerCompareRoutes(router *mux.Router, redis_db Storage) {
+
+	router.HandleFunc("/api/v1/compare", func(w http.ResponseWriter, req *http.Request) {
+		if _, ok := hasRole(w, req, roleViewer); !ok {
+			return
+		}
+		cmp, status, err := comparisonOf(redis_db, req)
+		if err != nil {
+			writeJSONError(w, status, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, cmp)
+	}).Methods("GET")
+
+	router.HandleFunc("/_compare", func(w http.ResponseWriter, req *http.Request) {
+		if !requireLogin(w, req) {
+			return
+		}
+		if identity, ok := identify(req); !ok || !identity.can(roleViewer) {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "Needs the viewer role")
+			return
+		}
+
+		page := ComparePage{Slugs: strings.Join(req.URL.Query()["slugs"], ","), JSONURL: "/api/v1/compare?" + req.URL.RawQuery}
+		page.Query, _ = parseComparisonQuery(req.URL.Query())
+		status := http.StatusOK
+		if page.Slugs != "" || page.Query.Campaign != "" {
+			var err error
+			if page.Comparison, status, err = comparisonOf(redis_db, req); status == http.StatusServiceUnavailable {
+				writeUnavailable(w)
+				return
+			} else if err != nil {
+				page.Error = err.Error()
+			}
+		}
+		chartOf(&page)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		setLanguage(w, req)
+		w.WriteHeader(status)
+		renderPage(w, req, "compare.html", viewerBranding(req), page)
+	}).Methods("GET")
+}
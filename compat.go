@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Request and response shapes of other shorteners' APIs, so existing tooling
+// can point at this server: Bitly's POST /v4/shorten, and the shorturl and
+// expand actions of YOURLS' yourls-api.php (used by WordPress plugins). The
+// API key goes where those expect theirs: a Bearer token for Bitly, the
+// signature parameter for YOURLS.
+
+type bitlyLink struct {
+	CreatedAt      string            `json:"created_at"`
+	Id             string            `json:"id"`
+	Link           string            `json:"link"`
+	CustomBitlinks []string          `json:"custom_bitlinks"`
+	LongURL        string            `json:"long_url"`
+	Archived       bool              `json:"archived"`
+	Tags           []string          `json:"tags"`
+	Deeplinks      []string          `json:"deeplinks"`
+	References     map[string]string `json:"references"`
+}
+
+type bitlyError struct {
+	Message     string `json:"message"`
+	Resource    string `json:"resource"`
+	Description string `json:"description"`
+}
+
+type yourlsResponse struct {
+	Status     string     `json:"status"` // success, fail
+	Code       string     `json:"code,omitempty"`
+	Message    string     `json:"message"`
+	URL        *yourlsURL `json:"url,omitempty"`
+	ShortURL   string     `json:"shorturl,omitempty"`
+	Title      string     `json:"title,omitempty"`
+	Keyword    string     `json:"keyword,omitempty"`
+	LongURL    string     `json:"longurl,omitempty"`
+	ErrorCode  string     `json:"errorCode,omitempty"`
+	StatusCode int        `json:"statusCode"`
+}
+
+type yourlsURL struct {
+	Keyword string `json:"keyword"`
+	URL     string `json:"url"`
+	Title   string `json:"title"`
+	Date    string `json:"date"`
+	IP      string `json:"ip"`
+}
+
+// publicURL makes an absolute URL on the host the request came to
+func publicURL(req *http.Request, path string) string {
+	scheme := "http"
+	if req.TLS != nil || req.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + req.Host + path
+}
+
+func writeBitlyError(w http.ResponseWriter, status int, message string, description string) {
+	if status == http.StatusServiceUnavailable {
+		setRetryAfter(w)
+	}
+	writeJSON(w, status, bitlyError{Message: message, Resource: "bitlinks", Description: description})
+}
+
+var bitlyErrorCodes = map[int]string{
+	http.StatusUnprocessableEntity: "INVALID_ARG_LONG_URL",
+	http.StatusTooManyRequests:     "MONTHLY_LINK_LIMIT_EXCEEDED",
+	http.StatusServiceUnavailable:  "TEMPORARILY_UNAVAILABLE",
+	http.StatusConflict:            "ALREADY_A_BITLY_LINK",
+	http.StatusForbidden:           "FORBIDDEN",
+}
+
+func registerCompatRoutes(router *mux.Router, redis_db Storage) {
+
+	router.HandleFunc("/v4/shorten", func(w http.ResponseWriter, req *http.Request) {
+		identity, ok := identify(req)
+		if !ok {
+			writeBitlyError(w, http.StatusForbidden, "FORBIDDEN", "Unknown access token")
+			return
+		}
+		var body struct {
+			LongURL   string `json:"long_url"`
+			Domain    string `json:"domain"`
+			GroupGuid string `json:"group_guid"`
+		}
+		if err := readJSON(w, req, &body); err != nil || body.LongURL == "" {
+			writeBitlyError(w, http.StatusBadRequest, "INVALID_ARG_LONG_URL", "Expected {\"long_url\": ...}")
+			return
+		}
+
+		su, status, err := shorten(redis_db, w, req, identity, body.LongURL, LinkOptions{})
+		if err != nil {
+			writeBitlyError(w, status, bitlyErrorCodes[status], err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, bitlyLink{
+			CreatedAt:      su.Created.UTC().Format("2006-01-02T15:04:05+0000"),
+			Id:             req.Host + "/" + su.Slug,
+			Link:           publicURL(req, "/"+su.Slug),
+			CustomBitlinks: []string{},
+			LongURL:        su.Target,
+			Tags:           []string{},
+			Deeplinks:      []string{},
+			References:     map[string]string{},
+		})
+	}).Methods("POST")
+
+	router.HandleFunc("/yourls-api.php", func(w http.ResponseWriter, req *http.Request) {
+		answer := func(r yourlsResponse) {
+			if req.FormValue("format") == "simple" {
+				w.WriteHeader(r.StatusCode)
+				switch {
+				case r.Status != "success":
+					fmt.Fprint(w, r.Message)
+				case r.LongURL != "":
+					fmt.Fprint(w, r.LongURL)
+				default:
+					fmt.Fprint(w, r.ShortURL)
+				}
+				return
+			}
+			writeJSON(w, r.StatusCode, r)
+		}
+		fail := func(status int, code string, message string) {
+			if status == http.StatusServiceUnavailable {
+				setRetryAfter(w)
+			}
+			answer(yourlsResponse{Status: "fail", Code: code, Message: message, ErrorCode: fmt.Sprint(status), StatusCode: status})
+		}
+
+		identity, ok := identityOfKey(req.FormValue("signature"))
+		if !ok {
+			fail(http.StatusForbidden, "error:auth", "Please log in")
+			return
+		}
+
+		switch req.FormValue("action") {
+		case "shorturl":
+			if req.FormValue("keyword") != "" {
+				fail(http.StatusBadRequest, "error:keyword", "Custom keywords are not supported")
+				return
+			}
+			su, status, err := shorten(redis_db, w, req, identity, req.FormValue("url"), LinkOptions{})
+			if err != nil {
+				fail(status, "error:url", err.Error())
+				return
+			}
+			short_url := publicURL(req, "/"+su.Slug)
+			answer(yourlsResponse{
+				Status: "success",
+				URL: &yourlsURL{
+					Keyword: su.Slug,
+					URL:     su.Target,
+					Date:    su.Created.UTC().Format("2006-01-02 15:04:05"),
+					IP:      remoteHost(req),
+				},
+				Message:    su.Target + " added to database",
+				ShortURL:   short_url,
+				StatusCode: http.StatusOK,
+			})
+
+		case "expand":
+			// a full short URL or only its keyword
+			keyword := req.FormValue("shorturl")
+			keyword = keyword[strings.LastIndex(keyword, "/")+1:]
+			if unescaped, err := url.PathUnescape(keyword); err == nil {
+				keyword = unescaped
+			}
+			if keyword = normalizeSlug(keyword); !slugIsValid(keyword) && !aliasIsValid(keyword) {
+				fail(http.StatusNotFound, "not_found", "Error: short URL not found")
+				return
+			}
+			link, err := resolveLink(redis_db, req.Context(), keyword)
+			if redisUnavailable(err) {
+				fail(http.StatusServiceUnavailable, "error:db", err.Error())
+				return
+			} else if err != nil {
+				fail(http.StatusNotFound, "not_found", "Error: short URL not found")
+				return
+			}
+			if !mayFollow(link.access, viewerOf(req)) {
+				fail(http.StatusForbidden, "error:auth", "This link is restricted")
+				return
+			}
+			answer(yourlsResponse{
+				Status:     "success",
+				Message:    "success",
+				Keyword:    keyword,
+				ShortURL:   publicURL(req, "/"+keyword),
+				LongURL:    link.target,
+				StatusCode: http.StatusOK,
+			})
+
+		default:
+			fail(http.StatusBadRequest, "error:action", "Unknown or missing action parameter")
+		}
+	}).Methods("GET", "POST")
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Conditional GET support, so dashboards polling links get 304s while nothing changed.
+
+// linkETag covers every field of the link except the TTL countdown, which
+// moves every second; the expiry itself only moves on clicks and edits.
+// Last-Modified is the latest of creation, the last click and the last edit,
+// see ShortUrl.Modified.
+func linkETag(su ShortUrl) string {
+	su.Ttl = 0
+	state, _ := json.Marshal(su)
+	sum := sha256.Sum256(state)
+	return `W/"` + hex.EncodeToString(sum[:12]) + `"`
+}
+
+// localizedETag tells apart the answers in each locale, for pages
+func localizedETag(etag string, locale string) string {
+	return strings.TrimSuffix(etag, `"`) + "-" + locale + `"`
+}
+
+// touchLink records an edit of the link, for Last-Modified. Whatever changes
+// something shown about a link calls it, in the same pipeline.
+func touchLink(pipe redis.Pipeliner, ctx context.Context, slug string) {
+	pipe.HSet(ctx, keyOfSlugMeta(slug), "modified", time.Now().Unix())
+}
+
+// notModified sets the validators and answers 304 when the client's copy is current.
+// If-None-Match wins over If-Modified-Since, as in RFC 7232.
+func notModified(w http.ResponseWriter, req *http.Request, etag string, modified time.Time) bool {
+	w.Header().Set("ETag", etag)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				w.WriteHeader(http.StatusNotModified)
+				return true
+			}
+		}
+		return false
+	}
+
+	if ims := req.Header.Get("If-Modified-Since"); ims != "" && !modified.IsZero() {
+		if since, err := http.ParseTime(ims); err == nil && !modified.Truncate(time.Second).After(since) {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+)
+
+// Duration is a time.Duration which reads as "10s" or "1h30m" in the config file
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.New("Duration must be a string like \"10s\"")
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+type ServerConfig struct {
+	Listen            string   `json:"listen"`
+	ReadTimeout       Duration `json:"read_timeout"`
+	ReadHeaderTimeout Duration `json:"read_header_timeout"`
+	WriteTimeout      Duration `json:"write_timeout"`
+	IdleTimeout       Duration `json:"idle_timeout"`
+	MaxHeaderBytes    int      `json:"max_header_bytes"`
+	KeepAlives        bool     `json:"keep_alives"`
+
+	RouteTimeouts RouteTimeoutsConfig `json:"route_timeouts"`
+	SlowRequest   Duration            `json:"slow_request"` // requests slower than this are logged; 0 logs none
+
+	// HTTP/2 is only negotiated over TLS, so these go together
+	HTTP2       bool   `json:"http2"`
+	TLSCertFile string `json:"tls_cert_file"`
+	TLSKeyFile  string `json:"tls_key_file"`
+
+	ClientCerts ClientCertsConfig `json:"client_certs"`
+}
+
+type RedisConfig struct {
+	Addr         string         `json:"addr"`
+	Username     string         `json:"username"` // an ACL user, "default" when empty
+	Password     string         `json:"password"`
+	DB           int            `json:"db"`
+	TLS          RedisTLSConfig `json:"tls"`
+	PoolSize     int            `json:"pool_size"`
+	MinIdleConns int            `json:"min_idle_conns"` // kept open, so bursts don't wait for dials
+	MaxConnAge   Duration       `json:"max_conn_age"`   // 0 keeps connections as long as they work
+	PoolTimeout  Duration       `json:"pool_timeout"`
+	IdleTimeout  Duration       `json:"idle_timeout"`
+	DialTimeout  Duration       `json:"dial_timeout"`
+	ReadTimeout  Duration       `json:"read_timeout"`
+	WriteTimeout Duration       `json:"write_timeout"`
+
+	// Per command deadline, and the total any one HTTP request may spend in Redis
+	OpTimeout     Duration `json:"op_timeout"`
+	RequestBudget Duration `json:"request_budget"`
+	RetryAfter    Duration `json:"retry_after"` // suggested to clients when Redis was too slow
+
+	RequireOnStart bool `json:"require_on_start"` // exit when Redis can't be reached at startup
+}
+
+type Config struct {
+	Server     ServerConfig     `json:"server"`
+	Redis      RedisConfig      `json:"redis"`
+	AccessLog  AccessLogConfig  `json:"access_log"`
+	Clicks     ClicksConfig     `json:"clicks"`
+	Export     ExportConfig     `json:"export"`
+	ClickHouse ClickHouseConfig `json:"clickhouse"`
+	Backup     BackupConfig     `json:"backup"`
+	Policy     PolicyConfig     `json:"policy"`
+	Listing    ListingConfig    `json:"listing"`
+	APIKeys    []APIKeyConfig   `json:"api_keys"`
+	Quotas     QuotasConfig     `json:"quotas"`
+	Details    DetailsConfig    `json:"details"`
+	Anomaly    AnomalyConfig    `json:"anomaly"`
+	Rewrites   []RewriteRule    `json:"rewrites"`
+	Unwrap     UnwrapConfig     `json:"unwrap"`
+	Visibility VisibilityConfig `json:"visibility"`
+	LDAP       LDAPConfig       `json:"ldap"`
+	SAML       SAMLConfig       `json:"saml"`
+	Roles      RolesConfig      `json:"roles"`
+	Trash      TrashConfig      `json:"trash"`
+	Squatting  SquattingConfig  `json:"squatting"`
+	Slugs      SlugsConfig      `json:"slugs"`
+	Thumbnails ThumbnailsConfig `json:"thumbnails"`
+	Titles     TitlesConfig     `json:"titles"`
+	Outbound   OutboundConfig   `json:"outbound"`
+	Feeds      FeedsConfig      `json:"feeds"`
+	Kubernetes KubernetesConfig `json:"kubernetes"`
+	GoLinks    GoLinksConfig    `json:"go_links"`
+	Search     SearchConfig     `json:"search"`
+	CDN        CDNConfig        `json:"cdn"`
+	GDPR       GDPRConfig       `json:"gdpr"`
+	Retention  RetentionConfig  `json:"retention"`
+	Activation ActivationConfig `json:"activation"`
+	AppLinks   AppLinksConfig   `json:"app_links"`
+	Goals      GoalsConfig      `json:"goals"`
+	Archive    ArchiveConfig    `json:"archive"`
+	Health     HealthConfig     `json:"health"`
+	Theme      ThemeConfig      `json:"theme"`
+	Locales    LocalesConfig    `json:"locales"`
+	Jobs       JobsConfig       `json:"jobs"`
+
+	Migrations MigrationsConfig `json:"migrations"`
+	Circuit    CircuitConfig    `json:"circuit"`
+	Cache      CacheConfig      `json:"cache"`
+	Region     RegionConfig     `json:"region"`
+
+	Reservations ReservationsConfig `json:"reservations"`
+	Abuse        AbuseConfig        `json:"abuse"`
+
+	SignedRequests SignedRequestsConfig `json:"signed_requests"`
+	EmailGateway   EmailGatewayConfig   `json:"email_gateway"`
+	Attribution    AttributionConfig    `json:"attribution"`
+	OptOut         OptOutConfig         `json:"opt_out"`
+	KeyRotation    KeyRotationConfig    `json:"key_rotation"`
+	Metering       MeteringConfig       `json:"metering"`
+	RedisMemory    RedisMemoryConfig    `json:"redis_memory"`
+	Shards         ShardsConfig         `json:"shards"`
+
+	// Keys the HMAC of signed tokens; random per process when empty
+	SigningSecret string `json:"signing_secret"`
+}
+
+type ListingConfig struct {
+	PageSize    int `json:"page_size"`
+	MaxPageSize int `json:"max_page_size"`
+}
+
+type ClicksConfig struct {
+	// Links created without their own dedup_window use this one, 0 disables dedup
+	DedupWindow Duration `json:"dedup_window"`
+
+	// How long counters, series and geo counts live after the last click; the link's TTL when 0
+	CounterTTL   Duration `json:"counter_ttl"`
+	KeepCounters bool     `json:"keep_counters"` // never expire them
+
+	// Clicks which couldn't be written are held and retried, up to this many
+	RetryBufferSize int      `json:"retry_buffer_size"`
+	RetryFor        Duration `json:"retry_for"`
+
+	// Where click events go: any of export, redis_stream, clickhouse, stdout
+	Sinks        []string `json:"sinks"`
+	StreamKey    string   `json:"stream_key"`
+	StreamMaxLen int64    `json:"stream_max_len"` // approximate
+}
+
+func defaultRedisConfig() RedisConfig {
+	return RedisConfig{
+		Addr:         "localhost:6379",
+		Password:     "", // no password set
+		DB:           0,  // use default DB
+		PoolSize:     20,
+		PoolTimeout:  Duration{4 * time.Second},
+		IdleTimeout:  Duration{5 * time.Minute},
+		DialTimeout:  Duration{5 * time.Second},
+		ReadTimeout:  Duration{3 * time.Second},
+		WriteTimeout: Duration{3 * time.Second},
+
+		OpTimeout:     Duration{time.Second},
+		RequestBudget: Duration{2 * time.Second},
+		RetryAfter:    Duration{5 * time.Second},
+	}
+}
+
+func defaultConfig() Config {
+	return Config{
+		Server: ServerConfig{
+			Listen:            ":8000",
+			ReadTimeout:       Duration{10 * time.Second},
+			ReadHeaderTimeout: Duration{5 * time.Second},
+			WriteTimeout:      Duration{10 * time.Second},
+			IdleTimeout:       Duration{120 * time.Second},
+			MaxHeaderBytes:    1 << 16,
+			KeepAlives:        true,
+			HTTP2:             true,
+			RouteTimeouts: RouteTimeoutsConfig{
+				Redirect: Duration{2 * time.Second},
+				API:      Duration{10 * time.Second},
+				Export:   Duration{time.Minute},
+			},
+			SlowRequest: Duration{time.Second},
+		},
+		Redis: defaultRedisConfig(),
+		AccessLog: AccessLogConfig{
+			Format:       "combined",
+			Destination:  "stdout",
+			MaxSizeMB:    100,
+			MaxBackups:   5,
+			SyslogTag:    "url-shortener",
+			RedactParams: []string{"token", "access_token", "api_key", "key", "sig", "password"},
+		},
+		Clicks: ClicksConfig{
+			RetryBufferSize: 10000,
+			RetryFor:        Duration{time.Hour},
+			Sinks:           []string{"export"},
+			StreamKey:       "clicks",
+			StreamMaxLen:    1000000,
+		},
+		Export: ExportConfig{
+			QueueSize:     10000,
+			BatchSize:     100,
+			FlushInterval: Duration{time.Second},
+		},
+		Backup: BackupConfig{
+			Interval:   Duration{6 * time.Hour},
+			Prefix:     "backups/",
+			S3Endpoint: "https://s3.amazonaws.com",
+			S3Region:   "us-east-1",
+		},
+		Policy: PolicyConfig{
+			AllowedSchemes: []string{"http", "https"},
+			BlockedHosts:   []string{},
+			MaxTargetLen:   2048,
+		},
+		Listing: ListingConfig{
+			PageSize:    10,
+			MaxPageSize: 100,
+		},
+		Details: DetailsConfig{
+			MaxShareTokenTTL: Duration{30 * 24 * time.Hour},
+		},
+		Unwrap: UnwrapConfig{
+			Hosts:    []string{"bit.ly", "t.co", "tinyurl.com", "goo.gl", "ow.ly", "buff.ly", "is.gd", "rebrand.ly"},
+			MaxDepth: 5,
+		},
+		LDAP: LDAPConfig{
+			MemberFilter: "(&(mail={email})(memberOf=cn={group},ou=groups,dc=example,dc=com))",
+			Timeout:      Duration{5 * time.Second},
+			CacheFor:     Duration{5 * time.Minute},
+		},
+		Outbound: OutboundConfig{
+			AllowedSchemes: []string{"http", "https"},
+			AllowedPorts:   []int{80, 443},
+			MaxRedirects:   10,
+			MaxBytes:       512 * 1024,
+			Timeout:        Duration{10 * time.Second},
+		},
+		Kubernetes: KubernetesConfig{
+			TokenFile:     "/var/run/secrets/kubernetes.io/serviceaccount/token",
+			CAFile:        "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt",
+			LabelSelector: "url-shortener/links=true",
+			Interval:      Duration{time.Minute},
+		},
+		Search: SearchConfig{
+			Backend: "auto",
+		},
+		CDN: CDNConfig{
+			MaxAge: Duration{5 * time.Minute},
+		},
+		Locales: LocalesConfig{
+			Default: sourceLocale,
+			Dir:     "locales",
+		},
+		Health: HealthConfig{
+			Interval: Duration{time.Hour},
+			Failures: 2,
+		},
+		Archive: ArchiveConfig{
+			Endpoint: "https://web.archive.org/save/",
+			Timeout:  Duration{2 * time.Minute},
+		},
+		Activation: ActivationConfig{
+			PendingFor: Duration{24 * time.Hour},
+		},
+		GDPR: GDPRConfig{
+			IPs:          gdprHashIPs,
+			SaltRotation: Duration{24 * time.Hour},
+		},
+		Feeds: FeedsConfig{
+			Horizon:  Duration{7 * 24 * time.Hour},
+			TokenTTL: Duration{365 * 24 * time.Hour},
+		},
+		Titles: TitlesConfig{
+			Timeout: Duration{10 * time.Second},
+		},
+		Thumbnails: ThumbnailsConfig{
+			Timeout:  Duration{30 * time.Second},
+			MaxBytes: 1 << 20,
+		},
+		Slugs: SlugsConfig{
+			MaxRunes: 32,
+			Numeric:  NumericSlugsConfig{Length: 6},
+		},
+		Squatting: SquattingConfig{
+			ReservedTerms: []string{},
+			PopularLinks:  100,
+			Action:        "reject",
+		},
+		Trash: TrashConfig{
+			Retention: Duration{30 * 24 * time.Hour},
+		},
+		Roles: RolesConfig{
+			Anonymous: roleEditor,
+			Session:   roleViewer,
+		},
+		SAML: SAMLConfig{
+			SessionFor: Duration{8 * time.Hour},
+			ClockSkew:  Duration{2 * time.Minute},
+		},
+		Circuit: CircuitConfig{
+			Failures:  5,
+			Cooldown:  Duration{5 * time.Second},
+			CacheSize: 10000,
+		},
+		Region: RegionConfig{PrimaryRedis: defaultRedisConfig()},
+		Reservations: ReservationsConfig{
+			TTL:    Duration{time.Hour},
+			MaxTTL: Duration{7 * 24 * time.Hour},
+		},
+		Cache: CacheConfig{
+			Preload:         1000,
+			PreloadInterval: Duration{5 * time.Minute},
+			Tracking:        TrackingConfig{Size: 10000},
+			Shared: SharedCacheConfig{
+				TTL:          Duration{time.Minute},
+				Prefix:       "shortener:slug:",
+				Timeout:      Duration{50 * time.Millisecond},
+				MaxIdleConns: 8,
+			},
+		},
+		Migrations: MigrationsConfig{
+			OnStart:     true,
+			LockTimeout: Duration{10 * time.Minute},
+		},
+		SignedRequests: SignedRequestsConfig{
+			MaxSkew: Duration{5 * time.Minute},
+			Clients: []SignedClientConfig{},
+		},
+		OptOut: OptOutConfig{
+			CountClicks: true,
+		},
+		RedisMemory: RedisMemoryConfig{
+			EvictionPolicy: "warn",
+			Interval:       Duration{15 * time.Second},
+		},
+		Shards: ShardsConfig{
+			HealthInterval: Duration{5 * time.Second},
+		},
+		Metering: MeteringConfig{
+			BillingDay: 1,
+			Retention:  Duration{400 * 24 * time.Hour},
+		},
+		KeyRotation: KeyRotationConfig{
+			Overlap:    Duration{24 * time.Hour},
+			MaxOverlap: Duration{7 * 24 * time.Hour},
+		},
+		EmailGateway: EmailGatewayConfig{
+			LinkTTL:     Duration{90 * 24 * time.Hour},
+			DedupWindow: Duration{24 * time.Hour},
+			Tag:         "email",
+		},
+		Abuse: AbuseConfig{
+			Window:       Duration{time.Minute},
+			MaxMisses:    30,
+			Backoff:      Duration{time.Minute},
+			MaxBackoff:   Duration{time.Hour},
+			Forgive:      Duration{24 * time.Hour},
+			MaxTarpitted: 100,
+			MaxClients:   100000,
+			Exempt:       []string{},
+
+			HoneypotAction: "backoff",
+			BlockFor:       Duration{24 * time.Hour},
+		},
+		Anomaly: AnomalyConfig{
+			Interval:      Duration{5 * time.Minute},
+			BaselineHours: 24,
+			ZScore:        4,
+			MinClicks:     50,
+		},
+	}
+}
+
+// loadConfig reads a JSON config file over the defaults. An empty path means defaults only.
+func loadConfig(path string) (Config, error) {
+	c := defaultConfig()
+	if path == "" {
+		return c, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return c, err
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&c); err != nil {
+		return c, err
+	}
+	if err := validateRedis(c.Redis); err != nil {
+		return c, err
+	}
+	if err := validateClientCerts(c.Server); err != nil {
+		return c, err
+	}
+	if err := validateNumericSlugs(c.Slugs.Numeric); err != nil {
+		return c, err
+	}
+	if err := validateSharedCache(c.Cache.Shared); err != nil {
+		return c, err
+	}
+	if err := validateTracking(c.Cache.Tracking); err != nil {
+		return c, err
+	}
+	if err := validateRegion(c.Region); err != nil {
+		return c, err
+	}
+	if err := validateReservations(c.Reservations); err != nil {
+		return c, err
+	}
+	if err := validateSignedRequests(c.SignedRequests); err != nil {
+		return c, err
+	}
+	if err := validateAbuse(c.Abuse); err != nil {
+		return c, err
+	}
+	if err := validateEmailGateway(c.EmailGateway); err != nil {
+		return c, err
+	}
+	if err := validateAttribution(c.Attribution); err != nil {
+		return c, err
+	}
+	if err := validateKeyRotation(c.KeyRotation); err != nil {
+		return c, err
+	}
+	if err := validateMetering(c.Metering); err != nil {
+		return c, err
+	}
+	if err := validateRedisMemory(c.RedisMemory); err != nil {
+		return c, err
+	}
+	if err := validateShards(c); err != nil {
+		return c, err
+	}
+	if err := validateOutbound(c.Outbound); err != nil {
+		return c, err
+	}
+	if err := validateJobs(c); err != nil {
+		return c, err
+	}
+	if err := validateCDN(c.CDN); err != nil {
+		return c, err
+	}
+	if err := validateGDPR(c.GDPR); err != nil {
+		return c, err
+	}
+	if err := validateRetention(c.Retention); err != nil {
+		return c, err
+	}
+	if err := validateActivation(c.Activation); err != nil {
+		return c, err
+	}
+	if err := validateHealth(c.Health); err != nil {
+		return c, err
+	}
+	if err := validateTheme(c.Theme); err != nil {
+		return c, err
+	}
+	return c, validateRoles(c)
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// A new link touches its url: key, meta, the indexes, the reverse
+// target->slug index, the tenant's links and the daily counters. They're all
+// written by one Lua script, so a link is never half-created: the script
+// checks for a slug or alias conflict before writing anything, and Redis runs
+// it without interleaving other commands.
+//
+// With shards, the link's keys and the indexes are on different servers, so
+// no one script reaches them all. The link is written by a script on its
+// slug's shard, then filed in the indexes on the home Redis in one
+// transaction; should that fail, the link is deleted again and the create
+// fails.
+
+// targetlinks:<sha256 of target> holds every slug pointing at that target, by creation time
+func keyOfTargetLinks(digest string) string {
+	return "targetlinks:" + digest
+}
+
+func targetDigest(target string) string {
+	sum := sha256.Sum256([]byte(target))
+	return hex.EncodeToString(sum[:])
+}
+
+// KEYS: url, alias, meta, created idx, clicks idx, expires idx, daily created,
+// target links, tenant links, tenant daily creates, reservation, honeypot
+//
+// ARGV: slug, target, ttl seconds, created, expires, then meta field/value pairs
+var createLinkScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 or redis.call("EXISTS", KEYS[2]) == 1 or redis.call("EXISTS", KEYS[11]) == 1 or redis.call("EXISTS", KEYS[12]) == 1 then
+	return 0
+end
+local slug, ttl, created = ARGV[1], ARGV[3], ARGV[4]
+redis.call("SET", KEYS[1], ARGV[2], "EX", ttl)
+redis.call("DEL", KEYS[3])
+redis.call("HMSET", KEYS[3], unpack(ARGV, 6))
+redis.call("EXPIRE", KEYS[3], ttl)
+redis.call("ZADD", KEYS[4], created, slug)
+redis.call("ZADD", KEYS[5], "NX", 0, slug)
+redis.call("ZADD", KEYS[6], ARGV[5], slug)
+redis.call("INCR", KEYS[7])
+redis.call("EXPIRE", KEYS[7], 172800)
+if ARGV[2] ~= "" then
+	redis.call("ZADD", KEYS[8], created, slug)
+end
+redis.call("ZADD", KEYS[9], created, slug)
+redis.call("INCR", KEYS[10])
+redis.call("EXPIRE", KEYS[10], 172800)
+return 1
+`)
+
+// KEYS: url, alias, meta, reservation, honeypot, all on the slug's shard
+//
+// ARGV: target, ttl seconds, then meta field/value pairs
+var createShardedLinkScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 or redis.call("EXISTS", KEYS[2]) == 1 or redis.call("EXISTS", KEYS[4]) == 1 or redis.call("EXISTS", KEYS[5]) == 1 then
+	return 0
+end
+local ttl = ARGV[2]
+redis.call("SET", KEYS[1], ARGV[1], "EX", ttl)
+redis.call("DEL", KEYS[3])
+redis.call("HMSET", KEYS[3], unpack(ARGV, 3))
+redis.call("EXPIRE", KEYS[3], ttl)
+return 1
+`)
+
+// createLink reports false, without writing anything, when the slug is taken
+func createLink(redis_db Storage, ctx context.Context, slug string, target string, opts LinkOptions, created time.Time) (bool, error) {
+	meta := []interface{}{"created", created.Unix()}
+	if opts.DedupWindowSet || opts.DedupWindow > 0 {
+		meta = append(meta, "dedup_window", int64(opts.DedupWindow.Seconds()))
+	}
+	if opts.Tenant != "" {
+		meta = append(meta, "tenant", opts.Tenant)
+	}
+	if len(opts.UnwrappedFrom) > 0 {
+		chain, _ := json.Marshal(opts.UnwrappedFrom)
+		meta = append(meta, "unwrapped_from", string(chain))
+	}
+	if !opts.Access.Public() {
+		allow, _ := json.Marshal(opts.Access.Allow)
+		meta = append(meta, "visibility", opts.Access.Visibility, "allow", string(allow))
+	}
+	if opts.Access.Privacy != "" {
+		meta = append(meta, "privacy", opts.Access.Privacy)
+	}
+	if len(opts.Tags) > 0 {
+		meta = append(meta, "tags", strings.Join(opts.Tags, ","))
+	}
+	if opts.ManagedBy != "" {
+		meta = append(meta, "managed_by", opts.ManagedBy)
+	}
+	if opts.Draft {
+		meta = append(meta, "draft", 1)
+	}
+	if len(opts.Bundle) > 0 {
+		bundle, _ := json.Marshal(opts.Bundle)
+		meta = append(meta, "bundle", string(bundle))
+	}
+	ttl := opts.Ttl
+	if ttl <= 0 {
+		ttl = default_ttl
+	} else if ttl != default_ttl {
+		meta = append(meta, "ttl", int64(ttl.Seconds()))
+	}
+
+	if len(config.Shards.Endpoints) > 0 {
+		return createShardedLink(redis_db, ctx, slug, target, opts.Tenant, meta, ttl, created)
+	}
+
+	keys := []string{
+		keyOfSlug(slug),
+		keyOfAlias(slug),
+		keyOfSlugMeta(slug),
+		keyOfCreatedIndex,
+		keyOfClicksIndex,
+		keyOfExpiresIndex,
+		keyOfDailyStat("created", created),
+		keyOfTargetLinks(targetDigest(target)),
+		keyOfTenantLinks(opts.Tenant),
+		keyOfTenantDailyCreates(opts.Tenant, created),
+		keyOfReservation(slug),
+		keyOfHoneypot(slug),
+	}
+	args := append([]interface{}{
+		slug,
+		target,
+		int64(ttl.Seconds()),
+		created.Unix(),
+		created.Add(ttl).Unix(),
+	}, meta...)
+
+	written, err := createLinkScript.Run(ctx, redis_db, keys, args...).Int()
+	if written == 1 && config.Metering.Enabled {
+		redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			meterUsage(pipe, ctx, opts.Tenant, usageCreated, created)
+			return nil
+		})
+	}
+	return written == 1, err
+}
+
+// createShardedLink writes the link on its shard, then indexes it on the home
+// Redis. A link which can't be indexed is deleted, and the create fails with a
+// *StorageError.
+func createShardedLink(redis_db Storage, ctx context.Context, slug string, target string, tenant string, meta []interface{}, ttl time.Duration, created time.Time) (bool, error) {
+	keys := []string{
+		keyOfSlug(slug),
+		keyOfAlias(slug),
+		keyOfSlugMeta(slug),
+		keyOfReservation(slug),
+		keyOfHoneypot(slug),
+	}
+	args := append([]interface{}{target, int64(ttl.Seconds())}, meta...)
+
+	written, err := createShardedLinkScript.Run(ctx, redis_db, keys, args...).Int()
+	if err != nil || written != 1 {
+		return false, err
+	}
+	if err := indexLink(redis_db, ctx, slug, target, tenant, created, ttl); err != nil {
+		if err := redis_db.Del(ctx, keyOfSlug(slug), keyOfSlugMeta(slug)).Err(); err != nil {
+			log.Println("Cannot delete unindexed link", slug, err)
+		}
+		return false, &StorageError{Op: "index " + slug, Err: err}
+	}
+	return true, nil
+}
+
+// indexLink files a new link in the indexes and counts it
+func indexLink(redis_db Storage, ctx context.Context, slug string, target string, tenant string, created time.Time, ttl time.Duration) error {
+	_, err := redis_db.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		at := float64(created.Unix())
+		pipe.ZAdd(ctx, keyOfCreatedIndex, &redis.Z{Score: at, Member: slug})
+		pipe.ZAddNX(ctx, keyOfClicksIndex, &redis.Z{Score: 0, Member: slug})
+		pipe.ZAdd(ctx, keyOfExpiresIndex, &redis.Z{Score: float64(created.Add(ttl).Unix()), Member: slug})
+		countDaily(pipe, ctx, "created", created)
+		if target != "" {
+			pipe.ZAdd(ctx, keyOfTargetLinks(targetDigest(target)), &redis.Z{Score: at, Member: slug})
+		}
+		pipe.ZAdd(ctx, keyOfTenantLinks(tenant), &redis.Z{Score: at, Member: slug})
+		pipe.Incr(ctx, keyOfTenantDailyCreates(tenant, created))
+		pipe.Expire(ctx, keyOfTenantDailyCreates(tenant, created), 48*time.Hour)
+		meterUsage(pipe, ctx, tenant, usageCreated, created)
+		return nil
+	})
+	return err
+}
+
+// linksToTarget returns the slugs of live links to exactly this target, newest first
+func linksToTarget(redis_db Storage, ctx context.Context, target string) ([]string, error) {
+	slugs, err := redis_db.ZRevRange(ctx, keyOfTargetLinks(targetDigest(target)), 0, 99).Result()
+	if err != nil || len(slugs) == 0 {
+		return slugs, err
+	}
+	missing, err := missingSlugs(redis_db, ctx, slugs)
+	if err != nil {
+		return nil, err
+	}
+	gone := map[string]bool{}
+	for _, slug := range missing {
+		gone[slug] = true
+	}
+	live := []string{}
+	for _, slug := range slugs {
+		if !gone[slug] {
+			live = append(live, slug)
+		}
+	}
+	return live, nil
+}
+
+// shorten does all /_create does short of answering: it checks the role, the
+// Redis memory, the quota (setting its headers on w) and the target, unwraps
+// it and stores the link. A draft or a bundle has no target to check. On
+// failure it also returns the status to answer with.
+func shorten(redis_db Storage, w http.ResponseWriter, req *http.Request, identity Identity, target string, opts LinkOptions) (ShortUrl, int, error) {
+	if !identity.can(roleEditor) {
+		return ShortUrl{}, http.StatusForbidden, errors.New("Creating links needs the editor role")
+	}
+	if needsActivation(identity) && !opts.Activated {
+		return ShortUrl{}, http.StatusForbidden, errors.New("Links created without an API key need activation, through the form")
+	}
+	if redis_memory.full() {
+		memory_refusals.Inc()
+		setRetryAfter(w)
+		return ShortUrl{}, http.StatusInsufficientStorage, errors.New("Storage is full, no links can be created for now")
+	}
+	usage, err := checkQuota(redis_db, req.Context(), identity.Tenant)
+	if err != nil {
+		return ShortUrl{}, http.StatusServiceUnavailable, fmt.Errorf("Cannot check quota: %v", err)
+	}
+	setQuotaHeaders(w, usage)
+	if usage.ExceededLinks || usage.ExceededDaily {
+		log.Println("Quota exceeded for tenant", identity.Tenant, "key", identity.KeyId)
+		return ShortUrl{}, http.StatusTooManyRequests, errors.New("Quota exceeded")
+	}
+
+	opts.Tenant = identity.Tenant
+	if opts.Draft || len(opts.Bundle) > 0 {
+		su, err := store(redis_db, req.Context(), "", opts)
+		if redisUnavailable(err) {
+			return su, http.StatusServiceUnavailable, err
+		} else if err != nil {
+			return su, http.StatusConflict, fmt.Errorf("Failed to create: %v", err)
+		}
+		su.Access = opts.Access
+		return su, http.StatusCreated, nil
+	}
+
+	target = asciiTarget(target)
+	if _, err := validateTarget(target); err != nil {
+		return ShortUrl{}, http.StatusUnprocessableEntity, fmt.Errorf("Cannot shorten: %v", err)
+	}
+
+	if config.Unwrap.Enabled {
+		final, chain, err := unwrapTarget(redis_db, req.Context(), target, append([]string{req.Host}, config.Unwrap.SelfHosts...))
+		if err != nil {
+			return ShortUrl{}, http.StatusUnprocessableEntity, fmt.Errorf("Cannot shorten: %v", err)
+		}
+		target, opts.UnwrappedFrom = asciiTarget(final), chain
+	}
+
+	su, err := store(redis_db, req.Context(), target, opts)
+	if redisUnavailable(err) {
+		return su, http.StatusServiceUnavailable, err
+	} else if err != nil {
+		return su, http.StatusConflict, fmt.Errorf("Failed to create: %v", err)
+	}
+	reindexTerms(redis_db, req.Context(), su.Slug)
+	describeTarget(redis_db, su.Slug, su.Target, opts.Access)
+	return su, http.StatusCreated, nil
+}
+
+// describeTarget fetches what's kept about a new target, in the background
+func describeTarget(redis_db Storage, slug string, target string, access LinkAccess) {
+	if config.Thumbnails.Endpoint != "" {
+		go captureThumbnail(redis_db, slug, target)
+	}
+	if config.Titles.Enabled {
+		go fetchTitle(redis_db, slug, target)
+	}
+	if config.Archive.Enabled && access.Public() {
+		go archiveTarget(redis_db, slug, target)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// What /_create answers: a page to copy and share the new short URL from,
+// or the link as JSON when the client asked for JSON.
+
+type CreatedResponse struct {
+	LinkResponse
+	ShortURL string `json:"short_url"`
+}
+
+type CreatedPage struct {
+	Slug     string
+	Target   string
+	ShortURL string
+	QR       template.HTML
+	Share    []ShareLink
+}
+
+type ShareLink struct {
+	Name string
+	URL  string
+}
+
+func wantsJSON(req *http.Request) bool {
+	return strings.Contains(req.Header.Get("Accept"), "application/json")
+}
+
+func shareLinksOf(short_url string) []ShareLink {
+	u := url.QueryEscape(short_url)
+	return []ShareLink{
+		{"X", "https://twitter.com/intent/tweet?url=" + u},
+		{"Facebook", "https://www.facebook.com/sharer/sharer.php?u=" + u},
+		{"LinkedIn", "https://www.linkedin.com/sharing/share-offsite/?url=" + u},
+		{"Email", "mailto:?body=" + u},
+	}
+}
+
+func writeCreated(w http.ResponseWriter, req *http.Request, su ShortUrl) {
+	// a link created with a keyword is shared by it
+	short_url := publicURL(req, "/"+su.Slug)
+	if len(su.Aliases) > 0 {
+		short_url = publicURL(req, "/"+su.Aliases[0])
+	}
+	if wantsJSON(req) {
+		w.Header().Set("Location", "/api/v1/links/"+su.Slug)
+		writeJSON(w, http.StatusCreated, CreatedResponse{LinkResponse: linkResponseOf(su), ShortURL: short_url})
+		return
+	}
+
+	page := CreatedPage{Slug: su.Slug, Target: su.Target, ShortURL: short_url, Share: shareLinksOf(short_url)}
+	if qr, err := encodeQR([]byte(short_url)); err == nil {
+		page.QR = template.HTML(qr.SVG(4))
+	} else {
+		log.Println("No QR code for", short_url, err)
+	}
+
+	w.Header().Set("Location", "/"+su.Slug+"?details")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	setLanguage(w, req)
+	w.WriteHeader(http.StatusCreated)
+	renderPage(w, req, "created.html", viewerBranding(req), page)
+}
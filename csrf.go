@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// HTML forms which change anything carry a CSRF token, double-submitted: the
+// page sets it as a cookie and puts it in a hidden csrf_token field, and the
+// handler wants both, equal. Another site can make the browser send the
+// cookie, but can't read it to fill in the field. The token is signed, so a
+// cookie planted from a sibling domain doesn't pass either.
+//
+// Requests with an API key don't need one, as the browser never adds the key
+// by itself. Nor do requests without Origin and Sec-Fetch-Site headers, which
+// browsers send with every cross-site POST: those come from scripts and curl.
+
+const csrfCookie = "csrf_token"
+const csrfField = "csrf_token"
+const csrfTokenPurpose = "csrf"
+
+// csrfToken returns the token for a form, setting the cookie when there isn't a good one
+func csrfToken(w http.ResponseWriter, req *http.Request) string {
+	if cookie, err := req.Cookie(csrfCookie); err == nil {
+		if _, err := verifyToken(csrfTokenPurpose, cookie.Value); err == nil {
+			return cookie.Value
+		}
+	}
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	token := signToken(csrfTokenPurpose, hex.EncodeToString(nonce))
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(publicURL(req, "/"), "https:"),
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token
+}
+
+// checkCSRF writes the refusal and returns false when a browser's form post lacks a matching token
+func checkCSRF(w http.ResponseWriter, req *http.Request) bool {
+	if hasCredentials(req) {
+		return true
+	}
+	if req.Header.Get("Origin") == "" && req.Header.Get("Sec-Fetch-Site") == "" {
+		return true
+	}
+	cookie, err := req.Cookie(csrfCookie)
+	submitted := req.PostFormValue(csrfField)
+	if submitted == "" {
+		submitted = req.Header.Get("X-CSRF-Token")
+	}
+	if err == nil && submitted != "" && subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(submitted)) == 1 {
+		if _, err := verifyToken(csrfTokenPurpose, cookie.Value); err == nil {
+			return true
+		}
+	}
+	w.WriteHeader(http.StatusForbidden)
+	w.Write([]byte("Missing or stale form token, reload the page and try again"))
+	return false
+}
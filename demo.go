@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// --seed-demo-data fills the storage with a few hundred made-up links, with
+// clicks, hourly series and page titles, for UI work and load tests on a
+// developer's machine. The links are tagged demo in meta; they last 30 days
+// unless clicked, when the usual TTL takes over.
+
+var seed_demo_data = flag.Bool("seed-demo-data", false, "add a few hundred made-up links before serving")
+
+const demoLinks = 300
+const demoTTL = 30 * 24 * time.Hour
+const demoSeriesHours = 72
+
+var demoSites = []struct{ host, title string }{
+	{"en.wikipedia.org", "Wikipedia"},
+	{"github.com", "GitHub"},
+	{"news.ycombinator.com", "Hacker News"},
+	{"www.youtube.com", "YouTube"},
+	{"docs.python.org", "Python documentation"},
+	{"go.dev", "The Go Programming Language"},
+	{"www.nytimes.com", "The New York Times"},
+	{"stackoverflow.com", "Stack Overflow"},
+	{"www.bbc.co.uk", "BBC"},
+	{"example.com", "Example Domain"},
+}
+
+var demoTopics = []string{
+	"release-notes", "pricing", "careers", "blog/launch", "docs/getting-started", "events/2021-summit",
+	"support/faq", "newsletter", "survey", "webinar-signup", "product/roadmap", "about",
+}
+
+// seedDemoData writes n links created over the last 30 days, with clicks skewed toward a few popular ones
+func seedDemoData(redis_db Storage, ctx context.Context, n int) error {
+	now := time.Now()
+	random := rand.New(rand.NewSource(now.UnixNano()))
+	today := now.UTC().Truncate(24 * time.Hour)
+	clicks_today := int64(0)
+	created_today := int64(0)
+
+	for i := 0; i < n; i++ {
+		site := demoSites[random.Intn(len(demoSites))]
+		topic := demoTopics[random.Intn(len(demoTopics))]
+		created := now.Add(-time.Duration(random.Int63n(int64(demoTTL))))
+		clicks := int64(math.Pow(random.Float64(), 4) * 5000)
+
+		record := BackupRecord{
+			Slug:         randomSlug(),
+			Target:       fmt.Sprintf("https://%s/%s?ref=demo%d", site.host, topic, i),
+			Clicks:       clicks,
+			UniqueClicks: clicks * int64(40+random.Intn(50)) / 100,
+			Meta: map[string]string{
+				"created": fmt.Sprint(created.Unix()),
+				"title":   fmt.Sprintf("%s - %s", topic, site.title),
+				"demo":    "1",
+			},
+		}
+
+		// recent clicks go into the hourly series, spread unevenly
+		series := map[string]interface{}{}
+		last_click := time.Time{}
+		for left := clicks; left > 0; {
+			hour := now.Add(-time.Duration(random.Intn(demoSeriesHours)) * time.Hour).UTC()
+			if hour.Before(created) {
+				break
+			}
+			batch := 1 + random.Int63n(left)
+			field := hour.Format(seriesBucketFormat)
+			previous, _ := series[field].(int64)
+			series[field] = previous + batch
+			if hour.After(last_click) {
+				last_click = hour
+			}
+			if !hour.Before(today) {
+				clicks_today += batch
+			}
+			left -= batch
+		}
+		if !last_click.IsZero() {
+			record.Meta["last_click"] = fmt.Sprint(last_click.Unix())
+		}
+
+		_, err := redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, keyOfSlug(record.Slug), record.Target, demoTTL)
+			writeLinkRecord(pipe, ctx, record, demoTTL)
+			if len(series) > 0 {
+				pipe.HSet(ctx, keyOfSlugSeries(record.Slug), series)
+				expireCounter(pipe, ctx, keyOfSlugSeries(record.Slug), demoTTL)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := indexLinkTerms(redis_db, ctx, record.Slug); err != nil {
+			return err
+		}
+		if !created.Before(today) {
+			created_today++
+		}
+	}
+
+	_, err := redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.IncrBy(ctx, keyOfDailyStat("created", now), created_today)
+		pipe.Expire(ctx, keyOfDailyStat("created", now), 48*time.Hour)
+		pipe.IncrBy(ctx, keyOfDailyStat("clicks", now), clicks_today)
+		pipe.Expire(ctx, keyOfDailyStat("clicks", now), 48*time.Hour)
+		return nil
+	})
+	if err == nil {
+		log.Println("Seeded", n, "demo links")
+	}
+	return err
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+// A draft link has its slug before it has a target, so it can be printed or
+// shared while the page it's for is still being made. Until it's published,
+// following it shows a "coming soon" page in its tenant's theme, which isn't
+// counted as a click. Publishing sets the target, keeping the slug, its
+// aliases and its expiry.
+//
+// A draft is a link whose url: key is empty, with draft in its meta. It isn't
+// in the target index until published, and the link health job skips it.
+
+// KEYS: url, meta
+//
+// ARGV: target, now
+//
+// Returns when the link was created, or -1 when it isn't a draft
+var publishDraftScript = redis.NewScript(`
+if redis.call("HGET", KEYS[2], "draft") ~= "1" then
+	return -1
+end
+local ttl = redis.call("PTTL", KEYS[1])
+if ttl == -2 then
+	return -1
+elseif ttl > 0 then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ttl)
+else
+	redis.call("SET", KEYS[1], ARGV[1])
+end
+redis.call("HDEL", KEYS[2], "draft")
+redis.call("HSET", KEYS[2], "modified", ARGV[2])
+return tonumber(redis.call("HGET", KEYS[2], "created") or "0")
+`)
+
+var drafts = newCounter("shortener_drafts_total", "Draft links, by event: created or published")
+
+// publishDraft reports false, without writing anything, when slug isn't a draft
+func publishDraft(redis_db Storage, req *http.Request, slug string, target string) (bool, error) {
+	keys := []string{keyOfSlug(slug), keyOfSlugMeta(slug)}
+	created, err := publishDraftScript.Run(req.Context(), redis_db, keys, target, time.Now().Unix()).Int64()
+	if err != nil || created < 0 {
+		return false, err
+	}
+	// the target index is on the home Redis, the link on its shard
+	err = redis_db.ZAdd(req.Context(), keyOfTargetLinks(targetDigest(target)), &redis.Z{Score: float64(created), Member: slug}).Err()
+	return true, err
+}
+
+// writeDraftPage is shown instead of redirecting while a link is a draft
+func writeDraftPage(redis_db Storage, w http.ResponseWriter, req *http.Request, slug string) {
+	su, err := getDetailsOfKey(redis_db, req.Context(), slug)
+	if err != nil {
+		su = ShortUrl{Slug: slug}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	setLanguage(w, req)
+	w.Header().Set("Cache-Control", "no-store")
+	renderPage(w, req, "draft.html", brandingOf(su.Tenant), su)
+}
+
+func registerDraftRoutes(router *mux.Router, redis_db Storage) {
+
+	router.HandleFunc("", func(w http.ResponseWriter, req *http.Request) {
+		identity, ok := hasRole(w, req, roleEditor)
+		if !ok {
+			return
+		}
+		var body struct {
+			Title      string   `json:"title"` // shown on the coming soon page
+			Visibility string   `json:"visibility"`
+			Allow      string   `json:"allow"`
+			Privacy    string   `json:"privacy"`
+			Tags       []string `json:"tags"`
+		}
+		if err := readJSON(w, req, &body); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		opts := LinkOptions{Tags: body.Tags, Draft: true}
+		var err error
+		if opts.Access, err = parseLinkAccess(body.Visibility, body.Allow); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if opts.Access.Privacy, err = parseLinkPrivacy(body.Privacy); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		su, status, err := shorten(redis_db, w, req, identity, "", opts)
+		if err != nil {
+			writeJSONError(w, status, err.Error())
+			return
+		}
+		if title := strings.TrimSpace(body.Title); title != "" {
+			su.Title = truncateRunes(title, maxTitleRunes)
+			redis_db.HSet(req.Context(), keyOfSlugMeta(su.Slug), "title", su.Title)
+		}
+		reindexTerms(redis_db, req.Context(), su.Slug)
+		drafts.Inc("event", "created")
+		log.Println("Created draft", su.Slug, "by", identity.KeyId)
+		writeJSON(w, http.StatusCreated, linkResponseOf(su))
+	}).Methods("POST")
+
+	router.HandleFunc("/{slug:[0-9A-Za-z]+}/publish", func(w http.ResponseWriter, req *http.Request) {
+		su, ok := managedLink(w, req, redis_db)
+		if !ok {
+			return
+		}
+		var body struct {
+			Target string `json:"target"`
+		}
+		if err := readJSON(w, req, &body); err != nil || body.Target == "" {
+			writeJSONError(w, http.StatusBadRequest, "Expected {\"target\": ...}")
+			return
+		}
+		target := asciiTarget(body.Target)
+		if _, err := validateTarget(target); err != nil {
+			writeJSONError(w, http.StatusUnprocessableEntity, "Cannot publish: "+err.Error())
+			return
+		}
+		published, err := publishDraft(redis_db, req, su.Slug, target)
+		if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		if !published {
+			writeJSONError(w, http.StatusConflict, "Not a draft")
+			return
+		}
+		purgeLinks(append([]string{su.Slug}, su.Aliases...)...)
+		reindexTerms(redis_db, req.Context(), su.Slug)
+		describeTarget(redis_db, su.Slug, target, su.Access)
+		drafts.Inc("event", "published")
+		identity, _ := identify(req)
+		log.Println("Published draft", su.Slug, "to", target, "by", identity.KeyId)
+		su, err = getDetailsOfKey(redis_db, req.Context(), su.Slug)
+		if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, linkResponseOf(su))
+	}).Methods("POST")
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+// The duplicates report groups live links by normalized target, so a URL
+// shortened dozens of times shows up as one group. Merging a group keeps one
+// link and folds the others into it: each is moved to the trash, its slug
+// and aliases become aliases of the kept link, and its clicks are added to
+// the kept link's count. Old short URLs keep working, at the kept link.
+
+const maxDuplicateGroups = 100
+
+// normalizeTarget is the form links are compared in: lowercase scheme and
+// ASCII host, no default port, "/" for an empty path, and the query sorted.
+// The fragment is kept: single-page apps route on it, so it can tell pages
+// apart.
+func normalizeTarget(target string) string {
+	u, err := url.Parse(asciiTarget(target))
+	if err != nil {
+		return target
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	if port != "" {
+		host += ":" + port
+	}
+	u.Host = host
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = u.Query().Encode()
+	}
+	return u.String()
+}
+
+type DuplicateLink struct {
+	Slug   string `json:"slug"`
+	Target string `json:"target"`
+	Clicks int64  `json:"clicks"`
+}
+
+type DuplicateGroup struct {
+	Target string          `json:"target"` // normalized
+	Keep   string          `json:"keep"`   // the suggested link to merge into, the most clicked
+	Links  []DuplicateLink `json:"links"`
+}
+
+type DuplicatesReport struct {
+	Scanned int              `json:"scanned"`
+	Groups  []DuplicateGroup `json:"groups"`
+	More    bool             `json:"more"` // more groups than returned
+}
+
+// findDuplicates groups every live link by normalized target, largest groups first
+func findDuplicates(redis_db Storage, ctx context.Context, limit int) (DuplicatesReport, error) {
+	r := DuplicatesReport{Groups: []DuplicateGroup{}}
+	groups := map[string][]DuplicateLink{}
+	seen := map[string]bool{}
+	err := scanKeys(redis_db, ctx, keyOfSlug("*"), func(keys []string) error {
+		slugs := []string{}
+		for _, key := range keys {
+			if slug, err := slugFromKey(key); err == nil && !seen[slug] {
+				seen[slug] = true
+				slugs = append(slugs, slug)
+			}
+		}
+		if len(slugs) == 0 {
+			return nil
+		}
+		targets := make([]*redis.StringCmd, len(slugs))
+		clicks := make([]*redis.FloatCmd, len(slugs))
+		_, err := redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, slug := range slugs {
+				targets[i] = pipe.Get(ctx, keyOfSlug(slug))
+				clicks[i] = pipe.ZScore(ctx, keyOfClicksIndex, slug)
+			}
+			return nil
+		})
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		for i, slug := range slugs {
+			target, err := targets[i].Result()
+			if err != nil {
+				continue // expired since
+			}
+			r.Scanned++
+			normalized := normalizeTarget(target)
+			groups[normalized] = append(groups[normalized], DuplicateLink{Slug: slug, Target: target, Clicks: int64(clicks[i].Val())})
+		}
+		return nil
+	})
+	if err != nil {
+		return r, lookupError("duplicates", err)
+	}
+
+	for target, links := range groups {
+		if len(links) < 2 {
+			continue
+		}
+		sort.Slice(links, func(i, j int) bool {
+			if links[i].Clicks != links[j].Clicks {
+				return links[i].Clicks > links[j].Clicks
+			}
+			return links[i].Slug < links[j].Slug
+		})
+		r.Groups = append(r.Groups, DuplicateGroup{Target: target, Keep: links[0].Slug, Links: links})
+	}
+	sort.Slice(r.Groups, func(i, j int) bool {
+		if len(r.Groups[i].Links) != len(r.Groups[j].Links) {
+			return len(r.Groups[i].Links) > len(r.Groups[j].Links)
+		}
+		return r.Groups[i].Target < r.Groups[j].Target
+	})
+	if len(r.Groups) > limit {
+		r.Groups, r.More = r.Groups[:limit], true
+	}
+	return r, nil
+}
+
+// MergeRefusedError says why links can't be merged
+type MergeRefusedError struct {
+	Reason string
+}
+
+func (e MergeRefusedError) Error() string {
+	return e.Reason
+}
+
+type MergeResult struct {
+	Into    string   `json:"into"`
+	Merged  []string `json:"merged"`
+	Aliases []string `json:"aliases"` // now resolving to into, the merged slugs included
+	Clicks  int64    `json:"clicks"`  // added to into's count
+}
+
+// mergeLinks folds the links into another with the same normalized target
+func mergeLinks(redis_db Storage, ctx context.Context, into string, slugs []string, by string) (MergeResult, error) {
+	r := MergeResult{Into: into, Merged: []string{}, Aliases: []string{}}
+	kept, err := getDetailsOfKey(redis_db, ctx, into)
+	if err == errSlugNotFound {
+		return r, MergeRefusedError{"No link " + into}
+	} else if err != nil {
+		return r, err
+	}
+	want := normalizeTarget(kept.Target)
+	// a slug named twice would be trashed twice, and its clicks counted twice
+	seen := map[string]bool{}
+	unique := []string{}
+	for _, slug := range slugs {
+		if !seen[slug] {
+			seen[slug] = true
+			unique = append(unique, slug)
+		}
+	}
+	slugs = unique
+	for _, slug := range slugs {
+		if slug == into {
+			return r, MergeRefusedError{"Can't merge " + into + " into itself"}
+		}
+		su, err := getDetailsOfKey(redis_db, ctx, slug)
+		if err == errSlugNotFound {
+			return r, MergeRefusedError{"No link " + slug}
+		} else if err != nil {
+			return r, err
+		}
+		if normalizeTarget(su.Target) != want {
+			return r, MergeRefusedError{fmt.Sprintf("%s goes to %s, not %s", slug, su.Target, kept.Target)}
+		}
+		// sync would only create it again
+		if managed_by, _ := redis_db.HGet(ctx, keyOfSlugMeta(slug), "managed_by").Result(); managed_by != "" {
+			return r, MergeRefusedError{slug + " is managed by " + managed_by}
+		}
+	}
+
+	for _, slug := range slugs {
+		t, err := trashLink(redis_db, ctx, slug, by)
+		if err != nil {
+			return r, err
+		}
+		for _, alias := range append([]string{slug}, t.Aliases...) {
+			if err := addAlias(redis_db, ctx, into, alias); err == nil {
+				r.Aliases = append(r.Aliases, alias)
+			} else if err != errAliasTaken && err != errRouteName {
+				return r, err
+			}
+		}
+		if t.Clicks > 0 {
+			_, err = redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.IncrBy(ctx, keyOfSlugHitCount(into), t.Clicks)
+				expireCounter(pipe, ctx, keyOfSlugHitCount(into), kept.Ttl)
+				pipe.ZIncrBy(ctx, keyOfClicksIndex, float64(t.Clicks), into)
+				return nil
+			})
+			if err != nil {
+				return r, err
+			}
+			r.Clicks += t.Clicks
+		}
+		r.Merged = append(r.Merged, slug)
+		log.Println("Merged", slug, "into", into, "by", by)
+	}
+	reindexTerms(redis_db, ctx, into)
+	return r, nil
+}
+
+func handleDuplicates(redis_db Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		limit := maxDuplicateGroups
+		if v := req.FormValue("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxDuplicateGroups {
+				writeJSONError(w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxDuplicateGroups))
+				return
+			}
+			limit = n
+		}
+		r, err := findDuplicates(redis_db, req.Context(), limit)
+		if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, r)
+	}
+}
+
+func handleMerge(redis_db Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var body struct {
+			Into  string   `json:"into"`
+			Slugs []string `json:"slugs"`
+		}
+		if err := readJSON(w, req, &body); err != nil || body.Into == "" || len(body.Slugs) == 0 {
+			writeJSONError(w, http.StatusBadRequest, "Needs into and slugs")
+			return
+		}
+		identity, _ := identify(req)
+		r, err := mergeLinks(redis_db, req.Context(), body.Into, body.Slugs, identity.KeyId)
+		var refused MergeRefusedError
+		if errors.As(err, &refused) {
+			writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		} else if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, r)
+	}
+}
+
+type DuplicatesPage struct {
+	DuplicatesReport
+	Merged    string
+	Error     string
+	CSRFToken string
+}
+
+// registerDuplicatesPage serves the report as a page, each group with a button merging it into its suggested link
+func registerDuplicatesPage(router *mux.Router, redis_db Storage) {
+	admin := func(w http.ResponseWriter, req *http.Request) (Identity, bool) {
+		if !requireLogin(w, req) {
+			return Identity{}, false
+		}
+		identity, ok := identify(req)
+		if !ok || !identity.can(roleAdmin) {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "Needs the admin role")
+			return identity, false
+		}
+		return identity, true
+	}
+
+	router.HandleFunc("/_admin/duplicates", func(w http.ResponseWriter, req *http.Request) {
+		if _, ok := admin(w, req); !ok {
+			return
+		}
+		page := DuplicatesPage{Merged: req.FormValue("merged"), Error: req.FormValue("error")}
+		var err error
+		if page.DuplicatesReport, err = findDuplicates(redis_db, req.Context(), maxDuplicateGroups); err != nil {
+			writeUnavailable(w)
+			return
+		}
+		page.CSRFToken = csrfToken(w, req)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		setLanguage(w, req)
+		renderPage(w, req, "duplicates.html", viewerBranding(req), page)
+	}).Methods("GET")
+
+	router.HandleFunc("/_admin/duplicates/merge", func(w http.ResponseWriter, req *http.Request) {
+		identity, ok := admin(w, req)
+		if !ok || !checkCSRF(w, req) {
+			return
+		}
+		req.ParseForm()
+		r, err := mergeLinks(redis_db, req.Context(), req.PostForm.Get("into"), req.PostForm["slug"], identity.KeyId)
+		back := url.Values{}
+		if err != nil {
+			back.Set("error", err.Error())
+		} else {
+			back.Set("merged", fmt.Sprintf("Merged %s into %s", strings.Join(r.Merged, ", "), r.Into))
+		}
+		http.Redirect(w, req, "/_admin/duplicates?"+back.Encode(), http.StatusSeeOther)
+	}).Methods("POST")
+}
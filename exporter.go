@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Streams click events to Kafka (through a Kafka REST proxy) or NATS, for
+// downstream analytics. Events are queued and sent in batches; when the queue
+// is full new events are dropped rather than slowing down redirects.
+
+type ClickEvent struct {
+	Slug      string    `json:"slug"`
+	Timestamp time.Time `json:"timestamp"`
+	Referrer  string    `json:"referrer,omitempty"`
+	Country   string    `json:"country,omitempty"`
+	Region    string    `json:"region,omitempty"`
+	Visitor   string    `json:"visitor,omitempty"` // in GDPR mode, see gdpr.go
+	Party     string    `json:"party,omitempty"`   // who attributed the click, see attribution.go
+	UID       string    `json:"uid,omitempty"`     // the party's user
+}
+
+type ExportConfig struct {
+	Driver        string   `json:"driver"` // "", "kafka", "nats"
+	QueueSize     int      `json:"queue_size"`
+	BatchSize     int      `json:"batch_size"`
+	FlushInterval Duration `json:"flush_interval"`
+	CountryHeader string   `json:"country_header"` // set by the CDN in front, e.g. CF-IPCountry
+	RegionHeader  string   `json:"region_header"`  // e.g. CF-Region-Code
+
+	KafkaRestURL string `json:"kafka_rest_url"`
+	KafkaTopic   string `json:"kafka_topic"`
+
+	NatsAddr     string `json:"nats_addr"`
+	NatsSubject  string `json:"nats_subject"`
+	NatsUser     string `json:"nats_user"`
+	NatsPassword string `json:"nats_password"`
+}
+
+type eventPublisher interface {
+	publish(batch [][]byte) error
+}
+
+type clickExporter struct {
+	queue      chan ClickEvent
+	publisher  eventPublisher
+	batch_size int
+	interval   time.Duration
+
+	dropped uint64
+}
+
+func clickEventOf(req *http.Request, slug string) ClickEvent {
+	ev := ClickEvent{
+		Slug:      slug,
+		Timestamp: time.Now().UTC(),
+		Referrer:  req.Referer(),
+	}
+	if config.Export.CountryHeader != "" {
+		ev.Country = req.Header.Get(config.Export.CountryHeader)
+	}
+	if config.Export.RegionHeader != "" {
+		ev.Region = req.Header.Get(config.Export.RegionHeader)
+	}
+	if config.GDPR.Enabled {
+		ev.Visitor = visitorOf(req)
+	}
+	return ev
+}
+
+// newClickExporter returns nil when exporting is turned off
+func newClickExporter(c ExportConfig) (*clickExporter, error) {
+
+	var publisher eventPublisher
+	switch c.Driver {
+	case "":
+		return nil, nil
+	case "kafka":
+		if c.KafkaRestURL == "" || c.KafkaTopic == "" {
+			return nil, errors.New("Kafka export needs kafka_rest_url and kafka_topic")
+		}
+		publisher = &kafkaRestPublisher{
+			url:    strings.TrimRight(c.KafkaRestURL, "/") + "/topics/" + c.KafkaTopic,
+			client: &http.Client{Timeout: 10 * time.Second},
+		}
+	case "nats":
+		if c.NatsAddr == "" || c.NatsSubject == "" {
+			return nil, errors.New("NATS export needs nats_addr and nats_subject")
+		}
+		publisher = &natsPublisher{addr: c.NatsAddr, subject: c.NatsSubject, user: c.NatsUser, password: c.NatsPassword}
+	default:
+		return nil, fmt.Errorf("Unknown export driver %q", c.Driver)
+	}
+	return startExporter(publisher, c)
+}
+
+// startExporter queues and batches events for any publisher, with the export settings
+func startExporter(publisher eventPublisher, c ExportConfig) (*clickExporter, error) {
+	if c.FlushInterval.Duration <= 0 {
+		return nil, errors.New("Export flush_interval must be positive")
+	}
+	e := &clickExporter{
+		queue:      make(chan ClickEvent, c.QueueSize),
+		publisher:  publisher,
+		batch_size: c.BatchSize,
+		interval:   c.FlushInterval.Duration,
+	}
+	go e.run()
+	return e, nil
+}
+
+// Record never blocks
+func (e *clickExporter) Record(ev ClickEvent) {
+	select {
+	case e.queue <- ev:
+	default:
+		if atomic.AddUint64(&e.dropped, 1)%1000 == 1 {
+			log.Println("Click export queue full, dropping events")
+		}
+	}
+}
+
+func (e *clickExporter) run() {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	batch := make([][]byte, 0, e.batch_size)
+	for {
+		select {
+		case ev := <-e.queue:
+			if b, err := json.Marshal(ev); err == nil {
+				batch = append(batch, b)
+			}
+			if len(batch) < e.batch_size {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		e.flush(batch)
+		batch = batch[:0]
+	}
+}
+
+// flush retries a few times; meanwhile the queue absorbs (or drops) new events
+func (e *clickExporter) flush(batch [][]byte) {
+	backoff := 100 * time.Millisecond
+	for attempt := 0; attempt < 4; attempt++ {
+		err := e.publisher.publish(batch)
+		if err == nil {
+			return
+		}
+		log.Println("Click export failed, attempt", attempt+1, err)
+		time.Sleep(backoff)
+		backoff *= 4
+	}
+	atomic.AddUint64(&e.dropped, uint64(len(batch)))
+}
+
+// kafkaRestPublisher posts to the Confluent REST proxy v2 API
+type kafkaRestPublisher struct {
+	url    string
+	client *http.Client
+}
+
+func (k *kafkaRestPublisher) publish(batch [][]byte) error {
+	var body bytes.Buffer
+	body.WriteString(`{"records":[`)
+	for i, b := range batch {
+		if i > 0 {
+			body.WriteByte(',')
+		}
+		body.WriteString(`{"value":`)
+		body.Write(b)
+		body.WriteByte('}')
+	}
+	body.WriteString(`]}`)
+
+	resp, err := k.client.Post(k.url, "application/vnd.kafka.json.v2+json", &body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Kafka REST proxy answered %s", resp.Status)
+	}
+	return nil
+}
+
+// natsPublisher speaks just enough of the NATS text protocol to PUB, reconnecting as needed
+type natsPublisher struct {
+	addr     string
+	subject  string
+	user     string
+	password string
+
+	mu   sync.Mutex
+	conn net.Conn
+	w    *bufio.Writer
+}
+
+func (n *natsPublisher) connect() error {
+	conn, err := net.DialTimeout("tcp", n.addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if line, err := r.ReadString('\n'); err != nil || !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("Unexpected NATS greeting %q %v", line, err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	connect, _ := json.Marshal(map[string]interface{}{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     "url-shortener",
+		"user":     n.user,
+		"pass":     n.password,
+	})
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "CONNECT %s\r\n", connect)
+	if err := w.Flush(); err != nil {
+		conn.Close()
+		return err
+	}
+	n.conn, n.w = conn, w
+
+	// Answer server PINGs so the connection stays up
+	go func() {
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(line, "PING") {
+				n.mu.Lock()
+				if n.conn == conn {
+					n.w.WriteString("PONG\r\n")
+					n.w.Flush()
+				}
+				n.mu.Unlock()
+			} else if strings.HasPrefix(line, "-ERR") {
+				log.Println("NATS error:", strings.TrimSpace(line))
+			}
+		}
+	}()
+	return nil
+}
+
+func (n *natsPublisher) publish(batch [][]byte) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.conn == nil {
+		if err := n.connect(); err != nil {
+			return err
+		}
+	}
+	for _, b := range batch {
+		fmt.Fprintf(n.w, "PUB %s %d\r\n", n.subject, len(b))
+		n.w.Write(b)
+		n.w.WriteString("\r\n")
+	}
+	if err := n.w.Flush(); err != nil {
+		n.conn.Close()
+		n.conn = nil
+		return err
+	}
+	return nil
+}
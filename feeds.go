@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+// Feeds of a tenant's links expiring within feeds.horizon, as Atom for feed
+// readers and iCalendar for calendars, so owners can renew (click) the ones
+// they still need. Feed readers can't send an API key, so POST /api/v1/feeds
+// hands out URLs carrying a signed token for the caller's tenant.
+
+type FeedsConfig struct {
+	Horizon  Duration `json:"horizon"`
+	TokenTTL Duration `json:"token_ttl"`
+}
+
+const feedTokenPurpose = "feed"
+const maxFeedEntries = 200
+
+func feedToken(tenant string, expires time.Time) string {
+	return signToken(feedTokenPurpose, tenant+"|"+strconv.FormatInt(expires.Unix(), 10))
+}
+
+// feedTenant reads the tenant from ?token=, or from the caller's key or session
+func feedTenant(req *http.Request) (string, bool) {
+	if token := req.FormValue("token"); token != "" {
+		payload, err := verifyToken(feedTokenPurpose, token)
+		if err != nil {
+			return "", false
+		}
+		i := strings.LastIndexByte(payload, '|')
+		expires, err := strconv.ParseInt(payload[i+1:], 10, 64)
+		if i < 0 || err != nil || time.Now().Unix() >= expires {
+			return "", false
+		}
+		return payload[:i], true
+	}
+	identity, ok := identify(req)
+	if !ok || identity.KeyId == "" || !identity.can(roleViewer) {
+		return "", false
+	}
+	return identity.Tenant, true
+}
+
+// expiringLinks lists the tenant's links expiring within horizon, soonest first
+func expiringLinks(redis_db Storage, ctx context.Context, tenant string, horizon time.Duration) ([]ShortUrl, error) {
+	slugs, err := redis_db.ZRange(ctx, keyOfTenantLinks(tenant), 0, -1).Result()
+	if err != nil || len(slugs) == 0 {
+		return nil, err
+	}
+	scores := make([]*redis.FloatCmd, len(slugs))
+	_, err = redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, slug := range slugs {
+			scores[i] = pipe.ZScore(ctx, keyOfExpiresIndex, slug)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	now, until := time.Now().Unix(), time.Now().Add(horizon).Unix()
+	links := []ShortUrl{}
+	for i, slug := range slugs {
+		expires := int64(scores[i].Val())
+		if expires < now || expires > until {
+			continue
+		}
+		su, err := getDetailsOfKey(redis_db, ctx, slug)
+		if err == errSlugNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		links = append(links, su)
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].Expires.Before(links[j].Expires) })
+	if len(links) > maxFeedEntries {
+		links = links[:maxFeedEntries]
+	}
+	return links, nil
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Id      string   `xml:"id"`
+	Title   string   `xml:"title"`
+	Updated string   `xml:"updated"`
+	Link    atomLink `xml:"link"`
+	Summary string   `xml:"summary"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Id      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  string      `xml:"author>name"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+func feedSummary(su ShortUrl) string {
+	s := su.DisplayTarget()
+	if su.Title != "" {
+		s = su.Title + " - " + s
+	}
+	return fmt.Sprintf("%s (%d clicks). A click on the short link renews it.", s, su.Clicks)
+}
+
+func horizonText(d time.Duration) string {
+	if d >= 24*time.Hour && d%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%d days", d/(24*time.Hour))
+	}
+	return d.String()
+}
+
+func writeAtomFeed(w http.ResponseWriter, req *http.Request, tenant string, links []ShortUrl, horizon time.Duration) {
+	self := publicURL(req, req.URL.RequestURI())
+	feed := atomFeed{
+		Id:      "urn:shortener:" + req.Host + ":expiring:" + url.PathEscape(tenant),
+		Title:   "Short links expiring within " + horizonText(horizon),
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Author:  req.Host,
+		Links:   []atomLink{{Href: self, Rel: "self"}},
+		Entries: []atomEntry{},
+	}
+	for _, su := range links {
+		// a new entry each time the link is extended, dated when it came within the horizon
+		feed.Entries = append(feed.Entries, atomEntry{
+			Id:      fmt.Sprintf("urn:shortener:%s:%s:%d", req.Host, su.Slug, su.Expires.Unix()),
+			Title:   su.Slug + " expires " + su.Expires.UTC().Format("2006-01-02 15:04 MST"),
+			Updated: su.Expires.Add(-horizon).UTC().Format(time.RFC3339),
+			Link:    atomLink{Href: publicURL(req, "/"+su.Slug+"?details")},
+			Summary: feedSummary(su),
+		})
+	}
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	fmt.Fprint(w, xml.Header)
+	xml.NewEncoder(w).Encode(feed)
+}
+
+var icsEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`)
+
+// icsLine folds a content line at 75 octets, as RFC 5545 asks, without splitting a character
+func icsLine(b *strings.Builder, line string) {
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		b.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+		limit = 74 // after the leading space
+	}
+	b.WriteString(line + "\r\n")
+}
+
+func writeICalFeed(w http.ResponseWriter, req *http.Request, links []ShortUrl) {
+	const stamp = "20060102T150405Z"
+	var b strings.Builder
+	icsLine(&b, "BEGIN:VCALENDAR")
+	icsLine(&b, "VERSION:2.0")
+	icsLine(&b, "PRODID:-//url-shortener//expiring links//EN")
+	icsLine(&b, "X-WR-CALNAME:"+icsEscaper.Replace("Expiring short links on "+req.Host))
+	for _, su := range links {
+		details := publicURL(req, "/"+su.Slug+"?details")
+		icsLine(&b, "BEGIN:VEVENT")
+		icsLine(&b, fmt.Sprintf("UID:%s-%d@%s", su.Slug, su.Expires.Unix(), req.Host))
+		icsLine(&b, "DTSTAMP:"+time.Now().UTC().Format(stamp))
+		icsLine(&b, "DTSTART:"+su.Expires.UTC().Format(stamp))
+		icsLine(&b, "DURATION:PT15M")
+		icsLine(&b, "SUMMARY:"+icsEscaper.Replace("Short link "+su.Slug+" expires"))
+		icsLine(&b, "DESCRIPTION:"+icsEscaper.Replace(feedSummary(su)))
+		icsLine(&b, "URL:"+details)
+		icsLine(&b, "BEGIN:VALARM")
+		icsLine(&b, "ACTION:DISPLAY")
+		icsLine(&b, "TRIGGER:-PT1H")
+		icsLine(&b, "DESCRIPTION:"+icsEscaper.Replace("Short link "+su.Slug+" expires soon"))
+		icsLine(&b, "END:VALARM")
+		icsLine(&b, "END:VEVENT")
+	}
+	icsLine(&b, "END:VCALENDAR")
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	fmt.Fprint(w, b.String())
+}
+
+func registerFeedRoutes(router *mux.Router, redis_db Storage) {
+	router.HandleFunc("/api/v1/feeds", func(w http.ResponseWriter, req *http.Request) {
+		identity, ok := hasRole(w, req, roleViewer)
+		if !ok {
+			return
+		}
+		if identity.KeyId == "" {
+			writeJSONError(w, http.StatusForbidden, "Feeds are for API keys and signed-in users")
+			return
+		}
+		expires := time.Now().Add(config.Feeds.TokenTTL.Duration)
+		token := url.QueryEscape(feedToken(identity.Tenant, expires))
+		writeJSON(w, http.StatusCreated, map[string]interface{}{
+			"atom":       publicURL(req, "/feeds/expiring.atom?token="+token),
+			"ical":       publicURL(req, "/feeds/expiring.ics?token="+token),
+			"expires_at": expires.UTC(),
+		})
+	}).Methods("POST")
+
+	router.HandleFunc("/feeds/expiring.{format:atom|ics}", func(w http.ResponseWriter, req *http.Request) {
+		tenant, ok := feedTenant(req)
+		if !ok {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "Needs a valid feed token or API key")
+			return
+		}
+		horizon := config.Feeds.Horizon.Duration
+		links, err := expiringLinks(redis_db, req.Context(), tenant, horizon)
+		if err != nil {
+			writeUnavailable(w)
+			return
+		}
+		if mux.Vars(req)["format"] == "ics" {
+			writeICalFeed(w, req, links)
+		} else {
+			writeAtomFeed(w, req, tenant, links, horizon)
+		}
+	}).Methods("GET")
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Server-side fetching of targets, to see where they really lead
+
+type PagePreview struct {
+	FinalURL    string   `json:"final_url"`
+	Redirects   []string `json:"redirects"`
+	Status      int      `json:"status"`
+	Title       string   `json:"title,omitempty"`
+	Description string   `json:"description,omitempty"`
+}
+
+var titlePattern = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+var metaPattern = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+var attributePattern = regexp.MustCompile(`(?is)([a-z:-]+)\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+
+// pageText unescapes and collapses whitespace
+func pageText(s string) string {
+	return strings.Join(strings.Fields(html.UnescapeString(s)), " ")
+}
+
+// metaDescription finds the description, or failing that og:description, among the meta tags
+func metaDescription(body []byte) string {
+	found := map[string]string{}
+	for _, tag := range metaPattern.FindAll(body, -1) {
+		attributes := map[string]string{}
+		for _, m := range attributePattern.FindAllSubmatch(tag, -1) {
+			attributes[strings.ToLower(string(m[1]))] = string(m[2]) + string(m[3])
+		}
+		name := strings.ToLower(attributes["name"] + attributes["property"])
+		if _, seen := found[name]; !seen {
+			found[name] = pageText(attributes["content"])
+		}
+	}
+	if found["description"] != "" {
+		return found["description"]
+	}
+	return found["og:description"]
+}
+
+// fetchPage follows redirects (each hop checked against policy) and reads the page title and description
+func fetchPage(ctx context.Context, target string) (PagePreview, error) {
+	preview := PagePreview{Redirects: []string{}}
+
+	client := outboundClient(true, func(req *http.Request) error {
+		if _, err := validateTarget(req.URL.String()); err != nil {
+			return err
+		}
+		preview.Redirects = append(preview.Redirects, req.URL.String())
+		return nil
+	})
+
+	req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if err != nil {
+		return preview, err
+	}
+	req.Header.Set("User-Agent", "url-shortener-preview/1.0")
+	req.Header.Set("Accept", "text/html,*/*;q=0.5")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return preview, err
+	}
+	defer resp.Body.Close()
+
+	preview.FinalURL = resp.Request.URL.String()
+	preview.Status = resp.StatusCode
+
+	if strings.Contains(resp.Header.Get("Content-Type"), "html") {
+		// a title is near the top; the rest of a large page isn't needed
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, config.Outbound.MaxBytes))
+		if m := titlePattern.FindSubmatch(body); m != nil {
+			preview.Title = pageText(string(m[1]))
+		}
+		preview.Description = metaDescription(body)
+	}
+	return preview, nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// In GDPR mode client IPs are never stored or logged raw. With ips=hash a
+// visitor is known by an HMAC of their IP and User-Agent, keyed with a salt
+// which changes every salt_rotation and is then forgotten, so the same
+// visitor can't be followed from one period to the next. With ips=drop
+// there is no visitor at all, and click dedup counts every click.
+//
+// The salt of each period is gdpr:salt:<period>, shared by the replicas and
+// expiring after the next period. Click events carry the visitor, so
+// DELETE /api/v1/admin/visitors/{visitor} can remove them from the Redis
+// stream and ClickHouse. gdpr.retention caps the analytics retention, see
+// retention.go.
+
+type GDPRConfig struct {
+	Enabled      bool     `json:"enabled"`
+	IPs          string   `json:"ips"` // hash or drop
+	SaltRotation Duration `json:"salt_rotation"`
+	Retention    Duration `json:"retention"` // caps retention.events and retention.hourly; 0 leaves them
+}
+
+const (
+	gdprHashIPs = "hash"
+	gdprDropIPs = "drop"
+)
+
+var visitorPattern = regexp.MustCompile(`^[0-9a-f]{24}$`)
+
+func validateGDPR(c GDPRConfig) error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.IPs != gdprHashIPs && c.IPs != gdprDropIPs {
+		return fmt.Errorf("gdpr.ips must be %s or %s, not %q", gdprHashIPs, gdprDropIPs, c.IPs)
+	}
+	if c.SaltRotation.Duration < time.Minute {
+		return fmt.Errorf("gdpr.salt_rotation must be at least a minute")
+	}
+	if c.Retention.Duration < 0 {
+		return fmt.Errorf("gdpr.retention can't be negative")
+	}
+	return nil
+}
+
+func keyOfVisitorSalt(period int64) string {
+	return "gdpr:salt:" + strconv.FormatInt(period, 10)
+}
+
+// visitorSalts holds the current period's salt, fetched once per period
+type visitorSalts struct {
+	redis_db Storage
+	rotation time.Duration
+
+	mu       sync.Mutex
+	period   int64
+	salt     []byte
+	retry_at time.Time // set while using a salt of this process only
+}
+
+// Set in main when GDPR mode is on
+var visitor_salts *visitorSalts
+
+func newVisitorSalts(redis_db Storage, c GDPRConfig) *visitorSalts {
+	return &visitorSalts{redis_db: redis_db, rotation: c.SaltRotation.Duration}
+}
+
+func (v *visitorSalts) periodOf(at time.Time) int64 {
+	return at.Unix() / int64(v.rotation.Seconds())
+}
+
+// current returns the salt and when it stops being used
+func (v *visitorSalts) current() ([]byte, time.Time) {
+	now := time.Now()
+	period := v.periodOf(now)
+	until := time.Unix((period+1)*int64(v.rotation.Seconds()), 0)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.salt != nil && v.period == period && (v.retry_at.IsZero() || now.Before(v.retry_at)) {
+		return v.salt, until
+	}
+
+	fresh := make([]byte, 32)
+	rand.Read(fresh)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	key := keyOfVisitorSalt(period)
+	// whichever replica gets there first picks the salt
+	v.redis_db.SetNX(ctx, key, hex.EncodeToString(fresh), 2*v.rotation)
+	stored, err := v.redis_db.Get(ctx, key).Result()
+	salt, decode_err := hex.DecodeString(stored)
+	if err != nil || decode_err != nil {
+		// counted apart from the other replicas for a minute, rather than not at all
+		log.Println("Cannot read the visitor salt, using one of this process", err)
+		if v.period != period || v.salt == nil {
+			v.salt = fresh
+		}
+		v.period, v.retry_at = period, now.Add(time.Minute)
+		return v.salt, until
+	}
+	v.period, v.salt, v.retry_at = period, salt, time.Time{}
+	return salt, until
+}
+
+// visitorOf is who a request comes from: in GDPR mode a salted hash, or
+// nothing when IPs are dropped; otherwise a plain hash of IP and User-Agent
+func visitorOf(req *http.Request) string {
+	if !config.GDPR.Enabled {
+		return visitorHash(req)
+	}
+	if config.GDPR.IPs == gdprDropIPs || visitor_salts == nil {
+		return ""
+	}
+	salt, _ := visitor_salts.current()
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(remoteHost(req) + "\x00" + req.UserAgent()))
+	return hex.EncodeToString(mac.Sum(nil)[:12])
+}
+
+// loggedHost is what the access log shows of the client's address
+func loggedHost(req *http.Request) string {
+	if !config.GDPR.Enabled {
+		return remoteHost(req)
+	}
+	if visitor := visitorOf(req); visitor != "" {
+		return visitor
+	}
+	return "-"
+}
+
+// VisitorErasure reports what DELETE /api/v1/admin/visitors/{visitor} removed
+type VisitorErasure struct {
+	Visitor      string `json:"visitor"`
+	StreamEvents int    `json:"stream_events"`
+	DedupKeys    int    `json:"dedup_keys"`
+	ClickHouse   bool   `json:"clickhouse"` // a delete was submitted; ClickHouse applies it in the background
+}
+
+// eraseVisitor deletes the visitor's click events and dedup marks
+func eraseVisitor(redis_db Storage, ctx context.Context, visitor string) (VisitorErasure, error) {
+	r := VisitorErasure{Visitor: visitor}
+	err := scanKeys(redis_db, ctx, keyOfClickDedup("*", visitor), func(keys []string) error {
+		r.DedupKeys += len(keys)
+		return redis_db.Del(ctx, keys...).Err()
+	})
+	if err != nil {
+		return r, err
+	}
+
+	start := "-"
+	for {
+		entries, err := redis_db.XRangeN(ctx, config.Clicks.StreamKey, start, "+", 1000).Result()
+		if err != nil {
+			return r, err
+		}
+		ids := []string{}
+		for _, entry := range entries {
+			var ev ClickEvent
+			data, _ := entry.Values["event"].(string)
+			if json.Unmarshal([]byte(data), &ev) == nil && ev.Visitor == visitor {
+				ids = append(ids, entry.ID)
+			}
+		}
+		if len(ids) > 0 {
+			if err := redis_db.XDel(ctx, config.Clicks.StreamKey, ids...).Err(); err != nil {
+				return r, err
+			}
+			r.StreamEvents += len(ids)
+		}
+		if len(entries) < 1000 {
+			break
+		}
+		start = "(" + entries[len(entries)-1].ID
+	}
+
+	if clickHouseSinkEnabled() {
+		if err := clickHouseExec(config.ClickHouse, "ALTER TABLE "+clickHouseTable(config.ClickHouse)+" DELETE WHERE visitor = '"+visitor+"'"); err != nil {
+			return r, err
+		}
+		r.ClickHouse = true
+	}
+	return r, nil
+}
+
+func clickHouseSinkEnabled() bool {
+	for _, sink := range config.Clicks.Sinks {
+		if sink == "clickhouse" {
+			return true
+		}
+	}
+	return false
+}
+
+func registerPrivacyRoutes(router *mux.Router) {
+	// Visitors can find out their identifier, to ask for their clicks to be erased
+	router.HandleFunc("/api/v1/privacy/visitor", func(w http.ResponseWriter, req *http.Request) {
+		visitor := visitorOf(req)
+		if visitor == "" {
+			writeJSON(w, http.StatusOK, map[string]interface{}{"visitor": nil})
+			return
+		}
+		_, until := visitor_salts.current()
+		writeJSON(w, http.StatusOK, map[string]interface{}{"visitor": visitor, "valid_until": until.UTC()})
+	}).Methods("GET")
+}
+
+func handleEraseVisitor(redis_db Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		visitor := mux.Vars(req)["visitor"]
+		if !visitorPattern.MatchString(visitor) {
+			writeJSONError(w, http.StatusBadRequest, "visitor must be 24 hex digits")
+			return
+		}
+		r, err := eraseVisitor(redis_db, req.Context(), visitor)
+		if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		log.Println("Erased visitor", visitor+":", r.StreamEvents, "stream events,", r.DedupKeys, "dedup keys")
+		writeJSON(w, http.StatusOK, r)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// The geo click sink counts clicks by where they came from, for heat maps:
+// urlgeo:<slug> is a hash of clicks by country ("US") and by country and
+// region ("US-CA"), as the CDN in front reported them on the click event.
+// It expires like the click counters.
+
+var geoCodePattern = regexp.MustCompile(`^[A-Z0-9]{1,3}$`)
+
+type GeoRegion struct {
+	Region string `json:"region"`
+	Clicks int64  `json:"clicks"`
+}
+
+type GeoCountry struct {
+	Country string      `json:"country"`
+	Clicks  int64       `json:"clicks"`
+	Regions []GeoRegion `json:"regions,omitempty"`
+}
+
+type GeoStats struct {
+	Clicks    int64        `json:"clicks"` // of those with a known country
+	Countries []GeoCountry `json:"countries"`
+}
+
+func keyOfSlugGeo(slug string) string {
+	return "urlgeo:" + slug
+}
+
+// geoFieldsOf returns the hash fields a click counts towards, none when its country is unknown
+func geoFieldsOf(ev ClickEvent) []string {
+	country := strings.ToUpper(strings.TrimSpace(ev.Country))
+	if !geoCodePattern.MatchString(country) || country == "XX" {
+		return nil
+	}
+	fields := []string{country}
+	if region := strings.ToUpper(strings.TrimSpace(ev.Region)); geoCodePattern.MatchString(region) {
+		fields = append(fields, country+"-"+region)
+	}
+	return fields
+}
+
+// geoPublisher goes through the export queue like the other publishers
+type geoPublisher struct {
+	redis_db Storage
+}
+
+func (g *geoPublisher) publish(batch [][]byte) error {
+	ctx := context.Background()
+	_, err := g.redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, b := range batch {
+			var ev ClickEvent
+			if json.Unmarshal(b, &ev) != nil {
+				continue
+			}
+			fields := geoFieldsOf(ev)
+			for _, field := range fields {
+				pipe.HIncrBy(ctx, keyOfSlugGeo(ev.Slug), field, 1)
+			}
+			if len(fields) > 0 {
+				expireCounter(pipe, ctx, keyOfSlugGeo(ev.Slug), default_ttl)
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// clickGeo adds up the geo counts of the slugs, most clicks first
+func clickGeo(redis_db Storage, ctx context.Context, slugs []string) (GeoStats, error) {
+	stats := GeoStats{Countries: []GeoCountry{}}
+	hashes := make([]*redis.StringStringMapCmd, len(slugs))
+	_, err := redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, slug := range slugs {
+			hashes[i] = pipe.HGetAll(ctx, keyOfSlugGeo(slug))
+		}
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	countries := map[string]int64{}
+	regions := map[string]map[string]int64{}
+	for _, hash := range hashes {
+		for field, v := range hash.Val() {
+			n, _ := strconv.ParseInt(v, 10, 64)
+			if parts := strings.SplitN(field, "-", 2); len(parts) == 2 {
+				if regions[parts[0]] == nil {
+					regions[parts[0]] = map[string]int64{}
+				}
+				regions[parts[0]][parts[1]] += n
+			} else {
+				countries[field] += n
+				stats.Clicks += n
+			}
+		}
+	}
+
+	for country, clicks := range countries {
+		c := GeoCountry{Country: country, Clicks: clicks}
+		for region, n := range regions[country] {
+			c.Regions = append(c.Regions, GeoRegion{Region: region, Clicks: n})
+		}
+		sort.Slice(c.Regions, func(i, j int) bool {
+			if c.Regions[i].Clicks != c.Regions[j].Clicks {
+				return c.Regions[i].Clicks > c.Regions[j].Clicks
+			}
+			return c.Regions[i].Region < c.Regions[j].Region
+		})
+		stats.Countries = append(stats.Countries, c)
+	}
+	sort.Slice(stats.Countries, func(i, j int) bool {
+		if stats.Countries[i].Clicks != stats.Countries[j].Clicks {
+			return stats.Countries[i].Clicks > stats.Countries[j].Clicks
+		}
+		return stats.Countries[i].Country < stats.Countries[j].Country
+	})
+	return stats, nil
+}
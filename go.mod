@@ -4,7 +4,7 @@ go 1.15
 
 require (
 	github.com/cespare/reflex v0.3.0 // indirect
-	github.com/go-redis/redis/v8 v8.7.1 // indirect
-	github.com/gorilla/handlers v1.5.1 // indirect
-	github.com/gorilla/mux v1.8.0 // indirect
+	github.com/go-redis/redis/v8 v8.7.1
+	github.com/gorilla/handlers v1.5.1
+	github.com/gorilla/mux v1.8.0
 )
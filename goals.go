@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// A link may have a click goal. The click whose INCR brings the counter to
+// the goal or past it sets "goal_reached" in urlmeta: with HSETNX, and
+// whichever click gets to set it posts the webhook, so it's posted once
+// however many replicas count clicks at the same moment. With a redirect, the
+// clicks after the goal go there (a "sold out" page) instead of the target.
+// A new goal through PATCH starts over.
+
+type GoalsConfig struct {
+	WebhookURL string `json:"webhook_url"` // for goals without their own
+}
+
+type LinkGoal struct {
+	Clicks   int64  `json:"clicks"`
+	Redirect string `json:"redirect,omitempty"` // for the clicks past the goal
+	Webhook  string `json:"webhook,omitempty"`  // goals.webhook_url when empty
+}
+
+var goals_reached = newCounter("shortener_goals_reached_total", "Links whose click goal was reached")
+
+func goalOfMeta(encoded string) *LinkGoal {
+	if encoded == "" {
+		return nil
+	}
+	var g LinkGoal
+	if err := json.Unmarshal([]byte(encoded), &g); err != nil || g.Clicks <= 0 {
+		return nil
+	}
+	return &g
+}
+
+func validateGoal(g LinkGoal) error {
+	if g.Clicks <= 0 {
+		return fmt.Errorf("goal.clicks must be positive")
+	}
+	if g.Redirect != "" {
+		if _, err := validateTarget(g.Redirect); err != nil {
+			return fmt.Errorf("goal.redirect: %v", err)
+		}
+	}
+	if g.Webhook != "" {
+		if _, err := validateTarget(g.Webhook); err != nil {
+			return fmt.Errorf("goal.webhook: %v", err)
+		}
+	}
+	return nil
+}
+
+// setGoal replaces the link's goal, or removes it when nil, forgetting it was reached
+func setGoal(redis_db Storage, ctx context.Context, slug string, g *LinkGoal) error {
+	_, err := redis_db.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, keyOfSlugMeta(slug), "goal_reached")
+		touchLink(pipe, ctx, slug)
+		if g == nil {
+			pipe.HDel(ctx, keyOfSlugMeta(slug), "goal")
+			return nil
+		}
+		encoded, _ := json.Marshal(g)
+		pipe.HSet(ctx, keyOfSlugMeta(slug), "goal", string(encoded))
+		return nil
+	})
+	if err == nil {
+		// clicks the edge answers wouldn't count toward it
+		purgeLinks(slug)
+	}
+	return err
+}
+
+// goalTarget is where a click which brought the link's counter to count goes.
+// The first click at or past the goal marks it reached and posts the webhook.
+func goalTarget(redis_db Storage, ctx context.Context, slug string, target string, g *LinkGoal, count int64) string {
+	if g == nil || count < g.Clicks {
+		return target
+	}
+	now := time.Now()
+	first, err := redis_db.HSetNX(ctx, keyOfSlugMeta(slug), "goal_reached", now.Unix()).Result()
+	if err != nil {
+		log.Println("Cannot mark the goal of", slug, "reached", err)
+	} else if first {
+		goals_reached.Add(1)
+		log.Println("Link", slug, "reached its goal of", g.Clicks, "clicks")
+		go notifyGoal(slug, *g, count, now)
+	}
+	if count > g.Clicks && g.Redirect != "" {
+		return g.Redirect
+	}
+	return target
+}
+
+func notifyGoal(slug string, g LinkGoal, count int64, reached time.Time) {
+	payload := map[string]interface{}{
+		"event":   "click_goal_reached",
+		"slug":    slug,
+		"goal":    g.Clicks,
+		"clicks":  count,
+		"reached": reached.UTC(),
+	}
+	var err error
+	if g.Webhook != "" {
+		// the link's own webhook is the creator's choice of URL, so it goes through the outbound checks
+		err = postWebhookVia(outboundClient(false, nil), g.Webhook, payload)
+	} else if config.Goals.WebhookURL != "" {
+		err = postWebhook(config.Goals.WebhookURL, payload)
+	}
+	if err != nil {
+		log.Println("Goal webhook of", slug, "failed", err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// In go-links mode, links are also reached by keyword: go/payroll, go/Pay-Roll
+// and "go/pay roll" are all the same link. A keyword is folded to lowercase
+// without separators and stored as an alias, so it resolves like any other.
+// Asking for a keyword which doesn't exist answers a page offering to create
+// it.
+
+type GoLinksConfig struct {
+	Enabled bool `json:"enabled"`
+}
+
+var keywordPattern = regexp.MustCompile(`^[0-9a-z]{2,64}$`)
+
+// keywordOf folds case and drops '-', '_', '.' and spaces
+func keywordOf(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '-', '_', '.', ' ':
+			return -1
+		}
+		return r
+	}, strings.ToLower(s))
+}
+
+func keywordIsValid(keyword string) bool {
+	return keywordPattern.MatchString(keyword)
+}
+
+// checkKeyword applies the squatting checks aliases get
+func checkKeyword(redis_db Storage, ctx context.Context, identity Identity, keyword string) error {
+	if !identity.can(roleAdmin) {
+		squatting, err := squattingOf(redis_db, ctx, keyword)
+		if err != nil {
+			return err
+		}
+		if squatting != "" {
+			log.Println("Suspicious keyword", squatting, "by", identity.KeyId)
+			if config.Squatting.Action != "warn" {
+				return KeywordRefusedError{squatting}
+			}
+		}
+	}
+	return nil
+}
+
+// KeywordRefusedError carries why a keyword looks like squatting
+type KeywordRefusedError struct {
+	Reason string
+}
+
+func (e KeywordRefusedError) Error() string {
+	return e.Reason
+}
+
+type KeywordPage struct {
+	Keyword   string
+	CanCreate bool
+	CSRFToken string
+}
+
+// goLinkNotFound sends a keyword written another way to its folded form, or
+// offers to create it. It answers 404 for anything which can't be a keyword.
+func goLinkNotFound(w http.ResponseWriter, req *http.Request, requested string) {
+	keyword := keywordOf(requested)
+	if !keywordIsValid(keyword) {
+		writeLocalizedError(w, req, http.StatusNotFound, "Slug not found")
+		return
+	}
+	if keyword != requested {
+		destination := "/" + keyword
+		if req.URL.RawQuery != "" {
+			destination += "?" + req.URL.RawQuery
+		}
+		http.Redirect(w, req, destination, http.StatusFound)
+		return
+	}
+
+	identity, known := identify(req)
+	page := KeywordPage{Keyword: keyword, CanCreate: known && identity.can(roleEditor)}
+	if page.CanCreate {
+		page.CSRFToken = csrfToken(w, req)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	setLanguage(w, req)
+	w.WriteHeader(http.StatusNotFound)
+	renderPage(w, req, "keyword.html", viewerBranding(req), page)
+}
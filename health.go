@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// /healthz answers as long as the process serves HTTP; /readyz also needs
+// Redis. Its ping goes through the circuit breaker, so it can be the probe.
+// Shards being down doesn't make it fail, as the other links still work: they
+// are listed instead.
+func registerHealthRoutes(router *mux.Router, redis_db Storage, breaker *circuitBreaker) {
+
+	router.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "ok")
+	}).Methods("GET")
+
+	router.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		if err := redis_db.Ping(req.Context()).Err(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "Redis unavailable (circuit %s): %v", circuitStateNames[breaker.State()], err)
+			return
+		}
+		if down := shard_health.down(); len(down) > 0 {
+			fmt.Fprintf(w, "ok, shards down: %s", strings.Join(down, ", "))
+			return
+		}
+		fmt.Fprintf(w, "ok")
+	}).Methods("GET")
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+// A honeypot is a slug which looks like any other but is never shared, so
+// nobody following it found it honestly: it was guessed, or scraped from
+// somewhere it was planted. Following one answers 404 like any missing slug,
+// and, with abuse enabled, flags the client and does abuse.honeypot_action:
+// flag only, backoff (a strike at once), or block on every route.
+//
+// honeypot:<slug> holds the hits on it. While it's there, the name is taken,
+// as a reservation takes one: no link or alias is created under it.
+
+func keyOfHoneypot(slug string) string {
+	return "honeypot:" + slug
+}
+
+var honeypot_hits = newCounter("shortener_honeypot_hits_total", "Honeypot slugs followed, by action taken")
+
+// KEYS: honeypot, url, alias, reserved
+var seedHoneypotScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[2]) == 1 or redis.call("EXISTS", KEYS[3]) == 1 or redis.call("EXISTS", KEYS[4]) == 1 then
+	return 0
+end
+return redis.call("SETNX", KEYS[1], 0)
+`)
+
+// seedHoneypot reports false when slug is taken, by a link or otherwise
+func seedHoneypot(redis_db Storage, ctx context.Context, slug string) (bool, error) {
+	keys := []string{keyOfHoneypot(slug), keyOfSlug(slug), keyOfAlias(slug), keyOfReservation(slug)}
+	seeded, err := seedHoneypotScript.Run(ctx, redis_db, keys).Int()
+	return seeded == 1, err
+}
+
+type Honeypot struct {
+	Slug string `json:"slug"`
+	Hits int64  `json:"hits"`
+}
+
+func listHoneypots(redis_db Storage, ctx context.Context) ([]Honeypot, error) {
+	honeypots := []Honeypot{}
+	err := scanKeys(redis_db, ctx, keyOfHoneypot("*"), func(keys []string) error {
+		hits, err := redis_db.MGet(ctx, keys...).Result()
+		if err != nil {
+			return err
+		}
+		for i, key := range keys {
+			h := Honeypot{Slug: strings.TrimPrefix(key, keyOfHoneypot(""))}
+			if s, ok := hits[i].(string); ok {
+				h.Hits, _ = strconv.ParseInt(s, 10, 64)
+			}
+			honeypots = append(honeypots, h)
+		}
+		return nil
+	})
+	return honeypots, err
+}
+
+// caughtInHoneypot is called for a slug which wasn't found, and reports
+// whether it was a honeypot. Hits are written to writes_db.
+func caughtInHoneypot(redis_db Storage, writes_db Storage, req *http.Request, slug string) bool {
+	if abuse == nil || !slugIsValid(slug) {
+		return false
+	}
+	ctx := req.Context()
+	if n, err := redis_db.Exists(ctx, keyOfHoneypot(slug)).Result(); err != nil || n == 0 {
+		return false
+	}
+	ip, now := remoteHost(req), time.Now()
+	if abuse.exempted(ip) {
+		return true
+	}
+	action := abuse.c.HoneypotAction
+	_, err := writes_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Incr(ctx, keyOfHoneypot(slug))
+		pipe.ZAdd(ctx, keyOfFlaggedClients, &redis.Z{Score: float64(now.Unix()), Member: ip})
+		pipe.ZRemRangeByScore(ctx, keyOfFlaggedClients, "-inf", strconv.FormatInt(now.Add(-abuse.c.Forgive.Duration).Unix(), 10))
+		if action == "block" {
+			pipe.ZAdd(ctx, keyOfBlockedClients, &redis.Z{Score: float64(now.Add(abuse.c.BlockFor.Duration).Unix()), Member: ip})
+			pipe.ZRemRangeByScore(ctx, keyOfBlockedClients, "-inf", strconv.FormatInt(now.Unix(), 10))
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("Cannot flag", loggedHost(req), "for honeypot", slug, err)
+	}
+	event := map[string]interface{}{
+		"event":  "honeypot_hit",
+		"client": loggedHost(req),
+		"slug":   slug,
+		"action": action,
+	}
+	switch action {
+	case "backoff":
+		backoff, strikes := abuse.strike(ip, now)
+		event["strikes"], event["until"] = strikes, now.Add(backoff).UTC()
+	case "block":
+		until := now.Add(abuse.c.BlockFor.Duration)
+		abuse.block(ip, until)
+		event["until"] = until.UTC()
+	}
+	honeypot_hits.Inc("action", action)
+	log.Println("Honeypot", slug, "followed by", loggedHost(req), "action", action)
+	notifyAbuse(event)
+	return true
+}
+
+type FlaggedClient struct {
+	IP string    `json:"ip"`
+	At time.Time `json:"at"` // the last honeypot it followed
+}
+
+func flaggedClients(redis_db Storage, ctx context.Context) ([]FlaggedClient, error) {
+	zs, err := redis_db.ZRevRangeWithScores(ctx, keyOfFlaggedClients, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	flagged := make([]FlaggedClient, len(zs))
+	for i, z := range zs {
+		flagged[i] = FlaggedClient{IP: z.Member.(string), At: time.Unix(int64(z.Score), 0).UTC()}
+	}
+	return flagged, nil
+}
+
+// The most honeypots seeded in one request
+const maxHoneypotsSeeded = 1000
+
+func registerAbuseRoutes(router *mux.Router, redis_db Storage) {
+
+	router.HandleFunc("/honeypots", func(w http.ResponseWriter, req *http.Request) {
+		honeypots, err := listHoneypots(redis_db, req.Context())
+		if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, honeypots)
+	}).Methods("GET")
+
+	// Seeds the slugs given, and count more at random
+	router.HandleFunc("/honeypots", func(w http.ResponseWriter, req *http.Request) {
+		var body struct {
+			Count int      `json:"count"`
+			Slugs []string `json:"slugs"`
+		}
+		if err := readJSON(w, req, &body); err != nil || body.Count < 0 || body.Count+len(body.Slugs) == 0 || body.Count+len(body.Slugs) > maxHoneypotsSeeded {
+			writeJSONError(w, http.StatusBadRequest, "Expected {\"count\": ...} or {\"slugs\": [...]}, at most "+strconv.Itoa(maxHoneypotsSeeded))
+			return
+		}
+		for _, slug := range body.Slugs {
+			if slug == "" || !slugIsValid(slug) {
+				writeJSONError(w, http.StatusBadRequest, "Not a valid slug: "+slug)
+				return
+			}
+		}
+		seeded := []string{}
+		seed := func(slug string) (bool, error) {
+			ok, err := seedHoneypot(redis_db, req.Context(), slug)
+			if ok {
+				seeded = append(seeded, slug)
+			}
+			return ok, err
+		}
+		for _, slug := range body.Slugs {
+			if ok, err := seed(slug); err != nil {
+				writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+				return
+			} else if !ok {
+				writeJSONError(w, http.StatusConflict, "Slug taken: "+slug)
+				return
+			}
+		}
+		for i := 0; i < body.Count; i++ {
+			// a random slug is seldom taken; when it is, another is picked
+			for tries := 0; ; tries++ {
+				ok, err := seed(randomSlug())
+				if err != nil {
+					writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+					return
+				} else if ok {
+					break
+				} else if tries == 10 {
+					writeJSONError(w, http.StatusServiceUnavailable, "No free slug found")
+					return
+				}
+			}
+		}
+		identity, _ := identify(req)
+		log.Println("Seeded", len(seeded), "honeypots by", identity.KeyId)
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"seeded": seeded})
+	}).Methods("POST")
+
+	router.HandleFunc("/honeypots/{slug:[0-9A-Za-z]+}", func(w http.ResponseWriter, req *http.Request) {
+		slug := mux.Vars(req)["slug"]
+		n, err := redis_db.Del(req.Context(), keyOfHoneypot(slug)).Result()
+		if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		} else if n == 0 {
+			writeJSONError(w, http.StatusNotFound, "No such honeypot")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("DELETE")
+
+	router.HandleFunc("/abuse", func(w http.ResponseWriter, req *http.Request) {
+		blocked, err := blockedClients(redis_db, req.Context(), time.Now())
+		if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		flagged, err := flaggedClients(redis_db, req.Context())
+		if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"blocked": blocked, "flagged": flagged})
+	}).Methods("GET")
+
+	// Other replicas stop refusing it when they next read the blocklist
+	router.HandleFunc("/abuse/blocked/{ip}", func(w http.ResponseWriter, req *http.Request) {
+		ip := mux.Vars(req)["ip"]
+		n, err := redis_db.ZRem(req.Context(), keyOfBlockedClients, ip).Result()
+		if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		} else if n == 0 {
+			writeJSONError(w, http.StatusNotFound, "Not blocked")
+			return
+		}
+		if abuse != nil {
+			abuse.unblock(ip)
+		}
+		identity, _ := identify(req)
+		log.Println("Unblocked", ip, "by", identity.KeyId)
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("DELETE")
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Pages and the redirect's error messages are written in English, and looked
+// up in the catalog of the visitor's language: locales.dir/<language>.json,
+// mapping each English message to its translation. The language is the first
+// of Accept-Language with a catalog, trying "de" for "de-CH", else
+// locales.default. Messages missing from a catalog stay in English. Messages
+// with values in them are format strings: "%v clicks" translates the same.
+
+type LocalesConfig struct {
+	Default string `json:"default"`
+	Dir     string `json:"dir"`
+}
+
+const sourceLocale = "en"
+
+// Loaded in main from locales.dir; English has none
+var catalogs = map[string]map[string]string{}
+
+func loadCatalogs(c LocalesConfig) error {
+	files, err := filepath.Glob(filepath.Join(c.Dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		catalog := map[string]string{}
+		if err := json.Unmarshal(data, &catalog); err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		catalogs[strings.ToLower(strings.TrimSuffix(filepath.Base(file), ".json"))] = catalog
+	}
+	if _, ok := catalogs[c.Default]; !ok && c.Default != sourceLocale {
+		return fmt.Errorf("locales.default is %q, which has no catalog in %s", c.Default, c.Dir)
+	}
+	return nil
+}
+
+func hasLocale(locale string) bool {
+	_, ok := catalogs[locale]
+	return ok || locale == sourceLocale
+}
+
+// localeOf negotiates the language of the answer from Accept-Language
+func localeOf(req *http.Request) string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	tags := []weighted{}
+	for _, part := range strings.Split(req.Header.Get("Accept-Language"), ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			if v := strings.TrimSpace(param); strings.HasPrefix(v, "q=") {
+				if parsed, err := strconv.ParseFloat(v[2:], 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if q > 0 {
+			tags = append(tags, weighted{tag, q})
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool {
+		return tags[i].q > tags[j].q
+	})
+	for _, t := range tags {
+		if hasLocale(t.tag) {
+			return t.tag
+		}
+		if base := strings.SplitN(t.tag, "-", 2)[0]; hasLocale(base) {
+			return base
+		}
+	}
+	return config.Locales.Default
+}
+
+// translate formats message, as written in the locale's catalog
+func translate(locale string, message string, args ...interface{}) string {
+	if translated, ok := catalogs[locale][message]; ok && translated != "" {
+		message = translated
+	}
+	if len(args) == 0 {
+		return message
+	}
+	return fmt.Sprintf(message, args...)
+}
+
+// setLanguage says which language the answer is in, and that caches must
+// tell requests apart by Accept-Language; it's called before any page or
+// localized message is written
+func setLanguage(w http.ResponseWriter, req *http.Request) string {
+	locale := localeOf(req)
+	w.Header().Set("Content-Language", locale)
+	w.Header().Add("Vary", "Accept-Language")
+	return locale
+}
+
+// localize is translate in the language of the request
+func localize(req *http.Request, message string, args ...interface{}) string {
+	return translate(localeOf(req), message, args...)
+}
+
+// writeLocalizedError answers a plain text error in the visitor's language
+func writeLocalizedError(w http.ResponseWriter, req *http.Request, status int, message string, args ...interface{}) {
+	locale := setLanguage(w, req)
+	w.WriteHeader(status)
+	fmt.Fprint(w, translate(locale, message, args...))
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode"
+)
+
+// Internationalized hostnames are stored in their ASCII (punycode, RFC 3492)
+// form and shown in their Unicode form. A label mixing scripts (other than
+// the usual CJK combinations), or made only of letters which pass for Latin
+// ones, is a likely homograph: the details page flags it, policy can refuse
+// mixed-script hosts outright, and policy.homograph_interstitial shows a
+// warning page before redirecting to one.
+
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+)
+
+var errPunycode = errors.New("Invalid punycode")
+
+func punyAdapt(delta int, points int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / points
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
+
+func punyThreshold(k int, bias int) int {
+	switch {
+	case k <= bias:
+		return punyTMin
+	case k >= bias+punyTMax:
+		return punyTMax
+	}
+	return k - bias
+}
+
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func punyEncode(label string) string {
+	input := []rune(label)
+	var out []byte
+	for _, r := range input {
+		if r < 0x80 {
+			out = append(out, byte(r))
+		}
+	}
+	basic := len(out)
+	if basic > 0 {
+		out = append(out, '-')
+	}
+
+	n, delta, bias := punyInitialN, 0, punyInitialBias
+	for h := basic; h < len(input); {
+		m := int(unicode.MaxRune) + 1
+		for _, r := range input {
+			if int(r) >= n && int(r) < m {
+				m = int(r)
+			}
+		}
+		delta += (m - n) * (h + 1)
+		n = m
+		for _, r := range input {
+			if int(r) < n {
+				delta++
+			}
+			if int(r) != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := punyThreshold(k, bias)
+				if q < t {
+					break
+				}
+				out = append(out, punyDigit(t+(q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out = append(out, punyDigit(q))
+			bias = punyAdapt(delta, h+1, h == basic)
+			delta = 0
+			h++
+		}
+		delta++
+		n++
+	}
+	return string(out)
+}
+
+func punyDecode(s string) (string, error) {
+	var output []rune
+	pos := 0
+	if b := strings.LastIndexByte(s, '-'); b >= 0 {
+		for _, c := range s[:b] {
+			if c >= 0x80 {
+				return "", errPunycode
+			}
+			output = append(output, c)
+		}
+		pos = b + 1
+	}
+
+	n, i, bias := punyInitialN, 0, punyInitialBias
+	for pos < len(s) {
+		old_i, w := i, 1
+		for k := punyBase; ; k += punyBase {
+			if pos >= len(s) {
+				return "", errPunycode
+			}
+			c := s[pos]
+			pos++
+			var digit int
+			switch {
+			case c >= 'a' && c <= 'z':
+				digit = int(c - 'a')
+			case c >= 'A' && c <= 'Z':
+				digit = int(c - 'A')
+			case c >= '0' && c <= '9':
+				digit = int(c-'0') + 26
+			default:
+				return "", errPunycode
+			}
+			i += digit * w
+			if i > 1<<30 {
+				return "", errPunycode
+			}
+			t := punyThreshold(k, bias)
+			if digit < t {
+				break
+			}
+			w *= punyBase - t
+		}
+		bias = punyAdapt(i-old_i, len(output)+1, old_i == 0)
+		n += i / (len(output) + 1)
+		i %= len(output) + 1
+		if n > unicode.MaxRune {
+			return "", errPunycode
+		}
+		output = append(output[:i], append([]rune{rune(n)}, output[i:]...)...)
+		i++
+	}
+	return string(output), nil
+}
+
+// hostToASCII punycodes the labels of host which aren't ASCII
+func hostToASCII(host string) string {
+	labels := strings.Split(host, ".")
+	for i, label := range labels {
+		for _, r := range label {
+			if r >= 0x80 {
+				labels[i] = "xn--" + punyEncode(strings.ToLower(label))
+				break
+			}
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// hostToUnicode decodes punycoded labels, leaving any it can't decode as they are
+func hostToUnicode(host string) string {
+	labels := strings.Split(host, ".")
+	for i, label := range labels {
+		if strings.HasPrefix(strings.ToLower(label), "xn--") {
+			if decoded, err := punyDecode(label[4:]); err == nil {
+				labels[i] = decoded
+			}
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// asciiTarget rewrites an internationalized host in target to its ASCII form
+func asciiTarget(target string) string {
+	u, err := url.Parse(target)
+	if err != nil {
+		return target
+	}
+	host := u.Hostname()
+	ascii := hostToASCII(host)
+	if ascii == host {
+		return target
+	}
+	if port := u.Port(); port != "" {
+		u.Host = ascii + ":" + port
+	} else {
+		u.Host = ascii
+	}
+	return u.String()
+}
+
+// Scripts which commonly share a label
+var scriptFamilies = [][]string{
+	{"Latin", "Han", "Hiragana", "Katakana"},
+	{"Latin", "Han", "Hangul"},
+	{"Latin", "Han", "Bopomofo"},
+}
+
+// Letters of other scripts which look like Latin ones
+const latinLookalikes = "аеорсухіјѕԁһӏԛԝΑΒΕΖΗΙΚΜΝΟΡΤΥΧανορτυχ"
+
+func labelScripts(label string) map[string]bool {
+	scripts := map[string]bool{}
+	for _, r := range label {
+		if r < 0x80 && !unicode.IsLetter(r) {
+			continue
+		}
+		for name, table := range unicode.Scripts {
+			if name != "Common" && name != "Inherited" && unicode.Is(table, r) {
+				scripts[name] = true
+				break
+			}
+		}
+	}
+	return scripts
+}
+
+func mixedScript(label string) bool {
+	scripts := labelScripts(label)
+	if len(scripts) <= 1 {
+		return false
+	}
+	for _, family := range scriptFamilies {
+		within := true
+		for s := range scripts {
+			within = within && containsString(family, s)
+		}
+		if within {
+			return false
+		}
+	}
+	return true
+}
+
+func latinLookalike(label string) bool {
+	for _, r := range label {
+		if r >= 0x80 && !strings.ContainsRune(latinLookalikes, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// hostMixesScripts is true when a label of the (ASCII or Unicode) host mixes scripts
+func hostMixesScripts(host string) bool {
+	for _, label := range strings.Split(hostToUnicode(host), ".") {
+		if mixedScript(label) {
+			return true
+		}
+	}
+	return false
+}
+
+// likelyHomograph is true for hosts with a mixed-script label, or one which only looks Latin
+func likelyHomograph(host string) bool {
+	for _, label := range strings.Split(hostToUnicode(host), ".") {
+		if mixedScript(label) {
+			return true
+		}
+		non_ascii := false
+		for _, r := range label {
+			non_ascii = non_ascii || r >= 0x80
+		}
+		if non_ascii && latinLookalike(label) {
+			return true
+		}
+	}
+	return false
+}
+
+func hostOfTarget(target string) string {
+	if u, err := url.Parse(target); err == nil {
+		return u.Hostname()
+	}
+	return ""
+}
+
+// DisplayTarget shows the target with its host in Unicode
+func (su ShortUrl) DisplayTarget() string {
+	host := hostOfTarget(su.Target)
+	if unicode_host := hostToUnicode(host); unicode_host != host {
+		return strings.Replace(su.Target, host, unicode_host, 1)
+	}
+	return su.Target
+}
+
+func (su ShortUrl) Homograph() bool {
+	return likelyHomograph(hostOfTarget(su.Target))
+}
+
+// writeHomographWarning is shown instead of redirecting to a likely homograph
+func writeHomographWarning(w http.ResponseWriter, req *http.Request, su ShortUrl) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	setLanguage(w, req)
+	w.Header().Set("Cache-Control", "no-store")
+	renderPage(w, req, "interstitial.html", brandingOf(su.Tenant), su)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Secondary indexes, so listings can be sorted without scanning every key.
+// Links expire on their own while their index entries don't; readers drop
+// entries whose link is gone as they come across them.
+
+const keyOfCreatedIndex = "idx:created"
+const keyOfClicksIndex = "idx:clicks"
+const keyOfExpiresIndex = "idx:expires"
+const keyOfLastClickIndex = "idx:last_click"
+
+var linkIndexes = map[string]string{
+	"recent": keyOfCreatedIndex,
+	"clicks": keyOfClicksIndex,
+}
+
+func indexNewLink(pipe redis.Pipeliner, ctx context.Context, slug string, created time.Time, expires time.Time) {
+	pipe.ZAdd(ctx, keyOfCreatedIndex, &redis.Z{Score: float64(created.Unix()), Member: slug})
+	pipe.ZAddNX(ctx, keyOfClicksIndex, &redis.Z{Score: 0, Member: slug})
+	pipe.ZAdd(ctx, keyOfExpiresIndex, &redis.Z{Score: float64(expires.Unix()), Member: slug})
+}
+
+// indexClick is called with the link's new expiry, as clicks extend the TTL
+func indexClick(pipe redis.Pipeliner, ctx context.Context, slug string, at time.Time, expires time.Time) {
+	pipe.ZIncrBy(ctx, keyOfClicksIndex, 1, slug)
+	pipe.ZAdd(ctx, keyOfExpiresIndex, &redis.Z{Score: float64(expires.Unix()), Member: slug})
+	pipe.ZAdd(ctx, keyOfLastClickIndex, &redis.Z{Score: float64(at.Unix()), Member: slug})
+}
+
+func unindexLinks(pipe redis.Pipeliner, ctx context.Context, slugs ...string) {
+	members := make([]interface{}, len(slugs))
+	for i, slug := range slugs {
+		members[i] = slug
+	}
+	for _, index := range linkIndexes {
+		pipe.ZRem(ctx, index, members...)
+	}
+	pipe.ZRem(ctx, keyOfExpiresIndex, members...)
+	pipe.ZRem(ctx, keyOfLastClickIndex, members...)
+}
+
+// sortedLinks reads a page of an index, highest score first. Like
+// sampleExisting it returns the cursor (here an offset) of the next page.
+func sortedLinks(redis_db Storage, ctx context.Context, index string, offset uint64, page_size int) ([]ShortUrl, uint64, error) {
+	r := []ShortUrl{}
+
+	slugs, err := redis_db.ZRevRange(ctx, index, int64(offset), int64(offset)+int64(page_size)-1).Result()
+	if err != nil {
+		return r, offset, err
+	}
+
+	exists := make([]*redis.IntCmd, len(slugs))
+	_, err = redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, slug := range slugs {
+			exists[i] = pipe.Exists(ctx, keyOfSlug(slug))
+		}
+		return nil
+	})
+	if err != nil {
+		return r, offset, err
+	}
+
+	gone := []string{}
+	for i, slug := range slugs {
+		if exists[i].Val() == 0 {
+			gone = append(gone, slug)
+			continue
+		}
+		su, err := getDetailsOfKey(redis_db, ctx, slug)
+		if err == nil {
+			r = append(r, su)
+		} else if err != errSlugNotFound {
+			return r, offset, err
+		}
+	}
+	if len(gone) > 0 {
+		redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			unindexLinks(pipe, ctx, gone...)
+			return nil
+		})
+	}
+
+	if len(slugs) < page_size {
+		return r, 0, nil
+	}
+	// the removed entries shifted everything after them up
+	return r, offset + uint64(page_size-len(gone)), nil
+}
+
+// listLinks pages through links either in SCAN order (sort "") or by an index
+func listLinks(redis_db Storage, ctx context.Context, sort string, cursor uint64, page_size int) ([]ShortUrl, uint64, error) {
+	if sort == "" {
+		return sampleExisting(redis_db, ctx, cursor, page_size)
+	}
+	index, ok := linkIndexes[sort]
+	if !ok {
+		return nil, 0, errors.New("sort must be recent or clicks")
+	}
+	return sortedLinks(redis_db, ctx, index, cursor, page_size)
+}
+
+// reindexLinks adds every existing link to the indexes, for links created before them
+func reindexLinks(redis_db Storage, ctx context.Context) (int, error) {
+	count := 0
+	var cursor uint64
+	for {
+		keys, next, err := redis_db.Scan(ctx, cursor, keyOfSlug("*"), 500).Result()
+		if err != nil {
+			return count, err
+		}
+		for _, key := range keys {
+			slug, err := slugFromKey(key)
+			if err != nil {
+				continue
+			}
+			su, err := getDetailsOfKey(redis_db, ctx, slug)
+			if err != nil {
+				continue
+			}
+			created := su.Created
+			if created.IsZero() {
+				created = time.Now()
+			}
+			redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.ZAddNX(ctx, keyOfCreatedIndex, &redis.Z{Score: float64(created.Unix()), Member: slug})
+				pipe.ZAdd(ctx, keyOfClicksIndex, &redis.Z{Score: float64(su.Clicks), Member: slug})
+				pipe.ZAdd(ctx, keyOfExpiresIndex, &redis.Z{Score: float64(time.Now().Add(su.Ttl).Unix()), Member: slug})
+				return nil
+			})
+			count++
+		}
+		cursor = next
+		if cursor == 0 {
+			return count, nil
+		}
+	}
+}
+
+// pruneExpiresIndex drops the entries of links which already expired, which
+// would otherwise pile up; readers count from now on regardless
+func pruneExpiresIndex(redis_db Storage, ctx context.Context, now time.Time) (int64, error) {
+	return redis_db.ZRemRangeByScore(ctx, keyOfExpiresIndex, "-inf", "("+strconv.FormatInt(now.Unix(), 10)).Result()
+}
+
+func expiresIndexJob(redis_db Storage) scheduledJob {
+	return scheduledJob{name: "prune-expires-index", schedule: "@hourly", run: func(ctx context.Context) error {
+		pruned, err := pruneExpiresIndex(redis_db, ctx, time.Now())
+		if pruned > 0 {
+			log.Println("Pruned", pruned, "expired links from", keyOfExpiresIndex)
+		}
+		return err
+	}}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// The integrity job checks the keyspace for what a write cut short, or a
+// bug, leaves behind, so it's caught before visitors are: links the expiry
+// index says should still be there, aliases to links which are gone,
+// counters which aren't numbers, and keys whose TTL breaks the policy. It
+// only reports; purge-orphans is what cleans up. Entries left behind by links
+// which simply expired aren't violations, as indexes are cleaned lazily.
+
+const keyOfIntegrityReport = "integrity:report"
+
+// Slack for the time between a check and a write, and for clocks
+const integrityGrace = time.Minute
+
+var integrityInvariants = []string{
+	"indexed_without_link", // in idx:expires with a future expiry, but no url: key
+	"alias_without_link",   // alias: holding nothing, or a slug with no url: key
+	"counter_not_numeric",  // a count or series bucket which isn't an integer
+	"link_without_ttl",     // a url: key which never expires
+	"link_ttl_too_long",    // a url: key expiring later than its link's TTL allows
+	"counter_without_ttl",  // a counter which never expires, while counters should
+}
+
+type IntegrityReport struct {
+	Checked    time.Time      `json:"checked"`
+	Took       Duration       `json:"took"`
+	Links      int            `json:"links"`
+	Violations map[string]int `json:"violations"` // by invariant
+	Sample     []string       `json:"sample"`
+}
+
+func (r *IntegrityReport) violation(invariant string, what string) {
+	r.Violations[invariant]++
+	if len(r.Sample) < 50 {
+		r.Sample = append(r.Sample, invariant+" "+what)
+	}
+}
+
+var integrity_violations = newGauge("shortener_integrity_violations", "Keyspace invariants the last integrity run found broken, by invariant")
+
+// isReplyError is true for an error Redis answered, such as WRONGTYPE, rather than one reaching it
+func isReplyError(err error) bool {
+	_, ok := err.(redis.Error)
+	return ok && err != redis.Nil
+}
+
+func isInteger(s string) bool {
+	_, err := strconv.ParseInt(s, 10, 64)
+	return err == nil
+}
+
+// checkLinkTTLs checks every url: key expires, and not later than its link's TTL allows
+func checkLinkTTLs(redis_db Storage, ctx context.Context, r *IntegrityReport) error {
+	return scanKeys(redis_db, ctx, keyOfSlug("*"), func(keys []string) error {
+		ttls := make([]*redis.DurationCmd, len(keys))
+		link_ttls := make([]*redis.StringCmd, len(keys))
+		_, err := redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, key := range keys {
+				ttls[i] = pipe.TTL(ctx, key)
+				slug, _ := slugFromKey(key)
+				link_ttls[i] = pipe.HGet(ctx, keyOfSlugMeta(slug), "ttl")
+			}
+			return nil
+		})
+		if err != nil && err != redis.Nil && !isReplyError(err) {
+			return err
+		}
+		r.Links += len(keys)
+		for i, key := range keys {
+			ttl := ttls[i].Val()
+			// clicks renew a link to its own ttl, never past it
+			allowed := ttlOfMeta(map[string]string{"ttl": link_ttls[i].Val()})
+			switch {
+			case ttl == -1:
+				r.violation("link_without_ttl", key)
+			case ttl > allowed+integrityGrace:
+				r.violation("link_ttl_too_long", key+" "+ttl.String())
+			}
+		}
+		return nil
+	})
+}
+
+// checkExpiresIndex finds links which should still be live by idx:expires, but aren't
+func checkExpiresIndex(redis_db Storage, ctx context.Context, r *IntegrityReport) error {
+	min := strconv.FormatInt(time.Now().Add(integrityGrace).Unix(), 10)
+	var offset int64
+	for {
+		slugs, err := redis_db.ZRangeByScore(ctx, keyOfExpiresIndex, &redis.ZRangeBy{Min: min, Max: "+inf", Offset: offset, Count: 500}).Result()
+		if err != nil {
+			return err
+		}
+		if len(slugs) == 0 {
+			return nil
+		}
+		missing, err := missingSlugs(redis_db, ctx, slugs)
+		if err != nil {
+			return err
+		}
+		for _, slug := range missing {
+			r.violation("indexed_without_link", slug)
+		}
+		offset += int64(len(slugs))
+	}
+}
+
+// checkAliases finds aliases to nothing, or to links which are gone
+func checkAliases(redis_db Storage, ctx context.Context, r *IntegrityReport) error {
+	return scanKeys(redis_db, ctx, keyOfAlias("*"), func(keys []string) error {
+		// MGET answers nil for keys which aren't strings
+		canonicals, err := redis_db.MGet(ctx, keys...).Result()
+		if err != nil {
+			return err
+		}
+		slugs := []string{}
+		for i, v := range canonicals {
+			if slug, _ := v.(string); slug != "" {
+				slugs = append(slugs, slug)
+			} else {
+				r.violation("alias_without_link", keys[i])
+			}
+		}
+		missing, err := missingSlugs(redis_db, ctx, slugs)
+		if err != nil {
+			return err
+		}
+		gone := map[string]bool{}
+		for _, slug := range missing {
+			gone[slug] = true
+		}
+		for i, v := range canonicals {
+			if slug, _ := v.(string); gone[slug] {
+				r.violation("alias_without_link", keys[i]+" -> "+slug)
+			}
+		}
+		return nil
+	})
+}
+
+// checkCounters checks counters and series buckets are integers, and expire unless they're kept
+func checkCounters(redis_db Storage, ctx context.Context, r *IntegrityReport) error {
+	should_expire := counterTTL(default_ttl) > 0
+	for _, prefix := range []string{"urlhitcount:", "urluniqhitcount:", "urlseries:"} {
+		series := prefix == "urlseries:"
+		err := scanKeys(redis_db, ctx, prefix+"*", func(keys []string) error {
+			values := make([]redis.Cmder, len(keys))
+			ttls := make([]*redis.DurationCmd, len(keys))
+			_, err := redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+				for i, key := range keys {
+					if series {
+						values[i] = pipe.HGetAll(ctx, key)
+					} else {
+						values[i] = pipe.Get(ctx, key)
+					}
+					ttls[i] = pipe.TTL(ctx, key)
+				}
+				return nil
+			})
+			if err != nil && err != redis.Nil && !isReplyError(err) {
+				return err
+			}
+			for i, key := range keys {
+				switch err := values[i].Err(); {
+				case err == redis.Nil:
+					continue // gone meanwhile
+				case err != nil:
+					r.violation("counter_not_numeric", key+" "+err.Error())
+				case series:
+					for bucket, v := range values[i].(*redis.StringStringMapCmd).Val() {
+						if !isInteger(v) {
+							r.violation("counter_not_numeric", key+" "+bucket+"="+v)
+						}
+					}
+				default:
+					if v := values[i].(*redis.StringCmd).Val(); !isInteger(v) {
+						r.violation("counter_not_numeric", key+"="+v)
+					}
+				}
+				if should_expire && ttls[i].Val() == -1 {
+					r.violation("counter_without_ttl", key)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkIntegrity runs every check, and keeps the report for the admin API
+func checkIntegrity(redis_db Storage, ctx context.Context) (IntegrityReport, error) {
+	started := time.Now()
+	r := IntegrityReport{Checked: started.UTC(), Violations: map[string]int{}, Sample: []string{}}
+	for _, invariant := range integrityInvariants {
+		r.Violations[invariant] = 0
+	}
+	for _, check := range []func(Storage, context.Context, *IntegrityReport) error{checkLinkTTLs, checkExpiresIndex, checkAliases, checkCounters} {
+		if err := check(redis_db, ctx, &r); err != nil {
+			return r, err
+		}
+	}
+	r.Took = Duration{time.Since(started).Round(time.Millisecond)}
+
+	for invariant, n := range r.Violations {
+		integrity_violations.Set(float64(n), "invariant", invariant)
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return r, err
+	}
+	return r, redis_db.Set(ctx, keyOfIntegrityReport, data, 0).Err()
+}
+
+// lastIntegrityReport is the report of the last run, nil before the first
+func lastIntegrityReport(redis_db Storage, ctx context.Context) (*IntegrityReport, error) {
+	data, err := redis_db.Get(ctx, keyOfIntegrityReport).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var r IntegrityReport
+	return &r, json.Unmarshal(data, &r)
+}
+
+func (r IntegrityReport) total() int {
+	total := 0
+	for _, n := range r.Violations {
+		total += n
+	}
+	return total
+}
+
+func integrityJob(redis_db Storage) scheduledJob {
+	return scheduledJob{name: "integrity", schedule: "@daily", run: func(ctx context.Context) error {
+		r, err := checkIntegrity(redis_db, ctx)
+		if err != nil {
+			return err
+		}
+		if total := r.total(); total > 0 {
+			log.Printf("Keyspace integrity: %d violations in %d links: %v", total, r.Links, r.Violations)
+			log.Println("  ", strings.Join(r.Sample, "\n   "))
+		} else {
+			log.Println("Keyspace integrity: no violations in", r.Links, "links")
+		}
+		return nil
+	}}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Periodic work (backups, anomaly detection, orphan cleanup) is a scheduled
+// job: each has a cron schedule, by default taken from its feature's own
+// interval, optional jitter, and can be disabled under jobs.<name>. Every
+// replica keeps the schedule, but the first to claim job:<name>:<scheduled
+// time> does the run. job:<name>:lock is held while running, and renewed, so
+// a run overlapping the next one isn't started twice either.
+
+type JobConfig struct {
+	Schedule string   `json:"schedule"` // cron, or @every <duration>
+	Jitter   Duration `json:"jitter"`   // random delay after the scheduled time, up to this
+	Disabled bool     `json:"disabled"`
+}
+
+type JobsConfig map[string]JobConfig
+
+type scheduledJob struct {
+	name     string
+	schedule string // used unless jobs.<name>.schedule is set
+	run      func(ctx context.Context) error
+}
+
+var job_runs = newCounter("shortener_job_runs_total", "Scheduled job runs on this replica, by result: ok, error, or skipped when another replica had it")
+var job_duration = newGauge("shortener_job_duration_seconds", "How long the last run of each job on this replica took")
+var job_last_success = newGauge("shortener_job_last_success_timestamp_seconds", "When each job last succeeded on this replica")
+
+const jobLockTTL = time.Minute
+
+// Only extends the lock if this process still holds it
+var renewLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+func keyOfJobRun(job string, at time.Time) string {
+	return fmt.Sprintf("job:%s:%d", job, at.Unix())
+}
+
+func keyOfJobLock(job string) string {
+	return "job:" + job + ":lock"
+}
+
+func lockHolder() string {
+	return fmt.Sprintf("%s:%d", hostname(), os.Getpid())
+}
+
+// runOnce does the run of job due at, unless another replica has claimed it or is still running the job
+func runOnce(redis_db Storage, job string, at time.Time, ttl time.Duration, run func(ctx context.Context) error) (bool, error) {
+	ctx := context.Background()
+	holder := lockHolder()
+
+	claimed, err := redis_db.SetNX(ctx, keyOfJobRun(job, at), holder, ttl).Result()
+	if err != nil || !claimed {
+		return false, err
+	}
+	locked, err := redis_db.SetNX(ctx, keyOfJobLock(job), holder, jobLockTTL).Result()
+	if err != nil || !locked {
+		return false, err
+	}
+	defer releaseLockScript.Run(ctx, redis_db, []string{keyOfJobLock(job)}, holder)
+
+	// Renewing stops when the run ends; losing the lock cancels the run
+	run_ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		ticker := time.NewTicker(jobLockTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-run_ctx.Done():
+				return
+			case <-ticker.C:
+				renewed, err := renewLockScript.Run(ctx, redis_db, []string{keyOfJobLock(job)}, holder, jobLockTTL.Milliseconds()).Int()
+				if err == nil && renewed == 0 {
+					log.Println("Lost the lock of job", job)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	return true, run(run_ctx)
+}
+
+// everySchedule is the schedule of a feature's interval, "" for none
+func everySchedule(interval time.Duration) string {
+	if interval <= 0 {
+		return ""
+	}
+	return "@every " + interval.String()
+}
+
+// validateJobs checks the configured schedules
+func validateJobs(c Config) error {
+	for name, j := range c.Jobs {
+		if j.Schedule == "" {
+			continue
+		}
+		if _, err := parseSchedule(j.Schedule); err != nil {
+			return fmt.Errorf("jobs.%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// runScheduler starts each enabled job with a schedule, and returns
+func runScheduler(redis_db Storage, jobs []scheduledJob) {
+	for _, job := range jobs {
+		c := config.Jobs[job.name]
+		if c.Schedule != "" {
+			job.schedule = c.Schedule
+		}
+		if c.Disabled || job.schedule == "" {
+			continue
+		}
+		schedule, err := parseSchedule(job.schedule)
+		if err != nil {
+			log.Println("Not scheduling job", job.name, err)
+			continue
+		}
+		log.Println("Scheduled job", job.name, job.schedule)
+		go runScheduled(redis_db, job, schedule, c.Jitter.Duration)
+	}
+}
+
+func runScheduled(redis_db Storage, job scheduledJob, schedule cronSchedule, jitter time.Duration) {
+	for {
+		at := schedule.next(time.Now())
+		if at.IsZero() {
+			log.Println("Job", job.name, "will never run again")
+			return
+		}
+		delay := time.Until(at)
+		if jitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(jitter)))
+		}
+		time.Sleep(delay)
+
+		// claim the run until the one after, so late replicas don't repeat it
+		claim := schedule.next(at).Sub(at)
+		if claim < time.Minute {
+			claim = time.Minute
+		}
+		start := time.Now()
+		ran, err := runOnce(redis_db, job.name, at, claim, job.run)
+		switch {
+		case err != nil:
+			log.Println("Job", job.name, "failed", err)
+			job_runs.Inc("job", job.name, "result", "error")
+		case !ran:
+			job_runs.Inc("job", job.name, "result", "skipped")
+			continue
+		default:
+			job_runs.Inc("job", job.name, "result", "ok")
+			job_last_success.Set(float64(time.Now().Unix()), "job", job.name)
+		}
+		job_duration.Set(time.Since(start).Seconds(), "job", job.name)
+	}
+}
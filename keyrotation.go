@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+// An API consumer rotates its own key with POST /api/v1/keys/rotate: the new
+// key, for the same tenant and role, comes back once, and the old one keeps
+// working for the overlap, so clients can be moved over without an outage.
+//
+// Keys are known by the SHA-256 of their value. apikey:<digest> holds an
+// issued key's tenant and role, apikeys the digests of issued keys, and
+// apikeys:retired when each rotated key stops working, by digest. A key from
+// the config file which was rotated stays refused, though the file still has
+// it; an issued one's entry is dropped once its overlap passed. Every replica
+// reads them back every few seconds, so a new key may take that long to work
+// on all of them. Each rotation is kept in audit:keys and posted to the
+// webhook, if there is one.
+
+type KeyRotationConfig struct {
+	Enabled    bool     `json:"enabled"`
+	Overlap    Duration `json:"overlap"`     // how long a rotated key keeps working, unless the caller asks for less
+	MaxOverlap Duration `json:"max_overlap"` // the most a caller may ask for
+	WebhookURL string   `json:"webhook_url"`
+}
+
+func validateKeyRotation(c KeyRotationConfig) error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Overlap.Duration < 0 || c.MaxOverlap.Duration < c.Overlap.Duration {
+		return errors.New("key_rotation.overlap can't be negative, nor more than key_rotation.max_overlap")
+	}
+	return nil
+}
+
+const (
+	keyOfIssuedKeys  = "apikeys"
+	keyOfRetiredKeys = "apikeys:retired"
+	keyOfKeyAudit    = "audit:keys"
+	maxKeyAudit      = 1000
+	keysRefresh      = 10 * time.Second
+)
+
+func keyOfIssuedKey(digest string) string {
+	return "apikey:" + digest
+}
+
+func keyDigest(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+var key_rotations = newCounter("shortener_api_key_rotations_total", "API keys rotated by their holders")
+
+// rotatedKeys are the issued and retired keys, as last read from Redis
+type rotatedKeys struct {
+	mu      sync.RWMutex
+	issued  map[string]Identity // by digest; KeyId is left to the caller
+	retired map[string]time.Time
+}
+
+var rotated_keys = &rotatedKeys{issued: map[string]Identity{}, retired: map[string]time.Time{}}
+
+// usable is false of a rotated key past its overlap
+func (r *rotatedKeys) usable(digest string, now time.Time) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	until, retired := r.retired[digest]
+	return !retired || now.Before(until)
+}
+
+func (r *rotatedKeys) identity(digest string) (Identity, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	identity, ok := r.issued[digest]
+	return identity, ok
+}
+
+// rotated takes in a rotation made here, ahead of the next refresh
+func (r *rotatedKeys) rotated(old string, until time.Time, fresh string, identity Identity) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.retired[old] = until
+	r.issued[fresh] = identity
+}
+
+// refresh reads the issued and retired keys every few seconds, until the process ends
+func (r *rotatedKeys) refresh(redis_db Storage) {
+	for {
+		issued, retired, err := readRotatedKeys(redis_db, context.Background())
+		if err != nil {
+			log.Println("Cannot read the rotated API keys", err)
+		} else {
+			r.mu.Lock()
+			r.issued, r.retired = issued, retired
+			r.mu.Unlock()
+		}
+		time.Sleep(keysRefresh)
+	}
+}
+
+func readRotatedKeys(redis_db Storage, ctx context.Context) (map[string]Identity, map[string]time.Time, error) {
+	digests, err := redis_db.SMembers(ctx, keyOfIssuedKeys).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+	var retired_cmd *redis.StringStringMapCmd
+	cmds := make([]*redis.StringStringMapCmd, len(digests))
+	_, err = redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		retired_cmd = pipe.HGetAll(ctx, keyOfRetiredKeys)
+		for i, digest := range digests {
+			cmds[i] = pipe.HGetAll(ctx, keyOfIssuedKey(digest))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	issued := map[string]Identity{}
+	for i, digest := range digests {
+		attrs := cmds[i].Val()
+		if len(attrs) == 0 {
+			// expired after its overlap
+			redis_db.SRem(ctx, keyOfIssuedKeys, digest)
+			continue
+		}
+		issued[digest] = Identity{Tenant: attrs["tenant"], Role: attrs["role"]}
+	}
+	configured := map[string]bool{}
+	for _, k := range config.APIKeys {
+		configured[keyDigest(k.Key)] = true
+	}
+	now := time.Now()
+	retired := map[string]time.Time{}
+	for digest, until := range retired_cmd.Val() {
+		if _, live := issued[digest]; !configured[digest] && !live && !now.Before(unixTime(until)) {
+			// an issued key is gone with its apikey: hash once its overlap passed
+			redis_db.HDel(ctx, keyOfRetiredKeys, digest)
+			continue
+		}
+		retired[digest] = unixTime(until)
+	}
+	return issued, retired, nil
+}
+
+func newAPIKey() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+type KeyAuditEntry struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Tenant   string    `json:"tenant"`
+	KeyId    string    `json:"key_id"`
+	NewKeyId string    `json:"new_key_id,omitempty"`
+	Until    time.Time `json:"valid_until"` // when the old key stops working
+	Client   string    `json:"client,omitempty"`
+}
+
+func auditKeys(redis_db Storage, ctx context.Context, entry KeyAuditEntry) error {
+	encoded, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LPush(ctx, keyOfKeyAudit, encoded)
+		pipe.LTrim(ctx, keyOfKeyAudit, 0, maxKeyAudit-1)
+		return nil
+	})
+	return err
+}
+
+// keyAudit is the newest entries first, of one tenant unless all is set
+func keyAudit(redis_db Storage, ctx context.Context, tenant string, all bool) ([]KeyAuditEntry, error) {
+	encoded, err := redis_db.LRange(ctx, keyOfKeyAudit, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := []KeyAuditEntry{}
+	for _, e := range encoded {
+		var entry KeyAuditEntry
+		if json.Unmarshal([]byte(e), &entry) == nil && (all || entry.Tenant == tenant) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+var errKeyRotated = errors.New("This key was rotated already")
+
+// rotateKey issues a key replacing old, which keeps working until the returned time
+func rotateKey(redis_db Storage, ctx context.Context, old string, identity Identity, overlap time.Duration) (string, time.Time, error) {
+	fresh := newAPIKey()
+	old_digest, fresh_digest := keyDigest(old), keyDigest(fresh)
+	now := time.Now()
+	until := now.Add(overlap)
+	// the new key is stored first, so a failure can't leave the tenant without one
+	_, err := redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, keyOfIssuedKey(fresh_digest), "tenant", identity.Tenant, "role", identity.Role,
+			"created", now.Unix(), "replaces", identity.KeyId)
+		pipe.SAdd(ctx, keyOfIssuedKeys, fresh_digest)
+		return nil
+	})
+	if err != nil {
+		return "", until, err
+	}
+	first, err := redis_db.HSetNX(ctx, keyOfRetiredKeys, old_digest, until.Unix()).Result()
+	if err != nil || !first {
+		redis_db.Del(ctx, keyOfIssuedKey(fresh_digest))
+		redis_db.SRem(ctx, keyOfIssuedKeys, fresh_digest)
+		if err == nil {
+			err = errKeyRotated
+		}
+		return "", until, err
+	}
+	// an issued key is gone for good after its overlap; one from the config stays retired
+	if issued, err := redis_db.Exists(ctx, keyOfIssuedKey(old_digest)).Result(); err != nil {
+		log.Println("Cannot expire the rotated key", identity.KeyId, err)
+	} else if issued == 1 {
+		redis_db.ExpireAt(ctx, keyOfIssuedKey(old_digest), until)
+	}
+	rotated_keys.rotated(old_digest, until, fresh_digest, Identity{Tenant: identity.Tenant, Role: identity.Role})
+	return fresh, until, nil
+}
+
+func notifyKeyRotation(entry KeyAuditEntry) {
+	if config.KeyRotation.WebhookURL == "" {
+		return
+	}
+	go func() {
+		if err := postWebhook(config.KeyRotation.WebhookURL, entry); err != nil {
+			log.Println("Key rotation webhook failed", err)
+		}
+	}()
+}
+
+type KeyRotationResponse struct {
+	Key           string    `json:"key"` // shown this once
+	KeyId         string    `json:"key_id"`
+	Tenant        string    `json:"tenant"`
+	Role          string    `json:"role"`
+	OldKeyId      string    `json:"old_key_id"`
+	OldValidUntil time.Time `json:"old_key_valid_until"`
+}
+
+func registerKeyRoutes(router *mux.Router, redis_db Storage) {
+
+	// ?overlap= shortens how long the old key keeps working; 0s ends it now
+	router.HandleFunc("/rotate", func(w http.ResponseWriter, req *http.Request) {
+		key := apiKeyOfRequest(req)
+		if key == "" || config.Server.ClientCerts.Require {
+			writeJSONError(w, http.StatusBadRequest, "Only an API key can be rotated, sent as Authorization: Bearer or X-API-Key")
+			return
+		}
+		identity, ok := identityOfKey(key)
+		if !ok {
+			writeJSONError(w, http.StatusUnauthorized, "Unknown API key")
+			return
+		}
+		overlap := config.KeyRotation.Overlap.Duration
+		if s := req.FormValue("overlap"); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d < 0 || d > config.KeyRotation.MaxOverlap.Duration {
+				writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("overlap must be a duration from 0s to %v", config.KeyRotation.MaxOverlap.Duration))
+				return
+			}
+			overlap = d
+		}
+		fresh, until, err := rotateKey(redis_db, req.Context(), key, identity, overlap)
+		if err == errKeyRotated {
+			writeJSONError(w, http.StatusConflict, err.Error())
+			return
+		} else if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		key_rotations.Inc()
+		entry := KeyAuditEntry{Time: time.Now().UTC(), Event: "api_key_rotated", Tenant: identity.Tenant,
+			KeyId: identity.KeyId, NewKeyId: keyId(fresh), Until: until.UTC(), Client: loggedHost(req)}
+		if err := auditKeys(redis_db, req.Context(), entry); err != nil {
+			// the rotation is done; the log line below stands in for the entry
+			log.Println("Cannot audit the rotation of", identity.KeyId, err)
+		}
+		notifyKeyRotation(entry)
+		log.Println("Rotated API key", identity.KeyId, "of tenant", strconv.Quote(identity.Tenant), "to", entry.NewKeyId, "old one valid until", until.UTC())
+		writeJSON(w, http.StatusCreated, KeyRotationResponse{Key: fresh, KeyId: entry.NewKeyId, Tenant: identity.Tenant,
+			Role: identity.Role, OldKeyId: identity.KeyId, OldValidUntil: until.UTC()})
+	}).Methods("POST")
+
+	// The tenant's rotations, or with ?all=true, an admin's view of everyone's
+	router.HandleFunc("/audit", func(w http.ResponseWriter, req *http.Request) {
+		identity, ok := hasRole(w, req, roleViewer)
+		if !ok {
+			return
+		}
+		all := req.FormValue("all") == "true" && identity.can(roleAdmin)
+		entries, err := keyAudit(redis_db, req.Context(), identity.Tenant, all)
+		if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, entries)
+	}).Methods("GET")
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// In a cluster, short links can be declared next to the manifests they point
+// at: a ConfigMap carrying the configured label holds a sync file under
+// links.json. The kubernetes job lists those ConfigMaps and syncs each one,
+// as if by `sync --really`, under managed_by k8s.<namespace>.<name>, always
+// pruning: a link removed from a ConfigMap goes to the trash, and so do all
+// of a ConfigMap's links once the ConfigMap itself is deleted.
+
+type KubernetesConfig struct {
+	Enabled       bool     `json:"enabled"`
+	APIServer     string   `json:"api_server"` // the in-cluster address when empty
+	TokenFile     string   `json:"token_file"`
+	CAFile        string   `json:"ca_file"`
+	Namespace     string   `json:"namespace"` // every namespace when empty
+	LabelSelector string   `json:"label_selector"`
+	Interval      Duration `json:"interval"`
+}
+
+const kubernetesLinksKey = "links.json"
+const kubernetesManagedPrefix = "k8s."
+
+type configMapList struct {
+	Items []struct {
+		Metadata struct {
+			Namespace string `json:"namespace"`
+			Name      string `json:"name"`
+		} `json:"metadata"`
+		Data map[string]string `json:"data"`
+	} `json:"items"`
+}
+
+func kubernetesManagedBy(namespace string, name string) string {
+	return kubernetesManagedPrefix + namespace + "." + name
+}
+
+type kubernetesClient struct {
+	server    string
+	tokenFile string
+	client    *http.Client
+}
+
+func newKubernetesClient(c KubernetesConfig) (*kubernetesClient, error) {
+	server := c.APIServer
+	if server == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New("Not running in a cluster, set kubernetes.api_server")
+		}
+		server = "https://" + net.JoinHostPort(host, port)
+	}
+	tls_config := &tls.Config{}
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tls_config.RootCAs = x509.NewCertPool()
+		if !tls_config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates in %v", c.CAFile)
+		}
+	}
+	return &kubernetesClient{
+		server:    strings.TrimSuffix(server, "/"),
+		tokenFile: c.TokenFile,
+		client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tls_config, Proxy: http.ProxyFromEnvironment},
+		},
+	}, nil
+}
+
+func (k *kubernetesClient) configMaps(ctx context.Context, namespace string, selector string) (configMapList, error) {
+	var list configMapList
+	path := "/api/v1/configmaps"
+	if namespace != "" {
+		path = "/api/v1/namespaces/" + url.PathEscape(namespace) + "/configmaps"
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", k.server+path+"?labelSelector="+url.QueryEscape(selector), nil)
+	if err != nil {
+		return list, err
+	}
+	// Service account tokens are rotated, so it's read for every request
+	if k.tokenFile != "" {
+		token, err := ioutil.ReadFile(k.tokenFile)
+		if err != nil {
+			return list, err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return list, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return list, fmt.Errorf("Listing ConfigMaps: %v: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	return list, err
+}
+
+// syncKubernetes reconciles every labelled ConfigMap, then prunes the links of those which are gone
+func syncKubernetes(redis_db Storage, ctx context.Context, k *kubernetesClient, c KubernetesConfig) error {
+	list, err := k.configMaps(ctx, c.Namespace, c.LabelSelector)
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	failed := 0
+	for _, item := range list.Items {
+		managed_by := kubernetesManagedBy(item.Metadata.Namespace, item.Metadata.Name)
+		seen[managed_by] = true
+		// A broken ConfigMap is left as it was last synced, not pruned
+		f, err := readSyncFile(strings.NewReader(item.Data[kubernetesLinksKey]))
+		if err != nil {
+			log.Println("ConfigMap", item.Metadata.Namespace+"/"+item.Metadata.Name+":", err)
+			failed++
+			continue
+		}
+		f.ManagedBy, f.Prune = managed_by, true
+		report, err := syncLinks(redis_db, ctx, f, false)
+		if err != nil {
+			return err
+		}
+		for _, change := range report.Changes {
+			log.Println("ConfigMap", item.Metadata.Namespace+"/"+item.Metadata.Name+":", change.Action, change.Slug, strings.Join(change.Changes, "; "), change.Error)
+		}
+	}
+
+	prefix := kubernetesManagedPrefix
+	if c.Namespace != "" {
+		prefix += c.Namespace + "."
+	}
+	gone := []string{}
+	err = scanKeys(redis_db, ctx, keyOfSyncLinks(prefix+"*"), func(keys []string) error {
+		for _, key := range keys {
+			if managed_by := key[len(keyOfSyncLinks("")):]; !seen[managed_by] {
+				gone = append(gone, managed_by)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, managed_by := range gone {
+		report, err := syncLinks(redis_db, ctx, SyncFile{ManagedBy: managed_by, Prune: true}, false)
+		if err != nil {
+			return err
+		}
+		log.Println("ConfigMap for", managed_by, "is gone, pruned", len(report.Changes), "links")
+	}
+	if failed > 0 {
+		return fmt.Errorf("%v ConfigMaps could not be read", failed)
+	}
+	return nil
+}
+
+func kubernetesJob(redis_db Storage, k *kubernetesClient, c KubernetesConfig) scheduledJob {
+	return scheduledJob{name: "kubernetes", schedule: everySchedule(c.Interval.Duration), run: func(ctx context.Context) error {
+		return syncKubernetes(redis_db, ctx, k, c)
+	}}
+}
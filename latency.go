@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+// Every route belongs to a class with its own deadline: redirects get the
+// tightest, the API more, and exports (admin maintenance, its pages, and
+// feeds) the most.
+// The deadline is on the request's context, so Redis commands and outbound
+// fetches past it fail, and the handler answers as it does when Redis is slow.
+// Exports, which scan, get the whole deadline as their Redis budget too.
+// server.write_timeout still cuts off any response, whatever its class.
+//
+// A request taking longer than server.slow_request is logged with what its
+// Redis commands took, from traceHook, and counted on /metrics.
+
+type RouteTimeoutsConfig struct {
+	Redirect Duration `json:"redirect"`
+	API      Duration `json:"api"`
+	Export   Duration `json:"export"`
+}
+
+const (
+	routeRedirect = "redirect"
+	routeAPI      = "api"
+	routeExport   = "export"
+)
+
+var slow_requests = newCounter("shortener_slow_requests_total", "Requests slower than server.slow_request, by route class")
+var request_timeouts = newCounter("shortener_request_timeouts_total", "Requests which ran past their route class's timeout")
+
+// routeClassOf tells which deadline a matched route gets
+func routeClassOf(req *http.Request) string {
+	template := ""
+	if route := mux.CurrentRoute(req); route != nil {
+		template, _ = route.GetPathTemplate()
+	}
+	switch {
+	case strings.HasPrefix(template, "/{slug") && strings.HasSuffix(template, "}"):
+		return routeRedirect
+	case strings.HasPrefix(template, "/api/v1/admin/"), strings.HasPrefix(template, "/_admin/"), strings.HasPrefix(template, "/feeds/"):
+		return routeExport
+	}
+	return routeAPI
+}
+
+func routeTimeout(class string) time.Duration {
+	switch class {
+	case routeRedirect:
+		return config.Server.RouteTimeouts.Redirect.Duration
+	case routeExport:
+		return config.Server.RouteTimeouts.Export.Duration
+	}
+	return config.Server.RouteTimeouts.API.Duration
+}
+
+// redisTrace adds up a request's Redis commands by name
+type redisTrace struct {
+	mu       sync.Mutex
+	commands map[string]*redisTraceEntry
+}
+
+type redisTraceEntry struct {
+	count int
+	took  time.Duration
+}
+
+type traceKey struct{}
+type traceStartKey struct{}
+
+func (t *redisTrace) add(name string, took time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e := t.commands[name]
+	if e == nil {
+		e = &redisTraceEntry{}
+		t.commands[name] = e
+	}
+	e.count++
+	e.took += took
+}
+
+// String lists the commands, slowest first: "pipeline 2x840ms, get 1x3ms"
+func (t *redisTrace) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	names := make([]string, 0, len(t.commands))
+	for name := range t.commands {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return t.commands[names[i]].took > t.commands[names[j]].took
+	})
+	parts := make([]string, len(names))
+	for i, name := range names {
+		e := t.commands[name]
+		parts[i] = fmt.Sprintf("%s %dx%v", name, e.count, e.took.Round(time.Microsecond))
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// traceHook times the commands of requests being traced
+type traceHook struct{}
+
+func (traceHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	if ctx.Value(traceKey{}) == nil {
+		return ctx, nil
+	}
+	return context.WithValue(ctx, traceStartKey{}, time.Now()), nil
+}
+
+func (traceHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	if t, ok := ctx.Value(traceKey{}).(*redisTrace); ok {
+		if start, ok := ctx.Value(traceStartKey{}).(time.Time); ok {
+			t.add(strings.ToLower(cmd.Name()), time.Since(start))
+		}
+	}
+	return nil
+}
+
+func (h traceHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return h.BeforeProcess(ctx, nil)
+}
+
+func (traceHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	if t, ok := ctx.Value(traceKey{}).(*redisTrace); ok {
+		if start, ok := ctx.Value(traceStartKey{}).(time.Time); ok {
+			t.add("pipeline", time.Since(start))
+		}
+	}
+	return nil
+}
+
+// withRouteLimits is router middleware: the deadline of the route's class, and slow request logging
+func withRouteLimits(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		class := routeClassOf(req)
+		ctx := req.Context()
+		if timeout := routeTimeout(class); timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+			if class == routeExport {
+				ctx = context.WithValue(ctx, budgetKey{}, time.Now().Add(timeout))
+			}
+		}
+		threshold := config.Server.SlowRequest.Duration
+		var trace *redisTrace
+		if threshold > 0 {
+			trace = &redisTrace{commands: map[string]*redisTraceEntry{}}
+			ctx = context.WithValue(ctx, traceKey{}, trace)
+		}
+
+		start := time.Now()
+		next.ServeHTTP(w, req.WithContext(ctx))
+		took := time.Since(start)
+
+		if ctx.Err() == context.DeadlineExceeded {
+			request_timeouts.Inc("route", class)
+		}
+		if trace != nil && took > threshold {
+			slow_requests.Inc("route", class)
+			log.Println("Slow request", req.Header.Get(requestIDHeader), req.Method, req.URL.Path,
+				"route", class, "took", took.Round(time.Millisecond), "redis:", trace)
+		}
+	})
+}
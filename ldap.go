@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// For restricted links, group:<name> entries can also be checked against an
+// LDAP directory or Active Directory: the visitor's email and the group go
+// into member_filter, and they're a member if a search under base_dn finds
+// anything. Answers are cached for cache_for. This speaks just enough LDAPv3
+// (simple bind, search, unbind) over plain TCP or TLS.
+
+type LDAPConfig struct {
+	Addr         string   `json:"addr"` // host:port, empty turns LDAP off
+	TLS          bool     `json:"tls"`  // ldaps
+	BindDN       string   `json:"bind_dn"`
+	BindPassword string   `json:"bind_password"`
+	BaseDN       string   `json:"base_dn"`
+	MemberFilter string   `json:"member_filter"` // {email} and {group} are replaced, escaped
+	Timeout      Duration `json:"timeout"`
+	CacheFor     Duration `json:"cache_for"`
+}
+
+type ldapAnswer struct {
+	member bool
+	at     time.Time
+}
+
+var ldap_cache_mu sync.Mutex
+var ldap_cache = map[string]ldapAnswer{}
+
+// ldapIsMember asks the directory whether email is in group, or answers from the cache
+func ldapIsMember(c LDAPConfig, email string, group string) (bool, error) {
+	key := strings.ToLower(email) + "\x00" + group
+	ldap_cache_mu.Lock()
+	answer, ok := ldap_cache[key]
+	ldap_cache_mu.Unlock()
+	if ok && time.Since(answer.at) < c.CacheFor.Duration {
+		return answer.member, nil
+	}
+
+	filter := strings.NewReplacer("{email}", ldapEscape(email), "{group}", ldapEscape(group)).Replace(c.MemberFilter)
+	found, err := ldapSearchAny(c, filter)
+	if err != nil {
+		return false, err
+	}
+
+	ldap_cache_mu.Lock()
+	if len(ldap_cache) > 10000 {
+		ldap_cache = map[string]ldapAnswer{}
+	}
+	ldap_cache[key] = ldapAnswer{member: found, at: time.Now()}
+	ldap_cache_mu.Unlock()
+	return found, nil
+}
+
+// ldapEscape escapes a value for use in a search filter (RFC 4515)
+func ldapEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// ldapSearchAny reports whether filter matches at least one entry under the base DN
+func ldapSearchAny(c LDAPConfig, filter string) (bool, error) {
+	encoded_filter, err := parseLDAPFilter(filter)
+	if err != nil {
+		return false, err
+	}
+
+	dialer := &net.Dialer{Timeout: c.Timeout.Duration}
+	var conn net.Conn
+	if c.TLS {
+		host, _, _ := net.SplitHostPort(c.Addr)
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.Addr, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", c.Addr)
+	}
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.Timeout.Duration))
+	r := bufio.NewReader(conn)
+
+	if c.BindDN != "" {
+		bind := berConstructed(0x60, berInt(3), berString(0x04, c.BindDN), berString(0x80, c.BindPassword))
+		if _, err := conn.Write(ldapMessage(1, bind)); err != nil {
+			return false, err
+		}
+		tag, op, err := readLDAPMessage(r)
+		if err != nil {
+			return false, err
+		}
+		if tag != 0x61 {
+			return false, fmt.Errorf("Unexpected LDAP bind answer 0x%x", tag)
+		}
+		if err := ldapResult(op, "bind"); err != nil {
+			return false, err
+		}
+	}
+
+	search := berConstructed(0x63,
+		berString(0x04, c.BaseDN),
+		berTLV(0x0a, []byte{2}), // wholeSubtree
+		berTLV(0x0a, []byte{0}), // neverDerefAliases
+		berInt(1),               // sizeLimit
+		berInt(int(c.Timeout.Seconds())),
+		berTLV(0x01, []byte{0}), // typesOnly false
+		encoded_filter,
+		berTLV(0x30, berString(0x04, "1.1")), // no attributes
+	)
+	if _, err := conn.Write(ldapMessage(2, search)); err != nil {
+		return false, err
+	}
+
+	found := false
+	for {
+		tag, op, err := readLDAPMessage(r)
+		if err != nil {
+			return false, err
+		}
+		switch tag {
+		case 0x64: // SearchResultEntry
+			found = true
+		case 0x65: // SearchResultDone
+			conn.Write(ldapMessage(3, []byte{0x42, 0x00})) // unbind
+			if found {
+				return true, nil // sizeLimitExceeded is fine once there's an entry
+			}
+			return false, ldapResult(op, "search")
+		}
+	}
+}
+
+// ldapResult checks the resultCode of an LDAPResult
+func ldapResult(op []byte, what string) error {
+	fields, err := berChildren(op)
+	if err != nil || len(fields) < 3 || len(fields[0].value) == 0 {
+		return fmt.Errorf("Malformed LDAP %s result", what)
+	}
+	if code := fields[0].value[len(fields[0].value)-1]; code != 0 {
+		return fmt.Errorf("LDAP %s failed with code %d: %s", what, code, fields[2].value)
+	}
+	return nil
+}
+
+func ldapMessage(id int, op []byte) []byte {
+	return berConstructed(0x30, berInt(id), op)
+}
+
+// readLDAPMessage returns the tag and contents of the protocolOp of the next message
+func readLDAPMessage(r *bufio.Reader) (byte, []byte, error) {
+	tag, content, err := readBER(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if tag != 0x30 {
+		return 0, nil, errors.New("Malformed LDAP message")
+	}
+	fields, err := berChildren(content)
+	if err != nil || len(fields) < 2 {
+		return 0, nil, errors.New("Malformed LDAP message")
+	}
+	return fields[1].tag, fields[1].value, nil
+}
+
+// BER, as far as LDAP needs it
+
+type berField struct {
+	tag   byte
+	value []byte
+}
+
+func berLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+func berTLV(tag byte, content []byte) []byte {
+	return append(append([]byte{tag}, berLength(len(content))...), content...)
+}
+
+func berConstructed(tag byte, parts ...[]byte) []byte {
+	var content []byte
+	for _, p := range parts {
+		content = append(content, p...)
+	}
+	return berTLV(tag, content)
+}
+
+func berString(tag byte, s string) []byte {
+	return berTLV(tag, []byte(s))
+}
+
+func berInt(n int) []byte {
+	b := []byte{byte(n)}
+	for n >>= 8; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return berTLV(0x02, b)
+}
+
+func readBER(r io.Reader) (byte, []byte, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return 0, nil, err
+	}
+	length := int(head[1])
+	if length&0x80 != 0 {
+		size := length & 0x7f
+		if size == 0 || size > 4 {
+			return 0, nil, errors.New("Unsupported BER length")
+		}
+		b := make([]byte, size)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return 0, nil, err
+		}
+		length = 0
+		for _, c := range b {
+			length = length<<8 | int(c)
+		}
+	}
+	content := make([]byte, length)
+	_, err := io.ReadFull(r, content)
+	return head[0], content, err
+}
+
+func berChildren(content []byte) ([]berField, error) {
+	var fields []berField
+	r := strings.NewReader(string(content))
+	for r.Len() > 0 {
+		tag, value, err := readBER(r)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, berField{tag, value})
+	}
+	return fields, nil
+}
+
+// parseLDAPFilter encodes an RFC 4515 filter string: &, |, !, =, >=, <=, ~=,
+// presence, substrings and extensible matches such as AD's
+// memberOf:1.2.840.113556.1.4.1941:= for nested groups
+func parseLDAPFilter(s string) ([]byte, error) {
+	encoded, rest, err := parseLDAPFilterAt(strings.TrimSpace(s))
+	if err == nil && rest != "" {
+		err = errors.New("Trailing characters after LDAP filter")
+	}
+	return encoded, err
+}
+
+func parseLDAPFilterAt(s string) ([]byte, string, error) {
+	if !strings.HasPrefix(s, "(") {
+		return nil, s, errors.New("LDAP filter must start with (")
+	}
+	s = s[1:]
+	if s == "" {
+		return nil, s, errors.New("Unterminated LDAP filter")
+	}
+
+	switch s[0] {
+	case '&', '|', '!':
+		op := s[0]
+		s = s[1:]
+		var content []byte
+		for strings.HasPrefix(s, "(") {
+			var child []byte
+			var err error
+			if child, s, err = parseLDAPFilterAt(s); err != nil {
+				return nil, s, err
+			}
+			content = append(content, child...)
+		}
+		if !strings.HasPrefix(s, ")") {
+			return nil, s, errors.New("Unterminated LDAP filter")
+		}
+		tag := map[byte]byte{'&': 0xa0, '|': 0xa1, '!': 0xa2}[op]
+		return berTLV(tag, content), s[1:], nil
+	}
+
+	end := strings.IndexByte(s, ')')
+	if end < 0 {
+		return nil, s, errors.New("Unterminated LDAP filter")
+	}
+	item, rest := s[:end], s[end+1:]
+	eq := strings.IndexByte(item, '=')
+	if eq <= 0 {
+		return nil, rest, fmt.Errorf("Invalid LDAP filter item %q", item)
+	}
+	attr, value := item[:eq], item[eq+1:]
+
+	switch {
+	case strings.HasSuffix(attr, ">"):
+		return berConstructed(0xa5, berString(0x04, attr[:len(attr)-1]), berTLV(0x04, ldapUnescape(value))), rest, nil
+	case strings.HasSuffix(attr, "<"):
+		return berConstructed(0xa6, berString(0x04, attr[:len(attr)-1]), berTLV(0x04, ldapUnescape(value))), rest, nil
+	case strings.HasSuffix(attr, "~"):
+		return berConstructed(0xa8, berString(0x04, attr[:len(attr)-1]), berTLV(0x04, ldapUnescape(value))), rest, nil
+	case strings.HasSuffix(attr, ":"):
+		// attr[:dn][:rule]:=value
+		parts := strings.Split(attr[:len(attr)-1], ":")
+		var content []byte
+		dn := false
+		for _, p := range parts[1:] {
+			if p == "dn" {
+				dn = true
+			} else if p != "" {
+				content = append(content, berString(0x81, p)...)
+			}
+		}
+		if parts[0] != "" {
+			content = append(content, berString(0x82, parts[0])...)
+		}
+		content = append(content, berTLV(0x83, ldapUnescape(value))...)
+		if dn {
+			content = append(content, berTLV(0x84, []byte{0xff})...)
+		}
+		return berTLV(0xa9, content), rest, nil
+	case value == "*":
+		return berString(0x87, attr), rest, nil
+	case strings.Contains(value, "*"):
+		pieces := strings.Split(value, "*")
+		var subs []byte
+		for i, p := range pieces {
+			if p == "" {
+				continue
+			}
+			tag := byte(0x81) // any
+			if i == 0 {
+				tag = 0x80 // initial
+			} else if i == len(pieces)-1 {
+				tag = 0x82 // final
+			}
+			subs = append(subs, berTLV(tag, ldapUnescape(p))...)
+		}
+		return berConstructed(0xa4, berString(0x04, attr), berTLV(0x30, subs)), rest, nil
+	}
+	return berConstructed(0xa3, berString(0x04, attr), berTLV(0x04, ldapUnescape(value))), rest, nil
+}
+
+func ldapUnescape(s string) []byte {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				b = append(b, byte(c))
+				i += 2
+				continue
+			}
+		}
+		b = append(b, s[i])
+	}
+	return b
+}
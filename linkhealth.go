@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// The link-health job checks targets as sampling does (see sample.go) and
+// remembers which are down: after health.failures failed checks in a row a
+// link gets "down_since" in urlmeta:, and loses it on the first check which
+// succeeds. While a target is known down, visitors are sent to the link's
+// fallback, or health.fallback: a URL, or "archive" for the link's Wayback
+// Machine snapshot (see archive.go). Links with no fallback to go to aren't
+// checked. Going down and coming back purge the link at the CDN.
+
+type HealthConfig struct {
+	Enabled  bool     `json:"enabled"`
+	Interval Duration `json:"interval"`
+	Failures int64    `json:"failures"` // in a row before a target is down
+	Fallback string   `json:"fallback"` // for links without their own: a URL, or "archive"
+}
+
+const fallbackArchive = "archive"
+
+var links_down = newGauge("shortener_links_down", "Links whose target the last link-health run found down")
+
+func validateFallback(fallback string) error {
+	if fallback == "" || fallback == fallbackArchive {
+		return nil
+	}
+	if _, err := validateTarget(fallback); err != nil {
+		return fmt.Errorf("fallback must be %q or a URL: %v", fallbackArchive, err)
+	}
+	return nil
+}
+
+func validateHealth(c HealthConfig) error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Interval.Duration < time.Minute {
+		return fmt.Errorf("health.interval must be at least a minute")
+	}
+	if c.Failures < 1 {
+		return fmt.Errorf("health.failures must be at least 1")
+	}
+	if c.Fallback != "" && c.Fallback != fallbackArchive {
+		if u, err := url.Parse(c.Fallback); err != nil || !u.IsAbs() {
+			return fmt.Errorf("health.fallback must be %q or an absolute URL", fallbackArchive)
+		}
+	}
+	return nil
+}
+
+// healthFields are the meta fields fallbackOfMeta and hasFallback read
+var healthFields = []string{"fallback", "archive_url", "down_since"}
+
+// fallbackOfMeta is where visitors go while the target is down, "" while it isn't or there is nowhere
+func fallbackOfMeta(meta map[string]string) string {
+	if meta["down_since"] == "" {
+		return ""
+	}
+	fallback := meta["fallback"]
+	if fallback == "" {
+		fallback = config.Health.Fallback
+	}
+	if fallback == fallbackArchive {
+		return meta["archive_url"]
+	}
+	return fallback
+}
+
+// hasFallback tells if checking the link's target could change where it sends visitors
+func hasFallback(meta map[string]string) bool {
+	fallback := meta["fallback"]
+	if fallback == "" {
+		fallback = config.Health.Fallback
+	}
+	return (fallback == fallbackArchive && meta["archive_url"] != "") || (fallback != "" && fallback != fallbackArchive)
+}
+
+type HealthReport struct {
+	Checked  int
+	Down     int
+	WentDown []string
+	CameBack []string
+}
+
+// checkLinkHealth checks the target of every link with a fallback
+func checkLinkHealth(redis_db Storage, ctx context.Context, c HealthConfig) (HealthReport, error) {
+	var r HealthReport
+	var mu sync.Mutex
+	record := func(slug string, alive bool, meta map[string]string) {
+		key := keyOfSlugMeta(slug)
+		if alive {
+			if meta["down_since"] == "" && meta["health_failures"] == "" {
+				return
+			}
+			redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.HDel(ctx, key, "down_since", "health_failures")
+				if meta["down_since"] != "" {
+					touchLink(pipe, ctx, slug)
+				}
+				return nil
+			})
+			if meta["down_since"] != "" {
+				purgeLinks(slug)
+				mu.Lock()
+				r.CameBack = append(r.CameBack, slug)
+				mu.Unlock()
+			}
+			return
+		}
+		failures, err := redis_db.HIncrBy(ctx, key, "health_failures", 1).Result()
+		if err != nil {
+			return
+		}
+		if failures < c.Failures {
+			return
+		}
+		mu.Lock()
+		r.Down++
+		mu.Unlock()
+		if meta["down_since"] == "" {
+			redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.HSet(ctx, key, "down_since", time.Now().Unix())
+				touchLink(pipe, ctx, slug)
+				return nil
+			})
+			purgeLinks(slug)
+			mu.Lock()
+			r.WentDown = append(r.WentDown, slug)
+			mu.Unlock()
+		}
+	}
+
+	seen := map[string]bool{}
+	err := scanKeys(redis_db, ctx, keyOfSlug("*"), func(keys []string) error {
+		slugs := []string{}
+		for _, key := range keys {
+			if slug, err := slugFromKey(key); err == nil && !seen[slug] {
+				seen[slug] = true
+				slugs = append(slugs, slug)
+			}
+		}
+		targets := make([]*redis.StringCmd, len(slugs))
+		metas := make([]*redis.SliceCmd, len(slugs))
+		_, err := redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, slug := range slugs {
+				targets[i] = pipe.Get(ctx, keyOfSlug(slug))
+				metas[i] = pipe.HMGet(ctx, keyOfSlugMeta(slug), append(healthFields, "health_failures")...)
+			}
+			return nil
+		})
+		if err != nil && err != redis.Nil {
+			return err
+		}
+
+		var wg sync.WaitGroup
+		slots := make(chan struct{}, sampleChecksAtOnce)
+		for i, slug := range slugs {
+			target, err := targets[i].Result()
+			if err != nil || target == "" {
+				continue // expired since, or a draft
+			}
+			meta := map[string]string{}
+			for j, name := range append(healthFields, "health_failures") {
+				meta[name], _ = metas[i].Val()[j].(string)
+			}
+			if !hasFallback(meta) {
+				continue
+			}
+			r.Checked++
+			wg.Add(1)
+			go func(slug string, target string, meta map[string]string) {
+				defer wg.Done()
+				slots <- struct{}{}
+				defer func() { <-slots }()
+				record(slug, checkLiveness(ctx, target).Alive, meta)
+			}(slug, target, meta)
+		}
+		wg.Wait()
+		return ctx.Err()
+	})
+	return r, err
+}
+
+func healthJob(redis_db Storage, c HealthConfig) scheduledJob {
+	return scheduledJob{name: "link-health", schedule: everySchedule(c.Interval.Duration), run: func(ctx context.Context) error {
+		r, err := checkLinkHealth(redis_db, ctx, c)
+		if err != nil {
+			return err
+		}
+		links_down.Set(float64(r.Down))
+		for _, slug := range r.WentDown {
+			log.Println("Target of", slug, "is down, sending visitors to its fallback")
+		}
+		for _, slug := range r.CameBack {
+			log.Println("Target of", slug, "is back up")
+		}
+		log.Println("Checked", r.Checked, "targets,", r.Down, "down")
+		return nil
+	}}
+}
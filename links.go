@@ -0,0 +1,486 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+// JSON API over individual links, under /api/v1/links
+
+// LinkResponse is how a ShortUrl looks in the API
+type LinkResponse struct {
+	Slug               string                      `json:"slug"`
+	Target             string                      `json:"target"`
+	TargetUnicode      string                      `json:"target_unicode,omitempty"` // when the host is internationalized
+	Homograph          bool                        `json:"homograph,omitempty"`
+	Clicks             int                         `json:"clicks"`
+	UniqueClicks       int                         `json:"unique_clicks"`
+	DedupWindowSeconds int64                       `json:"dedup_window_seconds,omitempty"`
+	TtlSeconds         int64                       `json:"ttl_seconds"`
+	Created            *time.Time                  `json:"created,omitempty"`
+	ExpiresAt          *time.Time                  `json:"expires_at,omitempty"`
+	Aliases            []string                    `json:"aliases"`
+	UnwrappedFrom      []string                    `json:"unwrapped_from,omitempty"`
+	ClicksPerDay       float64                     `json:"clicks_per_day"`
+	CountersLost       bool                        `json:"counters_lost,omitempty"`
+	Visibility         string                      `json:"visibility"`
+	Allow              []string                    `json:"allow,omitempty"`
+	Privacy            string                      `json:"privacy,omitempty"`
+	AppLinks           *AppLinks                   `json:"app_links,omitempty"`
+	Goal               *LinkGoal                   `json:"goal,omitempty"`
+	GoalReached        *time.Time                  `json:"goal_reached,omitempty"`
+	ArchiveURL         string                      `json:"archive_url,omitempty"`
+	Fallback           string                      `json:"fallback,omitempty"`
+	DownSince          *time.Time                  `json:"down_since,omitempty"`
+	ThumbnailURL       string                      `json:"thumbnail_url,omitempty"`
+	Title              string                      `json:"title,omitempty"`
+	Description        string                      `json:"description,omitempty"`
+	Tags               []string                    `json:"tags,omitempty"`
+	Note               string                      `json:"note,omitempty"`
+	Draft              bool                        `json:"draft,omitempty"`
+	Disabled           bool                        `json:"disabled,omitempty"`
+	Readback           *Readback                   `json:"readback,omitempty"`
+	Bundle             []BundleDestinationResponse `json:"bundle,omitempty"`
+	Message            string                      `json:"message,omitempty"`
+}
+
+func linkResponseOf(su ShortUrl) LinkResponse {
+	r := LinkResponse{
+		Slug:               su.Slug,
+		Target:             su.Target,
+		Homograph:          su.Homograph(),
+		Clicks:             su.Clicks,
+		UniqueClicks:       su.UniqueClicks,
+		DedupWindowSeconds: int64(su.DedupWindow.Seconds()),
+		TtlSeconds:         int64(su.Ttl.Seconds()),
+		Aliases:            su.Aliases,
+		UnwrappedFrom:      su.UnwrappedFrom,
+		ClicksPerDay:       su.ClicksPerDay(),
+		CountersLost:       su.CountersLost,
+		Visibility:         visibilityPublic,
+		Allow:              su.Access.Allow,
+		Privacy:            su.Access.Privacy,
+		AppLinks:           su.Access.Apps,
+		Goal:               su.Access.Goal,
+		ArchiveURL:         su.ArchiveURL,
+		Fallback:           su.Fallback,
+		ThumbnailURL:       su.ThumbnailURL(),
+		Title:              su.Title,
+		Description:        su.Description,
+		Tags:               su.Tags,
+		Note:               su.Note,
+		Draft:              su.Access.Draft,
+		Disabled:           su.Access.Disabled,
+		Readback:           su.Readback(),
+		Bundle:             su.BundleDestinations(),
+		Message:            su.Message,
+	}
+	if !su.Access.Public() {
+		r.Visibility = su.Access.Visibility
+	}
+	if display := su.DisplayTarget(); display != su.Target {
+		r.TargetUnicode = display
+	}
+	if !su.Created.IsZero() {
+		created := su.Created.UTC()
+		r.Created = &created
+	}
+	if !su.DownSince.IsZero() {
+		down := su.DownSince.UTC()
+		r.DownSince = &down
+	}
+	if !su.GoalReached.IsZero() {
+		reached := su.GoalReached.UTC()
+		r.GoalReached = &reached
+	}
+	if !su.Expires.IsZero() {
+		expires := su.Expires.UTC()
+		r.ExpiresAt = &expires
+		r.TtlSeconds = int64(su.ExpiresIn().Seconds())
+	}
+	return r
+}
+
+// managedLink loads the link named in the route for a caller allowed to change it,
+// otherwise it writes the error response
+func managedLink(w http.ResponseWriter, req *http.Request, redis_db Storage) (ShortUrl, bool) {
+	su, err := getDetailsOfKey(redis_db, req.Context(), mux.Vars(req)["slug"])
+	if err == errSlugNotFound {
+		writeJSONError(w, http.StatusNotFound, "Slug not found")
+		return su, false
+	} else if err != nil {
+		writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+		return su, false
+	}
+	if !canManageLink(req, su) {
+		writeJSONError(w, http.StatusForbidden, "Only the link's owner can change it")
+		return su, false
+	}
+	return su, true
+}
+
+type LinkListResponse struct {
+	Links      []LinkResponse `json:"links"`
+	NextCursor string         `json:"next_cursor"` // "0" when there are no more
+}
+
+type PreviewResponse struct {
+	Target string `json:"target"`
+	PagePreview
+	FetchError string `json:"fetch_error,omitempty"`
+}
+
+func registerLinkRoutes(router *mux.Router, redis_db Storage) {
+
+	router.HandleFunc("", func(w http.ResponseWriter, req *http.Request) {
+		if _, ok := hasRole(w, req, roleViewer); !ok {
+			return
+		}
+		cursor, page_size, err := pageRequest(req)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if target := req.FormValue("target"); target != "" {
+			slugs, err := linksToTarget(redis_db, req.Context(), target)
+			if err != nil {
+				writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+				return
+			}
+			r := LinkListResponse{Links: []LinkResponse{}, NextCursor: "0"}
+			for _, slug := range slugs {
+				if su, err := getDetailsOfKey(redis_db, req.Context(), slug); err == nil {
+					r.Links = append(r.Links, linkResponseOf(su))
+				}
+			}
+			writeJSON(w, http.StatusOK, r)
+			return
+		}
+
+		sort := req.FormValue("sort")
+		if _, ok := linkIndexes[sort]; sort != "" && !ok {
+			writeJSONError(w, http.StatusBadRequest, "sort must be recent or clicks")
+			return
+		}
+		var links []ShortUrl
+		var next uint64
+		if q := req.FormValue("q"); q != "" {
+			links, next, err = searchLinks(redis_db, req.Context(), q, cursor, page_size)
+		} else {
+			links, next, err = listLinks(redis_db, req.Context(), sort, cursor, page_size)
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		r := LinkListResponse{Links: []LinkResponse{}, NextCursor: strconv.FormatUint(next, 10)}
+		for _, su := range links {
+			r.Links = append(r.Links, linkResponseOf(su))
+		}
+		writeJSON(w, http.StatusOK, r)
+	}).Methods("GET")
+
+	// Everything creation would check, plus where the target ends up; nothing is stored
+	router.HandleFunc("/preview", func(w http.ResponseWriter, req *http.Request) {
+		if _, ok := hasRole(w, req, roleEditor); !ok {
+			return
+		}
+		var body struct {
+			Target string `json:"target"`
+		}
+		if err := readJSON(w, req, &body); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Invalid JSON body")
+			return
+		}
+		if _, err := validateTarget(body.Target); err != nil {
+			writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+
+		r := PreviewResponse{Target: body.Target}
+		preview, err := fetchPage(req.Context(), body.Target)
+		r.PagePreview = preview
+		if err != nil {
+			r.FetchError = err.Error()
+		}
+		writeJSON(w, http.StatusOK, r)
+	}).Methods("POST")
+
+	router.HandleFunc("/{slug:[0-9A-Za-z]+}", func(w http.ResponseWriter, req *http.Request) {
+		su, err := getDetailsOfKey(redis_db, req.Context(), mux.Vars(req)["slug"])
+		if err == errSlugNotFound {
+			writeJSONError(w, http.StatusNotFound, "Slug not found")
+			return
+		} else if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		if !canViewDetails(req, su) {
+			writeJSONError(w, http.StatusForbidden, "Not allowed to see details of this link")
+			return
+		}
+		if notModified(w, req, linkETag(su), su.Modified()) {
+			return
+		}
+		writeJSON(w, http.StatusOK, linkResponseOf(su))
+	}).Methods("GET")
+
+	router.HandleFunc("/{slug:[0-9A-Za-z]+}/geo", func(w http.ResponseWriter, req *http.Request) {
+		su, err := getDetailsOfKey(redis_db, req.Context(), mux.Vars(req)["slug"])
+		if err == errSlugNotFound {
+			writeJSONError(w, http.StatusNotFound, "Slug not found")
+			return
+		} else if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		if !canViewDetails(req, su) {
+			writeJSONError(w, http.StatusForbidden, "Not allowed to see details of this link")
+			return
+		}
+		geo, err := clickGeo(redis_db, req.Context(), []string{su.Slug})
+		if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, geo)
+	}).Methods("GET")
+
+	// Deleting moves the link to the trash, where it can be restored
+	router.HandleFunc("/{slug:[0-9A-Za-z]+}", func(w http.ResponseWriter, req *http.Request) {
+		su, ok := managedLink(w, req, redis_db)
+		if !ok {
+			return
+		}
+		identity, _ := identify(req)
+		t, err := trashLink(redis_db, req.Context(), su.Slug, identity.KeyId)
+		if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		log.Println("Moved", su.Slug, "to trash by", identity.KeyId)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"slug":    su.Slug,
+			"deleted": t.Deleted,
+			"restore": "/api/v1/trash/" + su.Slug + "/restore",
+		})
+	}).Methods("DELETE")
+
+	router.HandleFunc("/{slug:[0-9A-Za-z]+}/aliases", func(w http.ResponseWriter, req *http.Request) {
+		su, ok := managedLink(w, req, redis_db)
+		if !ok {
+			return
+		}
+		var body struct {
+			Alias string `json:"alias"`
+		}
+		if err := readJSON(w, req, &body); err != nil || !aliasIsValid(normalizeSlug(body.Alias)) {
+			message := "alias must be 3 to 64 letters and digits"
+			if config.Slugs.Unicode {
+				message = fmt.Sprintf("alias must be 3 to 64 ASCII letters and digits, or up to %d letters, digits and emoji", config.Slugs.MaxRunes)
+			}
+			writeJSONError(w, http.StatusBadRequest, message)
+			return
+		}
+		body.Alias = normalizeSlug(body.Alias)
+		var warning string
+		if identity, _ := identify(req); !identity.can(roleAdmin) {
+			squatting, err := squattingOf(redis_db, req.Context(), body.Alias)
+			if err != nil {
+				writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+				return
+			}
+			if squatting != "" {
+				log.Println("Suspicious alias", squatting, "by", identity.KeyId)
+				if config.Squatting.Action != "warn" {
+					writeJSONError(w, http.StatusUnprocessableEntity, squatting)
+					return
+				}
+				warning = squatting
+			}
+		}
+		if err := addAlias(redis_db, req.Context(), su.Slug, body.Alias); err == errAliasTaken {
+			writeJSONError(w, http.StatusConflict, err.Error())
+			return
+		} else if err == errNumericName || err == errRouteName {
+			writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		} else if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		reindexTerms(redis_db, req.Context(), su.Slug)
+		r := map[string]string{"alias": body.Alias, "slug": su.Slug}
+		if warning != "" {
+			r["warning"] = warning
+		}
+		writeJSON(w, http.StatusCreated, r)
+	}).Methods("POST")
+
+	router.HandleFunc("/{slug:[0-9A-Za-z]+}/aliases/{alias}", func(w http.ResponseWriter, req *http.Request) {
+		su, ok := managedLink(w, req, redis_db)
+		if !ok {
+			return
+		}
+		if err := removeAlias(redis_db, req.Context(), su.Slug, normalizeSlug(mux.Vars(req)["alias"])); err != nil {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		reindexTerms(redis_db, req.Context(), su.Slug)
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("DELETE")
+
+	// Sets the note and tags; fields left out keep their value
+	router.HandleFunc("/{slug:[0-9A-Za-z]+}", func(w http.ResponseWriter, req *http.Request) {
+		su, ok := managedLink(w, req, redis_db)
+		if !ok {
+			return
+		}
+		var body struct {
+			Note     *string          `json:"note"`
+			Tags     *[]string        `json:"tags"`
+			AppLinks *json.RawMessage `json:"app_links"` // null removes them
+			Goal     *json.RawMessage `json:"goal"`      // null removes it
+			Fallback *string          `json:"fallback"`  // a URL or "archive", "" for health.fallback
+		}
+		if err := readJSON(w, req, &body); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var app_links *AppLinks
+		if body.AppLinks != nil && string(*body.AppLinks) != "null" {
+			app_links = &AppLinks{}
+			if err := json.Unmarshal(*body.AppLinks, app_links); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "app_links: "+err.Error())
+				return
+			}
+			if err := validateAppLinks(*app_links); err != nil {
+				writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+				return
+			}
+		}
+		var goal *LinkGoal
+		if body.Goal != nil && string(*body.Goal) != "null" {
+			goal = &LinkGoal{}
+			if err := json.Unmarshal(*body.Goal, goal); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "goal: "+err.Error())
+				return
+			}
+			if err := validateGoal(*goal); err != nil {
+				writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+				return
+			}
+		}
+		set, unset := map[string]interface{}{}, []string{}
+		if body.Note != nil {
+			if note := strings.TrimSpace(*body.Note); note != "" {
+				set["note"] = truncateRunes(note, maxNoteRunes)
+			} else {
+				unset = append(unset, "note")
+			}
+		}
+		if body.Fallback != nil {
+			if err := validateFallback(*body.Fallback); err != nil {
+				writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+				return
+			}
+			if *body.Fallback != "" {
+				set["fallback"] = *body.Fallback
+			} else {
+				unset = append(unset, "fallback")
+			}
+		}
+		if body.Tags != nil {
+			for _, tag := range *body.Tags {
+				if !tagPattern.MatchString(tag) {
+					writeJSONError(w, http.StatusBadRequest, "tags must be 1 to 32 letters, digits, '_', '.', ':' or '-'")
+					return
+				}
+			}
+			if len(*body.Tags) > 0 {
+				tags := append([]string{}, *body.Tags...)
+				sort.Strings(tags)
+				set["tags"] = strings.Join(tags, ",")
+			} else {
+				unset = append(unset, "tags")
+			}
+		}
+		_, err := redis_db.Pipelined(req.Context(), func(pipe redis.Pipeliner) error {
+			if len(set) > 0 {
+				pipe.HSet(req.Context(), keyOfSlugMeta(su.Slug), set)
+			}
+			if len(unset) > 0 {
+				pipe.HDel(req.Context(), keyOfSlugMeta(su.Slug), unset...)
+			}
+			if len(set)+len(unset) > 0 {
+				touchLink(pipe, req.Context(), su.Slug)
+			}
+			return nil
+		})
+		if err == nil && body.AppLinks != nil {
+			err = setAppLinks(redis_db, req.Context(), su.Slug, app_links)
+		}
+		if err == nil && body.Goal != nil {
+			err = setGoal(redis_db, req.Context(), su.Slug, goal)
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		if body.Fallback != nil {
+			purgeLinks(su.Slug) // cached with the link's access
+		}
+		reindexTerms(redis_db, req.Context(), su.Slug)
+		su, err = getDetailsOfKey(redis_db, req.Context(), su.Slug)
+		if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, linkResponseOf(su))
+	}).Methods("PATCH")
+
+	router.HandleFunc("/{slug:[0-9A-Za-z]+}/share", func(w http.ResponseWriter, req *http.Request) {
+		var body struct {
+			Ttl string `json:"ttl"`
+		}
+		if err := readJSON(w, req, &body); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Invalid JSON body")
+			return
+		}
+		ttl, err := time.ParseDuration(body.Ttl)
+		if err != nil || ttl <= 0 || ttl > config.Details.MaxShareTokenTTL.Duration {
+			writeJSONError(w, http.StatusBadRequest, "ttl must be a positive duration up to "+config.Details.MaxShareTokenTTL.String())
+			return
+		}
+
+		su, err := getDetailsOfKey(redis_db, req.Context(), mux.Vars(req)["slug"])
+		if err == errSlugNotFound {
+			writeJSONError(w, http.StatusNotFound, "Slug not found")
+			return
+		} else if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		if !ownsLink(req, su) {
+			writeJSONError(w, http.StatusForbidden, "Only the link's owner can share it")
+			return
+		}
+
+		expires := time.Now().Add(ttl).UTC()
+		token := shareToken(su.Slug, expires)
+		writeJSON(w, http.StatusCreated, map[string]interface{}{
+			"url":     shareURL(su.Slug, token),
+			"token":   token,
+			"expires": expires,
+		})
+	}).Methods("POST")
+}
@@ -2,31 +2,109 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
+	"flag"
 	"fmt"
-	"html/template"
 	"log"
 	"math/rand"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/go-redis/redis/v8"
-	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 )
 
 type ShortUrl struct {
-	Slug   string
-	Target string
-	Clicks int
-	Ttl    time.Duration
+	Slug          string
+	Target        string
+	Clicks        int
+	UniqueClicks  int
+	DedupWindow   time.Duration
+	Ttl           time.Duration
+	Created       time.Time // zero when unknown
+	LastClick     time.Time
+	Tenant        string
+	Anomaly       bool // flagged for a click spike
+	Aliases       []string
+	UnwrappedFrom []string // short links the target was found behind
+	CountersLost  bool     // clicked before, but the counters are gone (evicted)
+	Access        LinkAccess
+	HasThumbnail  bool
+	Title         string // of the target page, when fetched
+	Description   string
+	Expires       time.Time // from idx:expires, zero when the link isn't indexed
+	Tags          []string
+	Note          string
+	Edited        time.Time         // zero until touchLink
+	GoalReached   time.Time         // zero unless the goal in Access was reached
+	ArchiveURL    string            // a Wayback Machine snapshot of the target
+	Fallback      string            // the link's own, see linkhealth.go
+	DownSince     time.Time         // zero unless the target is known down
+	BundleClicks  map[string]string // of a bundle, by destination
+	Message       string            // the email it was wrapped for, see messages.go
+}
+
+// ExpiresIn is how long until the link expires, from its stored expiry when known
+func (su ShortUrl) ExpiresIn() time.Duration {
+	if su.Expires.IsZero() {
+		return su.Ttl
+	}
+	return time.Until(su.Expires).Round(time.Second)
+}
+
+// ClicksPerDay averages the clicks since creation, 0 when that isn't known
+func (su ShortUrl) ClicksPerDay() float64 {
+	if su.Created.IsZero() || su.CountersLost {
+		return 0
+	}
+	age := time.Since(su.Created)
+	if age < time.Hour {
+		age = time.Hour
+	}
+	return float64(su.Clicks) / age.Hours() * 24
+}
+
+// Modified is when anything shown about the link last changed
+func (su ShortUrl) Modified() time.Time {
+	latest := su.Created
+	for _, t := range []time.Time{su.LastClick, su.Edited} {
+		if t.After(latest) {
+			latest = t
+		}
+	}
+	return latest
+}
+
+// LinkOptions are the optional per-link settings chosen at creation
+type LinkOptions struct {
+	DedupWindow    time.Duration // clicks.dedup_window unless DedupWindowSet
+	DedupWindowSet bool          // so a window of 0 turns dedup off for the link
+	Tenant         string
+	UnwrappedFrom  []string
+	Access         LinkAccess
+	Ttl            time.Duration // default_ttl when 0
+	Tags           []string
+	ManagedBy      string              // the sync file owning the link, if any
+	Activated      bool                // confirmed by its anonymous creator, see activation.go
+	Draft          bool                // created without a target, see drafts.go
+	Numeric        bool                // a slug of digits only, see numeric.go
+	Bundle         []BundleDestination // a bundle, without a target, see bundles.go
 }
 
 type ServerSummary struct {
-	KnownSlugs   []ShortUrl
-	KeyspaceInfo string
+	KnownSlugs []ShortUrl
+	NextCursor uint64
+	PageSize   int
+	Sort       string
+	Query      string
+	Stats      Stats
+	CSRFToken  string
+	NeedsEmail bool // anonymous links are held for activation
+	Numeric    bool // numeric slugs can be asked for
 }
 
 func init() {
@@ -35,6 +113,8 @@ func init() {
 
 var default_ttl, _ = time.ParseDuration("1h")
 
+var config = defaultConfig()
+
 const runes = "abcdefghjklmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ1234567890"
 
 func randomSlug() string {
@@ -73,22 +153,56 @@ func keyOfSlugHitCount(slug string) string {
 	return "urlhitcount:" + slug
 }
 
-func store(redis_db redis.Client, ctx context.Context, target string) (ShortUrl, error) {
+func keyOfSlugUniqueHitCount(slug string) string {
+	return "urluniqhitcount:" + slug
+}
+
+func keyOfSlugMeta(slug string) string {
+	return "urlmeta:" + slug
+}
+
+// atoiOrZero parses a stored count, giving 0 for "" or junk
+func atoiOrZero(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+// unixTime parses a stored unix timestamp, giving the zero time for "" or junk
+func unixTime(s string) time.Time {
+	if seconds, err := strconv.ParseInt(s, 10, 64); err == nil && seconds > 0 {
+		return time.Unix(seconds, 0)
+	}
+	return time.Time{}
+}
+
+func store(redis_db Storage, ctx context.Context, target string, opts LinkOptions) (ShortUrl, error) {
 	// Persist a new short->long pair into the database, with 0 stats
 
 	for attempt := 0; attempt < 10; attempt++ {
 		slug := randomSlug()
-		val, err := redis_db.SetNX(ctx, keyOfSlug(slug), target, default_ttl).Result()
+		if opts.Numeric {
+			slug = randomNumericSlug(config.Slugs.Numeric.Length)
+		}
+		for !opts.Numeric && inNumericNamespace(slug) {
+			slug = randomSlug()
+		}
+		created := time.Now()
+		written, err := createLink(redis_db, ctx, slug, target, opts, created)
+		if err != nil {
+			return ShortUrl{}, err
+		}
 
-		if err == nil && val == true {
+		if written {
 			// Success
 			log.Println("Successfully created new value", slug, "for target", target)
 
 			new_short_url := ShortUrl{
-				Slug:   slug,
-				Target: target,
-				Clicks: 0,
-				Ttl:    default_ttl,
+				Slug:        slug,
+				Target:      target,
+				Clicks:      0,
+				DedupWindow: opts.dedupWindow(),
+				Ttl:         default_ttl,
+				Created:     created,
 			}
 			return new_short_url, nil
 		} else {
@@ -99,140 +213,658 @@ func store(redis_db redis.Client, ctx context.Context, target string) (ShortUrl,
 	return ShortUrl{}, errors.New("Could not store new url after several attempts")
 }
 
-func getDetailsOfKey(redis_db redis.Client, ctx context.Context, slug string) (ShortUrl, error) {
+func getDetailsOfKey(redis_db Storage, ctx context.Context, slug string) (ShortUrl, error) {
 	var target *redis.StringCmd
-	var counter *redis.IntCmd
+	var counters *redis.SliceCmd
 	var ttl *redis.DurationCmd
+	var meta *redis.StringStringMapCmd
+	var aliases *redis.StringSliceCmd
+	var expires *redis.FloatCmd
+	var bundle_clicks *redis.StringStringMapCmd
 
+	// Only reads: counters are created by the first click, and TTLs extended
+	// by clicks, not by looking
 	_, err := redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
 		target = pipe.Get(ctx, keyOfSlug(slug))
-		counter = pipe.IncrBy(ctx, keyOfSlugHitCount(slug), 0)
+		counters = pipe.MGet(ctx, keyOfSlugHitCount(slug), keyOfSlugUniqueHitCount(slug))
 		ttl = pipe.TTL(ctx, keyOfSlug(slug))
+		meta = pipe.HGetAll(ctx, keyOfSlugMeta(slug))
+		aliases = pipe.SMembers(ctx, keyOfSlugAliases(slug))
+		expires = pipe.ZScore(ctx, keyOfExpiresIndex, slug)
+		bundle_clicks = pipe.HGetAll(ctx, keyOfBundleClicks(slug))
 		return nil
 	})
+	if err == redis.Nil {
+		// only a missing target means a missing link; an unindexed one is fine
+		err = target.Err()
+	}
 
 	if err == nil {
+		clicks, counted := counters.Val()[0].(string)
+		unique_clicks, _ := counters.Val()[1].(string)
+		last_click := unixTime(meta.Val()["last_click"])
+		var expires_at time.Time
+		if e := expires.Val(); e > 0 {
+			expires_at = time.Unix(int64(e), 0)
+		}
 		return ShortUrl{
-			Slug:   slug,
-			Target: target.Val(),
-			Clicks: int(counter.Val()),
-			Ttl:    ttl.Val(),
+			Slug:          slug,
+			Target:        target.Val(),
+			Clicks:        atoiOrZero(clicks),
+			UniqueClicks:  atoiOrZero(unique_clicks),
+			CountersLost:  !counted && !last_click.IsZero(),
+			DedupWindow:   dedupWindowOfMeta(meta.Val()),
+			Ttl:           ttl.Val(),
+			Created:       unixTime(meta.Val()["created"]),
+			LastClick:     last_click,
+			Tenant:        meta.Val()["tenant"],
+			Anomaly:       anomalyIsCurrent(meta.Val()),
+			Aliases:       aliases.Val(),
+			UnwrappedFrom: unwrapChainOfMeta(meta.Val()),
+			Access:        accessOfMeta(meta.Val()),
+			HasThumbnail:  meta.Val()["thumbnail"] != "",
+			Title:         meta.Val()["title"],
+			Description:   meta.Val()["description"],
+			Tags:          tagsOfMeta(meta.Val()),
+			Note:          meta.Val()["note"],
+			GoalReached:   unixTime(meta.Val()["goal_reached"]),
+			ArchiveURL:    meta.Val()["archive_url"],
+			Fallback:      meta.Val()["fallback"],
+			DownSince:     unixTime(meta.Val()["down_since"]),
+			Expires:       expires_at,
+			Edited:        unixTime(meta.Val()["modified"]),
+			BundleClicks:  bundle_clicks.Val(),
+			Message:       meta.Val()["message"],
 		}, nil
 	}
-	return ShortUrl{}, err
+	return ShortUrl{}, lookupError("details of "+slug, err)
 }
 
-func sampleExisting(redis_db redis.Client, ctx context.Context) []ShortUrl {
+// sampleExisting returns about page_size links starting at a SCAN cursor, and the
+// cursor to continue from (0 once the keyspace is exhausted). SCAN may return
+// more than asked for in one step; those are kept rather than skipped.
+func sampleExisting(redis_db Storage, ctx context.Context, cursor uint64, page_size int) ([]ShortUrl, uint64, error) {
 
 	r := []ShortUrl{}
 
-	// Get a slice of keys, discard cursor
-	if keys, _, err := redis_db.Scan(ctx, 0, keyOfSlug("*"), 10).Result(); err == nil {
+	for {
+		keys, next, err := redis_db.Scan(ctx, cursor, keyOfSlug("*"), int64(page_size)).Result()
+		if err != nil {
+			return r, cursor, err
+		}
 		for _, v := range keys {
 			if slug, err := slugFromKey(v); err == nil {
-				if su, err := getDetailsOfKey(redis_db, ctx, slug); err == nil {
+				su, err := getDetailsOfKey(redis_db, ctx, slug)
+				if err == nil {
 					r = append(r, su)
+				} else if err != errSlugNotFound {
+					return r, cursor, err
 				}
 			}
 		}
+		cursor = next
+		if cursor == 0 || len(r) >= page_size {
+			return r, cursor, nil
+		}
+	}
+}
+
+// pageRequest reads ?cursor= and ?limit= for listings
+func pageRequest(req *http.Request) (uint64, int, error) {
+	var cursor uint64
+	page_size := config.Listing.PageSize
+	if v := req.FormValue("cursor"); v != "" {
+		c, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return 0, 0, errors.New("Invalid cursor")
+		}
+		cursor = c
+	}
+	if v := req.FormValue("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > config.Listing.MaxPageSize {
+			return 0, 0, fmt.Errorf("limit must be between 1 and %d", config.Listing.MaxPageSize)
+		}
+		page_size = n
 	}
-	return r
+	return cursor, page_size, nil
 }
 
 func main() {
 
-	redis_db := redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379",
-		Password: "", // no password set
-		DB:       0,  // use default DB
-	})
+	config_path := flag.String("config", os.Getenv("SHORTENER_CONFIG"), "path to JSON config file")
+	profile := flag.String("profile", "full", "full, or redirector to serve only redirects and health checks")
+	flag.Parse()
+
+	if *profile != "full" && *profile != "redirector" {
+		log.Fatalln("Unknown profile", *profile)
+	}
+	// The internet-facing tier can run as a redirector, leaving management to a private instance
+	redirector_only := *profile == "redirector"
+
+	if c, err := loadConfig(*config_path); err == nil {
+		config = c
+	} else {
+		log.Fatalln("Cannot load config", *config_path, err)
+	}
+	// A replica region only serves redirects
+	redirector_only = redirector_only || config.Region.replica()
+	logRegion(config.Region)
+	if err := loadCatalogs(config.Locales); err != nil {
+		log.Fatalln("Cannot load message catalogs", err)
+	}
+
+	redis_db, err := newStorage(config)
+	if err != nil {
+		log.Fatalln("Cannot set up Redis", err)
+	}
+	registerPoolMetrics(redis_db, config.Redis)
+	shared_cache = newSharedCache(config.Cache.Shared)
+	breaker := newCircuitBreaker(config.Circuit)
+	if breaker != nil {
+		redis_db.AddHook(breaker)
+	}
+	redis_db.AddHook(timeoutHook{op_timeout: config.Redis.OpTimeout.Duration})
+	redis_db.AddHook(traceHook{})
+	if err := verifyStorage(context.Background(), redis_db); err != nil {
+		log.Fatalln(err)
+	}
+	if err := checkEvictionPolicy(redis_db, config.RedisMemory); err != nil {
+		log.Fatalln(err)
+	}
+	// Clicks are written where links are
+	writes_db := redis_db
+	if config.Region.replica() {
+		if primary_db, err = newPrimaryRedis(config.Region); err != nil {
+			log.Fatalln(err)
+		}
+		writes_db = primary_db
+	}
+
+	if err := compileRewrites(config.Rewrites); err != nil {
+		log.Fatalln("Cannot load rewrite rules", err)
+	}
+
+	if err := setupSearch(redis_db, context.Background(), config.Search); err != nil {
+		log.Fatalln("Cannot set up search", err)
+	}
+
+	if runCommand(flag.Args(), redis_db) {
+		return
+	}
+
+	if config.Migrations.OnStart && !config.Region.replica() {
+		if err := migrateKeyspace(redis_db, context.Background(), config.Migrations); err != nil {
+			log.Fatalln("Cannot migrate keyspace", err)
+		}
+	}
+
+	if *seed_demo_data {
+		if err := seedDemoData(redis_db, context.Background(), demoLinks); err != nil {
+			log.Fatalln("Cannot seed demo data", err)
+		}
+	}
+
+	if !redirector_only {
+		jobs := []scheduledJob{orphansJob(redis_db), integrityJob(redis_db), expiresIndexJob(redis_db)}
+		if config.Backup.Driver != "" {
+			store, err := newBlobStore(config.Backup)
+			if err != nil {
+				log.Fatalln("Cannot set up backup", err)
+			}
+			jobs = append(jobs, backupJob(redis_db, store, config.Backup))
+		}
+		if config.Anomaly.Enabled {
+			jobs = append(jobs, anomalyJob(redis_db, config.Anomaly))
+		}
+		if events, hourly := analyticsRetention(config); events > 0 || hourly > 0 {
+			jobs = append(jobs, pruneAnalyticsJob(redis_db))
+		}
+		if config.Health.Enabled {
+			jobs = append(jobs, healthJob(redis_db, config.Health))
+		}
+		if config.Metering.Enabled {
+			jobs = append(jobs, meteringJob(redis_db))
+		}
+		if config.Kubernetes.Enabled {
+			k, err := newKubernetesClient(config.Kubernetes)
+			if err != nil {
+				log.Fatalln("Cannot set up Kubernetes", err)
+			}
+			jobs = append(jobs, kubernetesJob(redis_db, k, config.Kubernetes))
+		}
+		runScheduler(redis_db, jobs)
+	}
+
+	click_retries := newClickRetryBuffer(config.Clicks.RetryBufferSize)
+	go click_retries.run(writes_db)
+
+	if config.GDPR.Enabled {
+		visitor_salts = newVisitorSalts(writes_db, config.GDPR)
+	}
+	click_sink, err := newClickSink(config.Clicks, writes_db)
+	if err != nil {
+		log.Fatalln("Cannot set up click sinks", err)
+	}
+
+	if config.SAML.IdPSSOURL != "" {
+		if saml_provider, err = newSAMLProvider(config.SAML); err != nil {
+			log.Fatalln("Cannot set up SAML", err)
+		}
+	}
+
+	resolved_slugs := newResolvedSlugs(config.Circuit.CacheSize)
+	go resolved_slugs.preloadPeriodically(redis_db, config.Cache)
+	if tracked_slugs = newTrackedSlugs(redis_db, config.Cache.Tracking); tracked_slugs != nil {
+		go tracked_slugs.listen(config.Redis)
+	}
+	if abuse = newAbuseTracker(config.Abuse); abuse != nil {
+		go abuse.refreshBlocklist(redis_db)
+	}
+	// Kept up even with rotation off, so keys rotated before stay as they were
+	go rotated_keys.refresh(redis_db)
+	registerMemoryMetrics()
+	go redis_memory.watch(redis_db, config.RedisMemory)
+	go watchShards(redis_db, config.Shards)
 
 	router := mux.NewRouter()
+	router.MethodNotAllowedHandler = methodNotAllowed(router)
+	if config.Region.replica() {
+		router.NotFoundHandler = http.HandlerFunc(forwardToPrimary)
+	}
+	router.Use(withRouteLimits)
+	router.Use(withRegion)
+	router.Use(withBlocklist)
+	router.Use(withClientCerts)
+	router.Use(withSignedRequests(redis_db))
+	// Registered ahead of the slug route, which would match these paths too
+	registerHealthRoutes(router, redis_db, breaker)
+	// A replica region is watched like any other, though it only redirects
+	if !redirector_only || config.Region.replica() {
+		router.HandleFunc("/metrics", writeMetrics).Methods("GET")
+	}
 
-	router.HandleFunc("/{slug:[0-9A-Za-z]+}", func(w http.ResponseWriter, req *http.Request) {
+	follow := func(w http.ResponseWriter, req *http.Request) {
+		uncached(w)
 		// Find the matching key in redis
 		_, details := req.URL.Query()["details"]
+		if details && config.Region.replica() {
+			forwardToPrimary(w, req)
+			return
+		}
+		if details && redirector_only {
+			writeLocalizedError(w, req, http.StatusNotFound, "Details are not served here")
+			return
+		}
+
+		if !checkBackoff(w, req) {
+			return
+		}
 
 		vars := mux.Vars(req)
-		slug := vars["slug"]
-		if !slugIsValid(slug) {
-			w.WriteHeader(http.StatusNotAcceptable)
-			fmt.Fprintf(w, "Invalid slug")
+		slug := compactNumeric(normalizeSlug(vars["slug"]))
+		if !slugIsValid(slug) && !aliasIsValid(slug) && !(config.GoLinks.Enabled && keywordIsValid(slug)) {
+			if config.GoLinks.Enabled {
+				goLinkNotFound(w, req, slug)
+				return
+			}
+			writeLocalizedError(w, req, http.StatusNotAcceptable, "Invalid slug")
 			return
 		}
-		if target, err := redis_db.Get(req.Context(), keyOfSlug(slug)).Result(); err == nil {
+		// aliases count against, and show, their link
+		requested := slug
+		var link resolvedSlug
+		var err error
+		if cached, ok := tracked_slugs.get(requested); ok && !details {
+			link = cached
+		} else if cached, ok := resolved_slugs.fresh(requested, config.Cache.TTL.Duration); ok && !details {
+			link, err = cached, cached.err()
+		} else {
+			if details {
+				link, err = resolveLink(redis_db, req.Context(), requested)
+			} else {
+				since := tracked_slugs.begin()
+				link, err = shared_cache.resolveLink(redis_db, req.Context(), requested)
+				link, err = notReplicatedYet(req.Context(), requested, link, err)
+				if err == nil {
+					tracked_slugs.put(requested, link, since)
+				}
+				// during a Redis outage, redirects fall back on recently resolved slugs
+				link, err = resolved_slugs.remember(requested, link, err)
+			}
+		}
+		slug, target := link.slug, link.target
+		countLookup(err)
+		if err == nil {
 			var counter *redis.IntCmd
 			if details {
 
-				var ttl *redis.DurationCmd
-				redis_db.Pipelined(req.Context(), func(pipe redis.Pipeliner) error {
-					counter = pipe.IncrBy(req.Context(), keyOfSlugHitCount(slug), 0)
-					ttl = pipe.TTL(req.Context(), keyOfSlug(slug))
-					return nil
-				})
-
-				d := ShortUrl{
-					Slug:   slug,
-					Target: target,
-					Clicks: int(counter.Val()),
-					Ttl:    ttl.Val(),
-				}
-				t, _ := template.ParseFiles("details.html")
-				t.Execute(w, d)
+				d, err := getDetailsOfKey(redis_db, req.Context(), slug)
+				if err != nil && err != errSlugNotFound {
+					log.Println("Storage error reading details of", slug, "request", req.Header.Get(requestIDHeader), err)
+					writeUnavailable(w)
+					return
+				} else if err != nil {
+					writeLocalizedError(w, req, http.StatusNotFound, "Slug not found")
+					return
+				}
+				if !canViewDetails(req, d) {
+					writeLocalizedError(w, req, http.StatusForbidden, "Not allowed to see details of this link")
+					return
+				}
+				// the same link is a different page in each language
+				locale := setLanguage(w, req)
+				if notModified(w, req, localizedETag(linkETag(d), locale), d.Modified()) {
+					return
+				}
+				renderPage(w, req, "details.html", brandingOf(d.Tenant), d)
 			} else {
+				if !checkAccess(w, req, link.access) {
+					return
+				}
+				if link.access.Draft {
+					// not a click, there's nowhere to go yet
+					writeDraftPage(redis_db, w, req, slug)
+					return
+				}
+
 				// Count the hit and extend the TTL
 
-				redis_db.Pipelined(req.Context(), func(pipe redis.Pipeliner) error {
-					counter = redis_db.Incr(req.Context(), keyOfSlugHitCount(slug))
-					pipe.Expire(req.Context(), keyOfSlugHitCount(slug), default_ttl)
-					pipe.Expire(req.Context(), keyOfSlug(slug), default_ttl)
-					return nil
-				})
+				now := time.Now()
+				opted_out := optedOut(req)
+				var err error
+				counter, err = countClick(writes_db, req.Context(), slug, link.access, !opted_out || config.OptOut.CountClicks, now)
+				if err != nil && counter != nil {
+					// the redirect goes ahead regardless, the count is retried later
+					click_retries.add(slug, link.access.clickTTL(), now, err)
+				}
+
+				if opted_out {
+					// nothing which tells this visitor's clicks apart
+					opted_out_clicks.Inc("counted", strconv.FormatBool(counter != nil))
+				} else {
+					if window := dedupWindowOfSlug(redis_db, req.Context(), slug); window > 0 {
+						countUniqueClick(writes_db, req.Context(), slug, link.access.clickTTL(), visitorOf(req), window)
+					}
+
+					ev := clickEventOf(req, slug)
+					ev.Party, ev.UID = attributionOf(req, requested)
+					click_sink.Record(ev)
+				}
 
 				//counter, _ := redis_db.Incr(req.Context(), keyOfSlugHitCount(slug)).Result()
-				log.Println("Incremented counter for slug", slug, "to", counter.Val())
+				if counter != nil {
+					log.Println("Incremented counter for slug", slug, "to", counter.Val())
+				}
+				if len(link.access.Bundle) > 0 {
+					// counted as a click, but there's a choice of where to go
+					writeBundlePage(redis_db, w, req, slug, link.access)
+					return
+				}
+				if err == nil && counter != nil && link.access.Goal != nil {
+					target = goalTarget(writes_db, req.Context(), slug, target, link.access.Goal, counter.Val())
+				}
 				// do the redirect
-				http.Redirect(w, req, target, http.StatusFound)
+				destination := ShortUrl{Slug: slug, Target: rewriteTarget(target)}
+				if config.Policy.HomographInterstitial && destination.Homograph() {
+					destination.HasThumbnail, _ = redis_db.HExists(req.Context(), keyOfSlugMeta(slug), "thumbnail").Result()
+					writeHomographWarning(w, req, destination)
+					return
+				}
+				writeRedirect(w, req, slug, destination.Target, link.access)
 			}
 			//fmt.Fprintf(w, target)
 
 			return
 			// Do the redirect
 		}
+		if err != errSlugNotFound {
+			log.Println("Storage error looking up", requested, "request", req.Header.Get(requestIDHeader), err)
+			writeUnavailable(w)
+			return
+		}
+		if !caughtInHoneypot(redis_db, writes_db, req, requested) {
+			countMiss(req)
+		}
+		if config.GoLinks.Enabled && !details {
+			goLinkNotFound(w, req, requested)
+			return
+		}
 
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprintf(w, "Slug uot found")
+		writeLocalizedError(w, req, http.StatusNotFound, "Slug not found")
 
-	})
+	}
+	router.HandleFunc("/{slug:[0-9A-Za-z]+}", follow).Methods("GET", "HEAD")
+	if config.Slugs.Numeric.Enabled {
+		// numeric slugs as printed, in groups
+		router.HandleFunc("/{slug:[0-9]+(?:-[0-9]+)+}", follow).Methods("GET", "HEAD")
+	}
+	registerThumbnailRoutes(router, redis_db)
+	registerAppLinkRoutes(router, redis_db)
+	registerBundleRoutes(router, redis_db, writes_db)
+	registerOptOutRoutes(router)
+
+	if !redirector_only {
+		registerBadgeRoutes(router, redis_db)
+		registerFeedRoutes(router, redis_db)
+
+		router.HandleFunc("/_create", func(w http.ResponseWriter, req *http.Request) {
+			if !requireLogin(w, req) || !checkCSRF(w, req) {
+				return
+			}
+			identity, ok := identify(req)
+			if !ok {
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprintf(w, "Unknown API key")
+				return
+			}
+
+			opts := LinkOptions{Numeric: req.FormValue("numeric") != ""}
+			if opts.Numeric && !config.Slugs.Numeric.Enabled {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "Numeric slugs aren't enabled")
+				return
+			}
+			if v := req.FormValue("dedup_window"); v != "" {
+				window, err := time.ParseDuration(v)
+				if err != nil || window < 0 || (window > 0 && window < time.Second) {
+					// windows are kept in whole seconds
+					w.WriteHeader(http.StatusBadRequest)
+					fmt.Fprintf(w, "Invalid dedup_window, must be 0 or at least 1s")
+					return
+				}
+				opts.DedupWindow, opts.DedupWindowSet = window, true
+			}
+			if opts.Access, err = parseLinkAccess(req.FormValue("visibility"), req.FormValue("allow")); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "%v", err)
+				return
+			}
+			if opts.Access.Privacy, err = parseLinkPrivacy(req.FormValue("privacy")); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "%v", err)
+				return
+			}
 
-	router.HandleFunc("/_create", func(w http.ResponseWriter, req *http.Request) {
-		target := req.FormValue("target")
+			keyword := keywordOf(req.FormValue("keyword"))
+			if keyword != "" {
+				if !config.GoLinks.Enabled || !keywordIsValid(keyword) {
+					w.WriteHeader(http.StatusBadRequest)
+					fmt.Fprintf(w, "Invalid keyword")
+					return
+				}
+				if inNumericNamespace(keyword) {
+					w.WriteHeader(http.StatusUnprocessableEntity)
+					fmt.Fprintf(w, "%v", errNumericName)
+					return
+				}
+				if isRouteName(keyword) {
+					w.WriteHeader(http.StatusUnprocessableEntity)
+					fmt.Fprintf(w, "%v", errRouteName)
+					return
+				}
+				if _, _, err := resolveSlug(redis_db, req.Context(), keyword); err == nil {
+					w.WriteHeader(http.StatusConflict)
+					fmt.Fprintf(w, "Keyword is already in use")
+					return
+				} else if err != redis.Nil {
+					writeUnavailable(w)
+					return
+				}
+				if err := checkKeyword(redis_db, req.Context(), identity, keyword); err != nil {
+					if _, refused := err.(KeywordRefusedError); refused {
+						w.WriteHeader(http.StatusUnprocessableEntity)
+						fmt.Fprintf(w, "%v", err)
+					} else {
+						writeUnavailable(w)
+					}
+					return
+				}
+			}
 
-		if su, err := store(*redis_db, req.Context(), target); err == nil {
-			// Success, redirect to info url
-			http.Redirect(w, req, "/"+su.Slug+"?details", http.StatusCreated)
-		} else {
-			w.WriteHeader(http.StatusConflict)
-			fmt.Fprintf(w, "Failed to create: %v", err)
-		}
+			if needsActivation(identity) {
+				holdLink(redis_db, w, req, identity, keyword, opts)
+				return
+			}
 
-	})
+			if su, status, err := shorten(redis_db, w, req, identity, req.FormValue("target"), opts); err == nil {
+				if keyword != "" {
+					if err := addAlias(redis_db, req.Context(), su.Slug, keyword); err != nil {
+						// the link stays, under its random slug
+						log.Println("Keyword", keyword, "not added to", su.Slug, err)
+						w.WriteHeader(http.StatusConflict)
+						fmt.Fprintf(w, "Created %v, but not the keyword %v: %v", publicURL(req, "/"+su.Slug), keyword, err)
+						return
+					}
+					su.Aliases = []string{keyword}
+					reindexTerms(redis_db, req.Context(), su.Slug)
+				}
+				writeCreated(w, req, su)
+			} else if status == http.StatusServiceUnavailable {
+				writeUnavailable(w)
+			} else {
+				w.WriteHeader(status)
+				fmt.Fprintf(w, "%v", err)
+			}
 
-	router.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		}).Methods("POST")
 
-		summary := ServerSummary{}
+		router.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+			if !requireLogin(w, req) {
+				return
+			}
+			identity, ok := identify(req)
+			if !ok || !identity.can(roleViewer) {
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprintf(w, "Needs the viewer role")
+				return
+			}
 
-		summary.KnownSlugs = sampleExisting(*redis_db, req.Context())
+			summary := ServerSummary{}
 
-		if keyspace_stats, err := redis_db.Info(req.Context(), "keyspace").Result(); err == nil {
-			summary.KeyspaceInfo = keyspace_stats
+			cursor, page_size, err := pageRequest(req)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "%v", err)
+				return
+			}
+			summary.Sort = req.FormValue("sort")
+			summary.Query = req.FormValue("q")
+			if summary.Query != "" {
+				summary.KnownSlugs, summary.NextCursor, err = searchLinks(redis_db, req.Context(), summary.Query, cursor, page_size)
+			} else {
+				summary.KnownSlugs, summary.NextCursor, err = listLinks(redis_db, req.Context(), summary.Sort, cursor, page_size)
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "%v", err)
+				return
+			}
+			summary.PageSize = page_size
+
+			summary.Stats = gatherStats(redis_db, req.Context())
+			summary.CSRFToken = csrfToken(w, req)
+			summary.NeedsEmail = needsActivation(identity)
+			summary.Numeric = config.Slugs.Numeric.Enabled
+
+			setLanguage(w, req)
+			renderPage(w, req, "index.html", brandingOf(identity.Tenant), summary)
+
+		}).Methods("GET", "HEAD")
+
+		registerCompatRoutes(router, redis_db)
+		registerDuplicatesPage(router, redis_db)
+		registerCompareRoutes(router, redis_db)
+		registerPasteRoutes(router, redis_db)
+		if config.Metering.Enabled {
+			registerUsageRoutes(router, redis_db)
+		}
+		if config.Activation.Enabled {
+			registerActivationRoutes(router, redis_db)
+		}
+		if saml_provider != nil {
+			registerSAMLRoutes(router.PathPrefix("/saml").Subrouter(), redis_db, saml_provider)
+		}
+		registerCampaignRoutes(router.PathPrefix("/api/v1/campaigns").Subrouter(), redis_db)
+		registerLinkRoutes(router.PathPrefix("/api/v1/links").Subrouter(), redis_db)
+		registerReservationRoutes(router.PathPrefix("/api/v1/reservations").Subrouter(), redis_db)
+		registerDraftRoutes(router.PathPrefix("/api/v1/drafts").Subrouter(), redis_db)
+		registerBundleAPIRoutes(router.PathPrefix("/api/v1/bundles").Subrouter(), redis_db)
+		if config.EmailGateway.Enabled {
+			registerMessageRoutes(router.PathPrefix("/api/v1/messages").Subrouter(), redis_db)
+		}
+		if config.KeyRotation.Enabled {
+			registerKeyRoutes(router.PathPrefix("/api/v1/keys").Subrouter(), redis_db)
+		}
+		router.HandleFunc("/api/v1/search", handleSearch(redis_db)).Methods("GET")
+		if config.GDPR.Enabled {
+			registerPrivacyRoutes(router)
 		}
+		registerTrashRoutes(router.PathPrefix("/api/v1/trash").Subrouter(), redis_db)
+		registerAdminRoutes(router.PathPrefix("/api/v1/admin").Subrouter(), redis_db)
+		router.HandleFunc("/api/v1/stats", func(w http.ResponseWriter, req *http.Request) {
+			if _, ok := hasRole(w, req, roleViewer); !ok {
+				return
+			}
+			writeJSON(w, http.StatusOK, gatherStats(redis_db, req.Context()))
+		}).Methods("GET")
+	}
+	if config.Slugs.Unicode || config.GoLinks.Enabled {
+		// Last, so every other single-segment route is matched first. mux matches the
+		// decoded path, so percent-encoded slugs and keywords with spaces arrive decoded.
+		// Paths starting with _ are left to the routes above, to answer 405 there.
+		router.HandleFunc("/{slug:[^_/][^/]*}", follow).Methods("GET", "HEAD")
+	}
 
-		t, _ := template.ParseFiles("index.html")
-		t.Execute(w, summary)
+	logged_router, err := accessLogHandler(config.AccessLog, withRecovery(withRedisBudget(config.Redis.RequestBudget.Duration, withOptions(router))))
+	if err != nil {
+		log.Fatalln("Cannot set up access log", err)
+	}
 
-	})
+	server := &http.Server{
+		Addr:              config.Server.Listen,
+		Handler:           withRequestID(logged_router),
+		ReadTimeout:       config.Server.ReadTimeout.Duration,
+		ReadHeaderTimeout: config.Server.ReadHeaderTimeout.Duration,
+		WriteTimeout:      config.Server.WriteTimeout.Duration,
+		IdleTimeout:       config.Server.IdleTimeout.Duration,
+		MaxHeaderBytes:    config.Server.MaxHeaderBytes,
+	}
+	server.SetKeepAlivesEnabled(config.Server.KeepAlives)
+	if !config.Server.HTTP2 {
+		// A non-nil empty map turns off the automatic h2 upgrade
+		server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
 
-	log.Println("Listing for requests at http://localhost:8000/")
-	log.Fatal(http.ListenAndServe(":8000", handlers.CombinedLoggingHandler(os.Stdout, router)))
+	if config.Server.ClientCerts.enabled() {
+		if server.TLSConfig, err = clientCertsTLSConfig(config.Server.ClientCerts); err != nil {
+			log.Fatalln("Cannot set up client certificates", err)
+		}
+	}
+	if config.Server.TLSCertFile != "" {
+		log.Println("Listing for requests at https://" + config.Server.Listen + "/")
+		log.Fatal(server.ListenAndServeTLS(config.Server.TLSCertFile, config.Server.TLSKeyFile))
+	}
+	log.Println("Listing for requests at http://" + config.Server.Listen + "/")
+	log.Fatal(server.ListenAndServe())
 }
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Redis keeps every link in memory. Once it reaches maxmemory, an eviction
+// policy drops keys to make room: allkeys-* any link, and volatile-* any
+// link too, since they all expire. Only noeviction refuses writes instead, so
+// anything else is warned about at startup, or refused with
+// redis_memory.eviction_policy: "fail".
+//
+// The memory in use is read every interval, for /metrics and /api/v1/stats.
+// Above max_used_bytes, or max_used_ratio of maxmemory, no link is created:
+// better to refuse a new link than to lose an old one, whatever the policy.
+// With shards, each server is held to the cap, and the figures are totals.
+
+type RedisMemoryConfig struct {
+	EvictionPolicy string   `json:"eviction_policy"` // warn (the default), fail or ignore
+	MaxUsedBytes   int64    `json:"max_used_bytes"`
+	MaxUsedRatio   float64  `json:"max_used_ratio"` // of maxmemory, when Redis has one
+	Interval       Duration `json:"interval"`
+}
+
+func validateRedisMemory(c RedisMemoryConfig) error {
+	if c.EvictionPolicy != "warn" && c.EvictionPolicy != "fail" && c.EvictionPolicy != "ignore" {
+		return errors.New("redis_memory.eviction_policy must be warn, fail or ignore")
+	}
+	if c.MaxUsedBytes < 0 || c.MaxUsedRatio < 0 || c.MaxUsedRatio > 1 {
+		return errors.New("redis_memory.max_used_bytes can't be negative, and max_used_ratio must be from 0 to 1")
+	}
+	if c.Interval.Duration <= 0 {
+		return errors.New("redis_memory.interval must be positive")
+	}
+	return nil
+}
+
+// RedisMemory is what INFO said last
+type RedisMemory struct {
+	UsedBytes   int64     `json:"used_bytes"`
+	MaxBytes    int64     `json:"max_bytes,omitempty"` // 0 when Redis has no maxmemory
+	Policy      string    `json:"policy"`
+	EvictedKeys int64     `json:"evicted_keys"`
+	Full        bool      `json:"full"` // creation is refused
+	At          time.Time `json:"at"`
+}
+
+func infoFields(info string) map[string]string {
+	fields := map[string]string{}
+	for _, line := range strings.Split(info, "\n") {
+		if i := strings.IndexByte(line, ':'); i > 0 && !strings.HasPrefix(line, "#") {
+			fields[line[:i]] = strings.TrimSpace(line[i+1:])
+		}
+	}
+	return fields
+}
+
+func readRedisMemory(redis_db Storage, ctx context.Context) (RedisMemory, error) {
+	total := RedisMemory{At: time.Now()}
+	for i, server := range storageServers(redis_db) {
+		m, err := readServerMemory(server.client, ctx)
+		if err != nil {
+			return RedisMemory{}, fmt.Errorf("%s: %v", server.name, err)
+		}
+		total.UsedBytes += m.UsedBytes
+		total.MaxBytes += m.MaxBytes
+		total.EvictedKeys += m.EvictedKeys
+		total.Full = total.Full || memoryCapReached(config.RedisMemory, m)
+		if i == 0 || (m.evicting() && !total.evicting()) {
+			total.Policy = m.Policy
+		}
+	}
+	return total, nil
+}
+
+// readServerMemory is what INFO says of one Redis
+func readServerMemory(client *redis.Client, ctx context.Context) (RedisMemory, error) {
+	var memory, stats *redis.StringCmd
+	_, err := client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		memory = pipe.Info(ctx, "memory")
+		stats = pipe.Info(ctx, "stats")
+		return nil
+	})
+	if err != nil {
+		return RedisMemory{}, err
+	}
+	fields := infoFields(memory.Val())
+	m := RedisMemory{Policy: fields["maxmemory_policy"]}
+	m.UsedBytes, _ = strconv.ParseInt(fields["used_memory"], 10, 64)
+	m.MaxBytes, _ = strconv.ParseInt(fields["maxmemory"], 10, 64)
+	m.EvictedKeys, _ = strconv.ParseInt(infoFields(stats.Val())["evicted_keys"], 10, 64)
+	return m, nil
+}
+
+// evicting is true of a policy which may drop links once maxmemory is reached
+func (m RedisMemory) evicting() bool {
+	return m.MaxBytes > 0 && m.Policy != "" && m.Policy != "noeviction"
+}
+
+func memoryCapReached(c RedisMemoryConfig, m RedisMemory) bool {
+	if c.MaxUsedBytes > 0 && m.UsedBytes >= c.MaxUsedBytes {
+		return true
+	}
+	return c.MaxUsedRatio > 0 && m.MaxBytes > 0 && float64(m.UsedBytes) >= c.MaxUsedRatio*float64(m.MaxBytes)
+}
+
+// checkEvictionPolicy is run at startup; Redis being unavailable is left to verifyRedis
+func checkEvictionPolicy(redis_db Storage, c RedisMemoryConfig) error {
+	m, err := readRedisMemory(redis_db, context.Background())
+	if err != nil || c.EvictionPolicy == "ignore" || !m.evicting() {
+		return nil
+	}
+	msg := fmt.Sprintf("Redis evicts keys with maxmemory-policy %s once it reaches %d bytes, which can drop links; set it to noeviction", m.Policy, m.MaxBytes)
+	if c.EvictionPolicy == "fail" {
+		return errors.New(msg)
+	}
+	log.Println(msg)
+	return nil
+}
+
+var memory_refusals = newCounter("shortener_memory_refused_creations_total", "Links not created because Redis memory was over the cap")
+
+type memoryWatch struct {
+	mu   sync.RWMutex
+	last RedisMemory
+}
+
+var redis_memory = &memoryWatch{}
+
+func (m *memoryWatch) get() RedisMemory {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.last
+}
+
+// full is true while the last reading was over the cap
+func (m *memoryWatch) full() bool {
+	return m.get().Full
+}
+
+// watch reads the memory in use every interval, until the process ends
+func (m *memoryWatch) watch(redis_db Storage, c RedisMemoryConfig) {
+	for {
+		now, err := readRedisMemory(redis_db, context.Background())
+		if err != nil {
+			log.Println("Cannot read the Redis memory", err)
+		} else {
+			before := m.get()
+			if now.Full != before.Full {
+				log.Println("Redis memory at", now.UsedBytes, "bytes; creating links refused:", now.Full)
+			}
+			if now.evicting() && now.Policy != before.Policy && c.EvictionPolicy != "ignore" {
+				log.Println("Redis maxmemory-policy is", now.Policy, "which can drop links; set it to noeviction")
+			}
+			m.mu.Lock()
+			m.last = now
+			m.mu.Unlock()
+		}
+		time.Sleep(c.Interval.Duration)
+	}
+}
+
+func registerMemoryMetrics() {
+	newGaugeFunc("shortener_redis_used_memory_bytes", "Memory Redis uses, at the last reading", func() float64 {
+		return float64(redis_memory.get().UsedBytes)
+	})
+	newGaugeFunc("shortener_redis_maxmemory_bytes", "Redis maxmemory, 0 when unlimited", func() float64 {
+		return float64(redis_memory.get().MaxBytes)
+	})
+	newCounterFunc("shortener_redis_evicted_keys_total", "Keys Redis evicted for memory since it started", func() float64 {
+		return float64(redis_memory.get().EvictedKeys)
+	})
+	newGaugeFunc("shortener_redis_memory_full", "1 while creating links is refused for Redis memory", func() float64 {
+		if redis_memory.full() {
+			return 1
+		}
+		return 0
+	})
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+// For mail systems sending through the shortener: an outbound message's body
+// is posted with its Message-ID, every URL in it is wrapped in a link of its
+// own, and later the message's clicks are reported link by link. Links are
+// tagged email, carry the message id in their meta, and live link_ttl, since
+// mail is read long after it's sent.
+//
+// message:<tenant>:<id> holds when the message was wrapped and for how many
+// recipients, messagelinks:<tenant>:<id> its links, URL to slug. Wrapping the
+// same message again (a retried send) gives the same links; both keys expire
+// with them.
+
+type EmailGatewayConfig struct {
+	Enabled     bool     `json:"enabled"`
+	LinkTTL     Duration `json:"link_ttl"`
+	DedupWindow Duration `json:"dedup_window"` // how long a recipient's clicks count once
+	Tag         string   `json:"tag"`
+}
+
+func validateEmailGateway(c EmailGatewayConfig) error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.LinkTTL.Duration <= 0 {
+		return errors.New("email_gateway.link_ttl must be positive")
+	}
+	if c.DedupWindow.Duration < 0 || (c.DedupWindow.Duration > 0 && c.DedupWindow.Duration < time.Second) {
+		return errors.New("email_gateway.dedup_window must be 0 or at least 1s")
+	}
+	if !tagPattern.MatchString(c.Tag) {
+		return errors.New("email_gateway.tag must be a valid tag")
+	}
+	return nil
+}
+
+func keyOfMessage(tenant string, id string) string {
+	return "message:" + tenant + ":" + id
+}
+
+func keyOfMessageLinks(tenant string, id string) string {
+	return "messagelinks:" + tenant + ":" + id
+}
+
+const maxMessageIdLength = 255
+
+var errMessageNotFound = errors.New("Message not found")
+
+var errMessageId = errors.New("message_id must be given, at most 255 characters and without /")
+
+// messageIdOf takes a Message-ID as it's written in the header, <...> included
+func messageIdOf(s string) (string, error) {
+	id := strings.TrimSpace(s)
+	id = strings.TrimSuffix(strings.TrimPrefix(id, "<"), ">")
+	if id == "" || len(id) > maxMessageIdLength || strings.Contains(id, "/") {
+		return "", errMessageId
+	}
+	return id, nil
+}
+
+var messages_wrapped = newCounter("shortener_messages_wrapped_total", "Outbound messages wrapped by the email gateway, by whether they were wrapped before")
+
+type MessageResult struct {
+	MessageId string `json:"message_id"`
+	PasteResult
+}
+
+type MessageLinkStats struct {
+	URL          string `json:"url"`
+	Slug         string `json:"slug"`
+	Clicks       int64  `json:"clicks"`
+	UniqueClicks int64  `json:"unique_clicks"`
+}
+
+type MessageReport struct {
+	MessageId    string             `json:"message_id"`
+	Wrapped      time.Time          `json:"wrapped"`
+	Recipients   int64              `json:"recipients,omitempty"`
+	Clicks       int64              `json:"clicks"`
+	UniqueClicks int64              `json:"unique_clicks"`
+	ClickedLinks int                `json:"clicked_links"`
+	ClickThrough float64            `json:"click_through,omitempty"` // unique clicks per recipient
+	Links        []MessageLinkStats `json:"links"`
+}
+
+// wrappedLink is the link a message already has for target, if it's still there
+func wrappedLink(redis_db Storage, ctx context.Context, tenant string, id string, target string) (ShortUrl, bool, error) {
+	slug, err := redis_db.HGet(ctx, keyOfMessageLinks(tenant, id), target).Result()
+	if err == redis.Nil {
+		return ShortUrl{}, false, nil
+	} else if err != nil {
+		return ShortUrl{}, false, err
+	}
+	su, err := getDetailsOfKey(redis_db, ctx, slug)
+	if err == errSlugNotFound {
+		return ShortUrl{}, false, nil
+	}
+	return su, err == nil, err
+}
+
+// recordMessage keeps the links made for a message, and marks them with its id
+func recordMessage(redis_db Storage, ctx context.Context, tenant string, id string, recipients int64, r PasteResult) error {
+	ttl := config.EmailGateway.LinkTTL.Duration
+	_, err := redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSetNX(ctx, keyOfMessage(tenant, id), "wrapped", time.Now().Unix())
+		if recipients > 0 {
+			pipe.HSet(ctx, keyOfMessage(tenant, id), "recipients", recipients)
+		}
+		for _, link := range r.Links {
+			if !link.Reused {
+				pipe.HSet(ctx, keyOfMessageLinks(tenant, id), asciiTarget(link.URL), link.Slug)
+				pipe.HSet(ctx, keyOfSlugMeta(link.Slug), "message", id)
+			}
+		}
+		pipe.Expire(ctx, keyOfMessage(tenant, id), ttl)
+		pipe.Expire(ctx, keyOfMessageLinks(tenant, id), ttl)
+		return nil
+	})
+	return err
+}
+
+func messageReport(redis_db Storage, ctx context.Context, tenant string, id string) (MessageReport, error) {
+	var attrs, links *redis.StringStringMapCmd
+	_, err := redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		attrs = pipe.HGetAll(ctx, keyOfMessage(tenant, id))
+		links = pipe.HGetAll(ctx, keyOfMessageLinks(tenant, id))
+		return nil
+	})
+	if err != nil {
+		return MessageReport{}, err
+	}
+	if len(attrs.Val()) == 0 {
+		return MessageReport{}, errMessageNotFound
+	}
+	report := MessageReport{MessageId: id, Wrapped: unixTime(attrs.Val()["wrapped"]).UTC(), Links: []MessageLinkStats{}}
+	report.Recipients, _ = strconv.ParseInt(attrs.Val()["recipients"], 10, 64)
+	for target, slug := range links.Val() {
+		stats := MessageLinkStats{URL: target, Slug: slug}
+		su, err := getDetailsOfKey(redis_db, ctx, slug)
+		if err == nil {
+			stats.Clicks, stats.UniqueClicks = int64(su.Clicks), int64(su.UniqueClicks)
+		} else if err != errSlugNotFound {
+			return report, err
+		}
+		report.Clicks += stats.Clicks
+		report.UniqueClicks += stats.UniqueClicks
+		if stats.Clicks > 0 {
+			report.ClickedLinks++
+		}
+		report.Links = append(report.Links, stats)
+	}
+	if report.Recipients > 0 {
+		report.ClickThrough = float64(report.UniqueClicks) / float64(report.Recipients)
+	}
+	return report, nil
+}
+
+func registerMessageRoutes(router *mux.Router, redis_db Storage) {
+
+	router.HandleFunc("", func(w http.ResponseWriter, req *http.Request) {
+		identity, ok := hasRole(w, req, roleEditor)
+		if !ok {
+			return
+		}
+		var body struct {
+			MessageId  string   `json:"message_id"`
+			Body       string   `json:"body"`
+			Format     string   `json:"format"` // html (the default) or text
+			Recipients int64    `json:"recipients"`
+			Tags       []string `json:"tags"`
+		}
+		if err := readJSON(w, req, &body); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		id, err := messageIdOf(body.MessageId)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		p := PasteRequest{Text: body.Body, Format: body.Format, Tags: append(body.Tags, config.EmailGateway.Tag)}
+		if p.Format == "" {
+			p.Format = "html"
+		}
+		if err := validatePaste(p); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		opts := LinkOptions{Tags: p.Tags, Ttl: config.EmailGateway.LinkTTL.Duration, DedupWindow: config.EmailGateway.DedupWindow.Duration}
+		r, err := shortenText(redis_db, w, req, identity, p, opts, func(target string) (ShortUrl, bool, error) {
+			return wrappedLink(redis_db, req.Context(), identity.Tenant, id, target)
+		})
+		// what was wrapped before a failure is kept, for the retry
+		if record_err := recordMessage(redis_db, req.Context(), identity.Tenant, id, body.Recipients, r); err == nil {
+			err = record_err
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		rewrapped := len(r.Links) > 0 && r.Links[0].Reused
+		messages_wrapped.Inc("rewrapped", strconv.FormatBool(rewrapped))
+		log.Println("Wrapped", len(r.Links), "links of message", id, "for", identity.KeyId)
+		w.Header().Set("Location", "/api/v1/messages/"+url.PathEscape(id))
+		writeJSON(w, http.StatusOK, MessageResult{MessageId: id, PasteResult: r})
+	}).Methods("POST")
+
+	router.HandleFunc("/{id}", func(w http.ResponseWriter, req *http.Request) {
+		identity, ok := hasRole(w, req, roleViewer)
+		if !ok {
+			return
+		}
+		tenant := identity.Tenant
+		if t := req.FormValue("tenant"); t != "" && identity.can(roleAdmin) {
+			tenant = t
+		}
+		id, err := messageIdOf(mux.Vars(req)["id"])
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		report, err := messageReport(redis_db, req.Context(), tenant, id)
+		if err == errMessageNotFound {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		} else if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	}).Methods("GET")
+}
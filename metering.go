@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+// For chargeback in shared deployments, each tenant's usage is counted by UTC
+// day: links created, redirects served (bundle pages and their destinations
+// included), and once a day, the bytes its links take in Redis. A billing
+// period runs from billing_day of one month to the same day of the next; the
+// export adds up its days, and averages the storage samples.
+//
+// usage:<tenant> is a hash of counters, <what>:<YYYYMMDD>; usagetenants the
+// tenants with any. Days older than retention are dropped by the storage
+// sample, which runs as the meter-storage job.
+
+type MeteringConfig struct {
+	Enabled    bool     `json:"enabled"`
+	BillingDay int      `json:"billing_day"` // of the month, 1 to 28
+	Retention  Duration `json:"retention"`
+}
+
+func validateMetering(c MeteringConfig) error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.BillingDay < 1 || c.BillingDay > 28 {
+		return errors.New("metering.billing_day must be from 1 to 28")
+	}
+	if c.Retention.Duration < 31*24*time.Hour {
+		return errors.New("metering.retention must be at least 744h, a whole billing period")
+	}
+	return nil
+}
+
+const (
+	usageCreated   = "created"
+	usageRedirects = "redirects"
+	usageStorage   = "storage"
+
+	keyOfMeteredTenants = "usagetenants"
+	usageDayFormat      = "20060102"
+	usagePeriodFormat   = "2006-01"
+)
+
+func keyOfTenantUsage(tenant string) string {
+	return "usage:" + tenant
+}
+
+// meterUsage counts one of what for the tenant, when metering is on
+func meterUsage(pipe redis.Pipeliner, ctx context.Context, tenant string, what string, at time.Time) {
+	if !config.Metering.Enabled {
+		return
+	}
+	pipe.HIncrBy(ctx, keyOfTenantUsage(tenant), what+":"+at.UTC().Format(usageDayFormat), 1)
+	pipe.Expire(ctx, keyOfTenantUsage(tenant), config.Metering.Retention.Duration)
+	pipe.SAdd(ctx, keyOfMeteredTenants, tenant)
+}
+
+// linkKeys are every key a link may have, for measuring it
+func linkKeys(slug string) []string {
+	keys := []string{keyOfSlug(slug)}
+	for _, prefix := range orphanKeyPrefixes {
+		keys = append(keys, prefix+slug)
+	}
+	return keys
+}
+
+// tenantStorage is what the tenant's links take in Redis, as MEMORY USAGE reports it
+func tenantStorage(redis_db Storage, ctx context.Context, tenant string) (int64, error) {
+	slugs, err := redis_db.ZRange(ctx, keyOfTenantLinks(tenant), 0, -1).Result()
+	if err != nil {
+		return 0, err
+	}
+	total := int64(0)
+	for start := 0; start < len(slugs); start += 500 {
+		end := start + 500
+		if end > len(slugs) {
+			end = len(slugs)
+		}
+		batch := slugs[start:end]
+		sizes := []*redis.IntCmd{}
+		_, err := redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, slug := range batch {
+				for _, key := range linkKeys(slug) {
+					sizes = append(sizes, pipe.MemoryUsage(ctx, key))
+				}
+			}
+			return nil
+		})
+		if err != nil && err != redis.Nil {
+			return total, err
+		}
+		for _, size := range sizes {
+			// missing keys answer nil, and count nothing
+			total += size.Val()
+		}
+	}
+	return total, nil
+}
+
+// sampleStorage records each tenant's storage for today, and drops days past retention
+func sampleStorage(redis_db Storage, ctx context.Context, now time.Time) error {
+	tenants, err := meteredTenants(redis_db, ctx)
+	if err != nil {
+		return err
+	}
+	oldest := now.Add(-config.Metering.Retention.Duration).UTC().Format(usageDayFormat)
+	for _, tenant := range tenants {
+		bytes, err := tenantStorage(redis_db, ctx, tenant)
+		if err != nil {
+			return err
+		}
+		fields, err := redis_db.HKeys(ctx, keyOfTenantUsage(tenant)).Result()
+		if err != nil {
+			return err
+		}
+		_, err = redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, field := range fields {
+				if day := field[strings.IndexByte(field, ':')+1:]; day < oldest {
+					pipe.HDel(ctx, keyOfTenantUsage(tenant), field)
+				}
+			}
+			pipe.HSet(ctx, keyOfTenantUsage(tenant), usageStorage+":"+now.UTC().Format(usageDayFormat), bytes)
+			pipe.Expire(ctx, keyOfTenantUsage(tenant), config.Metering.Retention.Duration)
+			pipe.SAdd(ctx, keyOfMeteredTenants, tenant)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	log.Println("Sampled the storage of", len(tenants), "tenants")
+	return nil
+}
+
+// meteredTenants are those with usage, or with links which may not have any yet
+func meteredTenants(redis_db Storage, ctx context.Context) ([]string, error) {
+	tenants, err := redis_db.SMembers(ctx, keyOfMeteredTenants).Result()
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	for _, tenant := range tenants {
+		seen[tenant] = true
+	}
+	err = scanKeys(redis_db, ctx, keyOfTenantLinks("*"), func(keys []string) error {
+		for _, key := range keys {
+			if tenant := strings.TrimPrefix(key, keyOfTenantLinks("")); !seen[tenant] {
+				seen[tenant] = true
+				tenants = append(tenants, tenant)
+			}
+		}
+		return nil
+	})
+	sort.Strings(tenants)
+	return tenants, err
+}
+
+func meteringJob(redis_db Storage) scheduledJob {
+	return scheduledJob{name: "meter-storage", schedule: "@daily", run: func(ctx context.Context) error {
+		return sampleStorage(redis_db, ctx, time.Now())
+	}}
+}
+
+type BillingPeriod struct {
+	Name string    `json:"name"` // the month it starts in, 2006-01
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"` // exclusive
+}
+
+func billingPeriodStarting(year int, month time.Month) BillingPeriod {
+	from := time.Date(year, month, config.Metering.BillingDay, 0, 0, 0, 0, time.UTC)
+	return BillingPeriod{Name: from.Format(usagePeriodFormat), From: from, To: from.AddDate(0, 1, 0)}
+}
+
+// billingPeriodOf is the period named, or the one under way when name is empty
+func billingPeriodOf(name string, now time.Time) (BillingPeriod, error) {
+	if name == "" {
+		now = now.UTC()
+		p := billingPeriodStarting(now.Year(), now.Month())
+		if now.Before(p.From) {
+			p = billingPeriodStarting(now.Year(), now.Month()-1)
+		}
+		return p, nil
+	}
+	month, err := time.Parse(usagePeriodFormat, name)
+	if err != nil {
+		return BillingPeriod{}, errors.New("period must be a month, as 2006-01")
+	}
+	return billingPeriodStarting(month.Year(), month.Month()), nil
+}
+
+type DailyUsage struct {
+	Day          string `json:"day"`
+	LinksCreated int64  `json:"links_created"`
+	Redirects    int64  `json:"redirects"`
+	StorageBytes int64  `json:"storage_bytes,omitempty"` // when sampled that day
+}
+
+type TenantUsage struct {
+	Tenant           string       `json:"tenant"`
+	LinksCreated     int64        `json:"links_created"`
+	Redirects        int64        `json:"redirects"`
+	StorageBytes     int64        `json:"storage_bytes"` // averaged over the days sampled
+	StorageBytesPeak int64        `json:"storage_bytes_peak"`
+	Days             []DailyUsage `json:"days,omitempty"`
+}
+
+type UsageReport struct {
+	Period  BillingPeriod `json:"period"`
+	Tenants []TenantUsage `json:"tenants"`
+}
+
+func tenantUsage(redis_db Storage, ctx context.Context, tenant string, p BillingPeriod) (TenantUsage, error) {
+	counters, err := redis_db.HGetAll(ctx, keyOfTenantUsage(tenant)).Result()
+	if err != nil {
+		return TenantUsage{}, err
+	}
+	u := TenantUsage{Tenant: tenant, Days: []DailyUsage{}}
+	samples, sampled := int64(0), int64(0)
+	for day := p.From; day.Before(p.To); day = day.AddDate(0, 0, 1) {
+		d := DailyUsage{Day: day.Format("2006-01-02")}
+		suffix := ":" + day.Format(usageDayFormat)
+		d.LinksCreated, _ = strconv.ParseInt(counters[usageCreated+suffix], 10, 64)
+		d.Redirects, _ = strconv.ParseInt(counters[usageRedirects+suffix], 10, 64)
+		if s, ok := counters[usageStorage+suffix]; ok {
+			d.StorageBytes, _ = strconv.ParseInt(s, 10, 64)
+			samples += d.StorageBytes
+			sampled++
+			u.StorageBytesPeak = maxInt64(u.StorageBytesPeak, d.StorageBytes)
+		}
+		u.LinksCreated += d.LinksCreated
+		u.Redirects += d.Redirects
+		u.Days = append(u.Days, d)
+	}
+	if sampled > 0 {
+		u.StorageBytes = samples / sampled
+	}
+	return u, nil
+}
+
+func usageReport(redis_db Storage, ctx context.Context, p BillingPeriod) (UsageReport, error) {
+	r := UsageReport{Period: p, Tenants: []TenantUsage{}}
+	tenants, err := meteredTenants(redis_db, ctx)
+	if err != nil {
+		return r, err
+	}
+	for _, tenant := range tenants {
+		u, err := tenantUsage(redis_db, ctx, tenant, p)
+		if err != nil {
+			return r, err
+		}
+		u.Days = nil
+		r.Tenants = append(r.Tenants, u)
+	}
+	return r, nil
+}
+
+func writeUsageCSV(w http.ResponseWriter, r UsageReport) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="usage-`+r.Period.Name+`.csv"`)
+	out := csv.NewWriter(w)
+	out.Write([]string{"period", "from", "to", "tenant", "links_created", "redirects", "storage_bytes", "storage_bytes_peak"})
+	for _, u := range r.Tenants {
+		out.Write([]string{
+			r.Period.Name,
+			r.Period.From.Format("2006-01-02"),
+			r.Period.To.Format("2006-01-02"),
+			u.Tenant,
+			strconv.FormatInt(u.LinksCreated, 10),
+			strconv.FormatInt(u.Redirects, 10),
+			strconv.FormatInt(u.StorageBytes, 10),
+			strconv.FormatInt(u.StorageBytesPeak, 10),
+		})
+	}
+	out.Flush()
+}
+
+// handleUsageExport is every tenant's usage in a period, as JSON or with ?format=csv
+func handleUsageExport(redis_db Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		p, err := billingPeriodOf(req.FormValue("period"), time.Now())
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		r, err := usageReport(redis_db, req.Context(), p)
+		if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		if req.FormValue("format") == "csv" {
+			writeUsageCSV(w, r)
+			return
+		}
+		writeJSON(w, http.StatusOK, r)
+	}
+}
+
+// registerUsageRoutes adds a tenant's view of its own usage, day by day
+func registerUsageRoutes(router *mux.Router, redis_db Storage) {
+	router.HandleFunc("/api/v1/usage", func(w http.ResponseWriter, req *http.Request) {
+		identity, ok := hasRole(w, req, roleViewer)
+		if !ok {
+			return
+		}
+		p, err := billingPeriodOf(req.FormValue("period"), time.Now())
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		u, err := tenantUsage(redis_db, req.Context(), identity.Tenant, p)
+		if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"period": p, "usage": u})
+	}).Methods("GET")
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Every route names the methods it takes, so a GET can't create or change
+// anything. A path with routes, but none for the method, answers 405 with
+// Allow listing those there are, and OPTIONS answers the same list.
+
+var routeMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+
+// allowedMethods lists the methods some route takes for the request's path, none when there is no route
+func allowedMethods(router *mux.Router, req *http.Request) []string {
+	allowed := []string{}
+	for _, method := range routeMethods {
+		r := req.Clone(req.Context())
+		r.Method = method
+		var match mux.RouteMatch
+		if router.Match(r, &match) && match.MatchErr == nil {
+			allowed = append(allowed, method)
+		}
+	}
+	if len(allowed) > 0 {
+		allowed = append(allowed, "OPTIONS")
+	}
+	return allowed
+}
+
+// methodNotAllowed is the router's MethodNotAllowedHandler
+func methodNotAllowed(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Allow", strings.Join(allowedMethods(router, req), ", "))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Method not allowed"))
+	})
+}
+
+// withOptions answers OPTIONS for any path with routes
+func withOptions(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "OPTIONS" {
+			router.ServeHTTP(w, req)
+			return
+		}
+		allowed := allowedMethods(router, req)
+		if len(allowed) == 0 {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A small metrics registry, served at /metrics in the Prometheus text format.
+// Label values are passed as alternating name, value strings.
+
+type metric struct {
+	name  string
+	help  string
+	kind  string // counter or gauge
+	mu    sync.Mutex
+	value map[string]float64 // by rendered label set
+	fn    func() float64     // for gauges computed on scrape
+}
+
+var metrics_mu sync.Mutex
+var all_metrics = []*metric{}
+
+func newMetric(kind string, name string, help string) *metric {
+	m := &metric{name: name, help: help, kind: kind, value: map[string]float64{}}
+	metrics_mu.Lock()
+	all_metrics = append(all_metrics, m)
+	metrics_mu.Unlock()
+	return m
+}
+
+func newCounter(name string, help string) *metric {
+	return newMetric("counter", name, help)
+}
+
+func newGauge(name string, help string) *metric {
+	return newMetric("gauge", name, help)
+}
+
+func newGaugeFunc(name string, help string, fn func() float64) *metric {
+	m := newMetric("gauge", name, help)
+	m.fn = fn
+	return m
+}
+
+// newCounterFunc is for counts kept elsewhere, read on scrape
+func newCounterFunc(name string, help string, fn func() float64) *metric {
+	m := newMetric("counter", name, help)
+	m.fn = fn
+	return m
+}
+
+func renderLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := []string{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		pairs = append(pairs, labels[i]+`="`+value+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (m *metric) Add(delta float64, labels ...string) {
+	m.mu.Lock()
+	m.value[renderLabels(labels)] += delta
+	m.mu.Unlock()
+}
+
+func (m *metric) Inc(labels ...string) {
+	m.Add(1, labels...)
+}
+
+func (m *metric) Set(v float64, labels ...string) {
+	m.mu.Lock()
+	m.value[renderLabels(labels)] = v
+	m.mu.Unlock()
+}
+
+func writeMetrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics_mu.Lock()
+	defer metrics_mu.Unlock()
+	for _, m := range all_metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		if m.fn != nil {
+			fmt.Fprintf(w, "%s %g\n", m.name, m.fn())
+			continue
+		}
+		m.mu.Lock()
+		label_sets := make([]string, 0, len(m.value))
+		for labels := range m.value {
+			label_sets = append(label_sets, labels)
+		}
+		sort.Strings(label_sets)
+		for _, labels := range label_sets {
+			fmt.Fprintf(w, "%s%s %g\n", m.name, labels, m.value[labels])
+		}
+		m.mu.Unlock()
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// The keyspace layout is versioned in schema:version. Each migration upgrades
+// existing data by one version; they run at startup, in order, by whichever
+// replica takes schema:lock first. The others wait for it to finish.
+
+type MigrationsConfig struct {
+	OnStart     bool     `json:"on_start"`
+	LockTimeout Duration `json:"lock_timeout"` // how long a migrating replica holds the lock, and others wait
+}
+
+const keyOfSchemaVersion = "schema:version"
+const keyOfSchemaLock = "schema:lock"
+
+type migration struct {
+	description string
+	up          func(redis_db Storage, ctx context.Context) error
+}
+
+// Never reorder or remove entries: version n is migrations[n-1]
+var migrations = []migration{
+	{"add links created before idx:* to the indexes", func(redis_db Storage, ctx context.Context) error {
+		_, err := reindexLinks(redis_db, ctx)
+		return err
+	}},
+	{"fill the targetlinks: reverse index", backfillTargetLinks},
+	{"fill the search index", func(redis_db Storage, ctx context.Context) error {
+		_, err := indexAllLinkTerms(redis_db, ctx)
+		return err
+	}},
+}
+
+// Only deletes the lock if this process still holds it
+var releaseLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+func schemaVersion(redis_db Storage, ctx context.Context) (int, error) {
+	v, err := redis_db.Get(ctx, keyOfSchemaVersion).Int()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return v, err
+}
+
+// migrateKeyspace returns once the keyspace is at the latest version
+func migrateKeyspace(redis_db Storage, ctx context.Context, c MigrationsConfig) error {
+	latest := len(migrations)
+	holder := fmt.Sprintf("%s:%d", hostname(), os.Getpid())
+	deadline := time.Now().Add(c.LockTimeout.Duration)
+
+	for {
+		version, err := schemaVersion(redis_db, ctx)
+		if err != nil {
+			return err
+		}
+		if version > latest {
+			return fmt.Errorf("Keyspace is at version %d, newer than this build knows (%d)", version, latest)
+		}
+		if version == latest {
+			return nil
+		}
+
+		locked, err := redis_db.SetNX(ctx, keyOfSchemaLock, holder, c.LockTimeout.Duration).Result()
+		if err != nil {
+			return err
+		}
+		if locked {
+			defer releaseLockScript.Run(ctx, redis_db, []string{keyOfSchemaLock}, holder)
+			return runMigrations(redis_db, ctx, c)
+		}
+
+		if time.Now().After(deadline) {
+			return errors.New("Timed out waiting for another replica to migrate the keyspace")
+		}
+		log.Println("Waiting for another replica to migrate the keyspace from version", version)
+		time.Sleep(time.Second)
+	}
+}
+
+// runMigrations must hold the lock. It re-reads the version, as another
+// replica may have finished just before the lock was taken.
+func runMigrations(redis_db Storage, ctx context.Context, c MigrationsConfig) error {
+	version, err := schemaVersion(redis_db, ctx)
+	if err != nil {
+		return err
+	}
+	for version < len(migrations) {
+		m := migrations[version]
+		log.Printf("Migrating keyspace to version %d: %s", version+1, m.description)
+		start := time.Now()
+		if err := m.up(redis_db, ctx); err != nil {
+			return fmt.Errorf("Migration to version %d failed: %v", version+1, err)
+		}
+		version++
+		_, err := redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, keyOfSchemaVersion, version, 0)
+			pipe.Expire(ctx, keyOfSchemaLock, c.LockTimeout.Duration)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		log.Println("Keyspace at version", version, "after", time.Since(start))
+	}
+	return nil
+}
+
+func backfillTargetLinks(redis_db Storage, ctx context.Context) error {
+	return scanKeys(redis_db, ctx, keyOfSlug("*"), func(keys []string) error {
+		slugs := make([]string, len(keys))
+		for i, k := range keys {
+			slugs[i], _ = slugFromKey(k)
+		}
+
+		targets := make([]*redis.StringCmd, len(slugs))
+		created_at := make([]*redis.StringCmd, len(slugs))
+		_, err := redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, slug := range slugs {
+				targets[i] = pipe.Get(ctx, keys[i])
+				created_at[i] = pipe.HGet(ctx, keyOfSlugMeta(slug), "created")
+			}
+			return nil
+		})
+		if err != nil && err != redis.Nil {
+			return err
+		}
+
+		_, err = redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, slug := range slugs {
+				target, err := targets[i].Result()
+				if err != nil {
+					continue // expired since SCAN
+				}
+				created := unixTime(created_at[i].Val())
+				if created.IsZero() {
+					created = time.Now()
+				}
+				pipe.ZAddNX(ctx, keyOfTargetLinks(targetDigest(target)), &redis.Z{Score: float64(created.Unix()), Member: slug})
+			}
+			return nil
+		})
+		return err
+	})
+}
+
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return name
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"strings"
+)
+
+// Numeric slugs are for links read out over the phone or typed from an SMS:
+// only digits, and shorter than the usual slugs. A link is made with one by
+// asking for it at creation; the redirect takes it as it's written, or with
+// hyphens between groups of digits as it may be printed ("482-913").
+//
+// They share the url: keys with every other slug, but not names: with
+// slugs.numeric enabled, random slugs are never all digits, and all-digit
+// aliases and reservations are refused, so the numbers are kept for
+// numeric slugs.
+
+type NumericSlugsConfig struct {
+	Enabled bool `json:"enabled"`
+	Length  int  `json:"length"`
+}
+
+func validateNumericSlugs(c NumericSlugsConfig) error {
+	if c.Enabled && (c.Length < 4 || c.Length > 12) {
+		return errors.New("slugs.numeric.length must be between 4 and 12")
+	}
+	return nil
+}
+
+var errNumericName = errors.New("Names of only digits are kept for numeric slugs")
+
+func randomNumericSlug(length int) string {
+	b := make([]byte, length)
+	for i := range b {
+		b[i] = '0' + byte(rand.Intn(10))
+	}
+	return string(b)
+}
+
+func allDigits(s string) bool {
+	for _, char := range s {
+		if char < '0' || char > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// inNumericNamespace is true of a name only a numeric slug may have
+func inNumericNamespace(name string) bool {
+	return config.Slugs.Numeric.Enabled && allDigits(name)
+}
+
+// compactNumeric takes the hyphens out of a numeric slug written in groups
+func compactNumeric(slug string) string {
+	if !config.Slugs.Numeric.Enabled || !strings.Contains(slug, "-") {
+		return slug
+	}
+	compact := strings.Replace(slug, "-", "", -1)
+	if !allDigits(compact) {
+		return slug
+	}
+	return compact
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+// With opt_out.honor, a visitor whose browser sends DNT: 1 or Sec-GPC: 1 isn't
+// followed: their clicks make no click event in any sink, no unique-click
+// mark and no attribution. They still add to the link's counters, which say
+// nothing about anyone, unless count_clicks is off; then a click only renews
+// the link. /_privacy tells visitors what is recorded, and whether their
+// browser is opting out; /.well-known/gpc.json tells their browser GPC is
+// honored.
+
+type OptOutConfig struct {
+	Honor       bool `json:"honor"`
+	CountClicks bool `json:"count_clicks"` // opted-out clicks still add to the counters
+}
+
+var opted_out_clicks = newCounter("shortener_opted_out_clicks_total", "Clicks of visitors opting out of tracking, by whether they were counted")
+
+// optedOut is true of a request whose browser asks not to be tracked, when that's honored
+func optedOut(req *http.Request) bool {
+	return config.OptOut.Honor && (req.Header.Get("DNT") == "1" || req.Header.Get("Sec-GPC") == "1")
+}
+
+// renewLink extends a link's expiry to its ttl as a click does, without counting anything
+func renewLink(pipe redis.Pipeliner, ctx context.Context, slug string, ttl time.Duration) {
+	pipe.Expire(ctx, keyOfSlug(slug), ttl)
+	pipe.Expire(ctx, keyOfSlugMeta(slug), ttl)
+	pipe.ZAdd(ctx, keyOfExpiresIndex, &redis.Z{Score: float64(time.Now().Add(ttl).Unix()), Member: slug})
+}
+
+// clickEventsRecorded is true when some sink keeps a record of each click
+func clickEventsRecorded() bool {
+	for _, sink := range config.Clicks.Sinks {
+		if sink != "none" && (sink != "export" || config.Export.Driver != "") {
+			return true
+		}
+	}
+	return false
+}
+
+// PrivacyNotice is what /_privacy says is recorded of a click
+type PrivacyNotice struct {
+	ClickEvents    bool   `json:"click_events"` // a record of each click, with its time and referrer
+	IPs            string `json:"ips"`          // logged, hashed or dropped
+	SaltRotation   string `json:"salt_rotation,omitempty"`
+	HonorsOptOut   bool   `json:"honors_opt_out"`
+	CountsOptedOut bool   `json:"counts_opted_out"`
+	OptedOut       bool   `json:"opted_out"` // this request is opting out
+}
+
+func privacyNoticeOf(req *http.Request) PrivacyNotice {
+	n := PrivacyNotice{
+		ClickEvents:    clickEventsRecorded(),
+		IPs:            "logged",
+		HonorsOptOut:   config.OptOut.Honor,
+		CountsOptedOut: config.OptOut.CountClicks,
+		OptedOut:       optedOut(req),
+	}
+	if config.GDPR.Enabled && config.GDPR.IPs == gdprHashIPs {
+		n.IPs, n.SaltRotation = "hashed", config.GDPR.SaltRotation.Duration.String()
+	} else if config.GDPR.Enabled {
+		n.IPs = "dropped"
+	}
+	return n
+}
+
+func registerOptOutRoutes(router *mux.Router) {
+	router.HandleFunc("/_privacy", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Add("Vary", "DNT, Sec-GPC")
+		notice := privacyNoticeOf(req)
+		if wantsJSON(req) {
+			writeJSON(w, http.StatusOK, notice)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		setLanguage(w, req)
+		renderPage(w, req, "privacy.html", brandingOf(""), notice)
+	}).Methods("GET", "HEAD")
+
+	if config.OptOut.Honor {
+		router.HandleFunc("/.well-known/gpc.json", func(w http.ResponseWriter, req *http.Request) {
+			writeJSON(w, http.StatusOK, map[string]interface{}{"gpc": true})
+		}).Methods("GET", "HEAD")
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Counter, meta and series keys are written alongside url: keys but can
+// outlive them (or predate them, as viewing details used to create counters),
+// and index entries stay behind when links expire. This finds such leftovers
+// whose link is gone and deletes them, or only reports them on a dry run.
+
+var orphanKeyPrefixes = []string{"urlhitcount:", "urluniqhitcount:", "urlmeta:", "urlseries:", "urlaliases:", "urlthumb:", "urlterms:", "urldoc:", "urlgeo:", "urlbundle:"}
+
+// Kept after their link when counters are configured to outlive links
+var counterKeyPrefixes = map[string]bool{"urlhitcount:": true, "urluniqhitcount:": true, "urlseries:": true, "urlgeo:": true, "urlbundle:": true}
+
+type OrphanReport struct {
+	DryRun       bool           `json:"dry_run"`
+	Keys         map[string]int `json:"keys"`          // by key prefix
+	IndexEntries map[string]int `json:"index_entries"` // by index key
+	Sample       []string       `json:"sample"`
+}
+
+func (r *OrphanReport) note(what string) {
+	if len(r.Sample) < 20 {
+		r.Sample = append(r.Sample, what)
+	}
+}
+
+// missingSlugs returns which of the slugs have no url: key
+func missingSlugs(redis_db Storage, ctx context.Context, slugs []string) ([]string, error) {
+	exists := make([]*redis.IntCmd, len(slugs))
+	_, err := redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, slug := range slugs {
+			exists[i] = pipe.Exists(ctx, keyOfSlug(slug))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	missing := []string{}
+	for i, slug := range slugs {
+		if exists[i].Val() == 0 {
+			missing = append(missing, slug)
+		}
+	}
+	return missing, nil
+}
+
+func scanKeys(redis_db Storage, ctx context.Context, pattern string, each func(keys []string) error) error {
+	var cursor uint64
+	for {
+		keys, next, err := redis_db.Scan(ctx, cursor, pattern, 500).Result()
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if err := each(keys); err != nil {
+				return err
+			}
+		}
+		cursor = next
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+func purgeOrphanKeys(redis_db Storage, ctx context.Context, prefix string, report *OrphanReport) error {
+	return scanKeys(redis_db, ctx, prefix+"*", func(keys []string) error {
+		slugs := make([]string, len(keys))
+		for i, key := range keys {
+			slugs[i] = strings.TrimPrefix(key, prefix)
+		}
+		missing, err := missingSlugs(redis_db, ctx, slugs)
+		if err != nil || len(missing) == 0 {
+			return err
+		}
+		doomed := make([]string, len(missing))
+		for i, slug := range missing {
+			doomed[i] = prefix + slug
+			report.note(doomed[i])
+		}
+		report.Keys[prefix] += len(doomed)
+		if report.DryRun {
+			return nil
+		}
+		return redis_db.Del(ctx, doomed...).Err()
+	})
+}
+
+// purgeOrphanMembers cleans a sorted set or set of slugs
+func purgeOrphanMembers(redis_db Storage, ctx context.Context, index string, sorted bool, report *OrphanReport) error {
+	var cursor uint64
+	for {
+		var members []string
+		var next uint64
+		var err error
+		if sorted {
+			members, next, err = redis_db.ZScan(ctx, index, cursor, "", 500).Result()
+			// ZSCAN interleaves members and scores
+			slugs := []string{}
+			for i := 0; i < len(members); i += 2 {
+				slugs = append(slugs, members[i])
+			}
+			members = slugs
+		} else {
+			members, next, err = redis_db.SScan(ctx, index, cursor, "", 500).Result()
+		}
+		if err != nil {
+			return err
+		}
+
+		missing, err := missingSlugs(redis_db, ctx, members)
+		if err != nil {
+			return err
+		}
+		if len(missing) > 0 {
+			report.IndexEntries[index] += len(missing)
+			for _, slug := range missing {
+				report.note(index + " " + slug)
+			}
+			if !report.DryRun {
+				doomed := make([]interface{}, len(missing))
+				for i, slug := range missing {
+					doomed[i] = slug
+				}
+				if sorted {
+					err = redis_db.ZRem(ctx, index, doomed...).Err()
+				} else {
+					err = redis_db.SRem(ctx, index, doomed...).Err()
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		cursor = next
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// purgeOrphanAliases removes alias: keys whose link is gone
+func purgeOrphanAliases(redis_db Storage, ctx context.Context, report *OrphanReport) error {
+	return scanKeys(redis_db, ctx, keyOfAlias("*"), func(keys []string) error {
+		canonicals, err := redis_db.MGet(ctx, keys...).Result()
+		if err != nil {
+			return err
+		}
+		slugs := make([]string, len(keys))
+		for i, v := range canonicals {
+			slugs[i], _ = v.(string)
+		}
+		missing, err := missingSlugs(redis_db, ctx, slugs)
+		if err != nil {
+			return err
+		}
+		gone := map[string]bool{}
+		for _, slug := range missing {
+			gone[slug] = true
+		}
+		doomed := []string{}
+		for i, key := range keys {
+			if gone[slugs[i]] {
+				doomed = append(doomed, key)
+				report.note(key)
+			}
+		}
+		report.Keys["alias:"] += len(doomed)
+		if report.DryRun || len(doomed) == 0 {
+			return nil
+		}
+		return redis_db.Del(ctx, doomed...).Err()
+	})
+}
+
+func purgeOrphans(redis_db Storage, ctx context.Context, dry_run bool) (OrphanReport, error) {
+	report := OrphanReport{DryRun: dry_run, Keys: map[string]int{}, IndexEntries: map[string]int{}, Sample: []string{}}
+
+	for _, prefix := range orphanKeyPrefixes {
+		if countersOutliveLinks() && counterKeyPrefixes[prefix] {
+			continue
+		}
+		if err := purgeOrphanKeys(redis_db, ctx, prefix, &report); err != nil {
+			return report, err
+		}
+	}
+
+	if err := purgeOrphanAliases(redis_db, ctx, &report); err != nil {
+		return report, err
+	}
+
+	sorted_indexes := []string{keyOfCreatedIndex, keyOfClicksIndex, keyOfExpiresIndex}
+	for _, pattern := range []string{keyOfTenantLinks("*"), keyOfTargetLinks("*")} {
+		err := scanKeys(redis_db, ctx, pattern, func(keys []string) error {
+			sorted_indexes = append(sorted_indexes, keys...)
+			return nil
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+	for _, index := range sorted_indexes {
+		if err := purgeOrphanMembers(redis_db, ctx, index, true, &report); err != nil {
+			return report, err
+		}
+	}
+
+	for _, pattern := range []string{keyOfCampaignLinks("*"), keyOfSearchTerm("*")} {
+		err := scanKeys(redis_db, ctx, pattern, func(keys []string) error {
+			for _, index := range keys {
+				if err := purgeOrphanMembers(redis_db, ctx, index, false, &report); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// orphansJob has no schedule unless jobs.purge-orphans sets one
+func orphansJob(redis_db Storage) scheduledJob {
+	return scheduledJob{name: "purge-orphans", run: func(ctx context.Context) error {
+		report, err := purgeOrphans(redis_db, ctx, false)
+		log.Printf("Purged orphans: keys %v, index entries %v", report.Keys, report.IndexEntries)
+		return err
+	}}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Every request made on behalf of a link's target (previews, titles,
+// unwrapping) goes through outboundClient, so a target can't be used to reach
+// the service's own network. Addresses are checked when dialing, after DNS,
+// so a name which resolves (or later rebinds) to a private, loopback,
+// link-local or cloud metadata address is refused. Schemes and ports are
+// allowlisted on every hop, redirects are capped, and reading more than
+// max_bytes of a response fails.
+
+type OutboundConfig struct {
+	AllowedSchemes  []string `json:"allowed_schemes"`
+	AllowedPorts    []int    `json:"allowed_ports"`
+	BlockedNetworks []string `json:"blocked_networks"` // on top of the built-in ones
+	AllowedNetworks []string `json:"allowed_networks"` // exceptions to either, e.g. an intranet to preview
+	MaxRedirects    int      `json:"max_redirects"`
+	MaxBytes        int64    `json:"max_bytes"`
+	Timeout         Duration `json:"timeout"`
+	Proxy           string   `json:"proxy"` // see proxy.go
+}
+
+// Private, loopback, link-local (with 169.254.169.254, the metadata service), shared, multicast and reserved ranges
+var internalNetworks = []string{
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12",
+	"192.0.0.0/24", "192.0.2.0/24", "192.168.0.0/16", "198.18.0.0/15", "198.51.100.0/24", "203.0.113.0/24",
+	"224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "100::/64", "2001:db8::/32", "fc00::/7", "fe80::/10", "ff00::/8",
+}
+
+var errOutboundBlocked = errors.New("Outbound request blocked")
+var errResponseTooLarge = errors.New("Response is too large")
+
+func parseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid network %q: %v", cidr, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func validateOutbound(c OutboundConfig) error {
+	if _, err := parseNetworks(c.BlockedNetworks); err != nil {
+		return err
+	}
+	if _, err := parseNetworks(c.AllowedNetworks); err != nil {
+		return err
+	}
+	return validateProxy(c.Proxy)
+}
+
+func inNetworks(ip net.IP, cidrs []string) bool {
+	networks, _ := parseNetworks(cidrs)
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func outboundIPAllowed(ip net.IP) bool {
+	c := config.Outbound
+	if inNetworks(ip, c.AllowedNetworks) {
+		return true
+	}
+	return !inNetworks(ip, internalNetworks) && !inNetworks(ip, c.BlockedNetworks)
+}
+
+func outboundPortAllowed(port string) bool {
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range config.Outbound.AllowedPorts {
+		if p == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// outboundURLAllowed checks scheme and port before anything is resolved
+func outboundURLAllowed(u *url.URL) error {
+	scheme := strings.ToLower(u.Scheme)
+	if !containsString(config.Outbound.AllowedSchemes, scheme) {
+		return fmt.Errorf("%w: scheme %s", errOutboundBlocked, u.Scheme)
+	}
+	port := u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[scheme]
+	}
+	if !outboundPortAllowed(port) {
+		return fmt.Errorf("%w: port %s", errOutboundBlocked, port)
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !outboundIPAllowed(ip) {
+		return fmt.Errorf("%w: address %s", errOutboundBlocked, ip)
+	}
+	return nil
+}
+
+// outboundControl runs on the resolved address of each connection
+func outboundControl(network string, address string, _ syscall.RawConn) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !outboundIPAllowed(ip) {
+		return fmt.Errorf("%w: address %s", errOutboundBlocked, host)
+	}
+	if !outboundPortAllowed(port) {
+		return fmt.Errorf("%w: port %s", errOutboundBlocked, port)
+	}
+	return nil
+}
+
+// No proxy from the environment: one would connect on our behalf, past the
+// address checks. outbound.proxy goes through proxiedOutboundTransport.
+var outbound_transport = &http.Transport{
+	DialContext: (&net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: outboundControl,
+	}).DialContext,
+	TLSHandshakeTimeout: 5 * time.Second,
+	MaxIdleConns:        20,
+	IdleConnTimeout:     90 * time.Second,
+}
+
+type outboundRoundTripper struct{}
+
+func (outboundRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := outboundURLAllowed(req.URL); err != nil {
+		return nil, err
+	}
+	var resp *http.Response
+	var err error
+	if proxyURL() != nil {
+		if err := outboundHostAllowed(req.Context(), req.URL); err != nil {
+			return nil, err
+		}
+		resp, err = proxiedOutboundTransport().RoundTrip(req)
+	} else {
+		resp, err = outbound_transport.RoundTrip(req)
+	}
+	if err == nil {
+		resp.Body = &cappedBody{body: resp.Body, left: config.Outbound.MaxBytes}
+	}
+	return resp, err
+}
+
+// cappedBody fails reads past max_bytes rather than quietly truncating
+type cappedBody struct {
+	body io.ReadCloser
+	left int64
+}
+
+func (b *cappedBody) Read(p []byte) (int, error) {
+	if b.left <= 0 {
+		var one [1]byte
+		n, err := b.body.Read(one[:])
+		if n > 0 {
+			return 0, errResponseTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > b.left {
+		p = p[:b.left]
+	}
+	n, err := b.body.Read(p)
+	b.left -= int64(n)
+	return n, err
+}
+
+func (b *cappedBody) Close() error {
+	return b.body.Close()
+}
+
+// outboundClient fetches on behalf of targets. Without follow, a redirect is
+// returned as the response; with it, each_hop (when given) vets every hop.
+func outboundClient(follow bool, each_hop func(*http.Request) error) *http.Client {
+	return &http.Client{
+		Transport: outboundRoundTripper{},
+		Timeout:   config.Outbound.Timeout.Duration,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if !follow {
+				return http.ErrUseLastResponse
+			}
+			if len(via) >= config.Outbound.MaxRedirects {
+				return errors.New("Too many redirects")
+			}
+			if each_hop != nil {
+				return each_hop(req)
+			}
+			return nil
+		},
+	}
+}
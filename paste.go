@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// For newsletters and the like: a block of Markdown or HTML comes in, every
+// http(s) URL in it is shortened, and it goes back out with the short URLs in
+// their place. A URL the caller's tenant already has a public link to, for
+// exactly that target, gets that link again rather than a new one, so pasting
+// the same text twice gives the same short URLs. URLs on this service are
+// left alone.
+
+const maxPastedLinks = 200
+
+// Stops at whitespace and whatever delimits a URL in Markdown or HTML:
+// quotes, angle and square brackets
+var pastedURLPattern = regexp.MustCompile("(?i)https?://[^\\s<>\"'`\\[\\]{}|\\\\^]+")
+
+type PasteRequest struct {
+	Text   string   `json:"text"`
+	Format string   `json:"format"` // markdown (the default), html or text
+	Tags   []string `json:"tags"`
+}
+
+type PastedLink struct {
+	URL      string `json:"url"`
+	ShortURL string `json:"short_url"`
+	Slug     string `json:"slug"`
+	Reused   bool   `json:"reused"`
+}
+
+type SkippedURL struct {
+	URL   string `json:"url"`
+	Error string `json:"error"`
+}
+
+type PasteResult struct {
+	Text    string       `json:"text"`
+	Links   []PastedLink `json:"links"`
+	Skipped []SkippedURL `json:"skipped,omitempty"`
+}
+
+// validatePaste checks what shortenText can't answer for with a skipped URL
+func validatePaste(p PasteRequest) error {
+	if p.Format != "" && p.Format != "markdown" && p.Format != "html" && p.Format != "text" {
+		return errors.New("format must be markdown, html or text")
+	}
+	for _, tag := range p.Tags {
+		if !tagPattern.MatchString(tag) {
+			return fmt.Errorf("Invalid tag %q", tag)
+		}
+	}
+	return nil
+}
+
+var pasted_links = newCounter("shortener_pasted_links_total", "URLs shortened from pasted text, by result: created, reused or failed")
+
+// trimPastedURL takes off the punctuation around a URL in prose, and a
+// closing parenthesis it doesn't open, as in Markdown's [text](url)
+func trimPastedURL(found string) (string, string) {
+	u := found
+	for u != "" {
+		last := u[len(u)-1]
+		if strings.IndexByte(".,;:!?*", last) >= 0 || (last == ')' && strings.Count(u, "(") < strings.Count(u, ")")) {
+			u = u[:len(u)-1]
+			continue
+		}
+		break
+	}
+	return u, found[len(u):]
+}
+
+// selfHosted is true of URLs on this service, which are short already
+func selfHosted(req *http.Request, target string) bool {
+	host := hostOfTarget(target)
+	own := req.Host
+	if h, _, err := net.SplitHostPort(own); err == nil {
+		own = h
+	}
+	return strings.EqualFold(host, own) || containsString(config.Unwrap.SelfHosts, strings.ToLower(host))
+}
+
+// reusableLink is the tenant's public link to exactly this target, if it has one
+func reusableLink(redis_db Storage, ctx context.Context, identity Identity, target string) (ShortUrl, bool, error) {
+	slugs, err := linksToTarget(redis_db, ctx, target)
+	if err != nil {
+		return ShortUrl{}, false, err
+	}
+	for _, slug := range slugs {
+		su, err := getDetailsOfKey(redis_db, ctx, slug)
+		if err == errSlugNotFound {
+			continue
+		} else if err != nil {
+			return ShortUrl{}, false, err
+		}
+		if su.Tenant == identity.Tenant && su.Access.Public() && su.Access.Goal == nil {
+			return su, true, nil
+		}
+	}
+	return ShortUrl{}, false, nil
+}
+
+// shortenText rewrites every URL in p.Text, with the link existing finds for
+// it or else a new one made with opts. A URL which can't be shortened stays as
+// it was, and is reported in Skipped; once the quota runs out, so do the rest.
+func shortenText(redis_db Storage, w http.ResponseWriter, req *http.Request, identity Identity, p PasteRequest, opts LinkOptions,
+	existing func(target string) (ShortUrl, bool, error)) (PasteResult, error) {
+	r := PasteResult{Links: []PastedLink{}}
+	short_urls := map[string]string{}
+	failed := map[string]bool{}
+	var stop error
+	for _, found := range pastedURLPattern.FindAllString(p.Text, -1) {
+		raw, _ := trimPastedURL(found)
+		if _, done := short_urls[raw]; done || failed[raw] {
+			continue
+		}
+		target := raw
+		if p.Format == "html" {
+			target = html.UnescapeString(raw)
+		}
+		if selfHosted(req, target) {
+			continue
+		}
+		skip := func(err error) {
+			failed[raw] = true
+			r.Skipped = append(r.Skipped, SkippedURL{URL: target, Error: err.Error()})
+			pasted_links.Inc("result", "failed")
+		}
+		if stop != nil {
+			skip(stop)
+			continue
+		}
+		if len(r.Links) >= maxPastedLinks {
+			stop = fmt.Errorf("At most %d links are shortened from one text", maxPastedLinks)
+			skip(stop)
+			continue
+		}
+
+		su, reused, err := existing(asciiTarget(target))
+		if err != nil {
+			return r, err
+		}
+		if !reused {
+			var status int
+			su, status, err = shorten(redis_db, w, req, identity, target, opts)
+			if status == http.StatusServiceUnavailable {
+				return r, err
+			} else if status == http.StatusTooManyRequests || status == http.StatusForbidden || status == http.StatusInsufficientStorage {
+				stop = err
+			}
+			if err != nil {
+				skip(err)
+				continue
+			}
+		}
+		short_urls[raw] = publicURL(req, "/"+su.Slug)
+		r.Links = append(r.Links, PastedLink{URL: target, ShortURL: short_urls[raw], Slug: su.Slug, Reused: reused})
+		if reused {
+			pasted_links.Inc("result", "reused")
+		} else {
+			pasted_links.Inc("result", "created")
+		}
+	}
+
+	r.Text = pastedURLPattern.ReplaceAllStringFunc(p.Text, func(found string) string {
+		raw, rest := trimPastedURL(found)
+		if short_url, ok := short_urls[raw]; ok {
+			return short_url + rest
+		}
+		return found
+	})
+	log.Println("Shortened", len(r.Links), "links from pasted text, skipped", len(r.Skipped), "by", identity.KeyId)
+	return r, nil
+}
+
+type PastePage struct {
+	PasteRequest
+	Result    *PasteResult
+	Error     string
+	CSRFToken string
+}
+
+func registerPasteRoutes(router *mux.Router, redis_db Storage) {
+
+	router.HandleFunc("/api/v1/paste", func(w http.ResponseWriter, req *http.Request) {
+		identity, ok := hasRole(w, req, roleEditor)
+		if !ok {
+			return
+		}
+		var body PasteRequest
+		if err := readJSON(w, req, &body); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := validatePaste(body); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		r, err := shortenText(redis_db, w, req, identity, body, LinkOptions{Tags: body.Tags}, func(target string) (ShortUrl, bool, error) {
+			return reusableLink(redis_db, req.Context(), identity, target)
+		})
+		if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, r)
+	}).Methods("POST")
+
+	router.HandleFunc("/_paste", func(w http.ResponseWriter, req *http.Request) {
+		if !requireLogin(w, req) {
+			return
+		}
+		identity, ok := identify(req)
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintf(w, "Unknown API key")
+			return
+		}
+		page := PastePage{}
+		status := http.StatusOK
+		if req.Method == "POST" {
+			if !checkCSRF(w, req) {
+				return
+			}
+			page.Text, page.Format = req.FormValue("text"), req.FormValue("format")
+			for _, tag := range strings.Split(req.FormValue("tags"), ",") {
+				if tag = strings.TrimSpace(tag); tag != "" {
+					page.Tags = append(page.Tags, tag)
+				}
+			}
+			if err := validatePaste(page.PasteRequest); err != nil {
+				page.Error = err.Error()
+				status = http.StatusBadRequest
+			} else {
+				r, err := shortenText(redis_db, w, req, identity, page.PasteRequest, LinkOptions{Tags: page.Tags}, func(target string) (ShortUrl, bool, error) {
+					return reusableLink(redis_db, req.Context(), identity, target)
+				})
+				if err != nil {
+					log.Println("Cannot shorten pasted text", err)
+					writeUnavailable(w)
+					return
+				}
+				page.Result = &r
+			}
+		}
+		page.CSRFToken = csrfToken(w, req)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		setLanguage(w, req)
+		w.WriteHeader(status)
+		renderPage(w, req, "paste.html", brandingOf(identity.Tenant), page)
+	}).Methods("GET", "POST")
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// Rules a target has to pass before it can be shortened
+
+type PolicyConfig struct {
+	AllowedSchemes []string `json:"allowed_schemes"`
+	BlockedHosts   []string `json:"blocked_hosts"` // also blocks their subdomains
+	MaxTargetLen   int      `json:"max_target_length"`
+
+	BlockMixedScriptHosts bool `json:"block_mixed_script_hosts"`
+	HomographInterstitial bool `json:"homograph_interstitial"` // warn before redirecting to a likely homograph
+}
+
+var errTargetBlocked = errors.New("Target host is blocked")
+
+func validateTarget(target string) (*url.URL, error) {
+	if target == "" {
+		return nil, errors.New("Target is empty")
+	}
+	if config.Policy.MaxTargetLen > 0 && len(target) > config.Policy.MaxTargetLen {
+		return nil, errors.New("Target is too long")
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, errors.New("Target is not a valid URL")
+	}
+
+	scheme_allowed := false
+	for _, s := range config.Policy.AllowedSchemes {
+		if strings.EqualFold(u.Scheme, s) {
+			scheme_allowed = true
+		}
+	}
+	if !scheme_allowed {
+		return nil, errors.New("Target scheme " + u.Scheme + " is not allowed")
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("Target has no host")
+	}
+
+	if hostIsBlocked(u.Hostname()) {
+		return nil, errTargetBlocked
+	}
+	if config.Policy.BlockMixedScriptHosts && hostMixesScripts(u.Hostname()) {
+		return nil, errors.New("Target host mixes scripts")
+	}
+	return u, nil
+}
+
+func hostIsBlocked(host string) bool {
+	host = hostToASCII(strings.ToLower(strings.TrimSuffix(host, ".")))
+	for _, blocked := range config.Policy.BlockedHosts {
+		blocked = hostToASCII(strings.ToLower(blocked))
+		if host == blocked || strings.HasSuffix(host, "."+blocked) {
+			return true
+		}
+	}
+	return false
+}
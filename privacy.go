@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// A link created with privacy=no-referrer redirects with Referrer-Policy:
+// no-referrer, so the browser doesn't tell the target which page the click
+// came from. privacy=dereferrer goes further, for browsers which ignore the
+// header on redirects: it answers a page which sends the visitor on with a
+// meta refresh, itself under a no-referrer policy.
+
+const (
+	privacyNoReferrer = "no-referrer"
+	privacyDereferrer = "dereferrer"
+)
+
+func parseLinkPrivacy(privacy string) (string, error) {
+	switch privacy {
+	case "", privacyNoReferrer, privacyDereferrer:
+		return privacy, nil
+	}
+	return "", fmt.Errorf("privacy must be %s or %s", privacyNoReferrer, privacyDereferrer)
+}
+
+// writeRedirect sends the visitor to the target as the link's privacy asks
+func writeRedirect(w http.ResponseWriter, req *http.Request, slug string, target string, access LinkAccess) {
+	if access.FallbackTo != "" {
+		target = access.FallbackTo
+	}
+	if access.Apps != nil {
+		target = access.Apps.fallback(req, target)
+	}
+	switch access.Privacy {
+	case privacyDereferrer:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		setLanguage(w, req)
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		w.Header().Set("Cache-Control", "no-store")
+		renderPage(w, req, "dereferrer.html", brandingOf(""), ShortUrl{Slug: slug, Target: target})
+		return
+	case privacyNoReferrer:
+		w.Header().Set("Referrer-Policy", "no-referrer")
+	}
+	if access.Apps != nil {
+		// the redirect depends on the device
+		w.Header().Set("Vary", "User-Agent")
+		http.Redirect(w, req, target, http.StatusFound)
+		return
+	}
+	if access.Goal != nil {
+		// every click has to reach the counter
+		http.Redirect(w, req, target, http.StatusFound)
+		return
+	}
+	cdnRedirect(w, req, slug, target, access)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Requests to the internet can go through outbound.proxy, for networks where
+// egress needs one: an http://, https:// or socks5:// URL, with credentials
+// as its user and password. It carries the requests made for targets (see
+// outbound.go) and those to the operator's webhooks, the CDN's API and the
+// Wayback Machine. The service's own dependencies (Redis, ClickHouse, the
+// thumbnail renderer, Kubernetes, backups) are reached directly.
+//
+// Through a proxy the address a target's request ends up at can't be checked
+// when connecting, so the target's name is resolved and checked beforehand
+// instead: a name which rebinds between that lookup and the proxy's isn't
+// caught. Only the proxy itself is exempt from the address checks.
+
+func validateProxy(raw string) error {
+	if raw == "" {
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("outbound.proxy: %v", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return fmt.Errorf("outbound.proxy must be an http, https or socks5 URL, not %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("outbound.proxy has no host")
+	}
+	return nil
+}
+
+func proxyURL() *url.URL {
+	if config.Outbound.Proxy == "" {
+		return nil
+	}
+	u, _ := url.Parse(config.Outbound.Proxy)
+	return u
+}
+
+var egress_transport http.RoundTripper
+var egress_transport_once sync.Once
+
+// egressRoundTripper sends the operator's requests to the internet, through the proxy if there is one
+type egressRoundTripper struct{}
+
+func (egressRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	egress_transport_once.Do(func() {
+		egress_transport = http.DefaultTransport
+		if proxy := proxyURL(); proxy != nil {
+			t := http.DefaultTransport.(*http.Transport).Clone()
+			t.Proxy = http.ProxyURL(proxy)
+			egress_transport = t
+		}
+	})
+	return egress_transport.RoundTrip(req)
+}
+
+var outbound_proxied_transport *http.Transport
+var outbound_proxied_transport_once sync.Once
+
+// proxiedOutboundTransport is outbound_transport's counterpart through the proxy
+func proxiedOutboundTransport() *http.Transport {
+	outbound_proxied_transport_once.Do(func() {
+		outbound_proxied_transport = &http.Transport{
+			Proxy: http.ProxyURL(proxyURL()),
+			DialContext: (&net.Dialer{
+				Timeout: 5 * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout: 5 * time.Second,
+			MaxIdleConns:        20,
+			IdleConnTimeout:     90 * time.Second,
+		}
+	})
+	return outbound_proxied_transport
+}
+
+// outboundHostAllowed resolves a target's host, and checks every address it has
+func outboundHostAllowed(ctx context.Context, u *url.URL) error {
+	if ip := net.ParseIP(u.Hostname()); ip != nil {
+		return nil // checked by outboundURLAllowed
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if !outboundIPAllowed(addr.IP) {
+			return fmt.Errorf("%w: %s resolves to %s", errOutboundBlocked, u.Hostname(), addr.IP)
+		}
+	}
+	return nil
+}
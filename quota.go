@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Soft quotas per tenant: how many links may be alive at once, and how many
+// may be created per UTC day. 0 means unlimited.
+
+type QuotaConfig struct {
+	MaxActiveLinks   int64 `json:"max_active_links"`
+	MaxCreatesPerDay int64 `json:"max_creates_per_day"`
+}
+
+type QuotasConfig struct {
+	Default QuotaConfig            `json:"default"`
+	Tenants map[string]QuotaConfig `json:"tenants"`
+}
+
+type QuotaUsage struct {
+	Quota         QuotaConfig
+	ActiveLinks   int64
+	CreatedToday  int64
+	ResetsIn      time.Duration
+	ExceededLinks bool
+	ExceededDaily bool
+}
+
+func quotaOf(tenant string) QuotaConfig {
+	if q, ok := config.Quotas.Tenants[tenant]; ok {
+		return q
+	}
+	return config.Quotas.Default
+}
+
+func keyOfTenantLinks(tenant string) string {
+	return "tenantlinks:" + tenant
+}
+
+func keyOfTenantDailyCreates(tenant string, day time.Time) string {
+	return "quota:created:" + tenant + ":" + day.UTC().Format("20060102")
+}
+
+// tenantActiveLinks counts the tenant's links, forgetting those which expired
+func tenantActiveLinks(redis_db Storage, ctx context.Context, tenant string) (int64, error) {
+	slugs, err := redis_db.ZRange(ctx, keyOfTenantLinks(tenant), 0, -1).Result()
+	if err != nil || len(slugs) == 0 {
+		return 0, err
+	}
+	exists := make([]*redis.IntCmd, len(slugs))
+	_, err = redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, slug := range slugs {
+			exists[i] = pipe.Exists(ctx, keyOfSlug(slug))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	active := int64(0)
+	gone := []interface{}{}
+	for i, slug := range slugs {
+		if exists[i].Val() == 1 {
+			active++
+		} else {
+			gone = append(gone, slug)
+		}
+	}
+	if len(gone) > 0 {
+		redis_db.ZRem(ctx, keyOfTenantLinks(tenant), gone...)
+	}
+	return active, nil
+}
+
+func checkQuota(redis_db Storage, ctx context.Context, tenant string) (QuotaUsage, error) {
+	now := time.Now().UTC()
+	tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	u := QuotaUsage{Quota: quotaOf(tenant), ResetsIn: tomorrow.Sub(now)}
+
+	var err error
+	if u.Quota.MaxActiveLinks > 0 {
+		if u.ActiveLinks, err = tenantActiveLinks(redis_db, ctx, tenant); err != nil {
+			return u, err
+		}
+		u.ExceededLinks = u.ActiveLinks >= u.Quota.MaxActiveLinks
+	}
+	if u.Quota.MaxCreatesPerDay > 0 {
+		u.CreatedToday, err = redis_db.Get(ctx, keyOfTenantDailyCreates(tenant, now)).Int64()
+		if err != nil && err != redis.Nil {
+			return u, err
+		}
+		u.ExceededDaily = u.CreatedToday >= u.Quota.MaxCreatesPerDay
+	}
+	return u, nil
+}
+
+func setQuotaHeaders(w http.ResponseWriter, u QuotaUsage) {
+	h := w.Header()
+	if u.Quota.MaxActiveLinks > 0 {
+		h.Set("X-Quota-Links-Limit", strconv.FormatInt(u.Quota.MaxActiveLinks, 10))
+		h.Set("X-Quota-Links-Remaining", strconv.FormatInt(maxInt64(0, u.Quota.MaxActiveLinks-u.ActiveLinks), 10))
+	}
+	if u.Quota.MaxCreatesPerDay > 0 {
+		h.Set("X-Quota-Daily-Limit", strconv.FormatInt(u.Quota.MaxCreatesPerDay, 10))
+		h.Set("X-Quota-Daily-Remaining", strconv.FormatInt(maxInt64(0, u.Quota.MaxCreatesPerDay-u.CreatedToday), 10))
+		h.Set("X-Quota-Daily-Reset", strconv.FormatInt(int64(u.ResetsIn.Seconds()), 10))
+	}
+	if u.ExceededDaily {
+		h.Set("Retry-After", strconv.FormatInt(int64(u.ResetsIn.Seconds()), 10))
+	}
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
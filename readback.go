@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// For support staff reading a link out to someone: the slug spelled in the
+// NATO alphabet, with capitals called out, and whether it has characters
+// easily taken for others once written down (l and 1, 5 and S, ...). It's
+// worked out from the slug, so links made before this have it too.
+
+var natoAlphabet = map[rune]string{
+	'a': "Alfa", 'b': "Bravo", 'c': "Charlie", 'd': "Delta", 'e': "Echo",
+	'f': "Foxtrot", 'g': "Golf", 'h': "Hotel", 'i': "India", 'j': "Juliett",
+	'k': "Kilo", 'l': "Lima", 'm': "Mike", 'n': "November", 'o': "Oscar",
+	'p': "Papa", 'q': "Quebec", 'r': "Romeo", 's': "Sierra", 't': "Tango",
+	'u': "Uniform", 'v': "Victor", 'w': "Whiskey", 'x': "X-ray", 'y': "Yankee",
+	'z': "Zulu",
+	'0': "Zero", '1': "One", '2': "Two", '3': "Three", '4': "Four",
+	'5': "Five", '6': "Six", '7': "Seven", '8': "Eight", '9': "Nine",
+}
+
+// Characters which look like another in some fonts, then letters which only
+// differ from their other case by size
+const ambiguousCharacters = "l1 5S 2Z 8B 9gq uv" + " cCkKpPsSuUvVwWxXyYzZ"
+
+type Readback struct {
+	Phonetic            string   `json:"phonetic"`
+	Ambiguous           bool     `json:"ambiguous"`
+	AmbiguousCharacters []string `json:"ambiguous_characters,omitempty"`
+
+	Spelled []SpelledCharacter `json:"-"` // for the details page, which translates "capital"
+}
+
+type SpelledCharacter struct {
+	Word    string
+	Capital bool
+}
+
+// readbackOf is nil for a slug it can't spell, such as a unicode alias
+func readbackOf(slug string) *Readback {
+	r := &Readback{Spelled: []SpelledCharacter{}}
+	words := []string{}
+	seen := map[rune]bool{}
+	for _, char := range slug {
+		word, ok := natoAlphabet[unicode.ToLower(char)]
+		if !ok {
+			return nil
+		}
+		capital := unicode.IsUpper(char)
+		if unicode.IsLower(char) {
+			word = strings.ToLower(word)
+		}
+		r.Spelled = append(r.Spelled, SpelledCharacter{Word: word, Capital: capital})
+		if capital {
+			words = append(words, "capital "+word)
+		} else {
+			words = append(words, word)
+		}
+		if strings.ContainsRune(ambiguousCharacters, char) && !seen[char] {
+			seen[char] = true
+			r.Ambiguous = true
+			r.AmbiguousCharacters = append(r.AmbiguousCharacters, string(char))
+		}
+	}
+	r.Phonetic = strings.Join(words, ", ")
+	return r
+}
+
+func (su ShortUrl) Readback() *Readback {
+	return readbackOf(su.Slug)
+}
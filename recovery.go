@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strings"
+)
+
+// Every request gets an ID, taken from X-Request-Id when a proxy sent a sane
+// one, echoed in the response and the access log. A handler which panics is
+// logged with its stack and the ID, counted, and answered with a 500 page
+// (JSON under /api/) naming the ID, instead of a dropped connection.
+
+const requestIDHeader = "X-Request-Id"
+
+var handler_panics = newCounter("shortener_handler_panics_total", "Requests whose handler panicked")
+
+const serverErrorPage = `<!DOCTYPE html>
+<html><head><title>Something went wrong</title></head>
+<body><h1>Something went wrong</h1><p>This request failed on our side. If it keeps happening, please mention request %s.</p></body></html>
+`
+
+func requestIDIsSane(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(requestIDHeader)
+		if !requestIDIsSane(id) {
+			id = newRequestID()
+			req.Header.Set(requestIDHeader, id)
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, req)
+	})
+}
+
+// headerWatcher remembers whether the response was started, after which a 500 can't be sent
+type headerWatcher struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (h *headerWatcher) WriteHeader(status int) {
+	h.started = true
+	h.ResponseWriter.WriteHeader(status)
+}
+
+func (h *headerWatcher) Write(b []byte) (int, error) {
+	h.started = true
+	return h.ResponseWriter.Write(b)
+}
+
+func (h *headerWatcher) Flush() {
+	if f, ok := h.ResponseWriter.(http.Flusher); ok {
+		h.started = true
+		f.Flush()
+	}
+}
+
+func withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		watcher := &headerWatcher{ResponseWriter: w}
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			id := req.Header.Get(requestIDHeader)
+			log.Printf("Panic serving %s %s, request %s: %v\n%s", req.Method, req.URL.Path, id, p, debug.Stack())
+			handler_panics.Inc()
+			if watcher.started {
+				return
+			}
+			if strings.HasPrefix(req.URL.Path, "/api/") {
+				writeJSONError(w, http.StatusInternalServerError, "Internal error, request "+id)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, serverErrorPage, html.EscapeString(id))
+		}()
+		next.ServeHTTP(watcher, req)
+	})
+}
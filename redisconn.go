@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Managed Redis offerings tend to want TLS and a user of their own: redis.tls
+// turns TLS on, verifying the server against the system's CAs or ca_file,
+// with cert_file and key_file as the client's certificate where the server
+// asks for one. redis.username is the Redis 6 ACL user; without one,
+// password authenticates the default user as before.
+//
+// The connection is tried at startup. A refused password or a certificate
+// which doesn't verify won't get better by waiting, so they stop the
+// process; Redis not answering yet only does with redis.require_on_start,
+// otherwise the circuit breaker and /readyz deal with it as with any outage.
+
+type RedisTLSConfig struct {
+	Enabled            bool   `json:"enabled"`
+	CAFile             string `json:"ca_file"`   // the system's CAs when empty
+	CertFile           string `json:"cert_file"` // client certificate, with key_file
+	KeyFile            string `json:"key_file"`
+	ServerName         string `json:"server_name"` // the host of addr when empty
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+}
+
+func validateRedis(c RedisConfig) error {
+	if c.PoolSize <= 0 {
+		return errors.New("redis.pool_size must be positive")
+	}
+	if c.MinIdleConns < 0 || c.MinIdleConns > c.PoolSize {
+		return errors.New("redis.min_idle_conns must be between 0 and pool_size")
+	}
+	t := c.TLS
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return errors.New("redis.tls needs both cert_file and key_file, or neither")
+	}
+	if !t.Enabled && (t.CAFile != "" || t.CertFile != "" || t.ServerName != "" || t.InsecureSkipVerify) {
+		return errors.New("redis.tls has settings but isn't enabled")
+	}
+	if c.Username != "" && c.Password == "" {
+		return errors.New("redis.username needs a password")
+	}
+	return nil
+}
+
+// redisTLSConfig is nil without TLS
+func redisTLSConfig(c RedisConfig) (*tls.Config, error) {
+	if !c.TLS.Enabled {
+		return nil, nil
+	}
+	tls_config := &tls.Config{
+		ServerName:         c.TLS.ServerName,
+		InsecureSkipVerify: c.TLS.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if tls_config.ServerName == "" {
+		host, _, err := net.SplitHostPort(c.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("redis.addr: %v", err)
+		}
+		tls_config.ServerName = host
+	}
+	if c.TLS.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.TLS.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tls_config.RootCAs = x509.NewCertPool()
+		if !tls_config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates in %v", c.TLS.CAFile)
+		}
+	}
+	if c.TLS.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tls_config.Certificates = []tls.Certificate{cert}
+	}
+	return tls_config, nil
+}
+
+func redisOptions(c RedisConfig) (*redis.Options, error) {
+	tls_config, err := redisTLSConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	return &redis.Options{
+		Addr:         c.Addr,
+		Username:     c.Username,
+		Password:     c.Password,
+		DB:           c.DB,
+		TLSConfig:    tls_config,
+		PoolSize:     c.PoolSize,
+		MinIdleConns: c.MinIdleConns,
+		MaxConnAge:   c.MaxConnAge.Duration,
+		PoolTimeout:  c.PoolTimeout.Duration,
+		IdleTimeout:  c.IdleTimeout.Duration,
+		DialTimeout:  c.DialTimeout.Duration,
+		ReadTimeout:  c.ReadTimeout.Duration,
+		WriteTimeout: c.WriteTimeout.Duration,
+	}, nil
+}
+
+func newRedisClient(c RedisConfig) (*redis.Client, error) {
+	opts, err := redisOptions(c)
+	if err != nil {
+		return nil, err
+	}
+	return redis.NewClient(opts), nil
+}
+
+// registerPoolMetrics reads the client's connection pool on every scrape. A
+// miss had to dial, and a timeout waited pool_timeout for a free connection
+// in vain: timeouts, or active connections at pool_size, mean the pool is
+// too small for the load.
+func registerPoolMetrics(redis_db Storage, c RedisConfig) {
+	stats := redis_db.PoolStats
+	newCounterFunc("shortener_redis_pool_hits_total", "Redis commands which found a free connection in the pool", func() float64 {
+		return float64(stats().Hits)
+	})
+	newCounterFunc("shortener_redis_pool_misses_total", "Redis commands which had to open a connection", func() float64 {
+		return float64(stats().Misses)
+	})
+	newCounterFunc("shortener_redis_pool_timeouts_total", "Redis commands which gave up waiting for a connection", func() float64 {
+		return float64(stats().Timeouts)
+	})
+	newCounterFunc("shortener_redis_pool_stale_connections_total", "Redis connections closed for being idle or old", func() float64 {
+		return float64(stats().StaleConns)
+	})
+	newGaugeFunc("shortener_redis_pool_idle_connections", "Open Redis connections not in use", func() float64 {
+		return float64(stats().IdleConns)
+	})
+	newGaugeFunc("shortener_redis_pool_active_connections", "Open Redis connections in use", func() float64 {
+		s := stats()
+		return float64(s.TotalConns - s.IdleConns)
+	})
+	newGaugeFunc("shortener_redis_pool_size", "The most Redis connections the pool opens, redis.pool_size per server", func() float64 {
+		return float64(c.PoolSize * len(storageServers(redis_db)))
+	})
+}
+
+// redisMisconfigured is true for failures a retry won't fix: an error reply
+// (WRONGPASS, NOPERM, a DB out of range) or a TLS handshake which failed
+func redisMisconfigured(err error) bool {
+	var unknown_authority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	var record tls.RecordHeaderError
+	return isReplyError(err) ||
+		errors.As(err, &unknown_authority) ||
+		errors.As(err, &hostname) ||
+		errors.As(err, &invalid) ||
+		errors.As(err, &record)
+}
+
+// verifyRedis connects once at startup, returning an error when the process shouldn't go on
+func verifyRedis(ctx context.Context, redis_db *redis.Client, c RedisConfig) error {
+	ctx, cancel := context.WithTimeout(ctx, c.DialTimeout.Duration+c.ReadTimeout.Duration)
+	defer cancel()
+	user := c.Username
+	if user == "" {
+		user = "default"
+	}
+	err := redis_db.Ping(ctx).Err()
+	switch {
+	case err == nil:
+		log.Println("Connected to Redis at", c.Addr, "as", user, "TLS:", c.TLS.Enabled)
+		return nil
+	case redisMisconfigured(err):
+		return fmt.Errorf("Redis at %s refused the connection as %s: %v", c.Addr, user, err)
+	case c.RequireOnStart:
+		return fmt.Errorf("Redis at %s unavailable: %v", c.Addr, err)
+	}
+	log.Println("Redis at", c.Addr, "unavailable at startup, carrying on:", err)
+	return nil
+}
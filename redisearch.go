@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// When Redis has the RediSearch and RedisJSON modules, search uses them in
+// place of the search:<term> sets: each link's searchable fields are kept as
+// a JSON document, urldoc:<slug>, under a full-text index, idx:links. url:
+// keys stay the source of truth for redirects and everything else, so the
+// documents only mirror what search needs, and the rest of the keyspace is the
+// same with or without the modules.
+
+type SearchConfig struct {
+	// auto uses the modules when Redis has them, redisearch requires them, sets never uses them
+	Backend string `json:"backend"`
+}
+
+const keyOfLinkSearchIndex = "idx:links"
+const maxSearchMatches = 1000
+
+// Set once at startup, before anything is indexed or searched
+var redisearch_enabled bool
+
+func keyOfLinkDocument(slug string) string {
+	return "urldoc:" + slug
+}
+
+type LinkDocument struct {
+	Slug string   `json:"slug"`
+	Text string   `json:"text"` // searchWords of every searchable field
+	Tags []string `json:"tags"`
+}
+
+// redisModules lists the names of the loaded modules, lowercased
+func redisModules(redis_db Storage, ctx context.Context) (map[string]bool, error) {
+	modules := map[string]bool{}
+	v, err := redis_db.Do(ctx, "MODULE", "LIST").Result()
+	if err != nil {
+		return modules, err
+	}
+	list, _ := v.([]interface{})
+	for _, entry := range list {
+		fields, _ := entry.([]interface{})
+		for i := 0; i+1 < len(fields); i += 2 {
+			if key, _ := fields[i].(string); key == "name" {
+				name, _ := fields[i+1].(string)
+				modules[strings.ToLower(name)] = true
+			}
+		}
+	}
+	return modules, nil
+}
+
+// setupSearch picks the search backend, creating and filling idx:links the first time
+func setupSearch(redis_db Storage, ctx context.Context, c SearchConfig) error {
+	switch c.Backend {
+	case "sets":
+		return nil
+	case "auto", "redisearch":
+	default:
+		return fmt.Errorf("search.backend must be auto, redisearch or sets, not %q", c.Backend)
+	}
+	modules, err := redisModules(redis_db, ctx)
+	if _, refused := err.(redis.Error); refused && c.Backend == "auto" {
+		// some hosted Redis services don't allow MODULE; they don't have these modules either
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Cannot list Redis modules: %v", err)
+	}
+	if !modules["search"] || !modules["rejson"] {
+		if c.Backend == "redisearch" {
+			return fmt.Errorf("search.backend is redisearch, but Redis lacks the search or ReJSON module")
+		}
+		return nil
+	}
+	redisearch_enabled = true
+
+	if err := redis_db.Do(ctx, "FT.INFO", keyOfLinkSearchIndex).Err(); err == nil {
+		return nil
+	}
+	err = redis_db.Do(ctx, "FT.CREATE", keyOfLinkSearchIndex, "ON", "JSON",
+		"PREFIX", 1, keyOfLinkDocument(""),
+		"STOPWORDS", 0,
+		"SCHEMA",
+		"$.slug", "AS", "slug", "TAG",
+		"$.text", "AS", "text", "TEXT", "NOSTEM",
+		"$.tags[*]", "AS", "tags", "TAG").Err()
+	if err != nil && strings.Contains(err.Error(), "already exists") {
+		// another replica got there first, and fills it
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Cannot create %v: %v", keyOfLinkSearchIndex, err)
+	}
+	count, err := indexAllLinkTerms(redis_db, ctx)
+	log.Println("Created", keyOfLinkSearchIndex, "with", count, "links")
+	return err
+}
+
+func writeLinkDocument(redis_db Storage, ctx context.Context, su ShortUrl) error {
+	text := append([]string{su.Slug, su.Target, su.DisplayTarget(), su.Title, su.Description, su.Note}, su.Aliases...)
+	text = append(text, su.Tags...)
+	doc := LinkDocument{Slug: su.Slug, Text: strings.Join(searchWords(strings.Join(text, " ")), " "), Tags: su.Tags}
+	if doc.Tags == nil {
+		doc.Tags = []string{}
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return redis_db.Do(ctx, "JSON.SET", keyOfLinkDocument(su.Slug), "$", string(data)).Err()
+}
+
+// searchDocuments returns the slugs whose documents have every word, as a word or the start of one
+func searchDocuments(redis_db Storage, ctx context.Context, words []string) ([]string, error) {
+	// searchWords are letters and digits only, so need no escaping
+	clauses := make([]string, len(words))
+	for i, word := range words {
+		clauses[i] = "@text:" + word + "*"
+	}
+	v, err := redis_db.Do(ctx, "FT.SEARCH", keyOfLinkSearchIndex, strings.Join(clauses, " "),
+		"NOCONTENT", "LIMIT", 0, maxSearchMatches).Result()
+	if err != nil {
+		return nil, err
+	}
+	r, _ := v.([]interface{})
+	slugs := []string{}
+	if len(r) == 0 {
+		return slugs, nil
+	}
+	// the total, then the keys
+	for _, v := range r[1:] {
+		if key, ok := v.(string); ok {
+			slugs = append(slugs, strings.TrimPrefix(key, keyOfLinkDocument("")))
+		}
+	}
+	return slugs, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Several regions can serve redirects, each from a Redis of its own, while
+// links are only ever written in one. region.role "primary" is that one, as
+// a single region is. In a "replica" region, the Redis is a replica of the
+// primary's (Redis replication carries the links over, asynchronously) and
+// the service runs as a redirector: anything but a redirect is sent on to
+// the primary's primary_url with a 307, so creating, editing and the API
+// happen there. Clicks are written to the primary's Redis, primary_redis,
+// where counters stay whole; they're retried like any failed click write.
+//
+// There's one writer, so custom slugs and aliases can't conflict across
+// regions: each is claimed in the primary's Redis, and the first claim to
+// get there wins, the other getting 409 as ever. A link created moments ago
+// may not have reached a region yet, so a replica region asks primary_redis
+// before answering that a slug doesn't exist.
+
+type RegionConfig struct {
+	Name         string      `json:"name"` // in X-Shortener-Region, and the logs
+	Role         string      `json:"role"` // primary, or replica; empty for a single region
+	PrimaryURL   string      `json:"primary_url"`
+	PrimaryRedis RedisConfig `json:"primary_redis"` // in a replica region, where clicks are written
+}
+
+const regionHeader = "X-Shortener-Region"
+
+func validateRegion(c RegionConfig) error {
+	switch c.Role {
+	case "", "primary":
+		return nil
+	case "replica":
+	default:
+		return errors.New("region.role must be primary or replica")
+	}
+	if u, err := url.Parse(c.PrimaryURL); err != nil || u.Scheme == "" || u.Host == "" {
+		return errors.New("a replica region needs region.primary_url, an absolute url")
+	}
+	if err := validateRedis(c.PrimaryRedis); err != nil {
+		return errors.New("region.primary_" + err.Error())
+	}
+	return nil
+}
+
+func (c RegionConfig) replica() bool {
+	return c.Role == "replica"
+}
+
+var region_fallbacks = newCounter("shortener_region_primary_lookups_total", "Slugs a replica region didn't have, looked up in the primary, by result: found or missing")
+
+// Set in main in a replica region
+var primary_db *redis.Client
+
+func newPrimaryRedis(c RegionConfig) (*redis.Client, error) {
+	primary, err := newRedisClient(c.PrimaryRedis)
+	if err != nil {
+		return nil, err
+	}
+	primary.AddHook(timeoutHook{op_timeout: c.PrimaryRedis.OpTimeout.Duration})
+	primary.AddHook(traceHook{})
+	return primary, verifyRedis(context.Background(), primary, c.PrimaryRedis)
+}
+
+// notReplicatedYet looks a slug the region's Redis doesn't have up in the primary
+func notReplicatedYet(ctx context.Context, requested string, link resolvedSlug, err error) (resolvedSlug, error) {
+	if primary_db == nil || err != errSlugNotFound {
+		return link, err
+	}
+	link, err = resolveLink(primary_db, ctx, requested)
+	if err == nil {
+		region_fallbacks.Inc("result", "found")
+	} else if err == errSlugNotFound {
+		region_fallbacks.Inc("result", "missing")
+	}
+	return link, err
+}
+
+// withRegion names the region answering
+func withRegion(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if config.Region.Name != "" {
+			w.Header().Set(regionHeader, config.Region.Name)
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// forwardToPrimary sends a request a replica region doesn't serve on to the
+// primary. 307 keeps the method and body, so an API client's POST is repeated there.
+func forwardToPrimary(w http.ResponseWriter, req *http.Request) {
+	http.Redirect(w, req, strings.TrimSuffix(config.Region.PrimaryURL, "/")+req.URL.RequestURI(), http.StatusTemporaryRedirect)
+}
+
+// logRegion says what the region is at startup
+func logRegion(c RegionConfig) {
+	switch {
+	case c.replica():
+		log.Println("Region", c.Name, "is a replica: redirects only, clicks to", c.PrimaryRedis.Addr, "and the rest to", c.PrimaryURL)
+	case c.Role == "primary":
+		log.Println("Region", c.Name, "is the primary")
+	}
+}
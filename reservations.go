@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+// A custom slug can be reserved before the link's target is known, for when
+// the short link has to be printed or registered before its page exists.
+// Reserving answers a token; confirming with it and a target creates the link
+// under a generated slug with the reserved one as its alias, and releasing
+// gives the slug up early. Unconfirmed reservations lapse after their ttl.
+//
+// reserved:<alias> holds the reservation, with a digest of the token rather
+// than the token. While it's there, the name is taken: aliases and go link
+// keywords refuse it, and no link is created under it.
+
+type ReservationsConfig struct {
+	TTL    Duration `json:"ttl"`     // when the request doesn't say
+	MaxTTL Duration `json:"max_ttl"` // the longest a reservation may ask for
+}
+
+func validateReservations(c ReservationsConfig) error {
+	if c.TTL.Duration <= 0 || c.MaxTTL.Duration < c.TTL.Duration {
+		return errors.New("reservations.ttl must be positive, and no more than max_ttl")
+	}
+	return nil
+}
+
+const reservationTokenHeader = "X-Reservation-Token"
+
+func keyOfReservation(alias string) string {
+	return "reserved:" + alias
+}
+
+type Reservation struct {
+	Alias   string    `json:"alias"`
+	Token   string    `json:"token,omitempty"` // only when reserving
+	Tenant  string    `json:"tenant,omitempty"`
+	Expires time.Time `json:"expires_at"`
+	Confirm string    `json:"confirm"`
+}
+
+var reservations = newCounter("shortener_reservations_total", "Slug reservations, by outcome: reserved, confirmed, released or refused")
+
+var errReservationToken = errors.New("No such reservation, or the wrong token")
+
+func reservationDigest(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// KEYS: reserved, url, alias, honeypot
+//
+// ARGV: token digest, tenant, key id, reserved, ttl seconds
+var reserveScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 or redis.call("EXISTS", KEYS[2]) == 1 or redis.call("EXISTS", KEYS[3]) == 1 or redis.call("EXISTS", KEYS[4]) == 1 then
+	return 0
+end
+redis.call("HSET", KEYS[1], "token", ARGV[1], "tenant", ARGV[2], "by", ARGV[3], "reserved", ARGV[4])
+redis.call("EXPIRE", KEYS[1], ARGV[5])
+return 1
+`)
+
+// KEYS: reserved, url, alias, all on the alias's shard
+//
+// ARGV: token digest, slug
+var confirmReservationScript = redis.NewScript(`
+if redis.call("HGET", KEYS[1], "token") ~= ARGV[1] then
+	return -1
+end
+if redis.call("EXISTS", KEYS[2]) == 1 or redis.call("EXISTS", KEYS[3]) == 1 then
+	return 0
+end
+redis.call("SET", KEYS[3], ARGV[2])
+redis.call("DEL", KEYS[1])
+return 1
+`)
+
+// reserveAlias holds alias for ttl, answering the token, or errAliasTaken
+func reserveAlias(redis_db Storage, ctx context.Context, identity Identity, alias string, ttl time.Duration) (Reservation, error) {
+	if isRouteName(alias) {
+		return Reservation{}, errRouteName
+	}
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	token := hex.EncodeToString(nonce)
+	now := time.Now()
+	keys := []string{keyOfReservation(alias), keyOfSlug(alias), keyOfAlias(alias), keyOfHoneypot(alias)}
+	reserved, err := reserveScript.Run(ctx, redis_db, keys, reservationDigest(token), identity.Tenant, identity.KeyId, now.Unix(), int64(ttl.Seconds())).Int()
+	if err != nil {
+		return Reservation{}, err
+	}
+	if reserved == 0 {
+		return Reservation{}, errAliasTaken
+	}
+	return Reservation{Alias: alias, Token: token, Tenant: identity.Tenant, Expires: now.Add(ttl).UTC()}, nil
+}
+
+// checkReservation is nil when token holds alias's reservation
+func checkReservation(redis_db Storage, ctx context.Context, alias string, token string) error {
+	digest, err := redis_db.HGet(ctx, keyOfReservation(alias), "token").Result()
+	if err == redis.Nil || (err == nil && digest != reservationDigest(token)) {
+		return errReservationToken
+	}
+	return err
+}
+
+// confirmReservation makes alias point at slug, for the reservation's token
+func confirmReservation(redis_db Storage, ctx context.Context, alias string, token string, slug string) error {
+	keys := []string{keyOfReservation(alias), keyOfSlug(alias), keyOfAlias(alias)}
+	confirmed, err := confirmReservationScript.Run(ctx, redis_db, keys, reservationDigest(token), slug).Int()
+	switch {
+	case err != nil:
+		return err
+	case confirmed == -1:
+		return errReservationToken
+	case confirmed == 0:
+		return errAliasTaken
+	}
+	// the link may be on another shard than its alias
+	_, err = redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, keyOfSlugAliases(slug), alias)
+		touchLink(pipe, ctx, slug)
+		return nil
+	})
+	return err
+}
+
+func releaseReservation(redis_db Storage, ctx context.Context, alias string, token string) error {
+	if err := checkReservation(redis_db, ctx, alias, token); err != nil {
+		return err
+	}
+	return redis_db.Del(ctx, keyOfReservation(alias)).Err()
+}
+
+func registerReservationRoutes(router *mux.Router, redis_db Storage) {
+
+	router.HandleFunc("", func(w http.ResponseWriter, req *http.Request) {
+		identity, ok := hasRole(w, req, roleEditor)
+		if !ok {
+			return
+		}
+		var body struct {
+			Alias      string `json:"alias"`
+			TTLSeconds int64  `json:"ttl_seconds"`
+		}
+		if err := readJSON(w, req, &body); err != nil || !aliasIsValid(normalizeSlug(body.Alias)) {
+			writeJSONError(w, http.StatusBadRequest, "Expected {\"alias\": ...}, a valid alias")
+			return
+		}
+		alias := normalizeSlug(body.Alias)
+		if inNumericNamespace(alias) {
+			writeJSONError(w, http.StatusUnprocessableEntity, errNumericName.Error())
+			return
+		}
+		ttl := config.Reservations.TTL.Duration
+		if body.TTLSeconds != 0 {
+			ttl = time.Duration(body.TTLSeconds) * time.Second
+		}
+		if ttl <= 0 || ttl > config.Reservations.MaxTTL.Duration {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("ttl_seconds must be between 1 and %d", int64(config.Reservations.MaxTTL.Seconds())))
+			return
+		}
+		if !identity.can(roleAdmin) {
+			squatting, err := squattingOf(redis_db, req.Context(), alias)
+			if err != nil {
+				writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+				return
+			}
+			if squatting != "" && config.Squatting.Action != "warn" {
+				log.Println("Suspicious reservation", squatting, "by", identity.KeyId)
+				reservations.Inc("outcome", "refused")
+				writeJSONError(w, http.StatusUnprocessableEntity, squatting)
+				return
+			}
+		}
+		r, err := reserveAlias(redis_db, req.Context(), identity, alias, ttl)
+		if err == errAliasTaken {
+			reservations.Inc("outcome", "refused")
+			writeJSONError(w, http.StatusConflict, err.Error())
+			return
+		} else if err == errRouteName {
+			reservations.Inc("outcome", "refused")
+			writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		} else if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		reservations.Inc("outcome", "reserved")
+		log.Println("Reserved", alias, "for", identity.KeyId, "until", r.Expires)
+		r.Confirm = "/api/v1/reservations/" + alias + "/confirm"
+		writeJSON(w, http.StatusCreated, r)
+	}).Methods("POST")
+
+	// Creates the link; the body is the target and options, as for a new link,
+	// or draft instead of a target to publish it later
+	router.HandleFunc("/{alias}/confirm", func(w http.ResponseWriter, req *http.Request) {
+		identity, ok := hasRole(w, req, roleEditor)
+		if !ok {
+			return
+		}
+		alias := normalizeSlug(mux.Vars(req)["alias"])
+		token := req.Header.Get(reservationTokenHeader)
+		var body struct {
+			Target     string   `json:"target"`
+			Visibility string   `json:"visibility"`
+			Allow      string   `json:"allow"`
+			Privacy    string   `json:"privacy"`
+			Tags       []string `json:"tags"`
+			Draft      bool     `json:"draft"`
+		}
+		if err := readJSON(w, req, &body); err != nil || (body.Target != "") == body.Draft {
+			writeJSONError(w, http.StatusBadRequest, "Expected {\"target\": ...} or {\"draft\": true}")
+			return
+		}
+		opts := LinkOptions{Tags: body.Tags, Draft: body.Draft}
+		var err error
+		if opts.Access, err = parseLinkAccess(body.Visibility, body.Allow); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if opts.Access.Privacy, err = parseLinkPrivacy(body.Privacy); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := checkReservation(redis_db, req.Context(), alias, token); err == errReservationToken {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		} else if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+
+		su, status, err := shorten(redis_db, w, req, identity, body.Target, opts)
+		if err != nil {
+			writeJSONError(w, status, err.Error())
+			return
+		}
+		if err := confirmReservation(redis_db, req.Context(), alias, token, su.Slug); err != nil {
+			// it lapsed or was released meanwhile; the link goes, rather than stay without its name
+			if _, trash_err := trashLink(redis_db, req.Context(), su.Slug, identity.KeyId); trash_err != nil {
+				log.Println("Cannot trash", su.Slug, "after its reservation", alias, "failed", trash_err)
+			}
+			if err == errReservationToken || err == errAliasTaken {
+				writeJSONError(w, http.StatusConflict, "The reservation lapsed before it was confirmed")
+			} else {
+				writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			}
+			return
+		}
+		reindexTerms(redis_db, req.Context(), su.Slug)
+		reservations.Inc("outcome", "confirmed")
+		if body.Draft {
+			drafts.Inc("event", "created")
+		}
+		log.Println("Confirmed reservation", alias, "as", su.Slug, "by", identity.KeyId)
+		su.Aliases = []string{alias}
+		writeJSON(w, http.StatusCreated, linkResponseOf(su))
+	}).Methods("POST")
+
+	router.HandleFunc("/{alias}", func(w http.ResponseWriter, req *http.Request) {
+		identity, ok := hasRole(w, req, roleEditor)
+		if !ok {
+			return
+		}
+		alias := normalizeSlug(mux.Vars(req)["alias"])
+		if err := releaseReservation(redis_db, req.Context(), alias, req.Header.Get(reservationTokenHeader)); err == errReservationToken {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		} else if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		reservations.Inc("outcome", "released")
+		log.Println("Released reservation", alias, "by", identity.KeyId)
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("DELETE")
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// After shards are added, drained or removed, keys are where the old
+// configuration placed them. reshard, run with the new configuration, finds
+// the keys of links on any other server than the one placement gives them,
+// and copies them there with DUMP and RESTORE, keeping their TTL. It only
+// counts them on a dry run, and deletes the originals once told to.
+//
+// The steps: reshard --copy with the new configuration, roll it out to every
+// instance, then reshard --really. A key already on its new shard isn't
+// overwritten, so clicks counted there since the copy are kept, and those
+// counted on the old shard in between are lost.
+
+type ReshardReport struct {
+	DryRun  bool           `json:"dry_run"`
+	Moves   map[string]int `json:"moves"` // keys misplaced, by "from -> to"
+	Copied  int            `json:"copied"`
+	Deleted int            `json:"deleted"`
+	Sample  []string       `json:"sample"`
+}
+
+func (r *ReshardReport) note(what string) {
+	if len(r.Sample) < 20 {
+		r.Sample = append(r.Sample, what)
+	}
+}
+
+func reshard(redis_db Storage, ctx context.Context, copying bool, deleting bool) (ReshardReport, error) {
+	report := ReshardReport{DryRun: !copying && !deleting, Moves: map[string]int{}}
+	s, ok := redis_db.(*shardedStorage)
+	if !ok {
+		return report, errors.New("No shards configured, nothing to reshard")
+	}
+	for _, server := range s.servers {
+		var cursor uint64
+		for {
+			keys, next, err := server.client.Scan(ctx, cursor, "*", 500).Result()
+			if err != nil {
+				return report, err
+			}
+			if err := reshardKeys(s, ctx, server, keys, copying || deleting, deleting, &report); err != nil {
+				return report, err
+			}
+			cursor = next
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+	return report, nil
+}
+
+// reshardKeys moves those of keys, found on server, which belong elsewhere
+func reshardKeys(s *shardedStorage, ctx context.Context, server storageServer, keys []string, copying bool, deleting bool, report *ReshardReport) error {
+	misplaced := map[string][]string{} // by the server they belong on
+	for _, key := range keys {
+		if _, ok := shardedSlugOf(key); !ok {
+			continue
+		}
+		if to := s.placement.Get(key); to != server.name {
+			misplaced[to] = append(misplaced[to], key)
+			report.Moves[server.name+" -> "+to]++
+			report.note(key + ": " + server.name + " -> " + to)
+		}
+	}
+	if !copying || len(misplaced) == 0 {
+		return nil
+	}
+
+	for to, keys := range misplaced {
+		dumps := make([]*redis.StringCmd, len(keys))
+		ttls := make([]*redis.DurationCmd, len(keys))
+		_, err := server.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, key := range keys {
+				dumps[i] = pipe.Dump(ctx, key)
+				ttls[i] = pipe.PTTL(ctx, key)
+			}
+			return nil
+		})
+		if err != nil && err != redis.Nil {
+			return err
+		}
+
+		restores := make([]*redis.StatusCmd, len(keys))
+		_, err = s.clients[to].Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, key := range keys {
+				ttl := ttls[i].Val()
+				if dumps[i].Err() != nil || ttl == -2 {
+					continue // expired since SCAN
+				}
+				if ttl < 0 {
+					ttl = 0 // no expiry
+				}
+				restores[i] = pipe.Restore(ctx, key, ttl, dumps[i].Val())
+			}
+			return nil
+		})
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYKEY") {
+			return err
+		}
+		copied := []string{}
+		for i, key := range keys {
+			if restores[i] == nil {
+				continue
+			}
+			if err := restores[i].Err(); err == nil {
+				report.Copied++
+			} else if !strings.HasPrefix(err.Error(), "BUSYKEY") {
+				return err
+			}
+			copied = append(copied, key) // or there already
+		}
+
+		if deleting && len(copied) > 0 {
+			deleted, err := server.client.Del(ctx, copied...).Result()
+			report.Deleted += int(deleted)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Analytics are pruned by age by the prune-analytics job: per-click events
+// (the Redis stream and ClickHouse) after retention.events, and hourly click
+// series buckets after retention.hourly. Click totals and counts by country
+// are kept as long as their link, or its counters (see clicks.go).
+
+type RetentionConfig struct {
+	Events Duration `json:"events"` // 0 keeps them
+	Hourly Duration `json:"hourly"`
+}
+
+// analyticsRetention is retention, capped by gdpr.retention in GDPR mode
+func analyticsRetention(c Config) (events time.Duration, hourly time.Duration) {
+	events, hourly = c.Retention.Events.Duration, c.Retention.Hourly.Duration
+	if c.GDPR.Enabled && c.GDPR.Retention.Duration > 0 {
+		if events <= 0 || events > c.GDPR.Retention.Duration {
+			events = c.GDPR.Retention.Duration
+		}
+		if hourly <= 0 || hourly > c.GDPR.Retention.Duration {
+			hourly = c.GDPR.Retention.Duration
+		}
+	}
+	return events, hourly
+}
+
+func validateRetention(c RetentionConfig) error {
+	if c.Events.Duration < 0 || c.Hourly.Duration < 0 {
+		return fmt.Errorf("retention.events and retention.hourly can't be negative")
+	}
+	if c.Hourly.Duration > 0 && c.Hourly.Duration < time.Hour {
+		return fmt.Errorf("retention.hourly must be at least an hour")
+	}
+	return nil
+}
+
+type PruneReport struct {
+	StreamEvents  int64 `json:"stream_events"`
+	SeriesBuckets int64 `json:"series_buckets"`
+	ClickHouse    bool  `json:"clickhouse"` // a delete was submitted
+}
+
+// pruneAnalytics deletes click events older than events, and series buckets older than hourly; 0 keeps either
+func pruneAnalytics(redis_db Storage, ctx context.Context, events time.Duration, hourly time.Duration) (PruneReport, error) {
+	r := PruneReport{}
+	now := time.Now()
+	if events > 0 {
+		cutoff := now.Add(-events)
+		trimmed, err := redis_db.Do(ctx, "XTRIM", config.Clicks.StreamKey, "MINID", cutoff.UnixNano()/int64(time.Millisecond)).Int64()
+		if err != nil {
+			return r, err
+		}
+		r.StreamEvents = trimmed
+		if clickHouseSinkEnabled() {
+			err := clickHouseExec(config.ClickHouse, fmt.Sprintf("ALTER TABLE %s DELETE WHERE timestamp < toDateTime64(%d, 3, 'UTC')",
+				clickHouseTable(config.ClickHouse), cutoff.Unix()))
+			if err != nil {
+				return r, err
+			}
+			r.ClickHouse = true
+		}
+	}
+
+	if hourly > 0 {
+		oldest := now.Add(-hourly).UTC().Format(seriesBucketFormat)
+		err := scanKeys(redis_db, ctx, keyOfSlugSeries("*"), func(keys []string) error {
+			for _, key := range keys {
+				buckets, err := redis_db.HKeys(ctx, key).Result()
+				if err != nil {
+					return err
+				}
+				old := []string{}
+				for _, bucket := range buckets {
+					if bucket < oldest {
+						old = append(old, bucket)
+					}
+				}
+				if len(old) > 0 {
+					if err := redis_db.HDel(ctx, key, old...).Err(); err != nil {
+						return err
+					}
+					r.SeriesBuckets += int64(len(old))
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return r, err
+		}
+	}
+	return r, nil
+}
+
+func pruneAnalyticsJob(redis_db Storage) scheduledJob {
+	return scheduledJob{name: "prune-analytics", schedule: "@daily", run: func(ctx context.Context) error {
+		events, hourly := analyticsRetention(config)
+		report, err := pruneAnalytics(redis_db, ctx, events, hourly)
+		log.Printf("Pruned analytics: stream events %v, series buckets %v", report.StreamEvents, report.SeriesBuckets)
+		return err
+	}}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Rewrites applied to targets as they are redirected to, in order, without
+// touching what is stored. Each rule is a regex replacement on the whole URL,
+// and/or a list of query parameters to strip ("utm_*" strips by prefix).
+
+type RewriteRule struct {
+	Match       string   `json:"match"`
+	Replace     string   `json:"replace"`
+	StripParams []string `json:"strip_params"`
+}
+
+type compiledRewrite struct {
+	pattern *regexp.Regexp
+	replace string
+	strip   []string
+}
+
+var rewrite_rules []compiledRewrite
+
+func compileRewrites(rules []RewriteRule) error {
+	compiled := []compiledRewrite{}
+	for _, rule := range rules {
+		c := compiledRewrite{replace: rule.Replace, strip: rule.StripParams}
+		if rule.Match != "" {
+			pattern, err := regexp.Compile(rule.Match)
+			if err != nil {
+				return errors.New("Bad rewrite pattern " + rule.Match + ": " + err.Error())
+			}
+			c.pattern = pattern
+		} else if len(rule.StripParams) == 0 {
+			return errors.New("Rewrite rule needs match or strip_params")
+		}
+		compiled = append(compiled, c)
+	}
+	rewrite_rules = compiled
+	return nil
+}
+
+func stripParams(target string, names []string) string {
+	u, err := url.Parse(target)
+	if err != nil || u.RawQuery == "" {
+		return target
+	}
+	q := u.Query()
+	for param := range q {
+		for _, name := range names {
+			if param == name || (strings.HasSuffix(name, "*") && strings.HasPrefix(param, strings.TrimSuffix(name, "*"))) {
+				q.Del(param)
+			}
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func rewriteTarget(target string) string {
+	for _, rule := range rewrite_rules {
+		if rule.pattern != nil {
+			target = rule.pattern.ReplaceAllString(target, rule.replace)
+		}
+		if len(rule.strip) > 0 {
+			target = stripParams(target, rule.strip)
+		}
+	}
+	return target
+}
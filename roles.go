@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Roles over the management API and UI: viewers see listings and stats,
+// editors also create links and change their own, admins change every link
+// and use the admin API. API keys carry a role; SAML sessions get one from
+// their groups. Without a key or session, callers get roles.anonymous, which
+// is editor unless configured, as before roles existed.
+
+type RolesConfig struct {
+	Anonymous    string   `json:"anonymous"` // none, viewer, editor or admin
+	Session      string   `json:"session"`   // SAML sessions in none of the groups below
+	EditorGroups []string `json:"editor_groups"`
+	AdminGroups  []string `json:"admin_groups"`
+}
+
+const (
+	roleNone   = "none"
+	roleViewer = "viewer"
+	roleEditor = "editor"
+	roleAdmin  = "admin"
+)
+
+var roleRanks = map[string]int{roleNone: 0, roleViewer: 1, roleEditor: 2, roleAdmin: 3}
+
+func validateRoles(c Config) error {
+	roles := []string{c.Roles.Anonymous, c.Roles.Session}
+	for _, k := range c.APIKeys {
+		if k.Role != "" {
+			roles = append(roles, k.Role)
+		}
+	}
+	for _, k := range c.SignedRequests.Clients {
+		if k.Role != "" {
+			roles = append(roles, k.Role)
+		}
+	}
+	for _, k := range c.Server.ClientCerts.Identities {
+		if k.Role != "" {
+			roles = append(roles, k.Role)
+		}
+	}
+	for _, role := range roles {
+		if _, ok := roleRanks[role]; !ok {
+			return fmt.Errorf("Unknown role %q, expected none, viewer, editor or admin", role)
+		}
+	}
+	return nil
+}
+
+func (i Identity) can(role string) bool {
+	return roleRanks[i.Role] >= roleRanks[role]
+}
+
+func roleOfKey(k APIKeyConfig) string {
+	switch {
+	case k.Admin:
+		return roleAdmin
+	case k.Role != "":
+		return k.Role
+	}
+	return roleEditor
+}
+
+func roleOfSession(s Session) string {
+	for _, group := range s.Groups {
+		if containsString(config.Roles.AdminGroups, group) {
+			return roleAdmin
+		}
+	}
+	for _, group := range s.Groups {
+		if containsString(config.Roles.EditorGroups, group) {
+			return roleEditor
+		}
+	}
+	return config.Roles.Session
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// hasRole writes a JSON error unless the caller has at least role
+func hasRole(w http.ResponseWriter, req *http.Request, role string) (Identity, bool) {
+	identity, ok := identify(req)
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "Unknown API key")
+		return identity, false
+	}
+	if !identity.can(role) {
+		writeJSONError(w, http.StatusForbidden, "Needs the "+role+" role")
+		return identity, false
+	}
+	return identity, true
+}
+
+// requireRoleByMethod lets viewers read and editors change, for API subrouters
+func requireRoleByMethod(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		role := roleEditor
+		if req.Method == "GET" || req.Method == "HEAD" {
+			role = roleViewer
+		}
+		if _, ok := hasRole(w, req, role); ok {
+			next.ServeHTTP(w, req)
+		}
+	})
+}
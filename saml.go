@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+// SAML 2.0 SP-initiated login for the management UI, for IdPs which only
+// offer SAML apps. /saml/login sends the browser to the IdP with an
+// AuthnRequest (HTTP-Redirect binding), the IdP posts a signed Response back
+// to /saml/acs, and the visitor gets a signed session cookie. Only responses
+// to requests we sent are accepted, each once. IdPs are given
+// /saml/metadata. With SAML on, the UI needs a session or an API key, and
+// sessions also count as signed in for internal and restricted links.
+
+type SAMLConfig struct {
+	IdPSSOURL       string   `json:"idp_sso_url"`     // empty turns SAML off
+	IdPCertificate  string   `json:"idp_certificate"` // PEM
+	EntityID        string   `json:"entity_id"`
+	ACSURL          string   `json:"acs_url"` // https://<this server>/saml/acs
+	EmailAttribute  string   `json:"email_attribute"`
+	GroupsAttribute string   `json:"groups_attribute"`
+	SessionFor      Duration `json:"session_for"`
+	ClockSkew       Duration `json:"clock_skew"`
+}
+
+const (
+	nsSAMLProtocol  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	nsSAMLAssertion = "urn:oasis:names:tc:SAML:2.0:assertion"
+	samlSuccess     = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	samlBearer      = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+	samlPostBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	samlEmailFormat = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+
+	samlRequestTTL       = 10 * time.Minute
+	sessionCookie        = "shortener_session"
+	sessionTokenPurpose  = "session"
+	samlMaxResponseBytes = 1 << 20
+)
+
+type samlProvider struct {
+	config SAMLConfig
+	cert   *x509.Certificate
+}
+
+// Session is who signed in through SAML
+type Session struct {
+	Email   string   `json:"email"`
+	Groups  []string `json:"groups,omitempty"`
+	Expires int64    `json:"expires"`
+}
+
+var saml_provider *samlProvider
+
+func newSAMLProvider(c SAMLConfig) (*samlProvider, error) {
+	if c.EntityID == "" || c.ACSURL == "" {
+		return nil, errors.New("SAML needs entity_id and acs_url")
+	}
+	block, _ := pem.Decode([]byte(c.IdPCertificate))
+	if block == nil {
+		return nil, errors.New("SAML idp_certificate is not PEM")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return &samlProvider{config: c, cert: cert}, nil
+}
+
+func keyOfSAMLRequest(id string) string {
+	return "samlrequest:" + id
+}
+
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func registerSAMLRoutes(router *mux.Router, redis_db Storage, p *samlProvider) {
+	router.HandleFunc("/metadata", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/samlmetadata+xml")
+		fmt.Fprintf(w, `<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" entityID="%s">`+
+			`<md:SPSSODescriptor AuthnRequestsSigned="false" WantAssertionsSigned="true" protocolSupportEnumeration="%s">`+
+			`<md:NameIDFormat>%s</md:NameIDFormat>`+
+			`<md:AssertionConsumerService Binding="%s" Location="%s" index="0" isDefault="true"/>`+
+			`</md:SPSSODescriptor></md:EntityDescriptor>`,
+			xmlEscape(p.config.EntityID), nsSAMLProtocol, samlEmailFormat, samlPostBinding, xmlEscape(p.config.ACSURL))
+	}).Methods("GET")
+
+	// ?rd= is where to go after signing in, on this server
+	router.HandleFunc("/login", func(w http.ResponseWriter, req *http.Request) {
+		redirect := req.FormValue("rd")
+		if u, err := url.Parse(redirect); err == nil && u.IsAbs() && u.Host == req.Host {
+			redirect = u.RequestURI()
+		}
+		if !localPath(redirect) {
+			redirect = "/"
+		}
+		id := make([]byte, 20)
+		rand.Read(id)
+		request_id := "_" + hex.EncodeToString(id)
+		if err := redis_db.Set(req.Context(), keyOfSAMLRequest(request_id), redirect, samlRequestTTL).Err(); err != nil {
+			writeUnavailable(w)
+			return
+		}
+		login, err := p.loginURL(request_id)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "%v", err)
+			return
+		}
+		http.Redirect(w, req, login, http.StatusFound)
+	}).Methods("GET")
+
+	router.HandleFunc("/acs", func(w http.ResponseWriter, req *http.Request) {
+		req.Body = http.MaxBytesReader(w, req.Body, samlMaxResponseBytes)
+		raw, err := base64.StdEncoding.DecodeString(req.FormValue("SAMLResponse"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Malformed SAMLResponse")
+			return
+		}
+		session, request_id, err := p.readResponse(raw, time.Now())
+		if err != nil {
+			log.Println("SAML login refused", err)
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "Sign in failed")
+			return
+		}
+		redirect, err := takeSAMLRequest(redis_db, req.Context(), request_id)
+		if err == redis.Nil {
+			log.Println("SAML login refused, unknown or reused request", request_id)
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "Sign in expired, try again")
+			return
+		} else if err != nil {
+			writeUnavailable(w)
+			return
+		}
+
+		setSession(w, session)
+		log.Println("SAML login by", session.Email)
+		http.Redirect(w, req, redirect, http.StatusSeeOther)
+	}).Methods("POST")
+
+	router.HandleFunc("/logout", func(w http.ResponseWriter, req *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1})
+		http.Redirect(w, req, "/", http.StatusSeeOther)
+	}).Methods("GET", "POST")
+}
+
+// localPath keeps post-login redirects on this server
+func localPath(s string) bool {
+	return strings.HasPrefix(s, "/") && !strings.HasPrefix(s, "//") && !strings.HasPrefix(s, "/\\")
+}
+
+// takeSAMLRequest returns where a request was going, and forgets it so a response can't be replayed
+func takeSAMLRequest(redis_db Storage, ctx context.Context, id string) (string, error) {
+	var get *redis.StringCmd
+	var del *redis.IntCmd
+	_, err := redis_db.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		get = pipe.Get(ctx, keyOfSAMLRequest(id))
+		del = pipe.Del(ctx, keyOfSAMLRequest(id))
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return "", err
+	}
+	if del.Val() == 0 {
+		return "", redis.Nil
+	}
+	return get.Val(), nil
+}
+
+func (p *samlProvider) loginURL(request_id string) (string, error) {
+	authn := fmt.Sprintf(`<samlp:AuthnRequest xmlns:samlp="%s" xmlns:saml="%s" ID="%s" Version="2.0" IssueInstant="%s" `+
+		`Destination="%s" AssertionConsumerServiceURL="%s" ProtocolBinding="%s">`+
+		`<saml:Issuer>%s</saml:Issuer><samlp:NameIDPolicy Format="%s" AllowCreate="true"/></samlp:AuthnRequest>`,
+		nsSAMLProtocol, nsSAMLAssertion, request_id, time.Now().UTC().Format(time.RFC3339),
+		xmlEscape(p.config.IdPSSOURL), xmlEscape(p.config.ACSURL), samlPostBinding,
+		xmlEscape(p.config.EntityID), samlEmailFormat)
+
+	var deflated bytes.Buffer
+	fw, _ := flate.NewWriter(&deflated, flate.DefaultCompression)
+	fw.Write([]byte(authn))
+	fw.Close()
+
+	u, err := url.Parse(p.config.IdPSSOURL)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("SAMLRequest", base64.StdEncoding.EncodeToString(deflated.Bytes()))
+	q.Set("RelayState", request_id)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// readResponse verifies a Response and returns the session it grants and the request it answers
+func (p *samlProvider) readResponse(raw []byte, now time.Time) (Session, string, error) {
+	response, err := parseXMLTree(bytes.NewReader(raw))
+	if err != nil {
+		return Session{}, "", err
+	}
+	if !response.is(nsSAMLProtocol, "Response") {
+		return Session{}, "", errors.New("Not a SAML Response")
+	}
+	if status := response.child(nsSAMLProtocol, "Status"); status == nil ||
+		status.child(nsSAMLProtocol, "StatusCode") == nil ||
+		status.child(nsSAMLProtocol, "StatusCode").attr("Value") != samlSuccess {
+		return Session{}, "", errors.New("IdP didn't answer with success")
+	}
+	if d := response.attr("Destination"); d != "" && d != p.config.ACSURL {
+		return Session{}, "", fmt.Errorf("Response is for %s", d)
+	}
+	if len(response.childrenNamed(nsSAMLAssertion, "EncryptedAssertion")) > 0 {
+		return Session{}, "", errors.New("Encrypted assertions are not supported")
+	}
+	assertion := response.child(nsSAMLAssertion, "Assertion")
+	if assertion == nil {
+		return Session{}, "", errors.New("Response must hold exactly one assertion")
+	}
+
+	// either the assertion or the whole response must be signed
+	if assertion.child(nsDSig, "Signature") != nil {
+		err = verifyEnveloped(assertion, p.cert)
+	} else {
+		err = verifyEnveloped(response, p.cert)
+	}
+	if err != nil {
+		return Session{}, "", err
+	}
+
+	request_id, err := p.checkAssertion(assertion, now)
+	if err != nil {
+		return Session{}, "", err
+	}
+	if r := response.attr("InResponseTo"); r != "" && r != request_id {
+		return Session{}, "", errors.New("Response and assertion answer different requests")
+	}
+
+	session := Session{Expires: now.Add(p.config.SessionFor.Duration).Unix()}
+	if subject := assertion.child(nsSAMLAssertion, "Subject"); subject != nil {
+		if name_id := subject.child(nsSAMLAssertion, "NameID"); name_id != nil {
+			session.Email = strings.TrimSpace(name_id.text())
+		}
+	}
+	for _, statement := range assertion.childrenNamed(nsSAMLAssertion, "AttributeStatement") {
+		for _, attribute := range statement.childrenNamed(nsSAMLAssertion, "Attribute") {
+			name := attribute.attr("Name")
+			for _, value := range attribute.childrenNamed(nsSAMLAssertion, "AttributeValue") {
+				v := strings.TrimSpace(value.text())
+				if name == p.config.EmailAttribute && p.config.EmailAttribute != "" {
+					session.Email = v
+				} else if name == p.config.GroupsAttribute && p.config.GroupsAttribute != "" && v != "" {
+					session.Groups = append(session.Groups, v)
+				}
+			}
+		}
+	}
+	if session.Email == "" {
+		return Session{}, "", errors.New("Assertion names no email")
+	}
+	return session, request_id, nil
+}
+
+// checkAssertion checks it's for us, current, and a bearer answer to one of our requests, which it returns
+func (p *samlProvider) checkAssertion(assertion *xmlNode, now time.Time) (string, error) {
+	skew := p.config.ClockSkew.Duration
+	within := func(n *xmlNode) error {
+		if v := n.attr("NotBefore"); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil || now.Add(skew).Before(t) {
+				return errors.New("Assertion is not valid yet")
+			}
+		}
+		if v := n.attr("NotOnOrAfter"); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil || !now.Add(-skew).Before(t) {
+				return errors.New("Assertion has expired")
+			}
+		}
+		return nil
+	}
+
+	conditions := assertion.child(nsSAMLAssertion, "Conditions")
+	if conditions == nil {
+		return "", errors.New("Assertion has no conditions")
+	}
+	if err := within(conditions); err != nil {
+		return "", err
+	}
+	for _, restriction := range conditions.childrenNamed(nsSAMLAssertion, "AudienceRestriction") {
+		ours := false
+		for _, audience := range restriction.childrenNamed(nsSAMLAssertion, "Audience") {
+			ours = ours || strings.TrimSpace(audience.text()) == p.config.EntityID
+		}
+		if !ours {
+			return "", errors.New("Assertion is for another audience")
+		}
+	}
+
+	subject := assertion.child(nsSAMLAssertion, "Subject")
+	if subject == nil {
+		return "", errors.New("Assertion has no subject")
+	}
+	for _, confirmation := range subject.childrenNamed(nsSAMLAssertion, "SubjectConfirmation") {
+		data := confirmation.child(nsSAMLAssertion, "SubjectConfirmationData")
+		if confirmation.attr("Method") != samlBearer || data == nil {
+			continue
+		}
+		if data.attr("Recipient") != p.config.ACSURL || data.attr("InResponseTo") == "" || data.attr("NotOnOrAfter") == "" {
+			continue
+		}
+		if err := within(data); err != nil {
+			return "", err
+		}
+		return data.attr("InResponseTo"), nil
+	}
+	return "", errors.New("Assertion has no bearer confirmation answering our request")
+}
+
+func setSession(w http.ResponseWriter, s Session) {
+	payload, _ := json.Marshal(s)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    signToken(sessionTokenPurpose, string(payload)),
+		Path:     "/",
+		Expires:  time.Unix(s.Expires, 0),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(saml_provider.config.ACSURL, "https:"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// sessionOf returns the signed in SAML session, if any
+func sessionOf(req *http.Request) (Session, bool) {
+	if saml_provider == nil {
+		return Session{}, false
+	}
+	cookie, err := req.Cookie(sessionCookie)
+	if err != nil {
+		return Session{}, false
+	}
+	payload, err := verifyToken(sessionTokenPurpose, cookie.Value)
+	if err != nil {
+		return Session{}, false
+	}
+	var s Session
+	if json.Unmarshal([]byte(payload), &s) != nil || time.Now().Unix() >= s.Expires {
+		return Session{}, false
+	}
+	return s, true
+}
+
+// requireLogin sends visitors of the management UI through SAML. API keys still work without a session.
+func requireLogin(w http.ResponseWriter, req *http.Request) bool {
+	if saml_provider == nil || hasCredentials(req) {
+		return true
+	}
+	if _, ok := certIdentityOf(req); ok {
+		return true
+	}
+	if _, ok := sessionOf(req); ok {
+		return true
+	}
+	if req.Method == "GET" {
+		http.Redirect(w, req, "/saml/login?rd="+url.QueryEscape(req.URL.RequestURI()), http.StatusFound)
+	} else {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, "Sign in first")
+	}
+	return false
+}
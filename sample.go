@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// GET /api/v1/admin/sample picks n live links at random, for spot checks of
+// the inventory: one pass of SCAN over every url: key, keeping a reservoir of
+// n. Each link gets the key u^(1/weight), u uniform in (0,1), and the n
+// highest keys are the sample (Efraimidis and Spirakis' A-Res). With
+// weight=clicks a link's weight is its clicks plus one, so the links people
+// actually follow come up more often; by default every link weighs the same.
+// Each sampled target is then fetched, to tell dead links from live ones.
+
+const maxSampleSize = 100
+const sampleChecksAtOnce = 5
+
+type Liveness struct {
+	Alive    bool   `json:"alive"`
+	Status   int    `json:"status,omitempty"`
+	FinalURL string `json:"final_url,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Fallback string `json:"fallback,omitempty"` // the archived snapshot, when dead
+}
+
+type SampledLink struct {
+	LinkResponse
+	Liveness *Liveness `json:"liveness,omitempty"`
+}
+
+type LinkSample struct {
+	Scanned int           `json:"scanned"`
+	Weight  string        `json:"weight"`
+	Links   []SampledLink `json:"links"`
+}
+
+type sampleEntry struct {
+	slug string
+	key  float64
+}
+
+// sampleSlugs returns up to n slugs of live links, drawn at random, weighted by clicks if asked
+func sampleSlugs(redis_db Storage, ctx context.Context, n int, by_clicks bool) ([]string, int, error) {
+	reservoir := []sampleEntry{}
+	held := map[string]bool{}
+	scanned := 0
+	err := scanKeys(redis_db, ctx, keyOfSlug("*"), func(keys []string) error {
+		slugs := []string{}
+		for _, key := range keys {
+			if slug, err := slugFromKey(key); err == nil {
+				slugs = append(slugs, slug)
+			}
+		}
+		weights := make([]float64, len(slugs))
+		if by_clicks {
+			scores := make([]*redis.FloatCmd, len(slugs))
+			_, err := redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+				for i, slug := range slugs {
+					scores[i] = pipe.ZScore(ctx, keyOfClicksIndex, slug)
+				}
+				return nil
+			})
+			if err != nil && err != redis.Nil {
+				return err
+			}
+			for i := range slugs {
+				weights[i] = scores[i].Val()
+			}
+		}
+
+		for i, slug := range slugs {
+			// SCAN may return a key twice; it only gets one place
+			if held[slug] {
+				continue
+			}
+			scanned++
+			key := math.Pow(rand.Float64(), 1/(weights[i]+1))
+			if len(reservoir) < n {
+				reservoir = append(reservoir, sampleEntry{slug, key})
+				held[slug] = true
+				continue
+			}
+			lowest := 0
+			for j := range reservoir {
+				if reservoir[j].key < reservoir[lowest].key {
+					lowest = j
+				}
+			}
+			if key > reservoir[lowest].key {
+				delete(held, reservoir[lowest].slug)
+				reservoir[lowest] = sampleEntry{slug, key}
+				held[slug] = true
+			}
+		}
+		return nil
+	})
+	sort.Slice(reservoir, func(i, j int) bool {
+		return reservoir[i].key > reservoir[j].key
+	})
+	slugs := make([]string, len(reservoir))
+	for i, e := range reservoir {
+		slugs[i] = e.slug
+	}
+	return slugs, scanned, err
+}
+
+func checkLiveness(ctx context.Context, target string) *Liveness {
+	preview, err := fetchPage(ctx, target)
+	l := &Liveness{Status: preview.Status, FinalURL: preview.FinalURL}
+	if err != nil {
+		l.Error = err.Error()
+		return l
+	}
+	l.Alive = preview.Status < 400
+	return l
+}
+
+func handleSample(redis_db Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		n := 10
+		if v := req.FormValue("n"); v != "" {
+			var err error
+			if n, err = strconv.Atoi(v); err != nil || n < 1 || n > maxSampleSize {
+				writeJSONError(w, http.StatusBadRequest, "n must be between 1 and "+strconv.Itoa(maxSampleSize))
+				return
+			}
+		}
+		weight := req.FormValue("weight")
+		switch weight {
+		case "":
+			weight = "uniform"
+		case "uniform", "clicks":
+		default:
+			writeJSONError(w, http.StatusBadRequest, "weight must be uniform or clicks")
+			return
+		}
+
+		slugs, scanned, err := sampleSlugs(redis_db, req.Context(), n, weight == "clicks")
+		if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		r := LinkSample{Scanned: scanned, Weight: weight, Links: []SampledLink{}}
+		for _, slug := range slugs {
+			su, err := getDetailsOfKey(redis_db, req.Context(), slug)
+			if err == errSlugNotFound {
+				continue // expired since
+			} else if err != nil {
+				writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+				return
+			}
+			r.Links = append(r.Links, SampledLink{LinkResponse: linkResponseOf(su)})
+		}
+
+		if req.FormValue("check") != "false" {
+			var wg sync.WaitGroup
+			slots := make(chan struct{}, sampleChecksAtOnce)
+			for i := range r.Links {
+				wg.Add(1)
+				go func(link *SampledLink) {
+					defer wg.Done()
+					slots <- struct{}{}
+					defer func() { <-slots }()
+					link.Liveness = checkLiveness(req.Context(), link.Target)
+					if !link.Liveness.Alive {
+						link.Liveness.Fallback = link.ArchiveURL
+					}
+				}(&r.Links[i])
+			}
+			wg.Wait()
+		}
+		writeJSON(w, http.StatusOK, r)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Search uses an inverted index instead of scanning the keyspace:
+// search:<term> is the set of slugs whose slug, aliases, target, title,
+// description, note or tags contain a word starting with term, and
+// urlterms:<slug> the terms a link is filed under, so they can be taken out
+// again when it changes. A query matches the links having every word of it,
+// each as a word or the start of one.
+//
+// Entries of expired links stay behind until a search finds them missing, or
+// purge-orphans runs.
+
+const minTermRunes = 2
+const maxTermRunes = 24
+
+var ignoredTerms = map[string]bool{"http": true, "https": true, "www": true}
+
+func keyOfSearchTerm(term string) string {
+	return "search:" + term
+}
+
+func keyOfSlugTerms(slug string) string {
+	return "urlterms:" + slug
+}
+
+// searchWords splits text into lowercase words of letters and digits, cut to maxTermRunes
+func searchWords(text string) []string {
+	words := []string{}
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if r := []rune(word); len(r) > maxTermRunes {
+			word = string(r[:maxTermRunes])
+		}
+		if len([]rune(word)) >= minTermRunes && !ignoredTerms[word] {
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+// searchTerms are every prefix, of at least minTermRunes, of every word about the link
+func searchTerms(su ShortUrl) []string {
+	text := append([]string{su.Slug, su.Target, su.DisplayTarget(), su.Title, su.Description, su.Note}, su.Aliases...)
+	text = append(text, su.Tags...)
+	seen := map[string]bool{}
+	for _, word := range searchWords(strings.Join(text, " ")) {
+		r := []rune(word)
+		for n := minTermRunes; n <= len(r); n++ {
+			seen[string(r[:n])] = true
+		}
+	}
+	terms := make([]string, 0, len(seen))
+	for term := range seen {
+		terms = append(terms, term)
+	}
+	return terms
+}
+
+// indexLinkTerms files the link under its current terms, and out of those it no longer has
+func indexLinkTerms(redis_db Storage, ctx context.Context, slug string) error {
+	su, err := getDetailsOfKey(redis_db, ctx, slug)
+	if err == errSlugNotFound {
+		return unindexLinkTerms(redis_db, ctx, slug)
+	} else if err != nil {
+		return err
+	}
+	if redisearch_enabled {
+		return writeLinkDocument(redis_db, ctx, su)
+	}
+	old, err := redis_db.SMembers(ctx, keyOfSlugTerms(slug)).Result()
+	if err != nil {
+		return err
+	}
+	terms := searchTerms(su)
+	current := map[string]bool{}
+	for _, term := range terms {
+		current[term] = true
+	}
+	_, err = redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, term := range old {
+			if !current[term] {
+				pipe.SRem(ctx, keyOfSearchTerm(term), slug)
+			}
+		}
+		pipe.Del(ctx, keyOfSlugTerms(slug))
+		if len(terms) == 0 {
+			return nil
+		}
+		members := make([]interface{}, len(terms))
+		for i, term := range terms {
+			pipe.SAdd(ctx, keyOfSearchTerm(term), slug)
+			members[i] = term
+		}
+		pipe.SAdd(ctx, keyOfSlugTerms(slug), members...)
+		return nil
+	})
+	return err
+}
+
+// reindexTerms is indexLinkTerms for callers which go ahead regardless
+func reindexTerms(redis_db Storage, ctx context.Context, slug string) {
+	if err := indexLinkTerms(redis_db, ctx, slug); err != nil {
+		log.Println("Cannot update the search index for", slug, err)
+	}
+}
+
+func unindexLinkTerms(redis_db Storage, ctx context.Context, slug string) error {
+	if redisearch_enabled {
+		return redis_db.Del(ctx, keyOfLinkDocument(slug)).Err()
+	}
+	old, err := redis_db.SMembers(ctx, keyOfSlugTerms(slug)).Result()
+	if err != nil {
+		return err
+	}
+	_, err = redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, term := range old {
+			pipe.SRem(ctx, keyOfSearchTerm(term), slug)
+		}
+		pipe.Del(ctx, keyOfSlugTerms(slug))
+		return nil
+	})
+	return err
+}
+
+// indexAllLinkTerms fills the index for every link
+func indexAllLinkTerms(redis_db Storage, ctx context.Context) (int, error) {
+	count := 0
+	err := scanKeys(redis_db, ctx, keyOfSlug("*"), func(keys []string) error {
+		for _, key := range keys {
+			slug, err := slugFromKey(key)
+			if err != nil {
+				continue
+			}
+			if err := indexLinkTerms(redis_db, ctx, slug); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// searchLinks returns the links matching every word of q, most clicked
+// first. The cursor is an offset into the matches.
+func searchLinks(redis_db Storage, ctx context.Context, q string, cursor uint64, page_size int) ([]ShortUrl, uint64, error) {
+	r := []ShortUrl{}
+	words := searchWords(q)
+	if len(words) == 0 {
+		return r, 0, nil
+	}
+	keys := make([]string, len(words))
+	for i, word := range words {
+		keys[i] = keyOfSearchTerm(word)
+	}
+	var slugs []string
+	var err error
+	if redisearch_enabled {
+		slugs, err = searchDocuments(redis_db, ctx, words)
+	} else {
+		slugs, err = redis_db.SInter(ctx, keys...).Result()
+	}
+	if err != nil || len(slugs) == 0 {
+		return r, 0, lookupError("search", err)
+	}
+
+	clicks := make([]*redis.FloatCmd, len(slugs))
+	_, err = redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, slug := range slugs {
+			clicks[i] = pipe.ZScore(ctx, keyOfClicksIndex, slug)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return r, 0, lookupError("search", err)
+	}
+	score := make(map[string]float64, len(slugs))
+	for i, slug := range slugs {
+		score[slug] = clicks[i].Val()
+	}
+	sort.Slice(slugs, func(i, j int) bool {
+		if score[slugs[i]] != score[slugs[j]] {
+			return score[slugs[i]] > score[slugs[j]]
+		}
+		return slugs[i] < slugs[j]
+	})
+
+	if cursor >= uint64(len(slugs)) {
+		return r, 0, nil
+	}
+	page := slugs[cursor:]
+	next := uint64(0)
+	if len(page) > page_size {
+		page, next = page[:page_size], cursor+uint64(page_size)
+	}
+	for _, slug := range page {
+		su, err := getDetailsOfKey(redis_db, ctx, slug)
+		if err == errSlugNotFound {
+			unindexLinkTerms(redis_db, ctx, slug)
+			if !redisearch_enabled {
+				for _, key := range keys {
+					redis_db.SRem(ctx, key, slug)
+				}
+			}
+			continue
+		} else if err != nil {
+			return r, cursor, err
+		}
+		r = append(r, su)
+	}
+	return r, next, nil
+}
+
+func handleSearch(redis_db Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if _, ok := hasRole(w, req, roleViewer); !ok {
+			return
+		}
+		cursor, page_size, err := pageRequest(req)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		q := req.FormValue("q")
+		if len(searchWords(q)) == 0 {
+			writeJSONError(w, http.StatusBadRequest, "q needs a word of at least 2 letters or digits")
+			return
+		}
+		links, next, err := searchLinks(redis_db, req.Context(), q, cursor, page_size)
+		if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		r := LinkListResponse{Links: []LinkResponse{}, NextCursor: strconv.FormatUint(next, 10)}
+		for _, su := range links {
+			r.Links = append(r.Links, linkResponseOf(su))
+		}
+		writeJSON(w, http.StatusOK, r)
+	}
+}
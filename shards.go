@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Past what one Redis holds, links can be spread over several independent
+// ones, without Redis Cluster. Every key of a link lives on one shard, picked
+// by its slug: its url: key, meta, counters, series, aliases and the like, and
+// the alias:, reserved: and honeypot: claims on its name, so that creating a
+// link still checks and writes them in one script. Everything else stays on
+// the home Redis, redis.addr: the indexes, search, tenants, jobs and keys.
+//
+// A slug's shard is the one hashing highest with it (rendezvous hashing, a
+// consistent hash), so adding a shard only moves the slugs it now wins, and
+// removing one only those it held. Placement only follows the configuration:
+// a shard which is down isn't replaced by another, its links answer 503 until
+// it's back while the others carry on. A shard with drain: true gets no more
+// links; the reshard command (see reshard.go) moves keys to where they belong.
+//
+// SCAN, MGET, DEL, UNLINK and EXISTS are split across shards here. A script
+// or other command whose keys are on several shards is refused with
+// errCrossShard rather than run on the wrong one, and a transaction over
+// several shards is one per shard, not atomic across them.
+
+type ShardsConfig struct {
+	Endpoints      []ShardConfig `json:"endpoints"`
+	HealthInterval Duration      `json:"health_interval"`
+}
+
+// ShardConfig is one Redis taking links; everything but its address and
+// database is as in redis
+type ShardConfig struct {
+	Name  string `json:"name"` // placement hashes it, so a shard can change address
+	Addr  string `json:"addr"`
+	DB    int    `json:"db"`
+	Drain bool   `json:"drain"` // no new links, emptied by resharding
+}
+
+const homeShard = "home"
+
+func validateShards(c Config) error {
+	if len(c.Shards.Endpoints) == 0 {
+		return nil
+	}
+	if c.Shards.HealthInterval.Duration <= 0 {
+		return errors.New("shards.health_interval must be positive")
+	}
+	if c.Region.Role != "" {
+		return errors.New("shards can't be used with regions")
+	}
+	if c.Cache.Tracking.Enabled {
+		return errors.New("cache.tracking only tracks one Redis, and can't be used with shards")
+	}
+	names := map[string]bool{homeShard: true}
+	addrs := map[string]bool{c.Redis.Addr + "/" + strconv.Itoa(c.Redis.DB): true}
+	for _, s := range c.Shards.Endpoints {
+		if s.Name == "" || names[s.Name] {
+			return fmt.Errorf("shards.endpoints need names of their own, other than %q: %q", homeShard, s.Name)
+		}
+		addr := s.Addr + "/" + strconv.Itoa(s.DB)
+		if s.Addr == "" || addrs[addr] {
+			return fmt.Errorf("shard %s needs an addr and db of its own, not redis.addr's or another shard's", s.Name)
+		}
+		names[s.Name], addrs[addr] = true, true
+	}
+	return nil
+}
+
+func shardRedisConfig(home RedisConfig, s ShardConfig) RedisConfig {
+	c := home
+	c.Addr, c.DB = s.Addr, s.DB
+	return c
+}
+
+// shardedKeyPrefixes are the keys kept on their slug's shard
+var shardedKeyPrefixes = []string{"url:", "urlhitcount:", "urluniqhitcount:", "urlmeta:", "urlseries:", "urlaliases:", "urlthumb:", "urlgeo:", "urlbundle:", "urlclickdedup:", "alias:", "reserved:", "honeypot:"}
+
+// shardedSlugOf is the slug whose shard has key, false for keys of the home Redis
+func shardedSlugOf(key string) (string, bool) {
+	for _, prefix := range shardedKeyPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			slug := key[len(prefix):]
+			if i := strings.IndexByte(slug, ':'); i >= 0 {
+				slug = slug[:i] // urlclickdedup:<slug>:<visitor>
+			}
+			return slug, true
+		}
+	}
+	return "", false
+}
+
+// placement says which server has a key; it's the Ring's consistent hash
+type placement struct {
+	shards []string // taking links; with none, links stay home
+}
+
+func (p placement) Get(key string) string {
+	slug, ok := shardedSlugOf(key)
+	if !ok || len(p.shards) == 0 {
+		return homeShard
+	}
+	return p.shardOf(slug)
+}
+
+func (p placement) shardOf(slug string) string {
+	best, best_score := "", uint64(0)
+	for _, name := range p.shards {
+		sum := sha256.Sum256([]byte(name + "\x00" + slug))
+		if score := binary.BigEndian.Uint64(sum[:8]); best == "" || score > best_score {
+			best, best_score = name, score
+		}
+	}
+	return best
+}
+
+// shardedStorage is a Ring over the home Redis and the shards, placing keys
+// by placement instead of hashing them whole
+type shardedStorage struct {
+	*redis.Ring
+	placement placement
+	servers   []storageServer // home first, as SCAN goes through them
+	clients   map[string]*redis.Client
+}
+
+func newShardedStorage(home RedisConfig, c ShardsConfig) (*shardedStorage, error) {
+	s := &shardedStorage{clients: map[string]*redis.Client{}}
+	options := map[string]*redis.Options{}
+	addrs := map[string]string{}
+	add := func(name string, rc RedisConfig) error {
+		opts, err := redisOptions(rc)
+		if err != nil {
+			return fmt.Errorf("shard %s: %v", name, err)
+		}
+		options[name], addrs[name] = opts, rc.Addr
+		s.servers = append(s.servers, storageServer{name: name, config: rc})
+		return nil
+	}
+	if err := add(homeShard, home); err != nil {
+		return nil, err
+	}
+	for _, shard := range c.Endpoints {
+		if err := add(shard.Name, shardRedisConfig(home, shard)); err != nil {
+			return nil, err
+		}
+		if !shard.Drain {
+			s.placement.shards = append(s.placement.shards, shard.Name)
+		}
+	}
+
+	s.Ring = redis.NewRing(&redis.RingOptions{
+		Addrs: addrs,
+		// each server's client is set up as a lone Redis would be, with every redis.* setting
+		NewClient: func(name string, _ *redis.Options) *redis.Client {
+			s.clients[name] = redis.NewClient(options[name])
+			return s.clients[name]
+		},
+		// the same placement whichever shards are up: links aren't looked for elsewhere
+		NewConsistentHash:  func([]string) redis.ConsistentHash { return s.placement },
+		HeartbeatFrequency: c.HealthInterval.Duration,
+		MaxRetries:         -1, // each client retries as redis.max_retries says
+	})
+	for i := range s.servers {
+		s.servers[i].client = s.clients[s.servers[i].name]
+	}
+	s.Ring.AddHook(crossShardGuard{s.placement})
+	return s, nil
+}
+
+// AddHook adds hook to each server, so a command passes it once, where it
+// runs. The circuit breaker only guards the home Redis: a shard being down
+// shouldn't fail the links of the others.
+func (s *shardedStorage) AddHook(hook redis.Hook) {
+	if _, ok := hook.(*circuitBreaker); ok {
+		s.clients[homeShard].AddHook(hook)
+		return
+	}
+	for _, server := range s.servers {
+		server.client.AddHook(hook)
+	}
+}
+
+// Scan goes through the home Redis, then each shard; the low byte of the
+// cursor is which
+func (s *shardedStorage) Scan(ctx context.Context, cursor uint64, match string, count int64) *redis.ScanCmd {
+	server_cursor, i := splitScanCursor(cursor)
+	if i >= len(s.servers) {
+		return redis.NewScanCmdResult(nil, 0, errors.New("SCAN cursor of no shard"))
+	}
+	keys, next, err := s.servers[i].client.Scan(ctx, server_cursor, match, count).Result()
+	switch {
+	case err != nil:
+		return redis.NewScanCmdResult(nil, cursor, err)
+	case next != 0:
+		return redis.NewScanCmdResult(keys, scanCursor(next, i), nil)
+	case i+1 < len(s.servers):
+		return redis.NewScanCmdResult(keys, scanCursor(0, i+1), nil)
+	}
+	return redis.NewScanCmdResult(keys, 0, nil)
+}
+
+// scanCursor is server i's SCAN cursor as Scan hands it out
+func scanCursor(server_cursor uint64, i int) uint64 {
+	return server_cursor<<8 | uint64(i)
+}
+
+func splitScanCursor(cursor uint64) (uint64, int) {
+	return cursor >> 8, int(cursor & 0xff)
+}
+
+// byShard groups the positions of keys by server
+func (s *shardedStorage) byShard(keys []string) map[string][]int {
+	groups := map[string][]int{}
+	for i, key := range keys {
+		name := s.placement.Get(key)
+		groups[name] = append(groups[name], i)
+	}
+	return groups
+}
+
+func pickKeys(keys []string, at []int) []string {
+	picked := make([]string, len(at))
+	for j, i := range at {
+		picked[j] = keys[i]
+	}
+	return picked
+}
+
+func (s *shardedStorage) MGet(ctx context.Context, keys ...string) *redis.SliceCmd {
+	values := make([]interface{}, len(keys))
+	for name, at := range s.byShard(keys) {
+		got, err := s.clients[name].MGet(ctx, pickKeys(keys, at)...).Result()
+		if err != nil {
+			return redis.NewSliceResult(nil, err)
+		}
+		for j, i := range at {
+			values[i] = got[j]
+		}
+	}
+	return redis.NewSliceResult(values, nil)
+}
+
+// sumByShard runs a command counting keys on each server, adding up the counts
+func (s *shardedStorage) sumByShard(ctx context.Context, keys []string, command func(*redis.Client, context.Context, ...string) *redis.IntCmd) *redis.IntCmd {
+	total := int64(0)
+	for name, at := range s.byShard(keys) {
+		n, err := command(s.clients[name], ctx, pickKeys(keys, at)...).Result()
+		if err != nil {
+			return redis.NewIntResult(total, err)
+		}
+		total += n
+	}
+	return redis.NewIntResult(total, nil)
+}
+
+func (s *shardedStorage) Del(ctx context.Context, keys ...string) *redis.IntCmd {
+	return s.sumByShard(ctx, keys, (*redis.Client).Del)
+}
+
+func (s *shardedStorage) Unlink(ctx context.Context, keys ...string) *redis.IntCmd {
+	return s.sumByShard(ctx, keys, (*redis.Client).Unlink)
+}
+
+func (s *shardedStorage) Exists(ctx context.Context, keys ...string) *redis.IntCmd {
+	return s.sumByShard(ctx, keys, (*redis.Client).Exists)
+}
+
+// The Ring sends a command without keys to any server it likes; these go to
+// the home Redis, which is what stats, search and /readyz ask about
+
+func (s *shardedStorage) Ping(ctx context.Context) *redis.StatusCmd {
+	return s.clients[homeShard].Ping(ctx)
+}
+
+func (s *shardedStorage) Info(ctx context.Context, section ...string) *redis.StringCmd {
+	return s.clients[homeShard].Info(ctx, section...)
+}
+
+// Do runs where its first argument would be placed as a key: a command on a
+// link's key on its shard, anything else (MODULE LIST, FT.*) at home
+func (s *shardedStorage) Do(ctx context.Context, args ...interface{}) *redis.Cmd {
+	name := homeShard
+	if len(args) > 1 {
+		name = s.placement.Get(fmt.Sprint(args[1]))
+	}
+	return s.clients[name].Do(ctx, args...)
+}
+
+var errCrossShard = errors.New("Redis command over keys of several shards")
+
+// crossShardGuard refuses what the Ring would otherwise run on the first key's
+// shard alone
+type crossShardGuard struct {
+	placement placement
+}
+
+// commandKeys are the keys of scripts and the multi-key commands used here
+func commandKeys(cmd redis.Cmder) []interface{} {
+	args := cmd.Args()
+	switch cmd.Name() {
+	case "eval", "evalsha":
+		if len(args) < 3 {
+			return nil
+		}
+		n, _ := strconv.Atoi(fmt.Sprint(args[2]))
+		if 3+n > len(args) {
+			return nil
+		}
+		return args[3 : 3+n]
+	case "mget", "del", "unlink", "exists", "touch", "sinter", "sunion", "sdiff", "sinterstore", "sunionstore", "sdiffstore", "rename", "renamenx", "rpoplpush", "smove":
+		if cmd.Name() == "smove" && len(args) > 3 {
+			return args[1:3]
+		}
+		return args[1:]
+	case "mset", "msetnx":
+		keys := []interface{}{}
+		for i := 1; i < len(args); i += 2 {
+			keys = append(keys, args[i])
+		}
+		return keys
+	}
+	return nil
+}
+
+func (g crossShardGuard) check(cmd redis.Cmder) error {
+	keys := commandKeys(cmd)
+	for _, key := range keys {
+		if first, this := g.placement.Get(fmt.Sprint(keys[0])), g.placement.Get(fmt.Sprint(key)); this != first {
+			return fmt.Errorf("%w: %s on %s and %s", errCrossShard, cmd.Name(), first, this)
+		}
+	}
+	return nil
+}
+
+func (g crossShardGuard) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return ctx, g.check(cmd)
+}
+
+func (g crossShardGuard) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	return nil
+}
+
+func (g crossShardGuard) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	for _, cmd := range cmds {
+		if err := g.check(cmd); err != nil {
+			return ctx, err
+		}
+	}
+	return ctx, nil
+}
+
+func (g crossShardGuard) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return nil
+}
+
+// ShardHealth is what a server answered last, for /api/v1/stats
+type ShardHealth struct {
+	Name      string    `json:"name"`
+	Addr      string    `json:"addr"`
+	Up        bool      `json:"up"`
+	Draining  bool      `json:"draining,omitempty"`
+	LatencyMs float64   `json:"latency_ms"`
+	Keys      int64     `json:"keys"`
+	Error     string    `json:"error,omitempty"`
+	Since     time.Time `json:"since"` // when it went up, or down
+}
+
+var (
+	shard_up   = newGauge("shortener_shard_up", "1 while the Redis server answered its last ping, by shard")
+	shard_keys = newGauge("shortener_shard_keys", "Keys on the Redis server at its last ping, by shard")
+)
+
+type shardWatch struct {
+	mu   sync.RWMutex
+	last []ShardHealth
+}
+
+var shard_health = &shardWatch{}
+
+func (w *shardWatch) get() []ShardHealth {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.last
+}
+
+// down names the servers which didn't answer their last ping
+func (w *shardWatch) down() []string {
+	names := []string{}
+	for _, h := range w.get() {
+		if !h.Up {
+			names = append(names, h.Name)
+		}
+	}
+	return names
+}
+
+func (s *shardedStorage) draining(name string) bool {
+	for _, shard := range s.placement.shards {
+		if shard == name {
+			return false
+		}
+	}
+	return name != homeShard
+}
+
+// watchShards pings every server each interval, until the process ends; a
+// single Redis has nothing to watch
+func watchShards(redis_db Storage, c ShardsConfig) {
+	s, ok := redis_db.(*shardedStorage)
+	if !ok {
+		return
+	}
+	for {
+		before := map[string]ShardHealth{}
+		for _, h := range shard_health.get() {
+			before[h.Name] = h
+		}
+		now := []ShardHealth{}
+		for _, server := range s.servers {
+			h := ShardHealth{Name: server.name, Addr: server.config.Addr, Draining: s.draining(server.name), Since: time.Now()}
+			ctx, cancel := context.WithTimeout(context.Background(), c.HealthInterval.Duration)
+			start := time.Now()
+			keys, err := server.client.DBSize(ctx).Result()
+			cancel()
+			if err != nil {
+				h.Error = err.Error()
+			} else {
+				h.Up, h.Keys = true, keys
+				h.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+			}
+			if last, seen := before[h.Name]; seen && last.Up == h.Up {
+				h.Since = last.Since
+			} else if seen || !h.Up {
+				log.Println("Shard", h.Name, "at", h.Addr, "up:", h.Up, h.Error)
+			}
+			shard_up.Set(map[bool]float64{true: 1}[h.Up], "shard", h.Name)
+			shard_keys.Set(float64(h.Keys), "shard", h.Name)
+			now = append(now, h)
+		}
+		shard_health.mu.Lock()
+		shard_health.last = now
+		shard_health.mu.Unlock()
+		time.Sleep(c.HealthInterval.Duration)
+	}
+}
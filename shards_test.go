@@ -0,0 +1,186 @@
+package main
+
+// Tests of shard placement and of the parts of the sharded storage which
+// don't need a Redis: SCAN cursors, refusing commands over several shards,
+// and which keys reshard finds misplaced.
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func TestPlacementOfKeys(t *testing.T) {
+	p := placement{shards: []string{"a", "b", "c"}}
+	home := placement{}
+	cases := []struct {
+		key  string
+		want string
+	}{
+		{"url:abc", p.shardOf("abc")},
+		{"urlmeta:abc", p.shardOf("abc")},
+		{"urlhitcount:abc", p.shardOf("abc")},
+		{"alias:abc", p.shardOf("abc")},
+		{"idx:expires", homeShard},
+		{"apikey:abc", homeShard},
+		{"urlclickdedup:abc:f00d", p.shardOf("abc")},
+	}
+	for _, c := range cases {
+		if got := p.Get(c.key); got != c.want {
+			t.Errorf("Get(%q) = %q, want %q", c.key, got, c.want)
+		}
+		if got := home.Get(c.key); got != homeShard {
+			t.Errorf("Get(%q) without shards = %q, want %q", c.key, got, homeShard)
+		}
+	}
+}
+
+func TestPlacementIsStable(t *testing.T) {
+	// pinned: placement changing would move links, and need a reshard
+	cases := []struct {
+		slug string
+		want string
+	}{
+		{"abc", "a"},
+		{"Zx9", "a"},
+		{"x", "b"},
+		{"7", "b"},
+		{"q1", "c"},
+	}
+	for _, c := range cases {
+		for _, order := range [][]string{{"a", "b", "c"}, {"c", "b", "a"}, {"b", "a", "c"}} {
+			if got := (placement{shards: order}).shardOf(c.slug); got != c.want {
+				t.Errorf("shardOf(%q) over %v = %q, want %q", c.slug, order, got, c.want)
+			}
+		}
+	}
+}
+
+func TestAddingAShardOnlyMovesLinksToIt(t *testing.T) {
+	before := placement{shards: []string{"a", "b", "c"}}
+	after := placement{shards: []string{"a", "b", "c", "d"}}
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		slug := strconv.Itoa(i)
+		from, to := before.shardOf(slug), after.shardOf(slug)
+		if from == to {
+			continue
+		}
+		moved++
+		if to != "d" {
+			t.Errorf("%s moved from %s to %s, not to the new shard", slug, from, to)
+		}
+	}
+	if moved == 0 || moved > 400 {
+		t.Errorf("%d of 1000 links moved to a fourth shard, want about 250", moved)
+	}
+}
+
+func TestScanCursorRoundTrips(t *testing.T) {
+	cases := []struct {
+		server_cursor uint64
+		server        int
+	}{
+		{0, 0},
+		{0, 1},
+		{1, 0},
+		{17, 2},
+		{1<<40 + 3, 255},
+	}
+	for _, c := range cases {
+		cursor := scanCursor(c.server_cursor, c.server)
+		if server_cursor, server := splitScanCursor(cursor); server_cursor != c.server_cursor || server != c.server {
+			t.Errorf("splitScanCursor(scanCursor(%d, %d)) = %d, %d", c.server_cursor, c.server, server_cursor, server)
+		}
+	}
+	if scanCursor(0, 0) != 0 {
+		t.Error("the first server's first cursor isn't 0, so SCAN wouldn't start there")
+	}
+}
+
+func TestScanRefusesCursorOfNoShard(t *testing.T) {
+	s := &shardedStorage{servers: []storageServer{{name: homeShard}, {name: "a"}}}
+	if err := s.Scan(context.Background(), scanCursor(5, 2), "*", 10).Err(); err == nil {
+		t.Error("SCAN with a cursor of a third server of two succeeded")
+	}
+}
+
+func TestCrossShardGuard(t *testing.T) {
+	p := placement{shards: []string{"a", "b", "c"}}
+	slug := "abc"
+	other := "0"
+	for i := 0; p.shardOf(other) == p.shardOf(slug); i++ {
+		other = strconv.Itoa(i)
+	}
+	ctx := context.Background()
+	cases := []struct {
+		name    string
+		cmd     redis.Cmder
+		refused bool
+	}{
+		{"one key", redis.NewIntCmd(ctx, "del", "url:"+slug), false},
+		{"keys of one link", redis.NewIntCmd(ctx, "del", "url:"+slug, "urlmeta:"+slug, "alias:"+slug), false},
+		{"keys of two links", redis.NewIntCmd(ctx, "del", "url:"+slug, "url:"+other), true},
+		{"a link and an index", redis.NewIntCmd(ctx, "exists", "url:"+slug, "idx:expires"), true},
+		{"home keys", redis.NewIntCmd(ctx, "sunionstore", "tmp", "tag:a", "tag:b"), false},
+		{"script on one link", redis.NewCmd(ctx, "evalsha", "sha", 2, "url:"+slug, "urlmeta:"+slug, "target"), false},
+		{"script over two", redis.NewCmd(ctx, "evalsha", "sha", 2, "url:"+slug, "url:"+other, "url:"+other), true},
+		{"script arguments aren't keys", redis.NewCmd(ctx, "eval", "return 1", 1, "url:"+slug, "url:"+other), false},
+		{"mset", redis.NewStatusCmd(ctx, "mset", "url:"+slug, "x", "url:"+other, "y"), true},
+		{"smove", redis.NewBoolCmd(ctx, "smove", "urlaliases:"+slug, "urlaliases:"+slug, "url:"+other), false},
+		{"no keys", redis.NewStatusCmd(ctx, "ping"), false},
+	}
+	guard := crossShardGuard{p}
+	for _, c := range cases {
+		err := guard.check(c.cmd)
+		if refused := errors.Is(err, errCrossShard); refused != c.refused {
+			t.Errorf("%s: check = %v, want refused %v", c.name, err, c.refused)
+		}
+	}
+	if _, err := guard.BeforeProcessPipeline(ctx, []redis.Cmder{cases[0].cmd, cases[2].cmd}); !errors.Is(err, errCrossShard) {
+		t.Errorf("a pipeline with a command over two shards went ahead: %v", err)
+	}
+}
+
+func TestReshardFindsMisplacedKeys(t *testing.T) {
+	s := &shardedStorage{placement: placement{shards: []string{"a", "b"}}}
+	at := map[string]string{}
+	for i := 0; len(at) < 2; i++ {
+		slug := strconv.Itoa(i)
+		if _, ok := at[s.placement.shardOf(slug)]; !ok {
+			at[s.placement.shardOf(slug)] = slug
+		}
+	}
+	on_a, on_b := at["a"], at["b"]
+	cases := []struct {
+		server string
+		keys   []string
+		moves  map[string]int
+	}{
+		{"a", []string{"url:" + on_a, "urlmeta:" + on_a}, map[string]int{}},
+		{"a", []string{"url:" + on_b, "urlmeta:" + on_b, "url:" + on_a}, map[string]int{"a -> b": 2}},
+		{homeShard, []string{"idx:expires", "url:" + on_a, "alias:" + on_b}, map[string]int{"home -> a": 1, "home -> b": 1}},
+		{"c", []string{"url:" + on_a, "url:" + on_b, "apikey:x"}, map[string]int{"c -> a": 1, "c -> b": 1}},
+	}
+	for _, c := range cases {
+		report := ReshardReport{DryRun: true, Moves: map[string]int{}}
+		if err := reshardKeys(s, context.Background(), storageServer{name: c.server}, c.keys, false, false, &report); err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Moves) != len(c.moves) {
+			t.Errorf("keys %v on %s: moves %v, want %v", c.keys, c.server, report.Moves, c.moves)
+			continue
+		}
+		for move, n := range c.moves {
+			if report.Moves[move] != n {
+				t.Errorf("keys %v on %s: moves %v, want %v", c.keys, c.server, report.Moves, c.moves)
+			}
+		}
+		if report.Copied != 0 || report.Deleted != 0 {
+			t.Errorf("a dry run copied %d and deleted %d", report.Copied, report.Deleted)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// With cache.shared.servers, resolved slugs are also kept in memcached, so
+// a replica which hasn't resolved a slug itself finds it there instead of
+// asking Redis: the fleet shares one warm cache, and a cold or restarted
+// replica doesn't add to the redirects' tail latency. Only redirects use it,
+// and only links which exist are kept, for cache.shared.ttl at most; changing
+// a link drops its entry, like it purges the CDN (an alias's entry lasts its
+// ttl). Keys are spread over the servers by hash. A server which fails or is
+// slow is a miss, never an error.
+//
+// memcached is spoken to in its binary protocol. Entries from here are
+// checked against Redis before cache.tracking relies on them.
+
+type SharedCacheConfig struct {
+	Servers      []string `json:"servers"` // memcached host:port, none turns it off
+	TTL          Duration `json:"ttl"`
+	Prefix       string   `json:"prefix"`
+	Timeout      Duration `json:"timeout"`        // per operation, dial included
+	MaxIdleConns int      `json:"max_idle_conns"` // per server
+}
+
+func validateSharedCache(c SharedCacheConfig) error {
+	if len(c.Servers) == 0 {
+		return nil
+	}
+	if c.TTL.Duration < time.Second {
+		return errors.New("cache.shared.ttl must be at least 1s")
+	}
+	if c.TTL.Duration > 30*24*time.Hour {
+		return errors.New("cache.shared.ttl must be at most 30 days") // memcached's limit for relative expiry
+	}
+	for _, server := range c.Servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			return fmt.Errorf("cache.shared.servers: %v", err)
+		}
+	}
+	return nil
+}
+
+var shared_cache_requests = newCounter("shortener_shared_cache_requests_total", "Lookups in the shared cache, by result: hit, miss or error")
+
+// Set in main when configured
+var shared_cache *sharedCache
+
+type sharedCache struct {
+	c       SharedCacheConfig
+	servers []*memcachedServer
+}
+
+func newSharedCache(c SharedCacheConfig) *sharedCache {
+	if len(c.Servers) == 0 {
+		return nil
+	}
+	s := &sharedCache{c: c}
+	for _, addr := range c.Servers {
+		s.servers = append(s.servers, &memcachedServer{addr: addr, timeout: c.Timeout.Duration, idle: make(chan net.Conn, c.MaxIdleConns)})
+	}
+	return s
+}
+
+// sharedEntry is what's kept of a resolved slug
+type sharedEntry struct {
+	Slug   string     `json:"slug"`
+	Target string     `json:"target"`
+	Access LinkAccess `json:"access"`
+}
+
+func (s *sharedCache) keyOf(requested string) string {
+	return s.c.Prefix + requested
+}
+
+func (s *sharedCache) serverOf(key string) *memcachedServer {
+	return s.servers[crc32.ChecksumIEEE([]byte(key))%uint32(len(s.servers))]
+}
+
+// resolveLink is resolveLink, looking in the shared cache first, and filling it on a miss
+func (s *sharedCache) resolveLink(redis_db Storage, ctx context.Context, requested string) (resolvedSlug, error) {
+	if s == nil {
+		return resolveLink(redis_db, ctx, requested)
+	}
+	key := s.keyOf(requested)
+	if len(key) > memcachedMaxKey {
+		return resolveLink(redis_db, ctx, requested)
+	}
+
+	value, err := s.serverOf(key).get(key)
+	var e sharedEntry
+	switch {
+	case err == errMemcachedMiss:
+		shared_cache_requests.Inc("result", "miss")
+	case err != nil:
+		shared_cache_requests.Inc("result", "error") // not logged, as it would be for every redirect
+	case json.Unmarshal(value, &e) != nil:
+		shared_cache_requests.Inc("result", "error")
+	default:
+		shared_cache_requests.Inc("result", "hit")
+		return resolvedSlug{slug: e.Slug, target: e.Target, access: e.Access, shared: true}, nil
+	}
+
+	link, err := resolveLink(redis_db, ctx, requested)
+	if err == nil {
+		data, _ := json.Marshal(sharedEntry{Slug: link.slug, Target: link.target, Access: link.access})
+		go s.serverOf(key).set(key, data, s.c.TTL.Duration)
+	}
+	return link, err
+}
+
+// forget drops the slugs' entries
+func (s *sharedCache) forget(slugs ...string) {
+	if s == nil {
+		return
+	}
+	for _, slug := range slugs {
+		key := s.keyOf(slug)
+		if len(key) > memcachedMaxKey {
+			continue
+		}
+		if err := s.serverOf(key).delete(key); err != nil && err != errMemcachedMiss {
+			// it will be stale until its ttl
+			log.Println("Cannot drop", slug, "from the shared cache", err)
+		}
+	}
+}
+
+// A minimal memcached client, for the binary protocol's get, set and delete
+
+const memcachedMaxKey = 250
+
+const (
+	memcachedGet    = 0x00
+	memcachedSet    = 0x01
+	memcachedDelete = 0x04
+)
+
+var errMemcachedMiss = errors.New("memcached: not found")
+
+type memcachedServer struct {
+	addr    string
+	timeout time.Duration
+	idle    chan net.Conn
+}
+
+func (m *memcachedServer) conn() (net.Conn, error) {
+	select {
+	case conn := <-m.idle:
+		return conn, nil
+	default:
+		return net.DialTimeout("tcp", m.addr, m.timeout)
+	}
+}
+
+func (m *memcachedServer) release(conn net.Conn) {
+	select {
+	case m.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// roundTrip sends one request and reads its answer. A connection which
+// failed in any way is closed rather than reused.
+func (m *memcachedServer) roundTrip(opcode byte, key string, extras []byte, value []byte) ([]byte, error) {
+	conn, err := m.conn()
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(m.timeout))
+
+	var req bytes.Buffer
+	header := make([]byte, 24)
+	header[0] = 0x80 // request
+	header[1] = opcode
+	binary.BigEndian.PutUint16(header[2:], uint16(len(key)))
+	header[4] = byte(len(extras))
+	binary.BigEndian.PutUint32(header[8:], uint32(len(extras)+len(key)+len(value)))
+	req.Write(header)
+	req.Write(extras)
+	req.WriteString(key)
+	req.Write(value)
+	if _, err := conn.Write(req.Bytes()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if _, err := io.ReadFull(conn, header); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if header[0] != 0x81 || header[1] != opcode {
+		conn.Close()
+		return nil, fmt.Errorf("memcached: unexpected answer %x to %x", header[:2], opcode)
+	}
+	body := make([]byte, binary.BigEndian.Uint32(header[8:]))
+	if _, err := io.ReadFull(conn, body); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	m.release(conn)
+
+	switch status := binary.BigEndian.Uint16(header[6:]); status {
+	case 0:
+	case 1:
+		return nil, errMemcachedMiss
+	default:
+		return nil, fmt.Errorf("memcached: status %d %s", status, body)
+	}
+	extras_length, key_length := int(header[4]), int(binary.BigEndian.Uint16(header[2:]))
+	if extras_length+key_length > len(body) {
+		return nil, errors.New("memcached: short answer")
+	}
+	return body[extras_length+key_length:], nil
+}
+
+func (m *memcachedServer) get(key string) ([]byte, error) {
+	return m.roundTrip(memcachedGet, key, nil, nil)
+}
+
+func (m *memcachedServer) set(key string, value []byte, ttl time.Duration) error {
+	extras := make([]byte, 8) // flags, then expiry
+	binary.BigEndian.PutUint32(extras[4:], uint32(ttl.Seconds()))
+	_, err := m.roundTrip(memcachedSet, key, extras, value)
+	return err
+}
+
+func (m *memcachedServer) delete(key string) error {
+	_, err := m.roundTrip(memcachedDelete, key, nil, nil)
+	return err
+}
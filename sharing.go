@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With details.require_auth, a link's details are only shown to its tenant's
+// API keys, or to anyone holding a share token: a signed, expiring, read-only
+// grant for one slug which the owner can hand to stakeholders.
+
+type DetailsConfig struct {
+	RequireAuth      bool     `json:"require_auth"`
+	MaxShareTokenTTL Duration `json:"max_share_token_ttl"`
+}
+
+const shareTokenPurpose = "share"
+
+func shareToken(slug string, expires time.Time) string {
+	return signToken(shareTokenPurpose, slug+"|"+strconv.FormatInt(expires.Unix(), 10))
+}
+
+func shareTokenAllows(token string, slug string) bool {
+	payload, err := verifyToken(shareTokenPurpose, token)
+	if err != nil {
+		return false
+	}
+	parts := strings.SplitN(payload, "|", 2)
+	if len(parts) != 2 || parts[0] != slug {
+		return false
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	return err == nil && time.Now().Unix() < expires
+}
+
+// ownsLink is true for an API key or session of the tenant which created the link
+func ownsLink(req *http.Request, su ShortUrl) bool {
+	identity, ok := identify(req)
+	return ok && identity.KeyId != "" && identity.Tenant == su.Tenant
+}
+
+// canManageLink lets owning editors and admins change a link
+func canManageLink(req *http.Request, su ShortUrl) bool {
+	identity, ok := identify(req)
+	return ok && (identity.can(roleAdmin) || (identity.can(roleEditor) && ownsLink(req, su)))
+}
+
+func canViewDetails(req *http.Request, su ShortUrl) bool {
+	if !config.Details.RequireAuth {
+		return true
+	}
+	if token := req.URL.Query().Get("token"); token != "" && shareTokenAllows(token, su.Slug) {
+		return true
+	}
+	return ownsLink(req, su)
+}
+
+func shareURL(slug string, token string) string {
+	return "/" + slug + "?details&token=" + url.QueryEscape(token)
+}
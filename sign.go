@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+)
+
+// HMAC-signed tokens, keyed by config.SigningSecret. Each kind of token signs
+// with its own purpose string so one can't stand in for another.
+
+var generated_secret []byte
+var generated_secret_once sync.Once
+
+func signingKey() []byte {
+	if config.SigningSecret != "" {
+		return []byte(config.SigningSecret)
+	}
+	generated_secret_once.Do(func() {
+		log.Println("No signing_secret configured, using a random one; signed tokens won't survive a restart")
+		generated_secret = make([]byte, 32)
+		rand.Read(generated_secret)
+	})
+	return generated_secret
+}
+
+func signature(purpose string, payload string) []byte {
+	h := hmac.New(sha256.New, signingKey())
+	h.Write([]byte(purpose + "\x00" + payload))
+	return h.Sum(nil)
+}
+
+func signToken(purpose string, payload string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(signature(purpose, payload))
+}
+
+// verifyToken returns the payload of a token signed for purpose
+func verifyToken(purpose string, token string) (string, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return "", errors.New("Malformed token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", errors.New("Malformed token")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(sig, signature(purpose, string(payload))) {
+		return "", errors.New("Bad token signature")
+	}
+	return string(payload), nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// A service which can't keep a long-lived API key safe can sign each request
+// instead, with a secret it shares with the shortener. The signature is an
+// HMAC-SHA256 over the method, the path and query, a timestamp, an optional
+// nonce and a digest of the body, so a request can't be altered, and a
+// captured one is only good for max_skew. Within that, each signature is
+// accepted once: it's remembered in Redis, as signed:<client>:<signature>,
+// until its timestamp is too old anyway.
+//
+// A signed request is who signed it, with its client's tenant and role,
+// wherever an API key would be; one signed badly is answered 401.
+
+type SignedRequestsConfig struct {
+	MaxSkew Duration             `json:"max_skew"` // between the timestamp and our clock, either way
+	Clients []SignedClientConfig `json:"clients"`
+}
+
+type SignedClientConfig struct {
+	ID     string `json:"id"`
+	Secret string `json:"secret"`
+	Tenant string `json:"tenant"`
+	Role   string `json:"role"` // viewer, editor (the default) or admin
+}
+
+const (
+	signatureHeader          = "X-Signature"
+	signatureClientHeader    = "X-Signature-Client"
+	signatureTimestampHeader = "X-Signature-Timestamp"
+	signatureNonceHeader     = "X-Signature-Nonce"
+)
+
+// Shorter secrets are refused
+const minSigningSecret = 32
+
+func validateSignedRequests(c SignedRequestsConfig) error {
+	if c.MaxSkew.Duration <= 0 {
+		return errors.New("signed_requests.max_skew must be positive")
+	}
+	seen := map[string]bool{}
+	for _, client := range c.Clients {
+		if client.ID == "" || seen[client.ID] {
+			return fmt.Errorf("Signed client ids must be given, and unique: %q", client.ID)
+		}
+		seen[client.ID] = true
+		if len(client.Secret) < minSigningSecret {
+			return fmt.Errorf("The secret of signed client %q must be at least %d bytes", client.ID, minSigningSecret)
+		}
+	}
+	return nil
+}
+
+func keyOfSignature(client string, signature string) string {
+	return "signed:" + client + ":" + signature
+}
+
+var signed_requests = newCounter("shortener_signed_requests_total", "Signed requests, by result: ok, unknown_client, stale, bad_signature or replayed")
+
+type signedIdentityKey struct{}
+
+// signedIdentityOf is who signed the request, once withSignedRequests has checked it
+func signedIdentityOf(req *http.Request) (Identity, bool) {
+	identity, ok := req.Context().Value(signedIdentityKey{}).(Identity)
+	return identity, ok
+}
+
+// requestSignature is what a client signs a request with
+func requestSignature(secret string, method string, uri string, timestamp string, nonce string, body []byte) string {
+	digest := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + uri + "\n" + timestamp + "\n" + nonce + "\n" + hex.EncodeToString(digest[:])))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+var (
+	errUnknownSignedClient = errors.New("Unknown signed client")
+	errStaleSignature      = errors.New("Signature timestamp missing, or too far from now")
+	errBadSignature        = errors.New("Bad signature")
+	errReplayedSignature   = errors.New("Signature already used")
+	errUnreadableBody      = errors.New("Cannot read the signed body, at most 1MiB")
+)
+
+// verifySignedRequest checks a request's signature, reading its body and
+// putting it back for the handler
+func verifySignedRequest(redis_db Storage, w http.ResponseWriter, req *http.Request, now time.Time) (Identity, error) {
+	id := req.Header.Get(signatureClientHeader)
+	var client *SignedClientConfig
+	for i, c := range config.SignedRequests.Clients {
+		if c.ID == id {
+			client = &config.SignedRequests.Clients[i]
+			break
+		}
+	}
+	if client == nil {
+		return Identity{}, errUnknownSignedClient
+	}
+	timestamp := req.Header.Get(signatureTimestampHeader)
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	skew := now.Sub(time.Unix(unix, 0))
+	if err != nil || skew > config.SignedRequests.MaxSkew.Duration || -skew > config.SignedRequests.MaxSkew.Duration {
+		return Identity{}, errStaleSignature
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, 1<<20))
+	if err != nil {
+		return Identity{}, errUnreadableBody
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	signature := req.Header.Get(signatureHeader)
+	expected := requestSignature(client.Secret, req.Method, req.URL.RequestURI(), timestamp, req.Header.Get(signatureNonceHeader), body)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return Identity{}, errBadSignature
+	}
+
+	// good until the timestamp is stale both ways
+	first, err := redis_db.SetNX(req.Context(), keyOfSignature(client.ID, signature), now.Unix(), 2*config.SignedRequests.MaxSkew.Duration).Result()
+	if err != nil {
+		return Identity{}, err
+	}
+	if !first {
+		return Identity{}, errReplayedSignature
+	}
+	role := client.Role
+	if role == "" {
+		role = roleEditor
+	}
+	return Identity{Tenant: client.Tenant, KeyId: "signed:" + client.ID, Role: role}, nil
+}
+
+// withSignedRequests checks requests which carry a signature, and leaves the rest be
+func withSignedRequests(redis_db Storage) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Header.Get(signatureHeader) == "" {
+				next.ServeHTTP(w, req)
+				return
+			}
+			identity, err := verifySignedRequest(redis_db, w, req, time.Now())
+			switch err {
+			case nil:
+				signed_requests.Inc("result", "ok")
+				next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), signedIdentityKey{}, identity)))
+				return
+			case errUnknownSignedClient:
+				signed_requests.Inc("result", "unknown_client")
+			case errStaleSignature:
+				signed_requests.Inc("result", "stale")
+			case errBadSignature:
+				signed_requests.Inc("result", "bad_signature")
+			case errReplayedSignature:
+				signed_requests.Inc("result", "replayed")
+			case errUnreadableBody:
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			default:
+				writeJSONError(w, http.StatusServiceUnavailable, "Cannot check the signature: "+err.Error())
+				return
+			}
+			writeJSONError(w, http.StatusUnauthorized, err.Error())
+		})
+	}
+}
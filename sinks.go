@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Every click is recorded as a ClickEvent in each configured sink: the
+// export driver (Kafka, NATS), a Redis stream, ClickHouse, counts by country
+// (geo.go), or JSON lines on stdout.
+// Adding a sink means implementing ClickSink and naming it here.
+
+type ClickSink interface {
+	// Record must not hold up the redirect; sinks queue or drop instead
+	Record(ev ClickEvent)
+}
+
+func newClickSink(c ClicksConfig, redis_db Storage) (ClickSink, error) {
+	sinks := multiSink{}
+	for _, name := range c.Sinks {
+		switch name {
+		case "none":
+		case "export":
+			e, err := newClickExporter(config.Export)
+			if err != nil {
+				return nil, err
+			}
+			if e != nil {
+				sinks = append(sinks, e)
+			}
+		case "redis_stream":
+			publisher := &redisStreamPublisher{redis_db: redis_db, key: c.StreamKey, max_len: c.StreamMaxLen}
+			e, err := startExporter(publisher, config.Export)
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, e)
+		case "clickhouse":
+			publisher, err := newClickHousePublisher(config.ClickHouse)
+			if err != nil {
+				return nil, err
+			}
+			e, err := startExporter(publisher, config.Export)
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, e)
+		case "geo":
+			e, err := startExporter(&geoPublisher{redis_db: redis_db}, config.Export)
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, e)
+		case "stdout":
+			sinks = append(sinks, &stdoutSink{encoder: json.NewEncoder(os.Stdout)})
+		default:
+			return nil, fmt.Errorf("Unknown click sink %q", name)
+		}
+	}
+	if len(sinks) == 1 {
+		return sinks[0], nil
+	}
+	return sinks, nil
+}
+
+// multiSink records to each of its sinks; an empty one is the no-op sink
+type multiSink []ClickSink
+
+func (m multiSink) Record(ev ClickEvent) {
+	for _, s := range m {
+		s.Record(ev)
+	}
+}
+
+type stdoutSink struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+func (s *stdoutSink) Record(ev ClickEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.encoder.Encode(ev)
+}
+
+// redisStreamPublisher XADDs each event as one "event" field holding its JSON.
+// It goes through the export queue like the other publishers.
+type redisStreamPublisher struct {
+	redis_db Storage
+	key      string
+	max_len  int64
+}
+
+func (r *redisStreamPublisher) publish(batch [][]byte) error {
+	ctx := context.Background()
+	_, err := r.redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, b := range batch {
+			pipe.XAdd(ctx, &redis.XAddArgs{
+				Stream:       r.key,
+				MaxLenApprox: r.max_len,
+				Values:       map[string]interface{}{"event": string(b)},
+			})
+		}
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Custom slugs (aliases) which look like a reserved brand term, or like the
+// slug or alias of a popular link, are refused (or only warned about), to stop
+// paypa1login-style squatting on a public instance. Slugs are compared by
+// skeleton: lowercased, with lookalike digits and letter pairs folded
+// together. Admins are exempt.
+
+type SquattingConfig struct {
+	ReservedTerms []string `json:"reserved_terms"`
+	PopularLinks  int      `json:"popular_links"` // most clicked links whose slugs and aliases are protected
+	Action        string   `json:"action"`        // reject or warn
+}
+
+var skeletonReplacer = strings.NewReplacer(
+	"rn", "m", "vv", "w", "cl", "d",
+	"0", "o", "1", "l", "i", "l", "3", "e", "4", "a", "5", "s", "7", "t", "8", "b", "6", "b", "9", "g", "2", "z",
+)
+
+func slugSkeleton(s string) string {
+	return skeletonReplacer.Replace(strings.ToLower(s))
+}
+
+// popularSlugs returns the slugs and aliases of the most clicked links
+func popularSlugs(redis_db Storage, ctx context.Context, n int) ([]string, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	slugs, err := redis_db.ZRevRange(ctx, keyOfClicksIndex, 0, int64(n)-1).Result()
+	if err != nil || len(slugs) == 0 {
+		return slugs, err
+	}
+	aliases := make([]*redis.StringSliceCmd, len(slugs))
+	_, err = redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, slug := range slugs {
+			aliases[i] = pipe.SMembers(ctx, keyOfSlugAliases(slug))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range aliases {
+		slugs = append(slugs, a.Val()...)
+	}
+	return slugs, nil
+}
+
+// squattingOf describes what the custom slug looks like, or returns "" when it's fine
+func squattingOf(redis_db Storage, ctx context.Context, custom string) (string, error) {
+	skeleton := slugSkeleton(custom)
+	for _, term := range config.Squatting.ReservedTerms {
+		if t := slugSkeleton(term); t != "" && strings.Contains(skeleton, t) {
+			return fmt.Sprintf("%s looks like the reserved term %s", custom, term), nil
+		}
+	}
+	popular, err := popularSlugs(redis_db, ctx, config.Squatting.PopularLinks)
+	if err != nil {
+		return "", err
+	}
+	for _, slug := range popular {
+		if slug != custom && slugSkeleton(slug) == skeleton {
+			return fmt.Sprintf("%s looks like the popular link %s", custom, slug), nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Service-wide numbers for the index page and /api/v1/stats. Daily counters
+// live in stats:<what>:<YYYYMMDD> and fall away after a couple of days.
+
+type StorageHealth struct {
+	Driver    string  `json:"driver"`
+	Healthy   bool    `json:"healthy"`
+	LatencyMs float64 `json:"latency_ms"`
+	Version   string  `json:"version,omitempty"`
+	Error     string  `json:"error,omitempty"`
+
+	Memory *RedisMemory  `json:"memory,omitempty"` // at the last reading, see memory.go
+	Shards []ShardHealth `json:"shards,omitempty"` // at the last ping, see shards.go
+}
+
+type Stats struct {
+	ActiveLinks  int64         `json:"active_links"`
+	CreatedToday int64         `json:"created_today"`
+	ClicksToday  int64         `json:"clicks_today"`
+	ExpiringSoon int64         `json:"expiring_within_24h"`
+	Storage      StorageHealth `json:"storage"`
+}
+
+func keyOfDailyStat(what string, day time.Time) string {
+	return "stats:" + what + ":" + day.UTC().Format("20060102")
+}
+
+func countDaily(pipe redis.Pipeliner, ctx context.Context, what string, at time.Time) {
+	pipe.Incr(ctx, keyOfDailyStat(what, at))
+	pipe.Expire(ctx, keyOfDailyStat(what, at), 48*time.Hour)
+}
+
+func storageHealth(redis_db Storage, ctx context.Context) StorageHealth {
+	h := StorageHealth{Driver: "redis"}
+	start := time.Now()
+	if err := redis_db.Ping(ctx).Err(); err != nil {
+		h.Error = err.Error()
+		return h
+	}
+	h.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+	h.Healthy = true
+	if m := redis_memory.get(); !m.At.IsZero() {
+		h.Memory = &m
+	}
+	h.Shards = shard_health.get()
+
+	if info, err := redis_db.Info(ctx, "server").Result(); err == nil {
+		for _, line := range strings.Split(info, "\n") {
+			if strings.HasPrefix(line, "redis_version:") {
+				h.Version = strings.TrimSpace(strings.TrimPrefix(line, "redis_version:"))
+			}
+		}
+	}
+	return h
+}
+
+func gatherStats(redis_db Storage, ctx context.Context) Stats {
+	s := Stats{Storage: storageHealth(redis_db, ctx)}
+	if !s.Storage.Healthy {
+		return s
+	}
+
+	now := time.Now()
+	now_score := strconv.FormatInt(now.Unix(), 10)
+	var active, expiring *redis.IntCmd
+	var created, clicks *redis.StringCmd
+	redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		// entries behind the clock are links which already expired, left to prune-expires-index
+		active = pipe.ZCount(ctx, keyOfExpiresIndex, now_score, "+inf")
+		expiring = pipe.ZCount(ctx, keyOfExpiresIndex, now_score, strconv.FormatInt(now.Add(24*time.Hour).Unix(), 10))
+		created = pipe.Get(ctx, keyOfDailyStat("created", now))
+		clicks = pipe.Get(ctx, keyOfDailyStat("clicks", now))
+		return nil
+	})
+
+	s.ActiveLinks = active.Val()
+	s.ExpiringSoon = expiring.Val()
+	s.CreatedToday, _ = created.Int64()
+	s.ClicksToday, _ = clicks.Int64()
+	return s
+}
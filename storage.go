@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Looking up a slug either finds it, finds it doesn't exist (errSlugNotFound,
+// a 404), or fails to get an answer from storage (a *StorageError, a 503 with
+// Retry-After). Redirects count each outcome in shortener_lookups_total, and
+// log storage errors.
+
+var errSlugNotFound = errors.New("Slug not found")
+
+// StorageError is storage failing to answer, as opposed to answering that a slug doesn't exist
+type StorageError struct {
+	Op  string
+	Err error
+}
+
+func (e *StorageError) Error() string {
+	return e.Op + ": " + e.Err.Error()
+}
+
+func (e *StorageError) Unwrap() error {
+	return e.Err
+}
+
+// lookupError types an error from reading a slug
+func lookupError(op string, err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case err == redis.Nil || err == errSlugNotFound:
+		return errSlugNotFound
+	}
+	var storage_err *StorageError
+	if errors.As(err, &storage_err) {
+		return err
+	}
+	return &StorageError{Op: op, Err: err}
+}
+
+var lookups = newCounter("shortener_lookups_total", "Slug lookups for redirects and details, by result: found, not_found or storage_error")
+
+func countLookup(err error) {
+	switch {
+	case err == nil:
+		lookups.Inc("result", "found")
+	case err == errSlugNotFound:
+		lookups.Inc("result", "not_found")
+	default:
+		lookups.Inc("result", "storage_error")
+	}
+}
+
+// Storage is where everything is kept: one Redis, or with shards configured,
+// a home Redis and links spread over several more by slug (see shards.go).
+// Handlers use it the same way either way.
+type Storage interface {
+	redis.UniversalClient
+}
+
+func newStorage(c Config) (Storage, error) {
+	if len(c.Shards.Endpoints) == 0 {
+		return newRedisClient(c.Redis)
+	}
+	return newShardedStorage(c.Redis, c.Shards)
+}
+
+// storageServer is one Redis behind Storage, with its settings
+type storageServer struct {
+	name   string
+	client *redis.Client
+	config RedisConfig
+}
+
+// storageServers are the home Redis, then each shard, draining ones included
+func storageServers(redis_db Storage) []storageServer {
+	if s, ok := redis_db.(*shardedStorage); ok {
+		return s.servers
+	}
+	if client, ok := redis_db.(*redis.Client); ok {
+		return []storageServer{{name: homeShard, client: client, config: config.Redis}}
+	}
+	return nil
+}
+
+// verifyStorage is verifyRedis of every server, returning the first error
+func verifyStorage(ctx context.Context, redis_db Storage) error {
+	for _, server := range storageServers(redis_db) {
+		if err := verifyRedis(ctx, server.client, server.config); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// A sync file declares links by slug, so canonical links can live in git and
+// be applied like any other infrastructure. Syncing creates what's missing,
+// updates what drifted and, with prune, trashes the links the file no longer
+// lists. Links are marked with the file's managed_by name, and only links
+// carrying that mark are ever changed or pruned: a slug held by any other link
+// is reported as a conflict and left alone.
+//
+// synclinks:<name> holds the slugs a file has created, for pruning.
+
+type SyncFile struct {
+	ManagedBy string              `json:"managed_by"` // "sync" when empty
+	Tenant    string              `json:"tenant"`
+	Prune     bool                `json:"prune"`
+	Links     map[string]SyncLink `json:"links"`
+}
+
+type SyncLink struct {
+	Target string   `json:"target"`
+	Ttl    Duration `json:"ttl"` // default_ttl when empty
+	Tags   []string `json:"tags,omitempty"`
+}
+
+type SyncChange struct {
+	Slug    string   `json:"slug"`
+	Action  string   `json:"action"` // create, update, prune or conflict
+	Changes []string `json:"changes,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+type SyncReport struct {
+	DryRun    bool         `json:"dry_run"`
+	ManagedBy string       `json:"managed_by"`
+	Unchanged int          `json:"unchanged"`
+	Changes   []SyncChange `json:"changes"`
+}
+
+const defaultManagedBy = "sync"
+
+var managedByPattern = regexp.MustCompile(`^[0-9A-Za-z_.-]{1,64}$`)
+var tagPattern = regexp.MustCompile(`^[0-9A-Za-z_.:-]{1,32}$`)
+
+func keyOfSyncLinks(managed_by string) string {
+	return "synclinks:" + managed_by
+}
+
+func tagsOfMeta(meta map[string]string) []string {
+	if meta["tags"] == "" {
+		return nil
+	}
+	return strings.Split(meta["tags"], ",")
+}
+
+// ttlOfMeta is the TTL a link was created or synced with
+func ttlOfMeta(meta map[string]string) time.Duration {
+	seconds, err := strconv.ParseInt(meta["ttl"], 10, 64)
+	if err != nil || seconds <= 0 {
+		return default_ttl
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// readSyncFile parses and checks a whole file before anything is applied
+func readSyncFile(r io.Reader) (SyncFile, error) {
+	var f SyncFile
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&f); err != nil {
+		return f, fmt.Errorf("Cannot read sync file: %v", err)
+	}
+	if f.ManagedBy == "" {
+		f.ManagedBy = defaultManagedBy
+	}
+	if !managedByPattern.MatchString(f.ManagedBy) {
+		return f, errors.New("managed_by must be letters, digits, '_', '.' or '-'")
+	}
+	if strings.HasPrefix(f.ManagedBy, kubernetesManagedPrefix) {
+		return f, errors.New("managed_by names starting with " + kubernetesManagedPrefix + " are kept for ConfigMaps")
+	}
+	for slug, link := range f.Links {
+		if !slugIsValid(slug) && !aliasPattern.MatchString(slug) {
+			return f, fmt.Errorf("Link %q: slug must be 3 to 64 letters or digits", slug)
+		}
+		if isRouteName(slug) {
+			return f, fmt.Errorf("Link %q: %v", slug, errRouteName)
+		}
+		link.Target = asciiTarget(link.Target)
+		if _, err := validateTarget(link.Target); err != nil {
+			return f, fmt.Errorf("Link %q: %v", slug, err)
+		}
+		if link.Ttl.Duration < 0 {
+			return f, fmt.Errorf("Link %q: ttl must be positive", slug)
+		} else if link.Ttl.Duration == 0 {
+			link.Ttl.Duration = default_ttl
+		}
+		for _, tag := range link.Tags {
+			if !tagPattern.MatchString(tag) {
+				return f, fmt.Errorf("Link %q: bad tag %q", slug, tag)
+			}
+		}
+		sort.Strings(link.Tags)
+		f.Links[slug] = link
+	}
+	return f, nil
+}
+
+// syncLinks reconciles the links to the file. A dry run only reports what it would do.
+func syncLinks(redis_db Storage, ctx context.Context, f SyncFile, dry_run bool) (SyncReport, error) {
+	report := SyncReport{DryRun: dry_run, ManagedBy: f.ManagedBy, Changes: []SyncChange{}}
+	slugs := make([]string, 0, len(f.Links))
+	for slug := range f.Links {
+		slugs = append(slugs, slug)
+	}
+	sort.Strings(slugs)
+
+	for _, slug := range slugs {
+		change, err := syncLink(redis_db, ctx, f, slug, dry_run)
+		if err != nil {
+			return report, err
+		}
+		if change.Action == "" {
+			report.Unchanged++
+		} else {
+			report.Changes = append(report.Changes, change)
+		}
+	}
+
+	if !f.Prune {
+		return report, nil
+	}
+	managed, err := redis_db.SMembers(ctx, keyOfSyncLinks(f.ManagedBy)).Result()
+	if err != nil {
+		return report, lookupError("sync", err)
+	}
+	sort.Strings(managed)
+	for _, slug := range managed {
+		if _, listed := f.Links[slug]; listed {
+			continue
+		}
+		owner, err := redis_db.HGet(ctx, keyOfSlugMeta(slug), "managed_by").Result()
+		if err != nil && err != redis.Nil {
+			return report, lookupError("sync", err)
+		}
+		if owner != f.ManagedBy {
+			// Gone already, or trashed and restored by hand: no longer ours
+			if !dry_run {
+				redis_db.SRem(ctx, keyOfSyncLinks(f.ManagedBy), slug)
+			}
+			continue
+		}
+		report.Changes = append(report.Changes, SyncChange{Slug: slug, Action: "prune"})
+		if dry_run {
+			continue
+		}
+		if _, err := trashLink(redis_db, ctx, slug, f.ManagedBy); err != nil {
+			return report, lookupError("sync", err)
+		}
+		redis_db.SRem(ctx, keyOfSyncLinks(f.ManagedBy), slug)
+	}
+	return report, nil
+}
+
+// syncLink brings one slug in line, returning no action when it already was
+func syncLink(redis_db Storage, ctx context.Context, f SyncFile, slug string, dry_run bool) (SyncChange, error) {
+	want := f.Links[slug]
+	change := SyncChange{Slug: slug}
+
+	var target *redis.StringCmd
+	var meta *redis.StringStringMapCmd
+	var alias *redis.IntCmd
+	_, err := redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		target = pipe.Get(ctx, keyOfSlug(slug))
+		meta = pipe.HGetAll(ctx, keyOfSlugMeta(slug))
+		alias = pipe.Exists(ctx, keyOfAlias(slug))
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return change, lookupError("sync", err)
+	}
+
+	if alias.Val() > 0 {
+		change.Action, change.Error = "conflict", "slug is an alias of another link"
+		return change, nil
+	}
+
+	if target.Err() == redis.Nil {
+		change.Action = "create"
+		change.Changes = []string{"target " + want.Target}
+		if dry_run {
+			return change, nil
+		}
+		if redis_memory.full() {
+			memory_refusals.Inc()
+			change.Error = "not created, Redis memory is over the cap"
+			return change, nil
+		}
+		opts := LinkOptions{Tenant: f.Tenant, Ttl: want.Ttl.Duration, Tags: want.Tags, ManagedBy: f.ManagedBy}
+		written, err := createLink(redis_db, ctx, slug, want.Target, opts, time.Now())
+		if err != nil {
+			return change, lookupError("sync", err)
+		}
+		if !written {
+			change.Action, change.Error = "conflict", "slug was taken meanwhile"
+			return change, nil
+		}
+		redis_db.SAdd(ctx, keyOfSyncLinks(f.ManagedBy), slug)
+		reindexTerms(redis_db, ctx, slug)
+		log.Println("Sync", f.ManagedBy, "created", slug, "for target", want.Target)
+		return change, nil
+	}
+
+	if owner := meta.Val()["managed_by"]; owner != f.ManagedBy {
+		change.Action = "conflict"
+		if owner == "" {
+			change.Error = "slug is taken by a link not managed by sync"
+		} else {
+			change.Error = "slug is managed by " + owner
+		}
+		return change, nil
+	}
+
+	if target.Val() != want.Target {
+		change.Changes = append(change.Changes, "target "+target.Val()+" -> "+want.Target)
+	}
+	if tags := strings.Join(want.Tags, ","); meta.Val()["tags"] != tags {
+		change.Changes = append(change.Changes, "tags "+meta.Val()["tags"]+" -> "+tags)
+	}
+	if ttlOfMeta(meta.Val()) != want.Ttl.Duration {
+		change.Changes = append(change.Changes, "ttl "+ttlOfMeta(meta.Val()).String()+" -> "+want.Ttl.String())
+	}
+	if len(change.Changes) > 0 {
+		change.Action = "update"
+	}
+	if dry_run {
+		return change, nil
+	}
+
+	// The expiry is renewed on every run, so listed links don't lapse
+	ttl := want.Ttl.Duration
+	_, err = redis_db.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if target.Val() != want.Target {
+			created := unixTime(meta.Val()["created"])
+			pipe.Set(ctx, keyOfSlug(slug), want.Target, ttl)
+			pipe.ZRem(ctx, keyOfTargetLinks(targetDigest(target.Val())), slug)
+			pipe.ZAdd(ctx, keyOfTargetLinks(targetDigest(want.Target)), &redis.Z{Score: float64(created.Unix()), Member: slug})
+		}
+		if len(want.Tags) > 0 {
+			pipe.HSet(ctx, keyOfSlugMeta(slug), "tags", strings.Join(want.Tags, ","))
+		} else {
+			pipe.HDel(ctx, keyOfSlugMeta(slug), "tags")
+		}
+		if ttl != default_ttl {
+			pipe.HSet(ctx, keyOfSlugMeta(slug), "ttl", int64(ttl.Seconds()))
+		} else {
+			pipe.HDel(ctx, keyOfSlugMeta(slug), "ttl")
+		}
+		if len(change.Changes) > 0 {
+			touchLink(pipe, ctx, slug)
+		}
+		pipe.Expire(ctx, keyOfSlug(slug), ttl)
+		pipe.Expire(ctx, keyOfSlugMeta(slug), ttl)
+		for _, key := range []string{keyOfSlugHitCount(slug), keyOfSlugUniqueHitCount(slug), keyOfSlugSeries(slug)} {
+			expireCounter(pipe, ctx, key, ttl)
+		}
+		pipe.ZAdd(ctx, keyOfExpiresIndex, &redis.Z{Score: float64(time.Now().Add(ttl).Unix()), Member: slug})
+		pipe.SAdd(ctx, keyOfSyncLinks(f.ManagedBy), slug)
+		return nil
+	})
+	if err != nil {
+		return change, lookupError("sync", err)
+	}
+	if target.Val() != want.Target {
+		purgeLinks(slug)
+	}
+	if change.Action != "" {
+		reindexTerms(redis_db, ctx, slug)
+		log.Println("Sync", f.ManagedBy, "updated", slug+":", strings.Join(change.Changes, "; "))
+	}
+	return change, nil
+}
+
+// The API takes the same file as the command. Dry run unless ?dry_run=false.
+func handleSync(redis_db Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		f, err := readSyncFile(http.MaxBytesReader(w, req.Body, 4<<20))
+		if err != nil {
+			writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		report, err := syncLinks(redis_db, req.Context(), f, req.FormValue("dry_run") != "false")
+		if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	}
+}
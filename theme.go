@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Every page is parsed with theme.html, whose templates put the branding of
+// theme in the page: the organization's name as the title, a logo above and
+// footer text below, and colors as CSS custom properties. Tenants listed
+// under theme.tenants get their own branding, each field left empty taken
+// from the default. Pages about a link are branded for the link's tenant,
+// the others for the viewer's.
+
+type Branding struct {
+	OrganizationName string            `json:"organization_name"`
+	LogoURL          string            `json:"logo_url"`
+	Colors           map[string]string `json:"colors"` // text, background, link, accent, or any name, as --<name>
+	FooterText       string            `json:"footer_text"`
+}
+
+type ThemeConfig struct {
+	Branding
+	Tenants map[string]Branding `json:"tenants"`
+}
+
+var colorNamePattern = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+
+// Colors are written into the pages' CSS as they are, so nothing may close
+// the declaration or the style element
+func validateTheme(c ThemeConfig) error {
+	brandings := map[string]Branding{"": c.Branding}
+	for tenant, b := range c.Tenants {
+		brandings[tenant] = b
+	}
+	for tenant, b := range brandings {
+		for name, color := range b.Colors {
+			if !colorNamePattern.MatchString(name) || color == "" || strings.ContainsAny(color, ";{}<>\\\"'") {
+				if tenant != "" {
+					return fmt.Errorf("theme.tenants.%s.colors.%s must be a lowercase name and a CSS color", tenant, name)
+				}
+				return fmt.Errorf("theme.colors.%s must be a lowercase name and a CSS color", name)
+			}
+		}
+	}
+	return nil
+}
+
+// Style declares the colors as custom properties, for :root
+func (b Branding) Style() template.CSS {
+	names := make([]string, 0, len(b.Colors))
+	for name := range b.Colors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	declarations := make([]string, len(names))
+	for i, name := range names {
+		declarations[i] = "--" + name + ": " + b.Colors[name] + ";"
+	}
+	return template.CSS(strings.Join(declarations, " "))
+}
+
+// brandingOf is the default branding, with the tenant's on top
+func brandingOf(tenant string) Branding {
+	b := config.Theme.Branding
+	if b.OrganizationName == "" {
+		b.OrganizationName = "URL Shortener"
+	}
+	t, ok := config.Theme.Tenants[tenant]
+	if !ok || tenant == "" {
+		return b
+	}
+	if t.OrganizationName != "" {
+		b.OrganizationName = t.OrganizationName
+	}
+	if t.LogoURL != "" {
+		b.LogoURL = t.LogoURL
+	}
+	if t.FooterText != "" {
+		b.FooterText = t.FooterText
+	}
+	colors := map[string]string{}
+	for name, color := range b.Colors {
+		colors[name] = color
+	}
+	for name, color := range t.Colors {
+		colors[name] = color
+	}
+	b.Colors = colors
+	return b
+}
+
+// viewerBranding is the branding of whoever makes the request
+func viewerBranding(req *http.Request) Branding {
+	identity, _ := identify(req)
+	return brandingOf(identity.Tenant)
+}
+
+// renderPage executes the page's template, branded and in the request's language
+func renderPage(w io.Writer, req *http.Request, name string, brand Branding, data interface{}) error {
+	locale := localeOf(req)
+	t, err := template.New(name).Funcs(template.FuncMap{
+		"theme": func() Branding { return brand },
+		"lang":  func() string { return locale },
+		"t": func(message string, args ...interface{}) string {
+			return translate(locale, message, args...)
+		},
+	}).ParseFiles(name, "theme.html")
+	if err != nil {
+		return err
+	}
+	return t.Execute(w, data)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+// Thumbnails of target pages, taken by a rendering service (a headless
+// browser behind an HTTP endpoint) in the background after a link is
+// created. {url} in the endpoint is replaced by the escaped target, and the
+// service answers with the image. It's kept in urlthumb:<slug>, which orphan
+// cleanup removes once the link is gone, and meta's thumbnail field records
+// when it was taken. /_thumb/<slug> serves it to whoever may follow the link.
+
+type ThumbnailsConfig struct {
+	Endpoint string   `json:"endpoint"` // empty turns thumbnails off
+	Timeout  Duration `json:"timeout"`
+	MaxBytes int64    `json:"max_bytes"`
+}
+
+var thumbnail_client = &http.Client{}
+
+// Raster formats only; an SVG served from our origin could run script
+var thumbnailTypes = []string{"image/png", "image/jpeg", "image/webp", "image/gif"}
+
+func keyOfSlugThumbnail(slug string) string {
+	return "urlthumb:" + slug
+}
+
+// captureThumbnail asks the rendering service for a picture of target
+func captureThumbnail(redis_db Storage, slug string, target string) {
+	c := config.Thumbnails
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout.Duration)
+	defer cancel()
+
+	endpoint := strings.Replace(c.Endpoint, "{url}", url.QueryEscape(target), -1)
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		log.Println("Cannot capture thumbnail of", slug, err)
+		return
+	}
+	resp, err := thumbnail_client.Do(req)
+	if err != nil {
+		log.Println("Cannot capture thumbnail of", slug, err)
+		return
+	}
+	defer resp.Body.Close()
+	content_type := resp.Header.Get("Content-Type")
+	if resp.StatusCode != http.StatusOK || !containsString(thumbnailTypes, content_type) {
+		log.Println("Cannot capture thumbnail of", slug, "renderer answered", resp.Status, content_type)
+		return
+	}
+	image, err := ioutil.ReadAll(io.LimitReader(resp.Body, c.MaxBytes+1))
+	if err != nil {
+		log.Println("Cannot capture thumbnail of", slug, err)
+		return
+	}
+	if int64(len(image)) > c.MaxBytes {
+		log.Println("Thumbnail of", slug, "is over", c.MaxBytes, "bytes")
+		return
+	}
+
+	// The link may have been deleted meanwhile
+	exists, err := redis_db.Exists(ctx, keyOfSlug(slug)).Result()
+	if err != nil || exists == 0 {
+		return
+	}
+	_, err = redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, keyOfSlugThumbnail(slug), "type", content_type, "image", image)
+		pipe.HSet(ctx, keyOfSlugMeta(slug), "thumbnail", time.Now().Unix())
+		touchLink(pipe, ctx, slug)
+		return nil
+	})
+	if err != nil {
+		log.Println("Cannot store thumbnail of", slug, err)
+	}
+}
+
+func thumbnailURL(slug string) string {
+	return "/_thumb/" + url.PathEscape(slug)
+}
+
+// ThumbnailURL is where the details and warning pages find the picture, "" without one
+func (su ShortUrl) ThumbnailURL() string {
+	if !su.HasThumbnail {
+		return ""
+	}
+	return thumbnailURL(su.Slug)
+}
+
+func registerThumbnailRoutes(router *mux.Router, redis_db Storage) {
+	router.HandleFunc("/_thumb/{slug}", func(w http.ResponseWriter, req *http.Request) {
+		link, err := resolveLink(redis_db, req.Context(), normalizeSlug(mux.Vars(req)["slug"]))
+		if redisUnavailable(err) {
+			writeUnavailable(w)
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if !checkAccess(w, req, link.access) {
+			return
+		}
+		fields, err := redis_db.HMGet(req.Context(), keyOfSlugThumbnail(link.slug), "type", "image").Result()
+		if err != nil {
+			writeUnavailable(w)
+			return
+		}
+		content_type, _ := fields[0].(string)
+		image, _ := fields[1].(string)
+		if content_type == "" || image == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", content_type)
+		w.Header().Set("Content-Length", fmt.Sprint(len(image)))
+		w.Header().Set("Cache-Control", "private, max-age=3600")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		io.WriteString(w, image)
+	}).Methods("GET")
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Each Redis command (or pipeline) gets at most redis.op_timeout, and never
+// more than is left of its request's redis.request_budget. When Redis is slow
+// the request fails fast with 503 and Retry-After, instead of hanging the
+// redirect until the client gives up.
+
+type budgetKey struct{}
+type cancelKey struct{}
+
+// withRedisBudget starts the budget shared by all Redis calls of a request
+func withRedisBudget(budget time.Duration, h http.Handler) http.Handler {
+	if budget <= 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := context.WithValue(req.Context(), budgetKey{}, time.Now().Add(budget))
+		h.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// timeoutHook puts a deadline on every command's context
+type timeoutHook struct {
+	op_timeout time.Duration
+}
+
+func (h timeoutHook) limit(ctx context.Context) context.Context {
+	var deadline time.Time
+	if h.op_timeout > 0 {
+		deadline = time.Now().Add(h.op_timeout)
+	}
+	if budget, ok := ctx.Value(budgetKey{}).(time.Time); ok && (deadline.IsZero() || budget.Before(deadline)) {
+		deadline = budget
+	}
+	if deadline.IsZero() {
+		return ctx
+	}
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	return context.WithValue(ctx, cancelKey{}, cancel)
+}
+
+func (h timeoutHook) release(ctx context.Context) {
+	if cancel, ok := ctx.Value(cancelKey{}).(context.CancelFunc); ok {
+		cancel()
+	}
+}
+
+func (h timeoutHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return h.limit(ctx), nil
+}
+
+func (h timeoutHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	h.release(ctx)
+	return nil
+}
+
+func (h timeoutHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return h.limit(ctx), nil
+}
+
+func (h timeoutHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	h.release(ctx)
+	return nil
+}
+
+// redisUnavailable tells timeouts and an open circuit apart from answers like redis.Nil
+func redisUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+	var storage_err *StorageError
+	if errors.Is(err, context.DeadlineExceeded) || err == errCircuitOpen || errors.As(err, &storage_err) {
+		return true
+	}
+	var net_err net.Error
+	return errors.As(err, &net_err) && net_err.Timeout()
+}
+
+func setRetryAfter(w http.ResponseWriter) {
+	seconds := math.Ceil(config.Redis.RetryAfter.Seconds())
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Max(seconds, 1))))
+}
+
+const unavailablePage = `<!DOCTYPE html>
+<html><head><title>Back shortly</title></head>
+<body><h1>Back shortly</h1><p>This link can't be looked up right now. Please try again in a moment.</p></body></html>
+`
+
+func writeUnavailable(w http.ResponseWriter) {
+	setRetryAfter(w)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	fmt.Fprint(w, unavailablePage)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// The target page's <title> and meta description, fetched in the background
+// after a link is created and kept in meta's title and description fields, so
+// listings show more than a bare URL, and search finds links by them.
+
+type TitlesConfig struct {
+	Enabled bool     `json:"enabled"`
+	Timeout Duration `json:"timeout"`
+}
+
+const maxTitleRunes = 200
+const maxDescriptionRunes = 500
+const maxNoteRunes = 1000
+
+func truncateRunes(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n-1]) + "…"
+	}
+	return s
+}
+
+// fetchTitle reads the target's title and description into the link's meta
+func fetchTitle(redis_db Storage, slug string, target string) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.Titles.Timeout.Duration)
+	defer cancel()
+
+	page, err := fetchPage(ctx, target)
+	if err != nil {
+		log.Println("Cannot fetch title of", slug, err)
+		return
+	}
+	if page.Title == "" && page.Description == "" {
+		return
+	}
+	fields := map[string]interface{}{}
+	if page.Title != "" {
+		fields["title"] = truncateRunes(page.Title, maxTitleRunes)
+	}
+	if page.Description != "" {
+		fields["description"] = truncateRunes(page.Description, maxDescriptionRunes)
+	}
+
+	// The link may have been deleted meanwhile
+	exists, err := redis_db.Exists(ctx, keyOfSlug(slug)).Result()
+	if err != nil || exists == 0 {
+		return
+	}
+	_, err = redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, keyOfSlugMeta(slug), fields)
+		touchLink(pipe, ctx, slug)
+		return nil
+	})
+	if err != nil {
+		log.Println("Cannot store title of", slug, err)
+		return
+	}
+	reindexTerms(redis_db, ctx, slug)
+}
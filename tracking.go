@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// With cache.tracking, redirects are answered from process memory for as
+// long as Redis says nothing changed: a connection of its own turns on Redis
+// 6 client tracking for the link keys (url:, urlmeta: and alias:), and every
+// write to one of them, in any replica, arrives as an invalidation message.
+// Unlike cache.ttl, an edit or a delete takes effect at once.
+//
+// The Redis client here predates RESP3, so this is tracking's RESP2 form:
+// broadcast mode, redirected to the same connection subscribed to
+// __redis__:invalidate. Clicks write those keys too, extending the link's
+// expiry, so an invalidated entry isn't dropped but read again in the
+// background, one read per slug at a time, while it keeps answering; a link
+// which is gone is dropped then. Whenever the subscription is lost, or Redis
+// is flushed, the whole cache is dropped, and isn't used again until the
+// subscription is back.
+
+type TrackingConfig struct {
+	Enabled bool `json:"enabled"`
+	Size    int  `json:"size"` // the most slugs kept
+}
+
+func validateTracking(c TrackingConfig) error {
+	if c.Enabled && c.Size <= 0 {
+		return errors.New("cache.tracking.size must be positive")
+	}
+	return nil
+}
+
+const invalidationChannel = "__redis__:invalidate"
+
+var trackedPrefixes = []string{"url:", "urlmeta:", "alias:"}
+
+// More invalidated keys than this and they're forgotten, as if all were invalidated
+const trackedInvalidationsKept = 100000
+
+var (
+	tracking_requests      = newCounter("shortener_tracking_cache_requests_total", "Redirects looked up in the tracked cache, by result: hit or miss")
+	tracking_invalidations = newCounter("shortener_tracking_invalidations_total", "Invalidation messages from Redis, by kind: key, or flush for all keys")
+)
+
+// Set in main when configured
+var tracked_slugs *trackedSlugs
+
+type trackedSlugs struct {
+	redis_db Storage
+	size     int
+
+	mu      sync.Mutex
+	active  bool // subscribed, so invalidations arrive
+	entries map[string]*trackedEntry
+	by_slug map[string]map[string]bool // requested names by slug, for aliases
+	// Every invalidation has a sequence number; last has the last one by
+	// name, and anything before floor may have been invalidated.
+	seq   uint64
+	floor uint64
+	last  map[string]uint64
+}
+
+type trackedEntry struct {
+	link      resolvedSlug
+	reloading bool
+	again     bool // invalidated while reloading
+}
+
+func newTrackedSlugs(redis_db Storage, c TrackingConfig) *trackedSlugs {
+	if !c.Enabled {
+		return nil
+	}
+	t := &trackedSlugs{redis_db: redis_db, size: c.Size}
+	t.flushLocked()
+	newGaugeFunc("shortener_tracking_cache_entries", "Slugs in the tracked cache", func() float64 {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		return float64(len(t.entries))
+	})
+	return t
+}
+
+// get answers a redirect from memory
+func (t *trackedSlugs) get(requested string) (resolvedSlug, bool) {
+	if t == nil {
+		return resolvedSlug{}, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.entries[requested]
+	if !ok || !t.active {
+		tracking_requests.Inc("result", "miss")
+		return resolvedSlug{}, false
+	}
+	tracking_requests.Inc("result", "hit")
+	return e.link, true
+}
+
+// begin is called before reading a link, and its answer given to put
+func (t *trackedSlugs) begin() uint64 {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.seq
+}
+
+// put keeps a link read since begin. One which may have changed meanwhile,
+// or came from the shared cache, is read again right away.
+func (t *trackedSlugs) put(requested string, link resolvedSlug, since uint64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.active {
+		return
+	}
+	if _, ok := t.entries[requested]; !ok && len(t.entries) >= t.size {
+		for k := range t.entries {
+			t.removeLocked(k) // any one will do
+			break
+		}
+	}
+	t.setLocked(requested, link)
+	if link.shared || t.changedSinceLocked(requested, link.slug, since) {
+		t.reloadLocked(requested)
+	}
+}
+
+func (t *trackedSlugs) setLocked(requested string, link resolvedSlug) {
+	if e, ok := t.entries[requested]; ok {
+		if e.link.slug != link.slug {
+			delete(t.by_slug[e.link.slug], requested)
+		}
+		e.link = link
+	} else {
+		t.entries[requested] = &trackedEntry{link: link}
+	}
+	if t.by_slug[link.slug] == nil {
+		t.by_slug[link.slug] = map[string]bool{}
+	}
+	t.by_slug[link.slug][requested] = true
+}
+
+func (t *trackedSlugs) removeLocked(requested string) {
+	e, ok := t.entries[requested]
+	if !ok {
+		return
+	}
+	delete(t.entries, requested)
+	delete(t.by_slug[e.link.slug], requested)
+	if len(t.by_slug[e.link.slug]) == 0 {
+		delete(t.by_slug, e.link.slug)
+	}
+}
+
+func (t *trackedSlugs) changedSinceLocked(requested string, slug string, since uint64) bool {
+	return t.floor > since || t.last[requested] > since || t.last[slug] > since
+}
+
+// flushLocked drops everything, and makes any read in flight suspect
+func (t *trackedSlugs) flushLocked() {
+	t.seq++
+	t.floor = t.seq
+	t.entries = map[string]*trackedEntry{}
+	t.by_slug = map[string]map[string]bool{}
+	t.last = map[string]uint64{}
+}
+
+// flush drops everything, returning whether it was active
+func (t *trackedSlugs) flush(active bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	was_active := t.active
+	t.active = active
+	t.flushLocked()
+	return was_active
+}
+
+// invalidate takes a key Redis says changed
+func (t *trackedSlugs) invalidate(key string) {
+	var name string
+	for _, prefix := range trackedPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			name = strings.TrimPrefix(key, prefix)
+			break
+		}
+	}
+	if name == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.seq++
+	if len(t.last) >= trackedInvalidationsKept {
+		t.floor = t.seq
+		t.last = map[string]uint64{}
+	}
+	t.last[name] = t.seq
+
+	t.reloadLocked(name)
+	if !strings.HasPrefix(key, "alias:") {
+		for requested := range t.by_slug[name] {
+			t.reloadLocked(requested)
+		}
+	}
+}
+
+// reloadLocked reads an entry again in the background, unless it's already being read
+func (t *trackedSlugs) reloadLocked(requested string) {
+	e, ok := t.entries[requested]
+	if !ok {
+		return
+	}
+	if e.reloading {
+		e.again = true
+		return
+	}
+	e.reloading = true
+	go t.reload(requested)
+}
+
+func (t *trackedSlugs) reload(requested string) {
+	for {
+		since := t.begin()
+		link, err := resolveLink(t.redis_db, context.Background(), requested)
+
+		t.mu.Lock()
+		e, ok := t.entries[requested]
+		switch {
+		case !ok:
+			// flushed or evicted meanwhile
+		case err != nil:
+			if err != errSlugNotFound {
+				log.Println("Cannot reload", requested, "into the tracked cache", err)
+			}
+			t.removeLocked(requested)
+		case e.again || t.changedSinceLocked(requested, link.slug, since):
+			e.again = false
+			t.setLocked(requested, link)
+			t.mu.Unlock()
+			continue
+		default:
+			e.reloading = false
+			t.setLocked(requested, link)
+		}
+		t.mu.Unlock()
+		return
+	}
+}
+
+// listen turns tracking on, and takes invalidations until the process ends
+func (t *trackedSlugs) listen(c RedisConfig) {
+	opts, err := redisOptions(c)
+	if err != nil {
+		log.Fatalln("Cannot set up Redis", err)
+	}
+	opts.PoolSize, opts.MinIdleConns = 1, 0
+	// The subscribed connection is also the one tracking, redirected to
+	// itself, so every reconnect turns it on again
+	opts.OnConnect = func(ctx context.Context, cn *redis.Conn) error {
+		id, err := cn.ClientID(ctx).Result()
+		if err != nil {
+			return err
+		}
+		args := []interface{}{"client", "tracking", "on", "redirect", id, "bcast"}
+		for _, prefix := range trackedPrefixes {
+			args = append(args, "prefix", prefix)
+		}
+		return cn.Process(ctx, redis.NewCmd(ctx, args...))
+	}
+	client := redis.NewClient(opts)
+	for {
+		err := t.subscribe(context.Background(), client)
+		if t.flush(false) {
+			log.Println("Stopped tracking url keys in Redis, until subscribed again", err)
+		} else if isReplyError(err) {
+			log.Println("Cannot track url keys in Redis", err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// subscribe takes invalidations until the subscription is lost
+func (t *trackedSlugs) subscribe(ctx context.Context, client *redis.Client) error {
+	pubsub := client.Subscribe(ctx, invalidationChannel)
+	defer pubsub.Close()
+	pinged := false
+	for {
+		msg, err := pubsub.ReceiveTimeout(ctx, time.Minute)
+		var net_err net.Error
+		switch {
+		case errors.As(err, &net_err) && net_err.Timeout() && !pinged:
+			// quiet, make sure it's still there
+			if err := pubsub.Ping(ctx); err != nil {
+				return err
+			}
+			pinged = true
+			continue
+		case err != nil && strings.HasPrefix(err.Error(), "redis: unsupported pubsub message payload"):
+			// a FLUSHDB or FLUSHALL invalidates every key, with a nil the client can't parse
+			t.flush(true)
+			tracking_invalidations.Inc("kind", "flush")
+			continue
+		case err != nil:
+			return err
+		}
+		pinged = false
+
+		switch m := msg.(type) {
+		case *redis.Subscription:
+			// whatever changed before is unknown
+			t.flush(true)
+			log.Println("Tracking url keys in Redis")
+		case *redis.Message:
+			if m.Channel != invalidationChannel {
+				continue
+			}
+			tracking_invalidations.Inc("kind", "key")
+			for _, key := range m.PayloadSlice {
+				t.invalidate(key)
+			}
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+// Deleting a link moves it to trash:<slug>, a JSON copy of everything it had
+// (counters, meta, hourly series, aliases and campaigns) which expires after
+// trash.retention. Until then it can be restored as it was, or purged for
+// good. idx:trash orders trashed slugs by deletion time.
+
+type TrashConfig struct {
+	Retention Duration `json:"retention"`
+}
+
+type TrashedLink struct {
+	BackupRecord
+	Aliases   []string          `json:"aliases,omitempty"`
+	Campaigns []string          `json:"campaigns,omitempty"`
+	Series    map[string]string `json:"series,omitempty"`
+	Geo       map[string]string `json:"geo,omitempty"`
+	Bundle    map[string]string `json:"bundle,omitempty"` // clicks by destination
+	Deleted   time.Time         `json:"deleted"`
+	DeletedBy string            `json:"deleted_by,omitempty"`
+}
+
+const keyOfTrashIndex = "idx:trash"
+
+var errNotInTrash = errors.New("Slug is not in the trash")
+var errSlugTaken = errors.New("Slug is in use again, it can't be restored")
+
+func keyOfTrash(slug string) string {
+	return "trash:" + slug
+}
+
+// campaignsOf scans every campaign for the slug; deletions are rare enough
+func campaignsOf(redis_db Storage, ctx context.Context, slug string) ([]string, error) {
+	campaigns := []string{}
+	err := scanKeys(redis_db, ctx, keyOfCampaignLinks("*"), func(keys []string) error {
+		members := make([]*redis.BoolCmd, len(keys))
+		_, err := redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, key := range keys {
+				members[i] = pipe.SIsMember(ctx, key, slug)
+			}
+			return nil
+		})
+		for i, key := range keys {
+			if members[i].Val() {
+				campaigns = append(campaigns, key[len(keyOfCampaignLinks("")):])
+			}
+		}
+		return err
+	})
+	return campaigns, err
+}
+
+// trashLink moves a link and everything about it into the trash
+func trashLink(redis_db Storage, ctx context.Context, slug string, by string) (TrashedLink, error) {
+	var target *redis.StringCmd
+	var ttl *redis.DurationCmd
+	var counters *redis.SliceCmd
+	var meta, series, geo, bundle *redis.StringStringMapCmd
+	var aliases *redis.StringSliceCmd
+	_, err := redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		target = pipe.Get(ctx, keyOfSlug(slug))
+		ttl = pipe.TTL(ctx, keyOfSlug(slug))
+		counters = pipe.MGet(ctx, keyOfSlugHitCount(slug), keyOfSlugUniqueHitCount(slug))
+		meta = pipe.HGetAll(ctx, keyOfSlugMeta(slug))
+		series = pipe.HGetAll(ctx, keyOfSlugSeries(slug))
+		geo = pipe.HGetAll(ctx, keyOfSlugGeo(slug))
+		bundle = pipe.HGetAll(ctx, keyOfBundleClicks(slug))
+		aliases = pipe.SMembers(ctx, keyOfSlugAliases(slug))
+		return nil
+	})
+	if err != nil {
+		return TrashedLink{}, err
+	}
+	campaigns, err := campaignsOf(redis_db, ctx, slug)
+	if err != nil {
+		return TrashedLink{}, err
+	}
+
+	t := TrashedLink{
+		BackupRecord: BackupRecord{
+			Slug:       slug,
+			Target:     target.Val(),
+			TtlSeconds: int64(ttl.Val().Seconds()),
+			Meta:       meta.Val(),
+		},
+		Aliases:   aliases.Val(),
+		Campaigns: campaigns,
+		Series:    series.Val(),
+		Geo:       geo.Val(),
+		Bundle:    bundle.Val(),
+		Deleted:   time.Now().UTC(),
+		DeletedBy: by,
+	}
+	delete(t.Meta, "thumbnail") // the image itself isn't kept in the trash
+	if s, ok := counters.Val()[0].(string); ok {
+		t.Clicks, _ = strconv.ParseInt(s, 10, 64)
+	}
+	if s, ok := counters.Val()[1].(string); ok {
+		t.UniqueClicks, _ = strconv.ParseInt(s, 10, 64)
+	}
+	data, err := json.Marshal(t)
+	if err != nil {
+		return t, err
+	}
+	if err := unindexLinkTerms(redis_db, ctx, slug); err != nil {
+		return t, err
+	}
+
+	_, err = redis_db.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, keyOfTrash(slug), data, config.Trash.Retention.Duration)
+		pipe.ZAdd(ctx, keyOfTrashIndex, &redis.Z{Score: float64(t.Deleted.Unix()), Member: slug})
+		pipe.Del(ctx, keyOfSlug(slug), keyOfSlugHitCount(slug), keyOfSlugUniqueHitCount(slug),
+			keyOfSlugMeta(slug), keyOfSlugSeries(slug), keyOfSlugAliases(slug), keyOfSlugThumbnail(slug), keyOfSlugGeo(slug), keyOfBundleClicks(slug))
+		for _, alias := range t.Aliases {
+			pipe.Del(ctx, keyOfAlias(alias))
+		}
+		for _, campaign := range t.Campaigns {
+			pipe.SRem(ctx, keyOfCampaignLinks(campaign), slug)
+		}
+		unindexLinks(pipe, ctx, slug)
+		pipe.ZRem(ctx, keyOfTargetLinks(targetDigest(t.Target)), slug)
+		pipe.ZRem(ctx, keyOfTenantLinks(t.Meta["tenant"]), slug)
+		return nil
+	})
+	if err == nil {
+		purgeLinks(slug)
+	}
+	return t, err
+}
+
+func trashedLink(redis_db Storage, ctx context.Context, slug string) (TrashedLink, error) {
+	var t TrashedLink
+	data, err := redis_db.Get(ctx, keyOfTrash(slug)).Bytes()
+	if err == redis.Nil {
+		return t, errNotInTrash
+	} else if err != nil {
+		return t, err
+	}
+	err = json.Unmarshal(data, &t)
+	return t, err
+}
+
+// restoreLink puts a trashed link back with the TTL it had left. Aliases taken meanwhile are dropped.
+func restoreLink(redis_db Storage, ctx context.Context, slug string) (TrashedLink, error) {
+	t, err := trashedLink(redis_db, ctx, slug)
+	if err != nil {
+		return t, err
+	}
+	ttl := time.Duration(t.TtlSeconds) * time.Second
+	if ttl <= 0 {
+		ttl = default_ttl
+	}
+
+	if taken, err := redis_db.Exists(ctx, keyOfAlias(slug)).Result(); err != nil {
+		return t, err
+	} else if taken > 0 {
+		return t, errSlugTaken
+	}
+	created, err := redis_db.SetNX(ctx, keyOfSlug(slug), t.Target, ttl).Result()
+	if err != nil {
+		return t, err
+	}
+	if !created {
+		return t, errSlugTaken
+	}
+
+	restored_aliases := []string{}
+	for _, alias := range t.Aliases {
+		if err := addAlias(redis_db, ctx, slug, alias); err == nil {
+			restored_aliases = append(restored_aliases, alias)
+		} else if err != errAliasTaken && err != errRouteName {
+			return t, err
+		}
+	}
+	t.Aliases = restored_aliases
+
+	_, err = redis_db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		writeLinkRecord(pipe, ctx, t.BackupRecord, ttl)
+		if len(t.Series) > 0 {
+			fields := make(map[string]interface{}, len(t.Series))
+			for k, v := range t.Series {
+				fields[k] = v
+			}
+			pipe.HSet(ctx, keyOfSlugSeries(slug), fields)
+			expireCounter(pipe, ctx, keyOfSlugSeries(slug), ttl)
+		}
+		if len(t.Geo) > 0 {
+			fields := make(map[string]interface{}, len(t.Geo))
+			for k, v := range t.Geo {
+				fields[k] = v
+			}
+			pipe.HSet(ctx, keyOfSlugGeo(slug), fields)
+			expireCounter(pipe, ctx, keyOfSlugGeo(slug), ttl)
+		}
+		if len(t.Bundle) > 0 {
+			fields := make(map[string]interface{}, len(t.Bundle))
+			for k, v := range t.Bundle {
+				fields[k] = v
+			}
+			pipe.HSet(ctx, keyOfBundleClicks(slug), fields)
+			expireCounter(pipe, ctx, keyOfBundleClicks(slug), ttl)
+		}
+		for _, campaign := range t.Campaigns {
+			pipe.SAdd(ctx, keyOfCampaignLinks(campaign), slug)
+		}
+		pipe.Del(ctx, keyOfTrash(slug))
+		pipe.ZRem(ctx, keyOfTrashIndex, slug)
+		return nil
+	})
+	if err == nil {
+		reindexTerms(redis_db, ctx, slug)
+	}
+	return t, err
+}
+
+// purgeTrashedLink deletes a trashed link for good
+func purgeTrashedLink(redis_db Storage, ctx context.Context, slug string) error {
+	var del *redis.IntCmd
+	_, err := redis_db.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		del = pipe.Del(ctx, keyOfTrash(slug))
+		pipe.ZRem(ctx, keyOfTrashIndex, slug)
+		return nil
+	})
+	if err == nil && del.Val() == 0 {
+		return errNotInTrash
+	}
+	return err
+}
+
+// listTrash returns trashed links, most recently deleted first, forgetting those past retention
+func listTrash(redis_db Storage, ctx context.Context, limit int) ([]TrashedLink, error) {
+	r := []TrashedLink{}
+	slugs, err := redis_db.ZRevRange(ctx, keyOfTrashIndex, 0, int64(limit)-1).Result()
+	if err != nil || len(slugs) == 0 {
+		return r, err
+	}
+	keys := make([]string, len(slugs))
+	for i, slug := range slugs {
+		keys[i] = keyOfTrash(slug)
+	}
+	values, err := redis_db.MGet(ctx, keys...).Result()
+	if err != nil {
+		return r, err
+	}
+	gone := []interface{}{}
+	for i, v := range values {
+		s, ok := v.(string)
+		if !ok {
+			gone = append(gone, slugs[i])
+			continue
+		}
+		var t TrashedLink
+		if json.Unmarshal([]byte(s), &t) == nil {
+			r = append(r, t)
+		}
+	}
+	if len(gone) > 0 {
+		redis_db.ZRem(ctx, keyOfTrashIndex, gone...)
+	}
+	return r, nil
+}
+
+func registerTrashRoutes(router *mux.Router, redis_db Storage) {
+	router.Use(requireRoleByMethod)
+
+	// Admins see everything, others their tenant's links
+	router.HandleFunc("", func(w http.ResponseWriter, req *http.Request) {
+		identity, ok := hasRole(w, req, roleEditor)
+		if !ok {
+			return
+		}
+		trashed, err := listTrash(redis_db, req.Context(), config.Listing.MaxPageSize)
+		if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		visible := []TrashedLink{}
+		for _, t := range trashed {
+			if identity.can(roleAdmin) || t.Meta["tenant"] == identity.Tenant {
+				visible = append(visible, t)
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"links": visible})
+	}).Methods("GET")
+
+	// managedTrash loads a trashed link for a caller allowed to change it
+	managedTrash := func(w http.ResponseWriter, req *http.Request) (TrashedLink, bool) {
+		t, err := trashedLink(redis_db, req.Context(), mux.Vars(req)["slug"])
+		if err == errNotInTrash {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return t, false
+		} else if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return t, false
+		}
+		if !canManageLink(req, ShortUrl{Slug: t.Slug, Tenant: t.Meta["tenant"]}) {
+			writeJSONError(w, http.StatusForbidden, "Only the link's owner can change it")
+			return t, false
+		}
+		return t, true
+	}
+
+	router.HandleFunc("/{slug:[0-9A-Za-z]+}/restore", func(w http.ResponseWriter, req *http.Request) {
+		t, ok := managedTrash(w, req)
+		if !ok {
+			return
+		}
+		t, err := restoreLink(redis_db, req.Context(), t.Slug)
+		if err == errSlugTaken {
+			writeJSONError(w, http.StatusConflict, err.Error())
+			return
+		} else if err == errNotInTrash {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		} else if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		identity, _ := identify(req)
+		log.Println("Restored", t.Slug, "from trash by", identity.KeyId)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"slug": t.Slug, "target": t.Target, "aliases": t.Aliases})
+	}).Methods("POST")
+
+	router.HandleFunc("/{slug:[0-9A-Za-z]+}", func(w http.ResponseWriter, req *http.Request) {
+		t, ok := managedTrash(w, req)
+		if !ok {
+			return
+		}
+		if err := purgeTrashedLink(redis_db, req.Context(), t.Slug); err == errNotInTrash {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		} else if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		identity, _ := identify(req)
+		log.Println("Purged", t.Slug, "from trash by", identity.KeyId)
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("DELETE")
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// When a new target is itself a short link (bit.ly, t.co, ... or one of ours)
+// follow it to where it really goes and store that instead, keeping the chain
+// so the details page can show what was unwrapped.
+
+type UnwrapConfig struct {
+	Enabled   bool     `json:"enabled"`
+	Hosts     []string `json:"hosts"`      // other shorteners
+	SelfHosts []string `json:"self_hosts"` // names this service is reached by
+	MaxDepth  int      `json:"max_depth"`
+}
+
+func hostIn(host string, hosts []string) bool {
+	host = strings.ToLower(host)
+	for _, h := range hosts {
+		if host == strings.ToLower(h) {
+			return true
+		}
+	}
+	return false
+}
+
+// Our own non-public links aren't unwrapped, which would reveal their target
+var errKeepWrapped = errors.New("Link is not public")
+
+// nextHop answers where one short link points, without following further
+func nextHop(redis_db Storage, ctx context.Context, u *url.URL, self_hosts []string) (string, error) {
+	if hostIn(u.Hostname(), self_hosts) {
+		link, err := resolveLink(redis_db, ctx, strings.Trim(u.Path, "/"))
+		if err == errSlugNotFound {
+			return "", errors.New("Target is a link of ours which doesn't exist")
+		}
+		if err == nil && !link.access.Public() {
+			return "", errKeepWrapped
+		}
+		return link.target, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "HEAD", u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := outboundClient(false, nil).Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 300 || resp.StatusCode >= 400 {
+		return "", errors.New("Short link " + u.String() + " does not redirect")
+	}
+	next, err := u.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return "", err
+	}
+	return next.String(), nil
+}
+
+// unwrapTarget returns the final destination and the short links passed on the way
+func unwrapTarget(redis_db Storage, ctx context.Context, target string, self_hosts []string) (string, []string, error) {
+	chain := []string{}
+	seen := map[string]bool{}
+	for {
+		u, err := validateTarget(target)
+		if err != nil {
+			return "", chain, err
+		}
+		if !hostIn(u.Hostname(), config.Unwrap.Hosts) && !hostIn(u.Hostname(), self_hosts) {
+			return target, chain, nil
+		}
+		if seen[target] {
+			return "", chain, errors.New("Short links redirect in a loop")
+		}
+		if len(chain) >= config.Unwrap.MaxDepth {
+			return "", chain, errors.New("Too many short links in a row")
+		}
+		seen[target] = true
+		chain = append(chain, target)
+
+		next, err := nextHop(redis_db, ctx, u, self_hosts)
+		if err == errKeepWrapped {
+			return target, chain[:len(chain)-1], nil
+		} else if err != nil {
+			return "", chain, err
+		}
+		target = next
+	}
+}
+
+func unwrapChainOfMeta(meta map[string]string) []string {
+	var chain []string
+	json.Unmarshal([]byte(meta["unwrapped_from"]), &chain)
+	return chain
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// A link is public (the default: anyone with the slug), internal (any signed
+// in visitor) or restricted (only allowlisted emails or groups). Visitors are
+// known from the headers an SSO proxy in front sets, such as oauth2-proxy's
+// X-Forwarded-Email and X-Forwarded-Groups, or by a valid API key. The proxy
+// must overwrite those headers on every request, or anyone can send them.
+
+type VisibilityConfig struct {
+	EmailHeader  string `json:"email_header"`
+	GroupsHeader string `json:"groups_header"` // comma separated
+	LoginURL     string `json:"login_url"`     // visitors without a session go here, with the link's URL appended
+}
+
+const (
+	visibilityPublic     = "public"
+	visibilityInternal   = "internal"
+	visibilityRestricted = "restricted"
+)
+
+type LinkAccess struct {
+	Visibility string              // "" is public
+	Allow      []string            // emails, or group:<name>
+	Privacy    string              // how the redirect hides the referrer, see privacy.go
+	Apps       *AppLinks           // where browsers go without the app, see applinks.go
+	Goal       *LinkGoal           // see goals.go
+	FallbackTo string              // where visitors go while the target is down, see linkhealth.go
+	Draft      bool                // no target yet, see drafts.go
+	Bundle     []BundleDestination // see bundles.go
+	Ttl        time.Duration       // how long a click keeps the link, see ttlOfMeta
+	Tenant     string              // whose link it is, for metering, see metering.go
+	Disabled   bool                // refuses the redirect, see bulk.go
+}
+
+type Viewer struct {
+	Signed bool
+	Email  string
+	Groups []string
+}
+
+// clickTTL is what a click renews the link to; entries cached before links
+// carried their ttl have none, and get the default
+func (a LinkAccess) clickTTL() time.Duration {
+	if a.Ttl > 0 {
+		return a.Ttl
+	}
+	return default_ttl
+}
+
+func (a LinkAccess) Public() bool {
+	return a.Visibility == "" || a.Visibility == visibilityPublic
+}
+
+func (a LinkAccess) allows(v Viewer) bool {
+	switch {
+	case a.Public():
+		return true
+	case !v.Signed:
+		return false
+	case a.Visibility == visibilityInternal:
+		return true
+	}
+	for _, allowed := range a.Allow {
+		if group := strings.TrimPrefix(allowed, "group:"); group != allowed {
+			for _, g := range v.Groups {
+				if g == group {
+					return true
+				}
+			}
+		} else if v.Email != "" && strings.EqualFold(allowed, v.Email) {
+			return true
+		}
+	}
+	return false
+}
+
+// mayFollow is allows, plus asking LDAP about groups the proxy didn't list
+func mayFollow(a LinkAccess, v Viewer) bool {
+	if a.allows(v) {
+		return true
+	}
+	if a.Visibility != visibilityRestricted || config.LDAP.Addr == "" || v.Email == "" {
+		return false
+	}
+	for _, allowed := range a.Allow {
+		if group := strings.TrimPrefix(allowed, "group:"); group != allowed {
+			member, err := ldapIsMember(config.LDAP, v.Email, group)
+			if err != nil {
+				log.Println("LDAP lookup failed", err)
+				return false
+			}
+			if member {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseLinkAccess reads the visibility and allow (comma separated) form fields
+func parseLinkAccess(visibility string, allow string) (LinkAccess, error) {
+	a := LinkAccess{}
+	switch visibility {
+	case "", visibilityPublic:
+		return a, nil
+	case visibilityInternal, visibilityRestricted:
+		a.Visibility = visibility
+	default:
+		return a, fmt.Errorf("visibility must be %s, %s or %s", visibilityPublic, visibilityInternal, visibilityRestricted)
+	}
+	for _, entry := range strings.Split(allow, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			a.Allow = append(a.Allow, entry)
+		}
+	}
+	if a.Visibility == visibilityRestricted && len(a.Allow) == 0 {
+		return a, errors.New("A restricted link needs emails or group:<name> entries to allow")
+	}
+	return a, nil
+}
+
+func accessOfMeta(meta map[string]string) LinkAccess {
+	a := LinkAccess{Visibility: meta["visibility"], Privacy: meta["privacy"], Apps: appLinksOfMeta(meta["app_links"]), Goal: goalOfMeta(meta["goal"]), FallbackTo: fallbackOfMeta(meta), Draft: meta["draft"] != "", Bundle: bundleOfMeta(meta["bundle"]), Tenant: meta["tenant"], Ttl: ttlOfMeta(meta), Disabled: meta["disabled"] != ""}
+	json.Unmarshal([]byte(meta["allow"]), &a.Allow)
+	return a
+}
+
+// accessFields are the meta fields accessOfMeta reads
+var accessFields = append([]string{"visibility", "allow", "privacy", "app_links", "goal", "draft", "bundle", "tenant", "ttl", "disabled"}, healthFields...)
+
+func accessOfSlug(redis_db Storage, ctx context.Context, slug string) (LinkAccess, error) {
+	fields, err := redis_db.HMGet(ctx, keyOfSlugMeta(slug), accessFields...).Result()
+	if err != nil {
+		return LinkAccess{}, err
+	}
+	meta := map[string]string{}
+	for i, name := range accessFields {
+		if s, ok := fields[i].(string); ok {
+			meta[name] = s
+		}
+	}
+	return accessOfMeta(meta), nil
+}
+
+// resolveLink is resolveSlug plus who may follow the link
+func resolveLink(redis_db Storage, ctx context.Context, requested string) (resolvedSlug, error) {
+	slug, target, err := resolveSlug(redis_db, ctx, requested)
+	if err != nil {
+		return resolvedSlug{slug: slug}, lookupError("resolve "+requested, err)
+	}
+	access, err := accessOfSlug(redis_db, ctx, slug)
+	return resolvedSlug{slug: slug, target: target, access: access}, lookupError("access of "+slug, err)
+}
+
+func viewerOf(req *http.Request) Viewer {
+	v := Viewer{}
+	if config.Visibility.EmailHeader != "" {
+		v.Email = req.Header.Get(config.Visibility.EmailHeader)
+	}
+	if config.Visibility.GroupsHeader != "" {
+		for _, g := range strings.Split(req.Header.Get(config.Visibility.GroupsHeader), ",") {
+			if g = strings.TrimSpace(g); g != "" {
+				v.Groups = append(v.Groups, g)
+			}
+		}
+	}
+	if s, ok := sessionOf(req); ok && v.Email == "" {
+		v.Email = s.Email
+		v.Groups = append(v.Groups, s.Groups...)
+	}
+	_, known := identify(req)
+	_, certified := certIdentityOf(req)
+	v.Signed = v.Email != "" || certified || (known && hasCredentials(req))
+	return v
+}
+
+// checkAccess writes the refusal and returns false when the visitor may not follow the link
+func checkAccess(w http.ResponseWriter, req *http.Request, a LinkAccess) bool {
+	if a.Disabled {
+		writeLocalizedError(w, req, http.StatusForbidden, "This link is disabled")
+		return false
+	}
+	if a.Public() {
+		return true
+	}
+	v := viewerOf(req)
+	if !v.Signed {
+		if config.Visibility.LoginURL != "" {
+			http.Redirect(w, req, config.Visibility.LoginURL+url.QueryEscape(publicURL(req, req.URL.RequestURI())), http.StatusFound)
+			return false
+		}
+		writeLocalizedError(w, req, http.StatusUnauthorized, "Sign in to follow this link")
+		return false
+	}
+	if !mayFollow(a, v) {
+		writeLocalizedError(w, req, http.StatusForbidden, "This link is restricted")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Outgoing notifications: a JSON POST, fire and forget from the caller's point of view
+
+var webhook_client = &http.Client{Timeout: 10 * time.Second, Transport: egressRoundTripper{}}
+
+func postWebhook(url string, payload interface{}) error {
+	return postWebhookVia(webhook_client, url, payload)
+}
+
+func postWebhookVia(client *http.Client, url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Webhook %s answered %s", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	_ "crypto/sha256" // registers crypto.SHA256
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Just enough XML Signature to check what a SAML IdP signs: one enveloped
+// signature over an element referenced by ID, exclusive canonicalization
+// (without comments), RSA with SHA-256; SHA-1 is refused, as its collisions
+// can be bought. Documents are read into a tree which keeps namespace
+// prefixes, so the canonical form can be rebuilt, and callers read their
+// values from the very element that was verified.
+
+const (
+	nsDSig     = "http://www.w3.org/2000/09/xmldsig#"
+	nsExcC14N  = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	nsXML      = "http://www.w3.org/XML/1998/namespace"
+	nsEnvelope = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+)
+
+var signatureMethods = map[string]crypto.Hash{
+	"http://www.w3.org/2001/04/xmldsig-more#rsa-sha256": crypto.SHA256,
+}
+
+var digestMethods = map[string]crypto.Hash{
+	"http://www.w3.org/2001/04/xmlenc#sha256": crypto.SHA256,
+}
+
+type xmlNode struct {
+	name     xml.Name // Space is the prefix as written
+	attrs    []xml.Attr
+	children []interface{} // *xmlNode or string
+	parent   *xmlNode
+}
+
+// parseXMLTree refuses DTDs, so no entity tricks get through
+func parseXMLTree(r io.Reader) (*xmlNode, error) {
+	decoder := xml.NewDecoder(r)
+	var root, current *xmlNode
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			n := &xmlNode{name: t.Name, attrs: t.Attr, parent: current}
+			if current != nil {
+				current.children = append(current.children, n)
+			} else if root == nil {
+				root = n
+			} else {
+				return nil, errors.New("More than one root element")
+			}
+			current = n
+		case xml.EndElement:
+			if current == nil || current.name != t.Name {
+				return nil, errors.New("Mismatched XML end element")
+			}
+			current = current.parent
+		case xml.CharData:
+			if current != nil {
+				current.children = append(current.children, string(t))
+			}
+		case xml.Directive:
+			return nil, errors.New("XML directives are not accepted")
+		}
+	}
+	if root == nil || current != nil {
+		return nil, errors.New("Incomplete XML document")
+	}
+	return root, nil
+}
+
+// lookupNS resolves a prefix ("" for the default namespace) in scope at n
+func (n *xmlNode) lookupNS(prefix string) (string, bool) {
+	if prefix == "xml" {
+		return nsXML, true
+	}
+	for e := n; e != nil; e = e.parent {
+		for _, a := range e.attrs {
+			if (prefix == "" && a.Name.Space == "" && a.Name.Local == "xmlns") ||
+				(prefix != "" && a.Name.Space == "xmlns" && a.Name.Local == prefix) {
+				return a.Value, true
+			}
+		}
+	}
+	return "", false
+}
+
+func (n *xmlNode) is(space string, local string) bool {
+	uri, _ := n.lookupNS(n.name.Space)
+	return uri == space && n.name.Local == local
+}
+
+func (n *xmlNode) attr(local string) string {
+	for _, a := range n.attrs {
+		if a.Name.Space == "" && a.Name.Local == local {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func (n *xmlNode) childrenNamed(space string, local string) []*xmlNode {
+	var found []*xmlNode
+	for _, c := range n.children {
+		if e, ok := c.(*xmlNode); ok && e.is(space, local) {
+			found = append(found, e)
+		}
+	}
+	return found
+}
+
+// child returns the only child with that name, or nil when there's none or several
+func (n *xmlNode) child(space string, local string) *xmlNode {
+	if found := n.childrenNamed(space, local); len(found) == 1 {
+		return found[0]
+	}
+	return nil
+}
+
+func (n *xmlNode) text() string {
+	var b strings.Builder
+	for _, c := range n.children {
+		switch c := c.(type) {
+		case string:
+			b.WriteString(c)
+		case *xmlNode:
+			b.WriteString(c.text())
+		}
+	}
+	return b.String()
+}
+
+// canonicalize writes n in exclusive canonical form, leaving out skip.
+// rendered holds the namespaces declared by output ancestors.
+func canonicalize(out *bytes.Buffer, n *xmlNode, skip *xmlNode, inclusive []string, rendered map[string]string) {
+	qualified := func(name xml.Name) string {
+		if name.Space == "" {
+			return name.Local
+		}
+		return name.Space + ":" + name.Local
+	}
+
+	// namespaces this element uses, plus the inclusive ones in scope
+	used := map[string]bool{n.name.Space: true}
+	type attribute struct {
+		uri   string
+		attr  xml.Attr
+		local string
+	}
+	var attrs []attribute
+	for _, a := range n.attrs {
+		if a.Name.Space == "xmlns" || (a.Name.Space == "" && a.Name.Local == "xmlns") {
+			continue
+		}
+		uri := ""
+		if a.Name.Space != "" {
+			uri, _ = n.lookupNS(a.Name.Space)
+			if a.Name.Space != "xml" {
+				used[a.Name.Space] = true
+			}
+		}
+		attrs = append(attrs, attribute{uri: uri, attr: a, local: a.Name.Local})
+	}
+	for _, prefix := range inclusive {
+		if prefix == "#default" {
+			prefix = ""
+		}
+		if _, ok := n.lookupNS(prefix); ok {
+			used[prefix] = true
+		}
+	}
+
+	var prefixes []string
+	children_rendered := map[string]string{}
+	for p, uri := range rendered {
+		children_rendered[p] = uri
+	}
+	for p := range used {
+		uri, _ := n.lookupNS(p)
+		previous, seen := rendered[p]
+		if (seen && previous == uri) || (!seen && p == "" && uri == "") {
+			continue
+		}
+		prefixes = append(prefixes, p)
+		children_rendered[p] = uri
+	}
+	sort.Strings(prefixes)
+	sort.Slice(attrs, func(i, j int) bool {
+		if attrs[i].uri != attrs[j].uri {
+			return attrs[i].uri < attrs[j].uri
+		}
+		return attrs[i].local < attrs[j].local
+	})
+
+	out.WriteString("<" + qualified(n.name))
+	for _, p := range prefixes {
+		uri := children_rendered[p]
+		if p == "" {
+			out.WriteString(` xmlns="` + c14nAttrEscape(uri) + `"`)
+		} else {
+			out.WriteString(" xmlns:" + p + `="` + c14nAttrEscape(uri) + `"`)
+		}
+	}
+	for _, a := range attrs {
+		out.WriteString(" " + qualified(a.attr.Name) + `="` + c14nAttrEscape(a.attr.Value) + `"`)
+	}
+	out.WriteString(">")
+	for _, c := range n.children {
+		switch c := c.(type) {
+		case string:
+			out.WriteString(c14nTextEscape(c))
+		case *xmlNode:
+			if c != skip {
+				canonicalize(out, c, skip, inclusive, children_rendered)
+			}
+		}
+	}
+	out.WriteString("</" + qualified(n.name) + ">")
+}
+
+func c14nAttrEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;").Replace(s)
+}
+
+func c14nTextEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;").Replace(s)
+}
+
+// excC14NMethod checks an exclusive canonicalization algorithm element and returns its inclusive prefixes
+func excC14NMethod(n *xmlNode) ([]string, error) {
+	if n == nil || n.attr("Algorithm") != nsExcC14N {
+		return nil, errors.New("Only exclusive XML canonicalization is supported")
+	}
+	if list := n.child(nsExcC14N, "InclusiveNamespaces"); list != nil {
+		return strings.Fields(list.attr("PrefixList")), nil
+	}
+	return nil, nil
+}
+
+// verifyEnveloped checks the ds:Signature directly inside signed, which must refer to signed itself
+func verifyEnveloped(signed *xmlNode, cert *x509.Certificate) error {
+	sig := signed.child(nsDSig, "Signature")
+	if sig == nil {
+		return errors.New("Element is not signed")
+	}
+	id := signed.attr("ID")
+	info := sig.child(nsDSig, "SignedInfo")
+	if id == "" || info == nil {
+		return errors.New("Malformed signature")
+	}
+
+	c14n_prefixes, err := excC14NMethod(info.child(nsDSig, "CanonicalizationMethod"))
+	if err != nil {
+		return err
+	}
+	method := info.child(nsDSig, "SignatureMethod")
+	if method == nil {
+		return errors.New("Malformed signature")
+	}
+	sig_hash, ok := signatureMethods[method.attr("Algorithm")]
+	if !ok {
+		return fmt.Errorf("Unsupported signature method %s", method.attr("Algorithm"))
+	}
+
+	ref := info.child(nsDSig, "Reference")
+	if ref == nil || ref.attr("URI") != "#"+id {
+		return errors.New("Signature must have one reference, to the signed element")
+	}
+	var ref_prefixes []string
+	enveloped := false
+	if transforms := ref.child(nsDSig, "Transforms"); transforms != nil {
+		for _, t := range transforms.childrenNamed(nsDSig, "Transform") {
+			if t.attr("Algorithm") == nsEnvelope {
+				enveloped = true
+			} else if ref_prefixes, err = excC14NMethod(t); err != nil {
+				return err
+			}
+		}
+	}
+	if !enveloped {
+		return errors.New("Only enveloped signatures are supported")
+	}
+	digest_method := ref.child(nsDSig, "DigestMethod")
+	digest_value := ref.child(nsDSig, "DigestValue")
+	if digest_method == nil || digest_value == nil {
+		return errors.New("Malformed signature")
+	}
+	digest_hash, ok := digestMethods[digest_method.attr("Algorithm")]
+	if !ok {
+		return fmt.Errorf("Unsupported digest method %s", digest_method.attr("Algorithm"))
+	}
+
+	var canonical bytes.Buffer
+	canonicalize(&canonical, signed, sig, ref_prefixes, map[string]string{})
+	expected, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(digest_value.text()), ""))
+	if err != nil || !bytes.Equal(expected, hashOf(digest_hash, canonical.Bytes())) {
+		return errors.New("Digest of signed element doesn't match")
+	}
+
+	canonical.Reset()
+	canonicalize(&canonical, info, nil, c14n_prefixes, map[string]string{})
+	value := sig.child(nsDSig, "SignatureValue")
+	if value == nil {
+		return errors.New("Malformed signature")
+	}
+	sig_bytes, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(value.text()), ""))
+	if err != nil {
+		return errors.New("Malformed signature value")
+	}
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("Only RSA signing certificates are supported")
+	}
+	return rsa.VerifyPKCS1v15(key, sig_hash, hashOf(sig_hash, canonical.Bytes()), sig_bytes)
+}
+
+func hashOf(h crypto.Hash, data []byte) []byte {
+	hasher := h.New()
+	hasher.Write(data)
+	return hasher.Sum(nil)
+}